@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/GannettDigital/go-newrelic-plugin/kafka"
+	status "github.com/GannettDigital/goStateModule"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	RootCmd.AddCommand(kafkaCmd)
+}
+
+var kafkaCmd = &cobra.Command{
+	Use:   "kafka",
+	Short: "execute a kafka collection",
+	Run: func(cmd *cobra.Command, args []string) {
+		var config = kafka.Config{
+			KafkaBrokers:        os.Getenv("KAFKA_BROKERS"),
+			KafkaVersion:        os.Getenv("KAFKA_VERSION"),
+			KafkaClientID:       os.Getenv("KAFKA_CLIENT_ID"),
+			KafkaTimeout:        os.Getenv("KAFKA_TIMEOUT"),
+			KafkaTopics:         os.Getenv("KAFKA_TOPICS"),
+			KafkaConsumerGroups: os.Getenv("KAFKA_CONSUMER_GROUPS"),
+			KafkaSASLMechanism:  os.Getenv("KAFKA_SASL_MECHANISM"),
+			KafkaSASLUser:       os.Getenv("KAFKA_SASL_USER"),
+			KafkaSASLPassword:   os.Getenv("KAFKA_SASL_PASSWORD"),
+			KafkaTLS:            os.Getenv("KAFKA_TLS") == "true",
+			KafkaTLSCAFile:      os.Getenv("KAFKA_TLS_CA_FILE"),
+			KafkaTLSCertFile:    os.Getenv("KAFKA_TLS_CERT_FILE"),
+			KafkaTLSKeyFile:     os.Getenv("KAFKA_TLS_KEY_FILE"),
+			KafkaTLSInsecure:    os.Getenv("KAFKA_TLS_INSECURE") == "true",
+			KafkaTLSServerName:  os.Getenv("KAFKA_TLS_SERVER_NAME"),
+		}
+		err := kafka.ValidateConfig(config)
+		if err != nil {
+			log.Fatalf("invalid config: %v\n", err)
+		}
+		kafka.Run(log, kafka.InitKafkaClient(log, config), config, prettyPrint, status.GetInfo().Version)
+	},
+}
@@ -17,11 +17,21 @@ var mongoCmd = &cobra.Command{
 	Short: "execute a mongo collection",
 	Run: func(cmd *cobra.Command, args []string) {
 		var config = mongo.Config{
-			MongoDBUser:     os.Getenv("MONGODB_USER"),
-			MongoDBPassword: os.Getenv("MONGODB_PASSWORD"),
-			MongoDBHost:     os.Getenv("MONGODB_HOST"),
-			MongoDBPort:     os.Getenv("MONGODB_PORT"),
-			MongoDB:         os.Getenv("MONGODB_DB"),
+			MongoDBUser:                  os.Getenv("MONGODB_USER"),
+			MongoDBPassword:              os.Getenv("MONGODB_PASSWORD"),
+			MongoDBHost:                  os.Getenv("MONGODB_HOST"),
+			MongoDBPort:                  os.Getenv("MONGODB_PORT"),
+			MongoDB:                      os.Getenv("MONGODB_DB"),
+			MongoDBURI:                   os.Getenv("MONGODB_URI"),
+			MongoDBAuthMechanism:         os.Getenv("MONGODB_AUTH_MECHANISM"),
+			MongoDBAuthSource:            os.Getenv("MONGODB_AUTH_SOURCE"),
+			MongoDBReplicaSet:            os.Getenv("MONGODB_REPLICA_SET"),
+			MongoDBReadPreference:        os.Getenv("MONGODB_READ_PREFERENCE"),
+			MongoDBTLS:                   os.Getenv("MONGODB_TLS") == "true",
+			MongoDBTLSCAFile:             os.Getenv("MONGODB_TLS_CA_FILE"),
+			MongoDBTLSCertificateKeyFile: os.Getenv("MONGODB_TLS_CERTIFICATE_KEY_FILE"),
+			MongoDBTLSInsecure:           os.Getenv("MONGODB_TLS_INSECURE") == "true",
+			StateFile:                    os.Getenv("MONGODB_STATE_FILE"),
 		}
 		err := mongo.ValidateConfig(config)
 		if err != nil {
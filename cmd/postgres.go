@@ -0,0 +1,20 @@
+package cmd
+
+import (
+	"github.com/GannettDigital/go-newrelic-plugin/postgres"
+	status "github.com/GannettDigital/goStateModule"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	RootCmd.AddCommand(postgresCmd)
+}
+
+var postgresCmd = &cobra.Command{
+	Use:   "postgres",
+	Short: "execute a postgres collection",
+	Run: func(cmd *cobra.Command, args []string) {
+		log.Info("postgres collection")
+		postgres.Run(log, prettyPrint, status.GetInfo().Version)
+	},
+}
@@ -1,13 +1,12 @@
 package couchbase
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
-	"sync"
 
 	"github.com/GannettDigital/go-newrelic-plugin/helpers"
 	"github.com/GannettDigital/paas-api-utils/utilsHTTP"
@@ -15,7 +14,19 @@ import (
 )
 
 var runner utilsHTTP.HTTPRunner
-var bucketList, remoteUUIDList, remoteStatEndpoints []string
+
+// remoteStatEndpoints are the replication stats reported for every bucket and
+// remote cluster
+var remoteStatEndpoints = []string{
+	"changes_left",
+	"rate_replicated",
+	"docs_written",
+	"docs_checked",
+	"docs_rep_queue",
+	"num_checkpoints",
+	"num_failedckpts",
+	"bandwidth_usage",
+}
 
 const EVENT_TYPE string = "DatastoreSample"
 const NAME string = "couchbase"
@@ -28,6 +39,22 @@ type CouchbaseConfig struct {
 	CouchbasePassword string
 	CouchbasePort     string
 	CouchbaseHost     string
+
+	// the stats zoom level and how the samples it returns are reduced to a
+	// single value, per bucket and optionally per bucket on every node
+	CouchbaseZoom             string
+	CouchbaseReduction        string
+	CouchbaseMetricReductions string
+	CouchbaseNodeStats        bool
+
+	// how many requests are made at once and how long each may take, in
+	// seconds
+	CouchbaseWorkers        int
+	CouchbaseRequestTimeout int
+
+	// where the topology is kept between runs to report rebalance, failover
+	// and membership events
+	CouchbaseStateFile string
 }
 
 type CouchbaseBucketStats struct {
@@ -145,6 +172,14 @@ type CouchbaseBucketStatsURI struct {
 	StatsObject struct {
 		URI string `json:"uri"`
 	} `json:"stats"`
+
+	// the bucket definition, reported as inventory
+	BucketType     string `json:"bucketType"`
+	ReplicaNumber  int    `json:"replicaNumber"`
+	EvictionPolicy string `json:"evictionPolicy"`
+	Quota          struct {
+		RAM int64 `json:"ram"`
+	} `json:"quota"`
 }
 
 type CouchbaseClusterInfo struct {
@@ -169,12 +204,35 @@ type CouchbaseClusterInfo struct {
 		HostName          string `json:"hostname"`
 		ClusterMembership string `json:"clusterMembership"`
 		Status            string `json:"status"`
+
+		Services []string `json:"services"`
+		Version  string   `json:"version"`
 	} `json:"nodes"`
+
+	// the memory quotas of the services, in MB
+	MemoryQuota         int64 `json:"memoryQuota"`
+	IndexMemoryQuota    int64 `json:"indexMemoryQuota"`
+	FTSMemoryQuota      int64 `json:"ftsMemoryQuota"`
+	CBASMemoryQuota     int64 `json:"cbasMemoryQuota"`
+	EventingMemoryQuota int64 `json:"eventingMemoryQuota"`
 }
 
 type CompleteBucketInfo struct {
 	bucketInfo  CouchbaseBucketStatsURI
 	bucketStats CouchbaseBucketStats
+	// node is set for the stats of the bucket on a single node
+	node       string
+	reductions sampleReductions
+}
+
+// CouchbaseBucketNodes is /pools/default/buckets/<bucket>/nodes
+type CouchbaseBucketNodes struct {
+	Servers []struct {
+		HostName    string `json:"hostname"`
+		StatsObject struct {
+			URI string `json:"uri"`
+		} `json:"stats"`
+	} `json:"servers"`
 }
 
 type CouchbaseRemoteReplicationStats struct {
@@ -221,6 +279,12 @@ func validateConfig(log *logrus.Logger, config CouchbaseConfig) error {
 	if config.CouchbaseUser == "" {
 		return errors.New("Config Yaml is missing CouchbaseUser value. Please check the config to continue")
 	}
+	if config.CouchbaseZoom != "" && !zooms[config.CouchbaseZoom] {
+		return fmt.Errorf("Config Yaml has an unknown COUCHBASE_ZOOM %q, expected minute or hour", config.CouchbaseZoom)
+	}
+	if _, err := parseReductions(config.CouchbaseReduction, config.CouchbaseMetricReductions); err != nil {
+		return fmt.Errorf("Config Yaml has an invalid reduction: %v", err)
+	}
 	return nil
 }
 
@@ -230,8 +294,8 @@ func fatalIfErr(log *logrus.Logger, err error) {
 	}
 }
 
-func executeAndDecode(log *logrus.Logger, httpReq http.Request, record interface{}) error {
-	code, data, err := runner.CallAPI(log, nil, &httpReq, &http.Client{})
+func executeAndDecode(log *logrus.Logger, client *http.Client, httpReq http.Request, record interface{}) error {
+	code, data, err := runner.CallAPI(log, nil, &httpReq, client)
 	if err != nil || code != 200 {
 		log.WithFields(logrus.Fields{
 			"code":    code,
@@ -239,6 +303,9 @@ func executeAndDecode(log *logrus.Logger, httpReq http.Request, record interface
 			"httpReq": httpReq,
 			"error":   err,
 		}).Error("Encountered error calling CallAPI")
+		if err == nil {
+			err = fmt.Errorf("unexpected response code %d", code)
+		}
 		return err
 	}
 	return json.Unmarshal(data, &record)
@@ -246,18 +313,6 @@ func executeAndDecode(log *logrus.Logger, httpReq http.Request, record interface
 
 func init() {
 	runner = &utilsHTTP.HTTPRunnerImpl{}
-	bucketList = []string{}
-	remoteUUIDList = []string{}
-	remoteStatEndpoints = []string{
-		"changes_left",
-		"rate_replicated",
-		"docs_written",
-		"docs_checked",
-		"docs_rep_queue",
-		"num_checkpoints",
-		"num_failedckpts",
-		"bandwidth_usage",
-	}
 }
 
 func Run(log *logrus.Logger, prettyPrint bool, version string) {
@@ -277,26 +332,40 @@ func Run(log *logrus.Logger, prettyPrint bool, version string) {
 		CouchbasePassword: os.Getenv("COUCHBASE_PASSWORD"),
 		CouchbasePort:     os.Getenv("COUCHBASE_PORT"),
 		CouchbaseHost:     os.Getenv("COUCHBASE_HOST"),
+
+		CouchbaseZoom:             os.Getenv("COUCHBASE_ZOOM"),
+		CouchbaseReduction:        os.Getenv("COUCHBASE_REDUCTION"),
+		CouchbaseMetricReductions: os.Getenv("COUCHBASE_METRIC_REDUCTIONS"),
+		CouchbaseNodeStats:        os.Getenv("COUCHBASE_NODE_STATS") == "true",
+
+		CouchbaseWorkers:        intSetting(os.Getenv("COUCHBASE_WORKERS"), DEFAULT_WORKERS),
+		CouchbaseRequestTimeout: intSetting(os.Getenv("COUCHBASE_REQUEST_TIMEOUT"), DEFAULT_REQUEST_TIMEOUT),
+
+		CouchbaseStateFile: os.Getenv("COUCHBASE_STATE_FILE"),
 	}
 	err := validateConfig(log, config)
 	fatalIfErr(log, err)
 
-	couchClusterResponses, getCouchClusterStatsError := getCouchClusterStats(log, config)
-	couchBucketResponses, getCouchBucketStatsError := getCouchBucketsStats(log, config)
-	couchReplicationResponses, getCouchReplicationStatsError := getCouchReplicationStats(log, config)
-	couchRemoteReplicationResponses, getCouchRemoteReplicationStatsError := getCouchRemoteReplicationStats(log, config)
-	for _, currentError := range []interface{}{getCouchClusterStatsError, getCouchBucketStatsError, getCouchReplicationStatsError, getCouchRemoteReplicationStatsError} {
-		if getCouchClusterStatsError != nil {
+	metrics, clusterTopology, err := collect(log, config)
+	if err != nil {
+		if len(metrics) == 0 {
 			log.WithFields(logrus.Fields{
-				"err": currentError,
+				"err": err,
 			}).Fatal("Error retreiving couchbase stats.")
 		}
+		log.WithError(err).Warn("Failed to collect some couchbase stats")
 	}
 
-	data.Metrics = append(data.Metrics, couchClusterResponses...)
-	data.Metrics = append(data.Metrics, couchBucketResponses...)
-	data.Metrics = append(data.Metrics, couchReplicationResponses...)
-	data.Metrics = append(data.Metrics, couchRemoteReplicationResponses...)
+	data.Metrics = append(data.Metrics, metrics...)
+	if clusterTopology.found {
+		data.Inventory = topologyInventory(clusterTopology)
+		previousState, found := readTopologyState(log, config)
+		events, state := topologyEvents(previousState, clusterTopology)
+		if found {
+			data.Events = append(data.Events, events...)
+		}
+		writeTopologyState(log, config, state)
+	}
 	fatalIfErr(log, helpers.OutputJSON(data, prettyPrint))
 }
 
@@ -330,62 +399,62 @@ func formatBucketInfoStatsStructToMap(completeBucketInfo CompleteBucketInfo) (bu
 		"provider":                                             PROVIDER,
 		"couchbase.scalr.clustername":                          os.Getenv("CB_CLUSTER_NAME"),
 		"couchbase.by_bucket.name":                             completeBucketInfo.bucketInfo.Name,
-		"couchbase.by_bucket.avg_bg_wait_time":                 avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.AVGBGWaitTime),
-		"couchbase.by_bucket.avg_disk_commit_time":             avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.AVGDiskCommitTime),
-		"couchbase.by_bucket.bytes_read":                       avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.BytesRead),
-		"couchbase.by_bucket.bytes_written":                    avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.BytesWritten),
-		"couchbase.by_bucket.cas_hits":                         avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.CasHits),
-		"couchbase.by_bucket.cas_misses":                       avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.CasMisses),
-		"couchbase.by_bucket.cmd_get":                          avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.CMDGet),
-		"couchbase.by_bucket.cmd_set":                          avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.CMDSet),
-		"couchbase.by_bucket.couch_docs_actual_disk_size":      avgInt64Sample(completeBucketInfo.bucketStats.OP.Samples.CouchDocsActualDiskSize),
-		"couchbase.by_bucket.couch_docs_data_size":             avgInt64Sample(completeBucketInfo.bucketStats.OP.Samples.CouchDocsDataSize),
-		"couchbase.by_bucket.couch_docs_disk_size":             avgInt64Sample(completeBucketInfo.bucketStats.OP.Samples.CouchDocsDiskSize),
-		"couchbase.by_bucket.couch_docs_fragmentation":         avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.CouchDocsFragmentation),
-		"couchbase.by_bucket.couch_total_disk_size":            avgInt64Sample(completeBucketInfo.bucketStats.OP.Samples.CouchTotalDiskSize),
-		"couchbase.by_bucket.couch_views_fragmentation":        avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.CouchViewsFragmentation),
-		"couchbase.by_bucket.couch_views_ops":                  avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.CouchViewsOps),
-		"couchbase.by_bucket.cpu_idle_ms":                      avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.CPUIdleTime),
-		"couchbase.by_bucket.cpu_utilization_rate":             avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.CPUUtilizationRate),
-		"couchbase.by_bucket.curr_connections":                 avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.CurrConnections),
-		"couchbase.by_bucket.curr_items":                       avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.CurrItems),
-		"couchbase.by_bucket.curr_items_tot":                   avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.CurrItemsTotal),
-		"couchbase.by_bucket.decr_hits":                        avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.DecrHits),
-		"couchbase.by_bucket.decr_misses":                      avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.DecrMisses),
-		"couchbase.by_bucket.delete_hits":                      avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.DeleteHits),
-		"couchbase.by_bucket.delete_misses":                    avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.DeleteMisses),
-		"couchbase.by_bucket.disk_commit_count":                avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.DiskCommitCount),
-		"couchbase.by_bucket.disk_update_count":                avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.DiskUpdateCount),
-		"couchbase.by_bucket.disk_write_queue":                 avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.DiskWriteQueue),
-		"couchbase.by_bucket.evictions":                        avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.Evictions),
-		"couchbase.by_bucket.get_hits":                         avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.GetHits),
-		"couchbase.by_bucket.get_misses":                       avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.GetMisses),
-		"couchbase.by_bucket.hit_ratio":                        avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.HitRatio),
-		"couchbase.by_bucket.incr_hits":                        avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.IncrHits),
-		"couchbase.by_bucket.mem_free":                         avgInt64Sample(completeBucketInfo.bucketStats.OP.Samples.MemFree),
-		"couchbase.by_bucket.mem_actual_free":                  avgInt64Sample(completeBucketInfo.bucketStats.OP.Samples.MemActuallFree),
-		"couchbase.by_bucket.mem_total":                        avgInt64Sample(completeBucketInfo.bucketStats.OP.Samples.MemTotal),
-		"couchbase.by_bucket.mem_used":                         avgInt64Sample(completeBucketInfo.bucketStats.OP.Samples.MemUsed),
-		"couchbase.by_bucket.mem_actual_used":                  avgInt64Sample(completeBucketInfo.bucketStats.OP.Samples.MemActuallUsed),
-		"couchbase.by_bucket.misses":                           avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.Misses),
-		"couchbase.by_bucket.ops":                              avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.Ops),
-		"couchbase.by_bucket.vb_active_itm_memory":             avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.VBActiveItmMemory),
-		"couchbase.by_bucket.vb_active_meta_data_memory":       avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.VBActiveMetaDataMemory),
-		"couchbase.by_bucket.vb_active_num":                    avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.VBActiveNums),
-		"couchbase.by_bucket.vb_active_queue_drain":            avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.VBActiveQueueDrain),
-		"couchbase.by_bucket.vb_active_queue_size":             avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.VBActiveQueueSize),
-		"couchbase.by_bucket.vb_active_resident_items_ratio":   avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.VBActiveResidentItemsRatio),
-		"couchbase.by_bucket.vb_active_num_non_resident":       avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.VBActiveNumNonResident),
-		"couchbase.by_bucket.vb_avg_total_queue_age":           avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.VBAvgTotalQueueAge),
-		"couchbase.by_bucket.vb_pending_ops_create":            avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.VBPendingOpsCreate),
-		"couchbase.by_bucket.vb_pending_queue_fill":            avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.VBPendingQueueFill),
-		"couchbase.by_bucket.vb_replica_curr_items":            avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.VBReplicaCurrItems),
-		"couchbase.by_bucket.vb_replica_itm_memory":            avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.VBReplicaItmMemory),
-		"couchbase.by_bucket.vb_replica_meta_data_memory":      avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.VBReplicaMetaDataMemory),
-		"couchbase.by_bucket.vb_replica_num":                   avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.VBReplicaNum),
-		"couchbase.by_bucket.vb_replica_queue_size":            avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.VBReplicaQueueSize),
-		"couchbase.by_bucket.xdc_ops":                          avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.XDCOPS),
-		"couchbase.by_bucket.vb_replica_resident_items_ration": avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.VBReplicaResidentItemsRatio),
+		"couchbase.by_bucket.avg_bg_wait_time":                 completeBucketInfo.float32Sample("avg_bg_wait_time", completeBucketInfo.bucketStats.OP.Samples.AVGBGWaitTime),
+		"couchbase.by_bucket.avg_disk_commit_time":             completeBucketInfo.float32Sample("avg_disk_commit_time", completeBucketInfo.bucketStats.OP.Samples.AVGDiskCommitTime),
+		"couchbase.by_bucket.bytes_read":                       completeBucketInfo.float32Sample("bytes_read", completeBucketInfo.bucketStats.OP.Samples.BytesRead),
+		"couchbase.by_bucket.bytes_written":                    completeBucketInfo.float32Sample("bytes_written", completeBucketInfo.bucketStats.OP.Samples.BytesWritten),
+		"couchbase.by_bucket.cas_hits":                         completeBucketInfo.float32Sample("cas_hits", completeBucketInfo.bucketStats.OP.Samples.CasHits),
+		"couchbase.by_bucket.cas_misses":                       completeBucketInfo.float32Sample("cas_misses", completeBucketInfo.bucketStats.OP.Samples.CasMisses),
+		"couchbase.by_bucket.cmd_get":                          completeBucketInfo.float32Sample("cmd_get", completeBucketInfo.bucketStats.OP.Samples.CMDGet),
+		"couchbase.by_bucket.cmd_set":                          completeBucketInfo.float32Sample("cmd_set", completeBucketInfo.bucketStats.OP.Samples.CMDSet),
+		"couchbase.by_bucket.couch_docs_actual_disk_size":      completeBucketInfo.int64Sample("couch_docs_actual_disk_size", completeBucketInfo.bucketStats.OP.Samples.CouchDocsActualDiskSize),
+		"couchbase.by_bucket.couch_docs_data_size":             completeBucketInfo.int64Sample("couch_docs_data_size", completeBucketInfo.bucketStats.OP.Samples.CouchDocsDataSize),
+		"couchbase.by_bucket.couch_docs_disk_size":             completeBucketInfo.int64Sample("couch_docs_disk_size", completeBucketInfo.bucketStats.OP.Samples.CouchDocsDiskSize),
+		"couchbase.by_bucket.couch_docs_fragmentation":         completeBucketInfo.float32Sample("couch_docs_fragmentation", completeBucketInfo.bucketStats.OP.Samples.CouchDocsFragmentation),
+		"couchbase.by_bucket.couch_total_disk_size":            completeBucketInfo.int64Sample("couch_total_disk_size", completeBucketInfo.bucketStats.OP.Samples.CouchTotalDiskSize),
+		"couchbase.by_bucket.couch_views_fragmentation":        completeBucketInfo.float32Sample("couch_views_fragmentation", completeBucketInfo.bucketStats.OP.Samples.CouchViewsFragmentation),
+		"couchbase.by_bucket.couch_views_ops":                  completeBucketInfo.float32Sample("couch_views_ops", completeBucketInfo.bucketStats.OP.Samples.CouchViewsOps),
+		"couchbase.by_bucket.cpu_idle_ms":                      completeBucketInfo.float32Sample("cpu_idle_ms", completeBucketInfo.bucketStats.OP.Samples.CPUIdleTime),
+		"couchbase.by_bucket.cpu_utilization_rate":             completeBucketInfo.float32Sample("cpu_utilization_rate", completeBucketInfo.bucketStats.OP.Samples.CPUUtilizationRate),
+		"couchbase.by_bucket.curr_connections":                 completeBucketInfo.float32Sample("curr_connections", completeBucketInfo.bucketStats.OP.Samples.CurrConnections),
+		"couchbase.by_bucket.curr_items":                       completeBucketInfo.float32Sample("curr_items", completeBucketInfo.bucketStats.OP.Samples.CurrItems),
+		"couchbase.by_bucket.curr_items_tot":                   completeBucketInfo.float32Sample("curr_items_tot", completeBucketInfo.bucketStats.OP.Samples.CurrItemsTotal),
+		"couchbase.by_bucket.decr_hits":                        completeBucketInfo.float32Sample("decr_hits", completeBucketInfo.bucketStats.OP.Samples.DecrHits),
+		"couchbase.by_bucket.decr_misses":                      completeBucketInfo.float32Sample("decr_misses", completeBucketInfo.bucketStats.OP.Samples.DecrMisses),
+		"couchbase.by_bucket.delete_hits":                      completeBucketInfo.float32Sample("delete_hits", completeBucketInfo.bucketStats.OP.Samples.DeleteHits),
+		"couchbase.by_bucket.delete_misses":                    completeBucketInfo.float32Sample("delete_misses", completeBucketInfo.bucketStats.OP.Samples.DeleteMisses),
+		"couchbase.by_bucket.disk_commit_count":                completeBucketInfo.float32Sample("disk_commit_count", completeBucketInfo.bucketStats.OP.Samples.DiskCommitCount),
+		"couchbase.by_bucket.disk_update_count":                completeBucketInfo.float32Sample("disk_update_count", completeBucketInfo.bucketStats.OP.Samples.DiskUpdateCount),
+		"couchbase.by_bucket.disk_write_queue":                 completeBucketInfo.float32Sample("disk_write_queue", completeBucketInfo.bucketStats.OP.Samples.DiskWriteQueue),
+		"couchbase.by_bucket.evictions":                        completeBucketInfo.float32Sample("evictions", completeBucketInfo.bucketStats.OP.Samples.Evictions),
+		"couchbase.by_bucket.get_hits":                         completeBucketInfo.float32Sample("get_hits", completeBucketInfo.bucketStats.OP.Samples.GetHits),
+		"couchbase.by_bucket.get_misses":                       completeBucketInfo.float32Sample("get_misses", completeBucketInfo.bucketStats.OP.Samples.GetMisses),
+		"couchbase.by_bucket.hit_ratio":                        completeBucketInfo.float32Sample("hit_ratio", completeBucketInfo.bucketStats.OP.Samples.HitRatio),
+		"couchbase.by_bucket.incr_hits":                        completeBucketInfo.float32Sample("incr_hits", completeBucketInfo.bucketStats.OP.Samples.IncrHits),
+		"couchbase.by_bucket.mem_free":                         completeBucketInfo.int64Sample("mem_free", completeBucketInfo.bucketStats.OP.Samples.MemFree),
+		"couchbase.by_bucket.mem_actual_free":                  completeBucketInfo.int64Sample("mem_actual_free", completeBucketInfo.bucketStats.OP.Samples.MemActuallFree),
+		"couchbase.by_bucket.mem_total":                        completeBucketInfo.int64Sample("mem_total", completeBucketInfo.bucketStats.OP.Samples.MemTotal),
+		"couchbase.by_bucket.mem_used":                         completeBucketInfo.int64Sample("mem_used", completeBucketInfo.bucketStats.OP.Samples.MemUsed),
+		"couchbase.by_bucket.mem_actual_used":                  completeBucketInfo.int64Sample("mem_actual_used", completeBucketInfo.bucketStats.OP.Samples.MemActuallUsed),
+		"couchbase.by_bucket.misses":                           completeBucketInfo.float32Sample("misses", completeBucketInfo.bucketStats.OP.Samples.Misses),
+		"couchbase.by_bucket.ops":                              completeBucketInfo.float32Sample("ops", completeBucketInfo.bucketStats.OP.Samples.Ops),
+		"couchbase.by_bucket.vb_active_itm_memory":             completeBucketInfo.float32Sample("vb_active_itm_memory", completeBucketInfo.bucketStats.OP.Samples.VBActiveItmMemory),
+		"couchbase.by_bucket.vb_active_meta_data_memory":       completeBucketInfo.float32Sample("vb_active_meta_data_memory", completeBucketInfo.bucketStats.OP.Samples.VBActiveMetaDataMemory),
+		"couchbase.by_bucket.vb_active_num":                    completeBucketInfo.float32Sample("vb_active_num", completeBucketInfo.bucketStats.OP.Samples.VBActiveNums),
+		"couchbase.by_bucket.vb_active_queue_drain":            completeBucketInfo.float32Sample("vb_active_queue_drain", completeBucketInfo.bucketStats.OP.Samples.VBActiveQueueDrain),
+		"couchbase.by_bucket.vb_active_queue_size":             completeBucketInfo.float32Sample("vb_active_queue_size", completeBucketInfo.bucketStats.OP.Samples.VBActiveQueueSize),
+		"couchbase.by_bucket.vb_active_resident_items_ratio":   completeBucketInfo.float32Sample("vb_active_resident_items_ratio", completeBucketInfo.bucketStats.OP.Samples.VBActiveResidentItemsRatio),
+		"couchbase.by_bucket.vb_active_num_non_resident":       completeBucketInfo.float32Sample("vb_active_num_non_resident", completeBucketInfo.bucketStats.OP.Samples.VBActiveNumNonResident),
+		"couchbase.by_bucket.vb_avg_total_queue_age":           completeBucketInfo.float32Sample("vb_avg_total_queue_age", completeBucketInfo.bucketStats.OP.Samples.VBAvgTotalQueueAge),
+		"couchbase.by_bucket.vb_pending_ops_create":            completeBucketInfo.float32Sample("vb_pending_ops_create", completeBucketInfo.bucketStats.OP.Samples.VBPendingOpsCreate),
+		"couchbase.by_bucket.vb_pending_queue_fill":            completeBucketInfo.float32Sample("vb_pending_queue_fill", completeBucketInfo.bucketStats.OP.Samples.VBPendingQueueFill),
+		"couchbase.by_bucket.vb_replica_curr_items":            completeBucketInfo.float32Sample("vb_replica_curr_items", completeBucketInfo.bucketStats.OP.Samples.VBReplicaCurrItems),
+		"couchbase.by_bucket.vb_replica_itm_memory":            completeBucketInfo.float32Sample("vb_replica_itm_memory", completeBucketInfo.bucketStats.OP.Samples.VBReplicaItmMemory),
+		"couchbase.by_bucket.vb_replica_meta_data_memory":      completeBucketInfo.float32Sample("vb_replica_meta_data_memory", completeBucketInfo.bucketStats.OP.Samples.VBReplicaMetaDataMemory),
+		"couchbase.by_bucket.vb_replica_num":                   completeBucketInfo.float32Sample("vb_replica_num", completeBucketInfo.bucketStats.OP.Samples.VBReplicaNum),
+		"couchbase.by_bucket.vb_replica_queue_size":            completeBucketInfo.float32Sample("vb_replica_queue_size", completeBucketInfo.bucketStats.OP.Samples.VBReplicaQueueSize),
+		"couchbase.by_bucket.xdc_ops":                          completeBucketInfo.float32Sample("xdc_ops", completeBucketInfo.bucketStats.OP.Samples.XDCOPS),
+		"couchbase.by_bucket.vb_replica_resident_items_ration": completeBucketInfo.float32Sample("vb_replica_resident_items_ration", completeBucketInfo.bucketStats.OP.Samples.VBReplicaResidentItemsRatio),
 	}
 }
 
@@ -395,43 +464,43 @@ func formatBucketInfoEPStatsStructToMap(completeBucketInfo CompleteBucketInfo) (
 		"provider":                                            PROVIDER,
 		"couchbase.scalr.clustername":                         os.Getenv("CB_CLUSTER_NAME"),
 		"couchbase.by_bucket.name":                            completeBucketInfo.bucketInfo.Name,
-		"couchbase.by_bucket.ep_bg_fetched":                   avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.EPBGFetched),
-		"couchbase.by_bucket.ep_cache_miss_rate":              avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.EPCacheMissRate),
-		"couchbase.by_bucket.ep_diskqueue_items":              avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.EPDiskQueueItems),
-		"couchbase.by_bucket.ep_diskqueue_drain":              avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.EPDiskQueueDrain),
-		"couchbase.by_bucket.ep_diskqueue_fill":               avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.EPDiskQueueFill),
-		"couchbase.by_bucket.ep_flusher_todo":                 avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.EPFlusherTodo),
-		"couchbase.by_bucket.ep_item_commit_failed":           avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.EpItemCommitFailed),
-		"couchbase.by_bucket.ep_max_size":                     avgInt64Sample(completeBucketInfo.bucketStats.OP.Samples.EPMaxSize),
-		"couchbase.by_bucket.ep_mem_high_wat":                 avgInt64Sample(completeBucketInfo.bucketStats.OP.Samples.EPMemHighWater),
-		"couchbase.by_bucket.ep_num_non_resident":             avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.EPNumNonResident),
-		"couchbase.by_bucket.ep_meta_data_memory":             avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.EPMetaDataMemory),
-		"couchbase.by_bucket.ep_num_value_ejects":             avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.EPNumValueEjects),
-		"couchbase.by_bucket.ep_num_ops_get_meta":             avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.EPNumOpsGetMeta),
-		"couchbase.by_bucket.ep_num_ops_set_meta":             avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.EPNumOpsSetMeta),
-		"couchbase.by_bucket.ep_oom_errors":                   avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.EPOOMErrors),
-		"couchbase.by_bucket.ep_ops_create":                   avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.EPOPSCreate),
-		"couchbase.by_bucket.ep_ops_update":                   avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.EPOPSUpdate),
-		"couchbase.by_bucket.ep_overhead":                     avgInt64Sample(completeBucketInfo.bucketStats.OP.Samples.EPOverhead),
-		"couchbase.by_bucket.ep_queue_size":                   avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.EPQueueSize),
-		"couchbase.by_bucket.ep_resident_items_rate":          avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.EPResidentItemsRate),
-		"couchbase.by_bucket.ep_tap_replica_queue_drain":      avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.EPTapReplicaQueueDrain),
-		"couchbase.by_bucket.ep_tap_total_queue_drain":        avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.EPTapTotalQueueDrain),
-		"couchbase.by_bucket.ep_tap_total_queue_fill":         avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.EPTapTotalQueueFill),
-		"couchbase.by_bucket.ep_tap_total_total_backlog_size": avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.EPTapTotalTotalBacklogSize),
-		"couchbase.by_bucket.ep_tmp_oom_errors":               avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.EPTMPOOMErrors),
-		"couchbase.by_bucket.ep_kv_size":                      avgInt64Sample(completeBucketInfo.bucketStats.OP.Samples.EPKVSize),
-		"couchbase.by_bucket.ep_mem_low_wat":                  avgInt64Sample(completeBucketInfo.bucketStats.OP.Samples.EPMemLowWater),
-		"couchbase.by_bucket.ep_dcp_replica_items_remaining":  avgInt64Sample(completeBucketInfo.bucketStats.OP.Samples.EPDcpReplicaItemsRemaining),
-		"couchbase.by_bucket.ep_dcp_replica_items_sent":       avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.EPDcpReplicaItemsSent),
-		"couchbase.by_bucket.ep_dcp_replica_total_bytes":      avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.EPDcpReplicaTotalBytes),
-		"couchbase.by_bucket.ep_dcp_xdcr_items_remaining":     avgInt64Sample(completeBucketInfo.bucketStats.OP.Samples.EPDcpXDCRItemsRemaining),
-		"couchbase.by_bucket.ep_dcp_xdcr_items_sent":          avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.EPDcpXDCRItemsSent),
-		"couchbase.by_bucket.ep_dcp_xdcr_total_bytes":         avgFloat32Sample(completeBucketInfo.bucketStats.OP.Samples.EPDcpXDCRTotalBytes),
-		"couchbase.by_bucket.ep_dcp_views_items_remaining":    avgInt64Sample(completeBucketInfo.bucketStats.OP.Samples.EPDcpViewItemsRemaining),
-		"couchbase.by_bucket.ep_dcp_2i_items_remaining":       avgInt64Sample(completeBucketInfo.bucketStats.OP.Samples.EPDcp2iItemsRemaining),
-		"couchbase.by_bucket.ep_dcp_fts_items_remaining":      avgInt64Sample(completeBucketInfo.bucketStats.OP.Samples.EPDcpFtsItemsRemaining),
-		"couchbase.by_bucket.ep_dcp_other_items_remaining":    avgInt64Sample(completeBucketInfo.bucketStats.OP.Samples.EPDcpOtherItemsRemaining),
+		"couchbase.by_bucket.ep_bg_fetched":                   completeBucketInfo.float32Sample("ep_bg_fetched", completeBucketInfo.bucketStats.OP.Samples.EPBGFetched),
+		"couchbase.by_bucket.ep_cache_miss_rate":              completeBucketInfo.float32Sample("ep_cache_miss_rate", completeBucketInfo.bucketStats.OP.Samples.EPCacheMissRate),
+		"couchbase.by_bucket.ep_diskqueue_items":              completeBucketInfo.float32Sample("ep_diskqueue_items", completeBucketInfo.bucketStats.OP.Samples.EPDiskQueueItems),
+		"couchbase.by_bucket.ep_diskqueue_drain":              completeBucketInfo.float32Sample("ep_diskqueue_drain", completeBucketInfo.bucketStats.OP.Samples.EPDiskQueueDrain),
+		"couchbase.by_bucket.ep_diskqueue_fill":               completeBucketInfo.float32Sample("ep_diskqueue_fill", completeBucketInfo.bucketStats.OP.Samples.EPDiskQueueFill),
+		"couchbase.by_bucket.ep_flusher_todo":                 completeBucketInfo.float32Sample("ep_flusher_todo", completeBucketInfo.bucketStats.OP.Samples.EPFlusherTodo),
+		"couchbase.by_bucket.ep_item_commit_failed":           completeBucketInfo.float32Sample("ep_item_commit_failed", completeBucketInfo.bucketStats.OP.Samples.EpItemCommitFailed),
+		"couchbase.by_bucket.ep_max_size":                     completeBucketInfo.int64Sample("ep_max_size", completeBucketInfo.bucketStats.OP.Samples.EPMaxSize),
+		"couchbase.by_bucket.ep_mem_high_wat":                 completeBucketInfo.int64Sample("ep_mem_high_wat", completeBucketInfo.bucketStats.OP.Samples.EPMemHighWater),
+		"couchbase.by_bucket.ep_num_non_resident":             completeBucketInfo.float32Sample("ep_num_non_resident", completeBucketInfo.bucketStats.OP.Samples.EPNumNonResident),
+		"couchbase.by_bucket.ep_meta_data_memory":             completeBucketInfo.float32Sample("ep_meta_data_memory", completeBucketInfo.bucketStats.OP.Samples.EPMetaDataMemory),
+		"couchbase.by_bucket.ep_num_value_ejects":             completeBucketInfo.float32Sample("ep_num_value_ejects", completeBucketInfo.bucketStats.OP.Samples.EPNumValueEjects),
+		"couchbase.by_bucket.ep_num_ops_get_meta":             completeBucketInfo.float32Sample("ep_num_ops_get_meta", completeBucketInfo.bucketStats.OP.Samples.EPNumOpsGetMeta),
+		"couchbase.by_bucket.ep_num_ops_set_meta":             completeBucketInfo.float32Sample("ep_num_ops_set_meta", completeBucketInfo.bucketStats.OP.Samples.EPNumOpsSetMeta),
+		"couchbase.by_bucket.ep_oom_errors":                   completeBucketInfo.float32Sample("ep_oom_errors", completeBucketInfo.bucketStats.OP.Samples.EPOOMErrors),
+		"couchbase.by_bucket.ep_ops_create":                   completeBucketInfo.float32Sample("ep_ops_create", completeBucketInfo.bucketStats.OP.Samples.EPOPSCreate),
+		"couchbase.by_bucket.ep_ops_update":                   completeBucketInfo.float32Sample("ep_ops_update", completeBucketInfo.bucketStats.OP.Samples.EPOPSUpdate),
+		"couchbase.by_bucket.ep_overhead":                     completeBucketInfo.int64Sample("ep_overhead", completeBucketInfo.bucketStats.OP.Samples.EPOverhead),
+		"couchbase.by_bucket.ep_queue_size":                   completeBucketInfo.float32Sample("ep_queue_size", completeBucketInfo.bucketStats.OP.Samples.EPQueueSize),
+		"couchbase.by_bucket.ep_resident_items_rate":          completeBucketInfo.float32Sample("ep_resident_items_rate", completeBucketInfo.bucketStats.OP.Samples.EPResidentItemsRate),
+		"couchbase.by_bucket.ep_tap_replica_queue_drain":      completeBucketInfo.float32Sample("ep_tap_replica_queue_drain", completeBucketInfo.bucketStats.OP.Samples.EPTapReplicaQueueDrain),
+		"couchbase.by_bucket.ep_tap_total_queue_drain":        completeBucketInfo.float32Sample("ep_tap_total_queue_drain", completeBucketInfo.bucketStats.OP.Samples.EPTapTotalQueueDrain),
+		"couchbase.by_bucket.ep_tap_total_queue_fill":         completeBucketInfo.float32Sample("ep_tap_total_queue_fill", completeBucketInfo.bucketStats.OP.Samples.EPTapTotalQueueFill),
+		"couchbase.by_bucket.ep_tap_total_total_backlog_size": completeBucketInfo.float32Sample("ep_tap_total_total_backlog_size", completeBucketInfo.bucketStats.OP.Samples.EPTapTotalTotalBacklogSize),
+		"couchbase.by_bucket.ep_tmp_oom_errors":               completeBucketInfo.float32Sample("ep_tmp_oom_errors", completeBucketInfo.bucketStats.OP.Samples.EPTMPOOMErrors),
+		"couchbase.by_bucket.ep_kv_size":                      completeBucketInfo.int64Sample("ep_kv_size", completeBucketInfo.bucketStats.OP.Samples.EPKVSize),
+		"couchbase.by_bucket.ep_mem_low_wat":                  completeBucketInfo.int64Sample("ep_mem_low_wat", completeBucketInfo.bucketStats.OP.Samples.EPMemLowWater),
+		"couchbase.by_bucket.ep_dcp_replica_items_remaining":  completeBucketInfo.int64Sample("ep_dcp_replica_items_remaining", completeBucketInfo.bucketStats.OP.Samples.EPDcpReplicaItemsRemaining),
+		"couchbase.by_bucket.ep_dcp_replica_items_sent":       completeBucketInfo.float32Sample("ep_dcp_replica_items_sent", completeBucketInfo.bucketStats.OP.Samples.EPDcpReplicaItemsSent),
+		"couchbase.by_bucket.ep_dcp_replica_total_bytes":      completeBucketInfo.float32Sample("ep_dcp_replica_total_bytes", completeBucketInfo.bucketStats.OP.Samples.EPDcpReplicaTotalBytes),
+		"couchbase.by_bucket.ep_dcp_xdcr_items_remaining":     completeBucketInfo.int64Sample("ep_dcp_xdcr_items_remaining", completeBucketInfo.bucketStats.OP.Samples.EPDcpXDCRItemsRemaining),
+		"couchbase.by_bucket.ep_dcp_xdcr_items_sent":          completeBucketInfo.float32Sample("ep_dcp_xdcr_items_sent", completeBucketInfo.bucketStats.OP.Samples.EPDcpXDCRItemsSent),
+		"couchbase.by_bucket.ep_dcp_xdcr_total_bytes":         completeBucketInfo.float32Sample("ep_dcp_xdcr_total_bytes", completeBucketInfo.bucketStats.OP.Samples.EPDcpXDCRTotalBytes),
+		"couchbase.by_bucket.ep_dcp_views_items_remaining":    completeBucketInfo.int64Sample("ep_dcp_views_items_remaining", completeBucketInfo.bucketStats.OP.Samples.EPDcpViewItemsRemaining),
+		"couchbase.by_bucket.ep_dcp_2i_items_remaining":       completeBucketInfo.int64Sample("ep_dcp_2i_items_remaining", completeBucketInfo.bucketStats.OP.Samples.EPDcp2iItemsRemaining),
+		"couchbase.by_bucket.ep_dcp_fts_items_remaining":      completeBucketInfo.int64Sample("ep_dcp_fts_items_remaining", completeBucketInfo.bucketStats.OP.Samples.EPDcpFtsItemsRemaining),
+		"couchbase.by_bucket.ep_dcp_other_items_remaining":    completeBucketInfo.int64Sample("ep_dcp_other_items_remaining", completeBucketInfo.bucketStats.OP.Samples.EPDcpOtherItemsRemaining),
 	}
 }
 
@@ -440,47 +509,96 @@ func getCouchBucketsStats(log *logrus.Logger, couchConfig CouchbaseConfig) (allB
 	if err != nil {
 		return []MetricData{}, err
 	}
-	var bucketCount = len(allBucketStatsInfos)
-	bucketStatsResponses := make(chan CompleteBucketInfo, bucketCount)
-	var wg sync.WaitGroup
-	wg.Add(bucketCount)
-	for _, currentBucket := range allBucketStatsInfos {
-		go func(currentBucket CouchbaseBucketStatsURI) {
-			defer wg.Done()
-			bucketStats, err := getBucketStats(log, couchConfig, currentBucket.StatsObject.URI)
-			if err != nil {
-				log.WithFields(logrus.Fields{
-					"currentBucket": currentBucket,
-					"error":         err,
-				}).Info("Error Retreiving bucket stats")
-			} else {
-				bucketStatsResponses <- CompleteBucketInfo{currentBucket, bucketStats}
-			}
-		}(currentBucket)
+	tasks, err := bucketTasks(log, couchConfig, allBucketStatsInfos)
+	if err != nil {
+		return []MetricData{}, err
 	}
-	wg.Wait()
-	close(bucketStatsResponses)
-	for response := range bucketStatsResponses {
-		bucketList = append(bucketList, response.bucketInfo.Name)
-		allBucketStats = append(allBucketStats, formatBucketInfoStatsStructToMap(response))
-		allBucketStats = append(allBucketStats, formatBucketInfoEPStatsStructToMap(response))
+	return mergeResults(runTasks(couchConfig, tasks))
+}
+
+// bucketTasks returns a task collecting the stats of every bucket, along with
+// one per node collecting its stats there when COUCHBASE_NODE_STATS is set
+func bucketTasks(log *logrus.Logger, config CouchbaseConfig, buckets []CouchbaseBucketStatsURI) ([]task, error) {
+	reductions, err := parseReductions(config.CouchbaseReduction, config.CouchbaseMetricReductions)
+	if err != nil {
+		return nil, err
+	}
+	var bucketNodes []CouchbaseBucketNodes
+	var nodesErrs []error
+	if config.CouchbaseNodeStats {
+		bucketNodes, nodesErrs = listBucketNodes(log, config, buckets)
+	}
+	tasks := make([]task, 0, len(buckets))
+	for i, currentBucket := range buckets {
+		currentBucket := currentBucket
+		tasks = append(tasks, task{
+			name: fmt.Sprintf("bucket %s stats", currentBucket.Name),
+			run: func() ([]MetricData, error) {
+				bucketStats, err := getBucketStats(log, config, currentBucket.StatsObject.URI)
+				if err != nil {
+					return nil, err
+				}
+				response := CompleteBucketInfo{bucketInfo: currentBucket, bucketStats: bucketStats, reductions: reductions}
+				return []MetricData{formatBucketInfoStatsStructToMap(response), formatBucketInfoEPStatsStructToMap(response)}, nil
+			},
+		})
+		if !config.CouchbaseNodeStats {
+			continue
+		}
+		if err := nodesErrs[i]; err != nil {
+			tasks = append(tasks, task{
+				name: fmt.Sprintf("bucket %s nodes", currentBucket.Name),
+				run: func() ([]MetricData, error) {
+					return nil, err
+				},
+			})
+			continue
+		}
+		for _, server := range bucketNodes[i].Servers {
+			server := server
+			tasks = append(tasks, task{
+				name: fmt.Sprintf("bucket %s node %s stats", currentBucket.Name, server.HostName),
+				run: func() ([]MetricData, error) {
+					bucketStats, err := getBucketStats(log, config, server.StatsObject.URI)
+					if err != nil {
+						return nil, err
+					}
+					response := CompleteBucketInfo{bucketInfo: currentBucket, bucketStats: bucketStats, reductions: reductions, node: server.HostName}
+					stats := formatBucketInfoStatsStructToMap(response)
+					epStats := formatBucketInfoEPStatsStructToMap(response)
+					stats["couchbase.by_bucket.node"] = server.HostName
+					epStats["couchbase.by_bucket.node"] = server.HostName
+					return []MetricData{stats, epStats}, nil
+				},
+			})
+		}
 	}
+	return tasks, nil
+}
 
-	return allBucketStats, nil
+// listBucketNodes lists the nodes of every bucket on the workers, so the
+// stats of a bucket on every node can each be collected by their own task. A
+// bucket whose nodes can't be listed has its error at the same index.
+func listBucketNodes(log *logrus.Logger, config CouchbaseConfig, buckets []CouchbaseBucketStatsURI) ([]CouchbaseBucketNodes, []error) {
+	bucketNodes := make([]CouchbaseBucketNodes, len(buckets))
+	errs := make([]error, len(buckets))
+	tasks := make([]task, len(buckets))
+	for i, bucket := range buckets {
+		i, bucket := i, bucket
+		tasks[i] = task{
+			name: fmt.Sprintf("bucket %s nodes", bucket.Name),
+			run: func() ([]MetricData, error) {
+				errs[i] = getAPI(log, config, fmt.Sprintf("/pools/default/buckets/%v/nodes", url.PathEscape(bucket.Name)), &bucketNodes[i])
+				return nil, nil
+			},
+		}
+	}
+	runTasks(config, tasks)
+	return bucketNodes, errs
 }
 
 func getBucketStats(log *logrus.Logger, config CouchbaseConfig, bucketURI string) (bucketStats CouchbaseBucketStats, err error) {
-	couchbaseStatsURI := fmt.Sprintf("%v:%v%v%v", config.CouchbaseHost, config.CouchbasePort, bucketURI, "?zoom=minute")
-	httpReq, err := http.NewRequest("GET", couchbaseStatsURI, bytes.NewBuffer([]byte("")))
-	if err != nil {
-		log.WithFields(logrus.Fields{
-			"couchbaseStatsURI": couchbaseStatsURI,
-			"error":             err,
-		}).Error("Encountered error creating http.NewRequest")
-		return CouchbaseBucketStats{}, err
-	}
-	httpReq.SetBasicAuth(config.CouchbaseUser, config.CouchbasePassword)
-	err = executeAndDecode(log, *httpReq, &bucketStats)
+	err = getAPI(log, config, fmt.Sprintf("%v?zoom=%v", bucketURI, zoom(config)), &bucketStats)
 	if err != nil {
 		return CouchbaseBucketStats{}, err
 	}
@@ -488,17 +606,7 @@ func getBucketStats(log *logrus.Logger, config CouchbaseConfig, bucketURI string
 }
 
 func getAllBucketsInfo(log *logrus.Logger, config CouchbaseConfig) (bucketStatsInfos []CouchbaseBucketStatsURI, err error) {
-	couchbaseStatsURI := fmt.Sprintf("%v:%v/%v", config.CouchbaseHost, config.CouchbasePort, "pools/default/buckets")
-	httpReq, err := http.NewRequest("GET", couchbaseStatsURI, bytes.NewBuffer([]byte("")))
-	if err != nil {
-		log.WithFields(logrus.Fields{
-			"couchbaseStatsURI": couchbaseStatsURI,
-			"error":             err,
-		}).Error("Encountered error creating http.NewRequest")
-		return []CouchbaseBucketStatsURI{}, err
-	}
-	httpReq.SetBasicAuth(config.CouchbaseUser, config.CouchbasePassword)
-	err = executeAndDecode(log, *httpReq, &bucketStatsInfos)
+	err = getAPI(log, config, "/pools/default/buckets", &bucketStatsInfos)
 	if err != nil {
 		return []CouchbaseBucketStatsURI{}, err
 	}
@@ -506,17 +614,7 @@ func getAllBucketsInfo(log *logrus.Logger, config CouchbaseConfig) (bucketStatsI
 }
 
 func getClusterInfo(log *logrus.Logger, config CouchbaseConfig) (clusterRecord CouchbaseClusterInfo, err error) {
-	couchbaseStatsURI := fmt.Sprintf("%v:%v/%v", config.CouchbaseHost, config.CouchbasePort, "pools/default")
-	httpReq, err := http.NewRequest("GET", couchbaseStatsURI, bytes.NewBuffer([]byte("")))
-	if err != nil {
-		log.WithFields(logrus.Fields{
-			"couchbaseStatsURI": couchbaseStatsURI,
-			"error":             err,
-		}).Error("Encountered error creating http.NewRequest")
-		return CouchbaseClusterInfo{}, err
-	}
-	httpReq.SetBasicAuth(config.CouchbaseUser, config.CouchbasePassword)
-	err = executeAndDecode(log, *httpReq, &clusterRecord)
+	err = getAPI(log, config, "/pools/default", &clusterRecord)
 	if err != nil {
 		return CouchbaseClusterInfo{}, err
 	}
@@ -528,18 +626,8 @@ type CouchbaseIndexStatusResponse struct {
 }
 
 func getClusterIndexStatus(log *logrus.Logger, config CouchbaseConfig, indexStatusUrl string) ([]CouchbaseIndex, error) {
-	couchbaseStatsURI := fmt.Sprintf("%v:%v/%v", config.CouchbaseHost, config.CouchbasePort, indexStatusUrl)
-	httpReq, err := http.NewRequest("GET", couchbaseStatsURI, bytes.NewBuffer([]byte("")))
-	if err != nil {
-		log.WithFields(logrus.Fields{
-			"couchbaseStatsURI": couchbaseStatsURI,
-			"error":             err,
-		}).Error("Encountered error creating http.NewRequest")
-		return []CouchbaseIndex{}, err
-	}
-	httpReq.SetBasicAuth(config.CouchbaseUser, config.CouchbasePassword)
 	var couchbaseIndexesResponse CouchbaseIndexStatusResponse
-	err = executeAndDecode(log, *httpReq, &couchbaseIndexesResponse)
+	err := getAPI(log, config, "/"+indexStatusUrl, &couchbaseIndexesResponse)
 	if err != nil {
 		return []CouchbaseIndex{}, err
 	}
@@ -555,7 +643,11 @@ func getCouchClusterStats(log *logrus.Logger, config CouchbaseConfig) ([]MetricD
 		}).Error("Encountered error querying Nodes")
 		return make([]MetricData, 0), err
 	}
+	return clusterMetrics(log, config, clusterResponse), nil
+}
 
+// clusterMetrics reports the nodes, indexes and storage totals of the cluster
+func clusterMetrics(log *logrus.Logger, config CouchbaseConfig, clusterResponse CouchbaseClusterInfo) []MetricData {
 	var returnMetrics []MetricData
 	// add by node cluster metrics
 	for _, node := range clusterResponse.Nodes {
@@ -612,7 +704,7 @@ func getCouchClusterStats(log *logrus.Logger, config CouchbaseConfig) ([]MetricD
 			"couchbase.cluster.ram.used":         clusterResponse.StorageTotals.RAM.RAMUsed,
 			"couchbase.cluster.ram.used_by_data": clusterResponse.StorageTotals.RAM.RAMUsedByData,
 		},
-	), nil
+	)
 }
 
 type couchbaseReplicationStats struct {
@@ -625,26 +717,25 @@ type couchbaseReplicationStats struct {
 }
 
 func getCouchReplicationStats(log *logrus.Logger, config CouchbaseConfig) ([]MetricData, error) {
-	couchbaseReplicationStatsURI := fmt.Sprintf("%v:%v/%v", config.CouchbaseHost, config.CouchbasePort, "pools/default/remoteClusters")
-	httpReq, err := http.NewRequest("GET", couchbaseReplicationStatsURI, bytes.NewBuffer([]byte("")))
-	returnMetrics := make([]MetricData, 0)
+	replicationStats, err := getRemoteClusters(log, config)
 	if err != nil {
-		log.WithFields(logrus.Fields{
-			"couchbaseReplicationStatsURI": couchbaseReplicationStatsURI,
-			"error": err,
-		}).Error("Encountered error creating http.NewRequest")
-		return returnMetrics, err
+		return make([]MetricData, 0), err
 	}
-	httpReq.SetBasicAuth(config.CouchbaseUser, config.CouchbasePassword)
+	return replicationMetrics(replicationStats), nil
+}
+
+func getRemoteClusters(log *logrus.Logger, config CouchbaseConfig) ([]couchbaseReplicationStats, error) {
 	var replicationStats []couchbaseReplicationStats
-	err = executeAndDecode(log, *httpReq, &replicationStats)
+	err := getAPI(log, config, "/pools/default/remoteClusters", &replicationStats)
 	if err != nil {
-		return returnMetrics, err
+		return nil, err
 	}
+	return replicationStats, nil
+}
 
-	// add by node cluster metrics
+func replicationMetrics(replicationStats []couchbaseReplicationStats) []MetricData {
+	returnMetrics := make([]MetricData, 0)
 	for _, replication := range replicationStats {
-		remoteUUIDList = append(remoteUUIDList, replication.UUID)
 		returnMetrics = append(returnMetrics,
 			MetricData{
 				"event_type":                     EVENT_TYPE,
@@ -658,85 +749,66 @@ func getCouchReplicationStats(log *logrus.Logger, config CouchbaseConfig) ([]Met
 			},
 		)
 	}
-
-	return returnMetrics, nil
+	return returnMetrics
 }
 
-type remoteMeticChanResp struct {
-	Data MetricData
-	Err  error
+func getCouchRemoteReplicationStats(log *logrus.Logger, config CouchbaseConfig, buckets []string, uuids []string) ([]MetricData, error) {
+	return mergeResults(runTasks(config, remoteReplicationTasks(log, config, buckets, uuids)))
 }
 
-func getCouchRemoteReplicationStats(log *logrus.Logger, config CouchbaseConfig) ([]MetricData, error) {
-	returnMetrics := make([]MetricData, 0)
-	statsChan := make(chan remoteMeticChanResp)
-	wg := &sync.WaitGroup{}
-
-	for _, bucket := range bucketList {
-		for _, uuid := range remoteUUIDList {
+// remoteReplicationTasks returns a task for every stat of the replication of
+// every bucket to every remote cluster
+func remoteReplicationTasks(log *logrus.Logger, config CouchbaseConfig, buckets []string, uuids []string) []task {
+	tasks := make([]task, 0, len(buckets)*len(uuids)*len(remoteStatEndpoints))
+	for _, bucket := range buckets {
+		for _, uuid := range uuids {
 			for _, endpoint := range remoteStatEndpoints {
-				wg.Add(1)
-				go processRemoteReplicationStats(log, config, wg, statsChan, bucket, uuid, endpoint)
+				bucket, uuid, endpoint := bucket, uuid, endpoint
+				tasks = append(tasks, task{
+					name: fmt.Sprintf("bucket %s replication %s to %s", bucket, endpoint, uuid),
+					run: func() ([]MetricData, error) {
+						stat, err := processRemoteReplicationStats(log, config, bucket, uuid, endpoint)
+						if err != nil {
+							return nil, err
+						}
+						return []MetricData{stat}, nil
+					},
+				})
 			}
 		}
 	}
-
-	go func() {
-		wg.Wait()
-		close(statsChan)
-	}()
-
-	for stat := range statsChan {
-		if stat.Err == nil {
-			returnMetrics = append(returnMetrics, stat.Data)
-		}
-	}
-
-	return returnMetrics, nil
+	return tasks
 }
 
-func processRemoteReplicationStats(log *logrus.Logger, config CouchbaseConfig, wg *sync.WaitGroup, statsChan chan<- remoteMeticChanResp, bucket string, uuid string, endpoint string) {
-	defer wg.Done()
-	encoded := fmt.Sprintf("%%2F%s%%2F%s%%2F%s%%2f%s", uuid, bucket, bucket, endpoint)
-	uri := fmt.Sprintf("%s:%s/pools/default/buckets/%s/stats/replications%s", config.CouchbaseHost, config.CouchbasePort, bucket, encoded)
-	httpReq, err := http.NewRequest("GET", uri, bytes.NewBuffer([]byte("")))
-	if err != nil {
-		log.WithFields(logrus.Fields{
-			"uri":   uri,
-			"error": err,
-		}).Error("Encountered error creating http.NewRequest")
-		statsChan <- remoteMeticChanResp{
-			Data: MetricData{},
-			Err:  err,
-		}
-	}
-	httpReq.SetBasicAuth(config.CouchbaseUser, config.CouchbasePassword)
-
+// processRemoteReplicationStats returns a stat of the replication of a bucket
+// to a remote cluster, the node stats are the sum of every node's latest
+// sample
+func processRemoteReplicationStats(log *logrus.Logger, config CouchbaseConfig, bucket string, uuid string, endpoint string) (MetricData, error) {
+	escaped := url.PathEscape(bucket)
+	encoded := fmt.Sprintf("%%2F%s%%2F%s%%2F%s%%2f%s", uuid, escaped, escaped, endpoint)
 	stat := CouchbaseRemoteReplicationStats{}
-	err = executeAndDecode(log, *httpReq, &stat)
+	err := getAPI(log, config, fmt.Sprintf("/pools/default/buckets/%s/stats/replications%s", escaped, encoded), &stat)
 	if err != nil {
-		statsChan <- remoteMeticChanResp{
-			Data: MetricData{},
-			Err:  err,
-		}
+		return MetricData{}, err
 	}
 
-	nodeStatValue := 0
-	for server := range stat.NodeStats {
-		nodeStatValue += int(server[len(server)-1])
+	var nodeStatValue int64
+	for _, samples := range stat.NodeStats {
+		if len(samples) > 0 {
+			nodeStatValue += samples[len(samples)-1]
+		}
 	}
 
-	statsChan <- remoteMeticChanResp{
-		Data: MetricData{
-			"event_type": EVENT_TYPE,
-			"provider":   PROVIDER,
-			fmt.Sprintf("couchbase.replication.%s.samplescount", endpoint): stat.SamplesCount,
-			fmt.Sprintf("couchbase.replication.%s.ispersistent", endpoint): stat.IsPersistent,
-			fmt.Sprintf("couchbase.replication.%s.lasttstamp", endpoint):   stat.LastTStamp,
-			fmt.Sprintf("couchbase.replication.%s.interval", endpoint):     stat.Internal,
-			fmt.Sprintf("couchbase.replication.%s.timestamp", endpoint):    stat.Timestamp,
-			fmt.Sprintf("couchbase.replication.%s.nodestats", endpoint):    nodeStatValue,
-		},
-		Err: err,
-	}
+	return MetricData{
+		"event_type":                   EVENT_TYPE,
+		"provider":                     PROVIDER,
+		"couchbase.replication.bucket": bucket,
+		"couchbase.replication.uuid":   uuid,
+		fmt.Sprintf("couchbase.replication.%s.samplescount", endpoint): stat.SamplesCount,
+		fmt.Sprintf("couchbase.replication.%s.ispersistent", endpoint): stat.IsPersistent,
+		fmt.Sprintf("couchbase.replication.%s.lasttstamp", endpoint):   stat.LastTStamp,
+		fmt.Sprintf("couchbase.replication.%s.interval", endpoint):     stat.Internal,
+		fmt.Sprintf("couchbase.replication.%s.timestamp", endpoint):    stat.Timestamp,
+		fmt.Sprintf("couchbase.replication.%s.nodestats", endpoint):    nodeStatValue,
+	}, nil
 }
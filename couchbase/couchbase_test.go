@@ -1,11 +1,15 @@
 package couchbase
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"os"
 	"reflect"
+	"sort"
 	"sync"
 	"testing"
+	"time"
 
 	fake "github.com/GannettDigital/paas-api-utils/utilsHTTP/fake"
 	"github.com/Sirupsen/logrus"
@@ -471,24 +475,28 @@ func TestGetCouchRemoteReplicationStats(t *testing.T) {
 			InputEndpoints: []string{"some_stats"},
 			ExpectedData: []MetricData{
 				{
-					"event_type": "CouchbaseReplicationSample",
-					"provider":   "couchbase",
+					"event_type":                   EVENT_TYPE,
+					"provider":                     "couchbase",
+					"couchbase.replication.bucket": "deployments",
+					"couchbase.replication.uuid":   "someuuid",
 					"couchbase.replication.some_stats.samplescount": 60,
 					"couchbase.replication.some_stats.ispersistent": true,
-					"couchbase.replication.some_stats.lasttstamp":   1510956143435,
+					"couchbase.replication.some_stats.lasttstamp":   int64(1510956143435),
 					"couchbase.replication.some_stats.interval":     1000,
 					"couchbase.replication.some_stats.timestamp":    []int64{1510956085435},
-					"couchbase.replication.some_stats.nodestats":    0,
+					"couchbase.replication.some_stats.nodestats":    int64(0),
 				},
 				{
-					"event_type": "CouchbaseReplicationSample",
-					"provider":   "couchbase",
+					"event_type":                   EVENT_TYPE,
+					"provider":                     "couchbase",
+					"couchbase.replication.bucket": "stuff",
+					"couchbase.replication.uuid":   "someuuid",
 					"couchbase.replication.some_stats.samplescount": 60,
 					"couchbase.replication.some_stats.ispersistent": true,
-					"couchbase.replication.some_stats.lasttstamp":   1510956143435,
+					"couchbase.replication.some_stats.lasttstamp":   int64(1510956143435),
 					"couchbase.replication.some_stats.interval":     1000,
 					"couchbase.replication.some_stats.timestamp":    []int64{1510956085435},
-					"couchbase.replication.some_stats.nodestats":    10,
+					"couchbase.replication.some_stats.nodestats":    int64(10),
 				},
 			},
 		},
@@ -498,17 +506,25 @@ func TestGetCouchRemoteReplicationStats(t *testing.T) {
 		g.Describe("getCouchRemoteReplicationStats()", func() {
 			g.It(test.TestDescription, func() {
 				runner = test.HTTPRunner
-				bucketList = test.InputBuckets
-				remoteUUIDList = test.InputUUIDs
+				origEndpoints := remoteStatEndpoints
 				remoteStatEndpoints = test.InputEndpoints
-				data, err := getCouchRemoteReplicationStats(test.InputLog, test.InputConfig)
-				g.Assert(len(data)).Equal(len(test.ExpectedData))
+				data, err := getCouchRemoteReplicationStats(test.InputLog, test.InputConfig, test.InputBuckets, test.InputUUIDs)
+				remoteStatEndpoints = origEndpoints
 				g.Assert(err).Equal(test.ExpectedErr)
+				sort.Slice(data, func(i, j int) bool {
+					return data[i]["couchbase.replication.bucket"].(string) < data[j]["couchbase.replication.bucket"].(string)
+				})
+				g.Assert(reflect.DeepEqual(data, test.ExpectedData)).IsTrue()
 			})
 		})
 	}
 }
 
+type remoteStatResult struct {
+	Data MetricData
+	Err  error
+}
+
 func TestProcessRemoteReplicationStats(t *testing.T) {
 	g := goblin.Goblin(t)
 
@@ -520,7 +536,7 @@ func TestProcessRemoteReplicationStats(t *testing.T) {
 		InputBucket     string
 		InputUUID       string
 		InputEndpoint   string
-		ExpectedResults remoteMeticChanResp
+		ExpectedResults remoteStatResult
 	}{
 		{
 			TestDescription: "Should successfully process a remote stats request",
@@ -545,16 +561,18 @@ func TestProcessRemoteReplicationStats(t *testing.T) {
 			InputBucket:   "deployments",
 			InputUUID:     "someuuid",
 			InputEndpoint: "some_stats",
-			ExpectedResults: remoteMeticChanResp{
+			ExpectedResults: remoteStatResult{
 				Data: MetricData{
-					"event_type": "CouchbaseReplicationSample",
-					"provider":   "couchbase",
+					"event_type":                   EVENT_TYPE,
+					"provider":                     "couchbase",
+					"couchbase.replication.bucket": "deployments",
+					"couchbase.replication.uuid":   "someuuid",
 					"couchbase.replication.some_stats.samplescount": 60,
 					"couchbase.replication.some_stats.ispersistent": true,
-					"couchbase.replication.some_stats.lasttstamp":   1510956143435,
+					"couchbase.replication.some_stats.lasttstamp":   int64(1510956143435),
 					"couchbase.replication.some_stats.interval":     1000,
 					"couchbase.replication.some_stats.timestamp":    []int64{1510956085435},
-					"couchbase.replication.some_stats.nodestats":    1,
+					"couchbase.replication.some_stats.nodestats":    int64(1),
 				},
 				Err: nil,
 			},
@@ -582,16 +600,57 @@ func TestProcessRemoteReplicationStats(t *testing.T) {
 			InputBucket:   "deployments",
 			InputUUID:     "someuuid",
 			InputEndpoint: "some_stats",
-			ExpectedResults: remoteMeticChanResp{
+			ExpectedResults: remoteStatResult{
+				Data: MetricData{
+					"event_type":                   EVENT_TYPE,
+					"provider":                     "couchbase",
+					"couchbase.replication.bucket": "deployments",
+					"couchbase.replication.uuid":   "someuuid",
+					"couchbase.replication.some_stats.samplescount": 60,
+					"couchbase.replication.some_stats.ispersistent": true,
+					"couchbase.replication.some_stats.lasttstamp":   int64(1510956143435),
+					"couchbase.replication.some_stats.interval":     1000,
+					"couchbase.replication.some_stats.timestamp":    []int64{1510956085435},
+					"couchbase.replication.some_stats.nodestats":    int64(6),
+				},
+				Err: nil,
+			},
+		},
+		{
+			TestDescription: "Should escape the bucket name in the stats path",
+			HTTPRunner: fake.HTTPResult{
+				ResultsList: []fake.Result{
+					{
+						Method: "GET",
+						URI:    "/pools/default/buckets/beer%25sample/stats/replications%2Fsomeuuid%2Fbeer%25sample%2Fbeer%25sample%2fsome_stats",
+						Code:   200,
+						Err:    nil,
+						Data:   []byte(`{"samplesCount": 60,"isPersistent": true,"lastTStamp": 1510956143435,"interval": 1000,"timestamp": [1510956085435],"nodeStats": {"10.84.87.226:8091": [3, 2]}}`),
+					},
+				},
+			},
+			InputLog: logrus.New(),
+			InputConfig: CouchbaseConfig{
+				CouchbaseHost:     "http://derp.com",
+				CouchbasePort:     "8091",
+				CouchbaseUser:     "derp",
+				CouchbasePassword: "derp",
+			},
+			InputBucket:   "beer%sample",
+			InputUUID:     "someuuid",
+			InputEndpoint: "some_stats",
+			ExpectedResults: remoteStatResult{
 				Data: MetricData{
-					"event_type": "CouchbaseReplicationSample",
-					"provider":   "couchbase",
+					"event_type":                   EVENT_TYPE,
+					"provider":                     "couchbase",
+					"couchbase.replication.bucket": "beer%sample",
+					"couchbase.replication.uuid":   "someuuid",
 					"couchbase.replication.some_stats.samplescount": 60,
 					"couchbase.replication.some_stats.ispersistent": true,
-					"couchbase.replication.some_stats.lasttstamp":   1510956143435,
+					"couchbase.replication.some_stats.lasttstamp":   int64(1510956143435),
 					"couchbase.replication.some_stats.interval":     1000,
 					"couchbase.replication.some_stats.timestamp":    []int64{1510956085435},
-					"couchbase.replication.some_stats.nodestats":    6,
+					"couchbase.replication.some_stats.nodestats":    int64(2),
 				},
 				Err: nil,
 			},
@@ -619,7 +678,7 @@ func TestProcessRemoteReplicationStats(t *testing.T) {
 			InputBucket:   "deployments",
 			InputUUID:     "someuuid",
 			InputEndpoint: "some_stats",
-			ExpectedResults: remoteMeticChanResp{
+			ExpectedResults: remoteStatResult{
 				Data: MetricData{},
 				Err:  errors.New("some error"),
 			},
@@ -630,18 +689,630 @@ func TestProcessRemoteReplicationStats(t *testing.T) {
 		g.Describe("processRemoteReplicationStats()", func() {
 			runner = test.HTTPRunner
 			g.It(test.TestDescription, func() {
-				wg := &sync.WaitGroup{}
-				inputChan := make(chan remoteMeticChanResp)
-				wg.Add(1)
-				go processRemoteReplicationStats(test.InputLog, test.InputConfig, wg, inputChan, test.InputBucket, test.InputUUID, test.InputEndpoint)
-				go func() {
-					wg.Wait()
-					close(inputChan)
-				}()
-
-				for data := range inputChan {
-					g.Assert(data.Err).Equal(test.ExpectedResults.Err)
+				data, err := processRemoteReplicationStats(test.InputLog, test.InputConfig, test.InputBucket, test.InputUUID, test.InputEndpoint)
+				g.Assert(err).Equal(test.ExpectedResults.Err)
+				g.Assert(reflect.DeepEqual(data, test.ExpectedResults.Data)).IsTrue()
+			})
+		})
+	}
+}
+
+func TestParseReductions(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	var tests = []struct {
+		DefaultReduction  string
+		MetricReductions  string
+		Metric            string
+		ExpectedReduction string
+		ExpectError       bool
+		TestDescription   string
+	}{
+		{
+			Metric:            "get_hits",
+			ExpectedReduction: REDUCTION_AVG,
+			TestDescription:   "Should default to avg",
+		},
+		{
+			DefaultReduction:  "last",
+			MetricReductions:  "ep_tmp_oom_errors:max, curr_items:p95",
+			Metric:            "curr_items",
+			ExpectedReduction: REDUCTION_P95,
+			TestDescription:   "Should use the metric's reduction",
+		},
+		{
+			DefaultReduction:  "last",
+			MetricReductions:  "ep_tmp_oom_errors:max",
+			Metric:            "get_hits",
+			ExpectedReduction: REDUCTION_LAST,
+			TestDescription:   "Should use the default reduction for other metrics",
+		},
+		{
+			DefaultReduction: "median",
+			ExpectError:      true,
+			TestDescription:  "Should error on an unknown default reduction",
+		},
+		{
+			MetricReductions: "get_hits",
+			ExpectError:      true,
+			TestDescription:  "Should error on a metric without a reduction",
+		},
+	}
+
+	for _, test := range tests {
+		g.Describe("parseReductions()", func() {
+			g.It(test.TestDescription, func() {
+				result, err := parseReductions(test.DefaultReduction, test.MetricReductions)
+				g.Assert(err != nil).Equal(test.ExpectError)
+				if !test.ExpectError {
+					g.Assert(result.reduction(test.Metric)).Equal(test.ExpectedReduction)
+				}
+			})
+		})
+	}
+}
+
+func TestReduceSample(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	samples := []float32{4, 1, 20, 2, 3, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19}
+	var tests = []struct {
+		Reduction       string
+		Float32Result   float32
+		Int64Result     float32
+		TestDescription string
+	}{
+		{Reduction: REDUCTION_AVG, Float32Result: 10.5, Int64Result: 10.5, TestDescription: "Should average the samples"},
+		{Reduction: REDUCTION_LAST, Float32Result: 19, Int64Result: 19, TestDescription: "Should take the last sample"},
+		{Reduction: REDUCTION_MAX, Float32Result: 20, Int64Result: 20, TestDescription: "Should take the highest sample"},
+		{Reduction: REDUCTION_P95, Float32Result: 19, Int64Result: 19, TestDescription: "Should take the 95th percentile"},
+	}
+
+	for _, test := range tests {
+		g.Describe("reduceFloat32Sample() and reduceInt64Sample()", func() {
+			g.It(test.TestDescription, func() {
+				int64Samples := make([]int64, len(samples))
+				for i, sample := range samples {
+					int64Samples[i] = int64(sample)
+				}
+				g.Assert(reduceFloat32Sample(samples, test.Reduction)).Equal(test.Float32Result)
+				g.Assert(reduceInt64Sample(int64Samples, test.Reduction)).Equal(test.Int64Result)
+				g.Assert(reduceFloat32Sample([]float32{}, test.Reduction)).Equal(float32(0))
+				g.Assert(samples[0]).Equal(float32(4))
+			})
+		})
+	}
+}
+
+func TestGetCouchBucketsNodeStats(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	config := couchbaseFakeConfig
+	config.CouchbaseZoom = "hour"
+	config.CouchbaseReduction = "max"
+	config.CouchbaseMetricReductions = "cmd_get:last"
+	config.CouchbaseNodeStats = true
+
+	var tests = []struct {
+		HTTPRunner      fake.HTTPResult
+		ExpectedNodes   map[string]bool
+		ExpectedErr     string
+		TestDescription string
+	}{
+		{
+			HTTPRunner: fake.HTTPResult{
+				ResultsList: []fake.Result{
+					fake.Result{
+						Method: "GET",
+						URI:    "/pools/default/buckets",
+						Code:   200,
+						Data:   []byte(`[{"name":"test1","uri":"/pools/default/buckets/test1","stats":{"uri":"/pools/default/buckets/test1/stats"}}]`),
+					},
+					fake.Result{
+						Method: "GET",
+						URI:    "/pools/default/buckets/test1/stats?zoom=hour",
+						Code:   200,
+						Data:   []byte(`{"op":{"samples":{"get_hits":[1,5,2],"cmd_get":[3,9,4]}}}`),
+					},
+					fake.Result{
+						Method: "GET",
+						URI:    "/pools/default/buckets/test1/nodes",
+						Code:   200,
+						Data:   []byte(`{"servers":[{"hostname":"10.0.0.1:8091","stats":{"uri":"/pools/default/buckets/test1/nodes/10.0.0.1%3A8091/stats"}},{"hostname":"10.0.0.2:8091","stats":{"uri":"/pools/default/buckets/test1/nodes/10.0.0.2%3A8091/stats"}}]}`),
+					},
+					fake.Result{
+						Method: "GET",
+						URI:    "/pools/default/buckets/test1/nodes/10.0.0.1%3A8091/stats?zoom=hour",
+						Code:   200,
+						Data:   []byte(`{"op":{"samples":{"get_hits":[1,2,0],"cmd_get":[3,5,4]}}}`),
+					},
+					fake.Result{
+						Method: "GET",
+						URI:    "/pools/default/buckets/test1/nodes/10.0.0.2%3A8091/stats?zoom=hour",
+						Code:   503,
+					},
+				},
+			},
+			ExpectedNodes:   map[string]bool{"": true, "10.0.0.1:8091": true},
+			ExpectedErr:     "bucket test1 node 10.0.0.2:8091 stats: unexpected response code 503",
+			TestDescription: "Should report the bucket stats of every node that responds",
+		},
+	}
+
+	for _, test := range tests {
+		g.Describe("getCouchBucketsStats() with node stats", func() {
+			g.It(test.TestDescription, func() {
+				runner = &test.HTTPRunner
+				result, err := getCouchBucketsStats(logrus.New(), config)
+				g.Assert(err.Error()).Equal(test.ExpectedErr)
+				g.Assert(len(result)).Equal(4)
+				nodes := make(map[string]bool)
+				for _, sample := range result {
+					node, _ := sample["couchbase.by_bucket.node"].(string)
+					nodes[node] = true
+					if _, ok := sample["couchbase.by_bucket.get_hits"]; !ok {
+						continue
+					}
+					if node == "" {
+						g.Assert(sample["couchbase.by_bucket.get_hits"]).Equal(float32(5))
+						g.Assert(sample["couchbase.by_bucket.cmd_get"]).Equal(float32(4))
+					} else {
+						g.Assert(sample["couchbase.by_bucket.get_hits"]).Equal(float32(2))
+						g.Assert(sample["couchbase.by_bucket.cmd_get"]).Equal(float32(4))
+					}
+				}
+				g.Assert(nodes).Equal(test.ExpectedNodes)
+			})
+		})
+	}
+}
+
+func TestGetCouchServiceStats(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	var tests = []struct {
+		HTTPRunner      fake.HTTPResult
+		ExpectedResult  []MetricData
+		ExpectError     bool
+		TestDescription string
+	}{
+		{
+			HTTPRunner: fake.HTTPResult{
+				ResultsList: []fake.Result{
+					fake.Result{
+						Method: "GET",
+						URI:    "/pools/default",
+						Code:   200,
+						Data:   []byte(`{"name":"default","nodes":[{"hostname":"10.0.0.1:8091","services":["kv","n1ql"]},{"hostname":"10.0.0.2:8091","services":["fts","kv"]},{"hostname":"10.0.0.3:8091","services":["kv"]}]}`),
+					},
+					fake.Result{
+						Method: "GET",
+						URI:    "/admin/vitals",
+						Code:   200,
+						Data:   []byte(`{"uptime":"1m0.5s","version":"6.6.0","cores":4,"request.completed.count":42,"request_time.mean":"536.57µs","memory.usage":1024}`),
+					},
+					fake.Result{
+						Method: "GET",
+						URI:    "/admin/active_requests",
+						Code:   200,
+						Data:   []byte(`[{"requestId":"a","elapsedTime":"1.5s"},{"requestId":"b","elapsedTime":"250ms"}]`),
+					},
+					fake.Result{
+						Method: "GET",
+						URI:    "/api/nsstats",
+						Code:   200,
+						Data:   []byte(`{"num_bytes_used_ram":2048,"travel:hotels:doc_count":12,"travel:hotels:num_mutations_to_index":3,"pct_cpu_gc":"n/a"}`),
+					},
+				},
+			},
+			ExpectedResult: []MetricData{
+				{
+					"event_type":                                         EVENT_TYPE,
+					"provider":                                           PROVIDER,
+					"couchbase.scalr.clustername":                        "",
+					"couchbase.cluster.name":                             "default",
+					"couchbase.query.node":                               "10.0.0.1:8091",
+					"couchbase.query.uptime_ms":                          float64(60500),
+					"couchbase.query.version":                            "6.6.0",
+					"couchbase.query.cores":                              float64(4),
+					"couchbase.query.request.completed.count":            float64(42),
+					"couchbase.query.request_time.mean_ms":               0.53657,
+					"couchbase.query.memory.usage":                       float64(1024),
+					"couchbase.query.active_requests":                    2,
+					"couchbase.query.active_requests.longest_elapsed_ms": float64(1500),
+				},
+				{
+					"event_type":                       EVENT_TYPE,
+					"provider":                         PROVIDER,
+					"couchbase.scalr.clustername":      "",
+					"couchbase.cluster.name":           "default",
+					"couchbase.fts.node":               "10.0.0.2:8091",
+					"couchbase.fts.num_bytes_used_ram": float64(2048),
+				},
+				{
+					"event_type":                           EVENT_TYPE,
+					"provider":                             PROVIDER,
+					"couchbase.scalr.clustername":          "",
+					"couchbase.cluster.name":               "default",
+					"couchbase.fts.node":                   "10.0.0.2:8091",
+					"couchbase.fts.bucket":                 "travel",
+					"couchbase.fts.index":                  "hotels",
+					"couchbase.fts.doc_count":              float64(12),
+					"couchbase.fts.num_mutations_to_index": float64(3),
+				},
+			},
+			TestDescription: "Should collect the services found in the node list",
+		},
+		{
+			HTTPRunner: fake.HTTPResult{
+				ResultsList: []fake.Result{
+					fake.Result{
+						Method: "GET",
+						URI:    "/pools/default",
+						Code:   200,
+						Data:   []byte(`{"name":"default","nodes":[{"hostname":"10.0.0.1:8091","services":["kv","n1ql"]}]}`),
+					},
+				},
+			},
+			ExpectedResult:  []MetricData{},
+			ExpectError:     true,
+			TestDescription: "Should report a service that can't be reached",
+		},
+	}
+
+	for _, test := range tests {
+		g.Describe("getCouchServiceStats()", func() {
+			g.It(test.TestDescription, func() {
+				runner = &test.HTTPRunner
+				result, err := getCouchServiceStats(logrus.New(), couchbaseFakeConfig)
+				g.Assert(err != nil).Equal(test.ExpectError)
+				g.Assert(result).Equal(test.ExpectedResult)
+			})
+		})
+	}
+}
+
+func TestGetIndexStats(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	g.Describe("getIndexStats()", func() {
+		g.It("Should report the stats of every index and of the indexer", func() {
+			runner = &fake.HTTPResult{
+				ResultsList: []fake.Result{
+					fake.Result{
+						Method: "GET",
+						URI:    "/api/v1/stats",
+						Code:   200,
+						Data:   []byte(`{"indexer":{"indexer_state":"Active","memory_used":4096},"travel:def_type":{"items_count":100,"frag_percent":12,"avg_scan_latency":5500},"travel:inventory:hotel:def_city":{"items_count":7}}`),
+					},
+				},
+			}
+			result, err := getIndexStats(logrus.New(), couchbaseFakeConfig, "http://10.0.0.1:9102")
+			g.Assert(err).Equal(nil)
+			g.Assert(result).Equal([]MetricData{
+				{
+					"couchbase.indexer.memory_used": float64(4096),
+				},
+				{
+					"couchbase.index.bucket":           "travel",
+					"couchbase.index.index":            "def_type",
+					"couchbase.index.items_count":      float64(100),
+					"couchbase.index.frag_percent":     float64(12),
+					"couchbase.index.avg_scan_latency": float64(5500),
+				},
+				{
+					"couchbase.index.bucket":      "travel",
+					"couchbase.index.scope":       "inventory",
+					"couchbase.index.collection":  "hotel",
+					"couchbase.index.index":       "def_city",
+					"couchbase.index.items_count": float64(7),
+				},
+			})
+		})
+	})
+}
+
+func TestGetEventingStats(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	g.Describe("getEventingStats()", func() {
+		g.It("Should report the stats of every function", func() {
+			runner = &fake.HTTPResult{
+				ResultsList: []fake.Result{
+					fake.Result{
+						Method: "GET",
+						URI:    "/api/v1/stats",
+						Code:   200,
+						Data:   []byte(`[{"function_name":"enrich","event_processing_stats":{"dcp_mutation":10},"execution_stats":{"on_update_success":9},"failure_stats":{"timeout_count":1},"worker_pids":{"worker_0":1234}},{"function_name":"audit","failure_stats":{"timeout_count":0}}]`),
+					},
+				},
+			}
+			result, err := getEventingStats(logrus.New(), couchbaseFakeConfig, "http://10.0.0.1:8096")
+			g.Assert(err).Equal(nil)
+			g.Assert(result).Equal([]MetricData{
+				{
+					"couchbase.eventing.function":                    "audit",
+					"couchbase.eventing.failure_stats.timeout_count": float64(0),
+				},
+				{
+					"couchbase.eventing.function":                            "enrich",
+					"couchbase.eventing.event_processing_stats.dcp_mutation": float64(10),
+					"couchbase.eventing.execution_stats.on_update_success":   float64(9),
+					"couchbase.eventing.failure_stats.timeout_count":         float64(1),
+				},
+			})
+		})
+	})
+}
+
+func TestServiceHost(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	var tests = []struct {
+		Host            string
+		HostName        string
+		Expected        string
+		TestDescription string
+	}{
+		{Host: "http://localhost", HostName: "10.0.0.1:8091", Expected: "http://10.0.0.1:8093", TestDescription: "Should replace the cluster manager port"},
+		{Host: "https://localhost", HostName: "[::1]:8091", Expected: "https://[::1]:8093", TestDescription: "Should keep the scheme and IPv6 addresses"},
+		{Host: "localhost", HostName: "cb1.example.com", Expected: "http://cb1.example.com:8093", TestDescription: "Should default to http"},
+	}
+
+	for _, test := range tests {
+		g.Describe("serviceHost()", func() {
+			g.It(test.TestDescription, func() {
+				g.Assert(serviceHost(CouchbaseConfig{CouchbaseHost: test.Host}, test.HostName, QUERY_PORT)).Equal(test.Expected)
+			})
+		})
+	}
+}
+
+func TestRunTasks(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	g.Describe("runTasks()", func() {
+		g.It("Should bound the concurrency and keep the order of the tasks", func() {
+			var lock sync.Mutex
+			running, maxRunning := 0, 0
+			tasks := make([]task, 20)
+			for i := range tasks {
+				i := i
+				tasks[i] = task{
+					name: fmt.Sprintf("task %d", i),
+					run: func() ([]MetricData, error) {
+						lock.Lock()
+						running++
+						if running > maxRunning {
+							maxRunning = running
+						}
+						lock.Unlock()
+						time.Sleep(time.Duration(20-i) * time.Millisecond)
+						lock.Lock()
+						running--
+						lock.Unlock()
+						if i%5 == 4 {
+							return nil, errors.New("failed")
+						}
+						return []MetricData{{"index": i}}, nil
+					},
+				}
+			}
+			metrics, err := mergeResults(runTasks(CouchbaseConfig{CouchbaseWorkers: 3}, tasks))
+			g.Assert(maxRunning <= 3).IsTrue()
+			g.Assert(len(metrics)).Equal(16)
+			for i := 1; i < len(metrics); i++ {
+				g.Assert(metrics[i-1]["index"].(int) < metrics[i]["index"].(int)).IsTrue()
+			}
+			g.Assert(err.Error()).Equal("task 4: failed; task 9: failed; task 14: failed; task 19: failed")
+		})
+	})
+}
+
+func TestCollect(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	// the replication stats all fail, their errors are collected in order
+	replicationFailures := make([]fake.Result, 0)
+	for _, bucket := range []string{"b1", "b2"} {
+		for _, endpoint := range remoteStatEndpoints {
+			replicationFailures = append(replicationFailures, fake.Result{
+				Method: "GET",
+				URI:    fmt.Sprintf("/pools/default/buckets/%s/stats/replications%%2Fu1%%2F%s%%2F%s%%2f%s", bucket, bucket, bucket, endpoint),
+				Code:   500,
+			})
+		}
+	}
+
+	var tests = []struct {
+		HTTPRunner      fake.HTTPResult
+		ExpectedKeys    []string
+		ExpectedErr     string
+		TestDescription string
+	}{
+		{
+			HTTPRunner: fake.HTTPResult{
+				ResultsList: append([]fake.Result{
+					fake.Result{
+						Method: "GET",
+						URI:    "/pools/default",
+						Code:   200,
+						Data:   []byte(`{"name":"default","nodes":[{"hostname":"10.0.0.1:8091","status":"healthy","services":["kv"]}]}`),
+					},
+					fake.Result{
+						Method: "GET",
+						URI:    "/pools/default/buckets",
+						Code:   200,
+						Data:   []byte(`[{"name":"b1","stats":{"uri":"/pools/default/buckets/b1/stats"}},{"name":"b2","stats":{"uri":"/pools/default/buckets/b2/stats"}}]`),
+					},
+					fake.Result{
+						Method: "GET",
+						URI:    "/pools/default/remoteClusters",
+						Code:   200,
+						Data:   []byte(`[{"name":"west","uuid":"u1"}]`),
+					},
+					fake.Result{
+						Method: "GET",
+						URI:    "/pools/default/tasks",
+						Code:   200,
+						Data:   []byte(`[{"type":"rebalance","status":"notRunning"}]`),
+					},
+					fake.Result{
+						Method: "GET",
+						URI:    "/settings/autoFailover",
+						Code:   200,
+						Data:   []byte(`{"enabled":true,"timeout":120,"count":0}`),
+					},
+					fake.Result{
+						Method: "GET",
+						URI:    "/pools/default/buckets/b1/stats?zoom=minute",
+						Code:   200,
+						Data:   []byte(`{"op":{"samples":{"get_hits":[1,2]}}}`),
+					},
+					fake.Result{
+						Method: "GET",
+						URI:    "/pools/default/buckets/b2/stats?zoom=minute",
+						Code:   200,
+						Data:   []byte(`{"op":{"samples":{"get_hits":[3,4]}}}`),
+					},
+				}, replicationFailures...),
+			},
+			ExpectedKeys: []string{
+				"couchbase.cluster.by_node.hostname",
+				"couchbase.cluster.hdd.free",
+				"couchbase.by_bucket.name",
+				"couchbase.by_bucket.name",
+				"couchbase.by_bucket.name",
+				"couchbase.by_bucket.name",
+				"couchbase.replication.uuid",
+			},
+			ExpectedErr:     "bucket b1 replication changes_left to u1: unexpected response code 500",
+			TestDescription: "Should collect everything found in order and aggregate the errors",
+		},
+	}
+
+	for _, test := range tests {
+		g.Describe("collect()", func() {
+			g.It(test.TestDescription, func() {
+				runner = &test.HTTPRunner
+				metrics, clusterTopology, err := collect(logrus.New(), couchbaseFakeConfig)
+				g.Assert(clusterTopology.found).IsTrue()
+				g.Assert(clusterTopology.tasksFound).IsTrue()
+				g.Assert(clusterTopology.autoFailover.Enabled).IsTrue()
+				g.Assert(len(metrics)).Equal(len(test.ExpectedKeys))
+				for i, key := range test.ExpectedKeys {
+					_, ok := metrics[i][key]
+					g.Assert(ok).IsTrue()
+				}
+				g.Assert(metrics[2]["couchbase.by_bucket.name"]).Equal("b1")
+				g.Assert(metrics[4]["couchbase.by_bucket.name"]).Equal("b2")
+				g.Assert(len(err.(collectionErrors))).Equal(2 * len(remoteStatEndpoints))
+				g.Assert(err.(collectionErrors)[0].Error()).Equal(test.ExpectedErr)
+			})
+		})
+	}
+}
+
+func TestTopologyInventory(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	g.Describe("topologyInventory()", func() {
+		g.It("Should report the cluster quotas, nodes and bucket definitions", func() {
+			var clusterTopology topology
+			err := json.Unmarshal([]byte(`{"name":"default","memoryQuota":2048,"indexMemoryQuota":512,"ftsMemoryQuota":256,"nodes":[{"hostname":"10.0.0.1:8091","status":"healthy","clusterMembership":"active","version":"6.6.0-7909-enterprise","services":["kv","index"]}]}`), &clusterTopology.cluster)
+			g.Assert(err).Equal(nil)
+			err = json.Unmarshal([]byte(`[{"name":"b1","bucketType":"membase","replicaNumber":1,"evictionPolicy":"valueOnly","quota":{"ram":1073741824,"rawRAM":536870912}}]`), &clusterTopology.buckets)
+			g.Assert(err).Equal(nil)
+			g.Assert(topologyInventory(clusterTopology)).Equal(map[string]InventoryData{
+				"cluster": {
+					"name":                  "default",
+					"memory_quota":          int64(2048),
+					"index_memory_quota":    int64(512),
+					"fts_memory_quota":      int64(256),
+					"cbas_memory_quota":     int64(0),
+					"eventing_memory_quota": int64(0),
+				},
+				"nodes/10.0.0.1:8091": {
+					"version":            "6.6.0-7909-enterprise",
+					"services":           "index,kv",
+					"status":             "healthy",
+					"cluster_membership": "active",
+				},
+				"buckets/b1": {
+					"type":            "membase",
+					"replicas":        1,
+					"eviction_policy": "valueOnly",
+					"ram_quota":       int64(1073741824),
+				},
+			})
+		})
+	})
+}
+
+func TestTopologyEvents(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	newTopology := func(cluster string, tasks string, autoFailover *AutoFailoverSettings) topology {
+		clusterTopology := topology{found: true, autoFailover: autoFailover}
+		json.Unmarshal([]byte(cluster), &clusterTopology.cluster)
+		if tasks != "" {
+			json.Unmarshal([]byte(tasks), &clusterTopology.tasks)
+			clusterTopology.tasksFound = true
+		}
+		return clusterTopology
+	}
+
+	var tests = []struct {
+		Previous        topologyState
+		Topology        topology
+		ExpectedEvents  []string
+		ExpectedState   topologyState
+		TestDescription string
+	}{
+		{
+			Previous:        topologyState{Rebalance: "notRunning", Nodes: map[string]string{"a:8091": "active"}},
+			Topology:        newTopology(`{"name":"c","nodes":[{"hostname":"a:8091","clusterMembership":"active"}]}`, `[{"type":"rebalance","status":"running","progress":12.5}]`, &AutoFailoverSettings{Count: 0}),
+			ExpectedEvents:  []string{"couchbase cluster c rebalance started"},
+			ExpectedState:   topologyState{Rebalance: "running", Nodes: map[string]string{"a:8091": "active"}},
+			TestDescription: "Should report a rebalance starting",
+		},
+		{
+			Previous:        topologyState{Rebalance: "running", Nodes: map[string]string{"a:8091": "active"}},
+			Topology:        newTopology(`{"name":"c","nodes":[{"hostname":"a:8091","clusterMembership":"active"}]}`, `[{"type":"xdcr","status":"running"}]`, nil),
+			ExpectedEvents:  []string{"couchbase cluster c rebalance finished"},
+			ExpectedState:   topologyState{Rebalance: "notRunning", Nodes: map[string]string{"a:8091": "active"}},
+			TestDescription: "Should report a rebalance finishing",
+		},
+		{
+			Previous: topologyState{Rebalance: "notRunning", FailoverCount: 0, Nodes: map[string]string{"a:8091": "active", "b:8091": "active", "c:8091": "active"}},
+			Topology: newTopology(`{"name":"c","nodes":[{"hostname":"a:8091","clusterMembership":"active"},{"hostname":"b:8091","clusterMembership":"inactiveFailed"}]}`, "", &AutoFailoverSettings{Count: 1}),
+			ExpectedEvents: []string{
+				"couchbase cluster c failed over 1 node(s) automatically",
+				"couchbase node b:8091 of cluster c went from active to inactiveFailed",
+				"couchbase node c:8091 of cluster c went from active to removed",
+			},
+			ExpectedState:   topologyState{Rebalance: "notRunning", FailoverCount: 1, Nodes: map[string]string{"a:8091": "active", "b:8091": "inactiveFailed"}},
+			TestDescription: "Should report failovers and nodes leaving the active membership",
+		},
+		{
+			Previous:        topologyState{Nodes: map[string]string{"a:8091": "inactiveAdded"}},
+			Topology:        newTopology(`{"name":"c","nodes":[{"hostname":"a:8091","clusterMembership":"active"}]}`, `[]`, &AutoFailoverSettings{Count: 0}),
+			ExpectedEvents:  []string{},
+			ExpectedState:   topologyState{Rebalance: "notRunning", Nodes: map[string]string{"a:8091": "active"}},
+			TestDescription: "Should not report nodes joining or an unknown rebalance state",
+		},
+	}
+
+	for _, test := range tests {
+		g.Describe("topologyEvents()", func() {
+			g.It(test.TestDescription, func() {
+				events, state := topologyEvents(test.Previous, test.Topology)
+				summaries := make([]string, len(events))
+				for i, event := range events {
+					summaries[i] = event["summary"].(string)
 				}
+				g.Assert(summaries).Equal(test.ExpectedEvents)
+				g.Assert(state).Equal(test.ExpectedState)
 			})
 		})
 	}
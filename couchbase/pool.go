@@ -0,0 +1,241 @@
+package couchbase
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// DEFAULT_WORKERS is how many requests are made at once when
+// COUCHBASE_WORKERS is not set
+const DEFAULT_WORKERS int = 8
+
+// DEFAULT_REQUEST_TIMEOUT bounds each request, in seconds, when
+// COUCHBASE_REQUEST_TIMEOUT is not set
+const DEFAULT_REQUEST_TIMEOUT int = 10
+
+// task makes the requests for part of a collection run
+type task struct {
+	name string
+	run  func() ([]MetricData, error)
+}
+
+type taskResult struct {
+	metrics []MetricData
+	err     error
+}
+
+// collectionErrors are the errors of the tasks of a collection run
+type collectionErrors []error
+
+func (e collectionErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// collect runs a collection in two rounds: the cluster, its buckets and the
+// remote clusters are listed first, then everything found is collected. All
+// the requests go through the same bounded set of workers and the metrics are
+// returned in the order of the tasks, whichever finishes first. The topology
+// found along the way is returned for the inventory and events.
+func collect(log *logrus.Logger, config CouchbaseConfig) ([]MetricData, topology, error) {
+	var clusterResponse CouchbaseClusterInfo
+	var buckets []CouchbaseBucketStatsURI
+	var remoteClusters []couchbaseReplicationStats
+	var clusterTasks []CouchbaseTask
+	var autoFailover AutoFailoverSettings
+	discovery := runTasks(config, []task{
+		{
+			name: "cluster",
+			run: func() (metrics []MetricData, err error) {
+				clusterResponse, err = getClusterInfo(log, config)
+				return nil, err
+			},
+		},
+		{
+			name: "buckets",
+			run: func() (metrics []MetricData, err error) {
+				buckets, err = getAllBucketsInfo(log, config)
+				return nil, err
+			},
+		},
+		{
+			name: "remote clusters",
+			run: func() (metrics []MetricData, err error) {
+				remoteClusters, err = getRemoteClusters(log, config)
+				return nil, err
+			},
+		},
+		{
+			name: "cluster tasks",
+			run: func() (metrics []MetricData, err error) {
+				clusterTasks, err = getClusterTasks(log, config)
+				return nil, err
+			},
+		},
+		{
+			name: "auto failover settings",
+			run: func() (metrics []MetricData, err error) {
+				autoFailover, err = getAutoFailoverSettings(log, config)
+				return nil, err
+			},
+		},
+	})
+	var errs collectionErrors
+	for _, result := range discovery {
+		if result.err != nil {
+			errs = append(errs, result.err)
+		}
+	}
+
+	tasks := make([]task, 0)
+	if discovery[0].err == nil {
+		tasks = append(tasks, task{
+			name: "cluster stats",
+			run: func() ([]MetricData, error) {
+				return clusterMetrics(log, config, clusterResponse), nil
+			},
+		})
+	}
+	clusterTopology := topology{
+		found:   discovery[0].err == nil && discovery[1].err == nil,
+		cluster: clusterResponse,
+		buckets: buckets,
+	}
+	if discovery[3].err == nil {
+		clusterTopology.tasks = clusterTasks
+		clusterTopology.tasksFound = true
+	}
+	if discovery[4].err == nil {
+		clusterTopology.autoFailover = &autoFailover
+	}
+
+	bucketStatsTasks, err := bucketTasks(log, config, buckets)
+	if err != nil {
+		return nil, clusterTopology, err
+	}
+	tasks = append(tasks, bucketStatsTasks...)
+	tasks = append(tasks, task{
+		name: "replication stats",
+		run: func() ([]MetricData, error) {
+			return replicationMetrics(remoteClusters), nil
+		},
+	})
+	bucketNames := make([]string, len(buckets))
+	for i, bucket := range buckets {
+		bucketNames[i] = bucket.Name
+	}
+	uuids := make([]string, len(remoteClusters))
+	for i, remoteCluster := range remoteClusters {
+		uuids[i] = remoteCluster.UUID
+	}
+	tasks = append(tasks, remoteReplicationTasks(log, config, bucketNames, uuids)...)
+	if discovery[0].err == nil {
+		tasks = append(tasks, serviceTasks(log, config, clusterResponse)...)
+	}
+
+	metrics, err := mergeResults(runTasks(config, tasks))
+	if err != nil {
+		errs = append(errs, err.(collectionErrors)...)
+	}
+	if len(errs) > 0 {
+		return metrics, clusterTopology, errs
+	}
+	return metrics, clusterTopology, nil
+}
+
+// runTasks runs the tasks on at most COUCHBASE_WORKERS workers, the results
+// are in the order of the tasks
+func runTasks(config CouchbaseConfig, tasks []task) []taskResult {
+	results := make([]taskResult, len(tasks))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for worker := 0; worker < workers(config) && worker < len(tasks); worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				metrics, err := tasks[index].run()
+				if err != nil {
+					err = fmt.Errorf("%s: %v", tasks[index].name, err)
+				}
+				results[index] = taskResult{metrics: metrics, err: err}
+			}
+		}()
+	}
+	for index := range tasks {
+		indexes <- index
+	}
+	close(indexes)
+	wg.Wait()
+	return results
+}
+
+// mergeResults returns the metrics of all the tasks along with their errors
+func mergeResults(results []taskResult) ([]MetricData, error) {
+	metrics := make([]MetricData, 0)
+	var errs collectionErrors
+	for _, result := range results {
+		metrics = append(metrics, result.metrics...)
+		if result.err != nil {
+			errs = append(errs, result.err)
+		}
+	}
+	if len(errs) > 0 {
+		return metrics, errs
+	}
+	return metrics, nil
+}
+
+// getAPI calls an endpoint of the cluster manager and decodes the response
+// into record
+func getAPI(log *logrus.Logger, config CouchbaseConfig, endpoint string, record interface{}) error {
+	return callAPI(log, config, fmt.Sprintf("%v:%v%v", config.CouchbaseHost, config.CouchbasePort, endpoint), record)
+}
+
+func callAPI(log *logrus.Logger, config CouchbaseConfig, uri string, record interface{}) error {
+	httpReq, err := http.NewRequest("GET", uri, bytes.NewBuffer([]byte("")))
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"uri":   uri,
+			"error": err,
+		}).Error("Encountered error creating http.NewRequest")
+		return err
+	}
+	httpReq.SetBasicAuth(config.CouchbaseUser, config.CouchbasePassword)
+	client := &http.Client{Timeout: time.Duration(requestTimeout(config)) * time.Second}
+	return executeAndDecode(log, client, *httpReq, record)
+}
+
+func workers(config CouchbaseConfig) int {
+	if config.CouchbaseWorkers <= 0 {
+		return DEFAULT_WORKERS
+	}
+	return config.CouchbaseWorkers
+}
+
+func requestTimeout(config CouchbaseConfig) int {
+	if config.CouchbaseRequestTimeout <= 0 {
+		return DEFAULT_REQUEST_TIMEOUT
+	}
+	return config.CouchbaseRequestTimeout
+}
+
+// intSetting parses a numeric setting, falling back to the default when it
+// is unset or invalid
+func intSetting(value string, fallback int) int {
+	setting, err := strconv.Atoi(value)
+	if err != nil || setting <= 0 {
+		return fallback
+	}
+	return setting
+}
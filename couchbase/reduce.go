@@ -0,0 +1,131 @@
+package couchbase
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// the reductions applied to the samples the stats endpoints return for the
+// zoom level, REDUCTION_AVG is used unless configured otherwise
+const (
+	REDUCTION_LAST string = "last"
+	REDUCTION_AVG  string = "avg"
+	REDUCTION_MAX  string = "max"
+	REDUCTION_P95  string = "p95"
+)
+
+// DEFAULT_ZOOM is the stats zoom level used when COUCHBASE_ZOOM is not set,
+// minute returns a sample per second and hour a sample every 4 seconds
+const DEFAULT_ZOOM string = "minute"
+
+var reductions = map[string]bool{
+	REDUCTION_LAST: true,
+	REDUCTION_AVG:  true,
+	REDUCTION_MAX:  true,
+	REDUCTION_P95:  true,
+}
+
+var zooms = map[string]bool{
+	"minute": true,
+	"hour":   true,
+}
+
+// sampleReductions is the reduction of every metric, those not listed use the
+// default one
+type sampleReductions struct {
+	defaultReduction string
+	metrics          map[string]string
+}
+
+// parseReductions reads COUCHBASE_REDUCTION along with the per metric
+// COUCHBASE_METRIC_REDUCTIONS, e.g. "ep_tmp_oom_errors:max,curr_items:last"
+func parseReductions(defaultReduction string, metricReductions string) (sampleReductions, error) {
+	result := sampleReductions{
+		defaultReduction: REDUCTION_AVG,
+		metrics:          make(map[string]string),
+	}
+	if defaultReduction != "" {
+		if !reductions[defaultReduction] {
+			return result, fmt.Errorf("unknown reduction %q, expected one of last, avg, max or p95", defaultReduction)
+		}
+		result.defaultReduction = defaultReduction
+	}
+	for _, metricReduction := range strings.Split(metricReductions, ",") {
+		metricReduction = strings.TrimSpace(metricReduction)
+		if metricReduction == "" {
+			continue
+		}
+		parts := strings.SplitN(metricReduction, ":", 2)
+		if len(parts) != 2 || !reductions[strings.TrimSpace(parts[1])] {
+			return result, fmt.Errorf("invalid metric reduction %q, expected <metric>:<last|avg|max|p95>", metricReduction)
+		}
+		result.metrics[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return result, nil
+}
+
+func (r sampleReductions) reduction(metric string) string {
+	if reduction, ok := r.metrics[metric]; ok {
+		return reduction
+	}
+	if r.defaultReduction != "" {
+		return r.defaultReduction
+	}
+	return REDUCTION_AVG
+}
+
+func (c CompleteBucketInfo) float32Sample(metric string, sampleSet []float32) float32 {
+	return reduceFloat32Sample(sampleSet, c.reductions.reduction(metric))
+}
+
+func (c CompleteBucketInfo) int64Sample(metric string, sampleSet []int64) float32 {
+	return reduceInt64Sample(sampleSet, c.reductions.reduction(metric))
+}
+
+func reduceFloat32Sample(sampleSet []float32, reduction string) float32 {
+	if len(sampleSet) == 0 {
+		return 0
+	}
+	switch reduction {
+	case REDUCTION_LAST:
+		return sampleSet[len(sampleSet)-1]
+	case REDUCTION_MAX:
+		max := sampleSet[0]
+		for _, currentSample := range sampleSet[1:] {
+			if currentSample > max {
+				max = currentSample
+			}
+		}
+		return max
+	case REDUCTION_P95:
+		sorted := make([]float32, len(sampleSet))
+		copy(sorted, sampleSet)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		// nearest rank
+		rank := int(math.Ceil(0.95 * float64(len(sorted))))
+		return sorted[rank-1]
+	default:
+		return avgFloat32Sample(sampleSet)
+	}
+}
+
+func reduceInt64Sample(sampleSet []int64, reduction string) float32 {
+	if reduction == REDUCTION_AVG || reduction == "" {
+		return avgInt64Sample(sampleSet)
+	}
+	converted := make([]float32, len(sampleSet))
+	for i, currentSample := range sampleSet {
+		converted[i] = float32(currentSample)
+	}
+	return reduceFloat32Sample(converted, reduction)
+}
+
+// zoom returns the configured stats zoom level
+func zoom(config CouchbaseConfig) string {
+	if config.CouchbaseZoom == "" {
+		return DEFAULT_ZOOM
+	}
+	return config.CouchbaseZoom
+}
@@ -0,0 +1,269 @@
+package couchbase
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// the ports the query, index, search and eventing services listen on, the
+// node list only reports the cluster manager port
+const (
+	QUERY_PORT    string = "8093"
+	INDEX_PORT    string = "9102"
+	FTS_PORT      string = "8094"
+	EVENTING_PORT string = "8096"
+)
+
+// serviceCollector collects the metrics of a service on a single node
+type serviceCollector struct {
+	name    string
+	port    string
+	collect func(log *logrus.Logger, config CouchbaseConfig, host string) ([]MetricData, error)
+}
+
+// serviceCollectors are keyed by the service name in the node's services list
+var serviceCollectors = map[string]serviceCollector{
+	"n1ql":     {name: "query", port: QUERY_PORT, collect: getQueryStats},
+	"index":    {name: "index", port: INDEX_PORT, collect: getIndexStats},
+	"fts":      {name: "fts", port: FTS_PORT, collect: getFTSStats},
+	"eventing": {name: "eventing", port: EVENTING_PORT, collect: getEventingStats},
+}
+
+// eventingStatGroups are the objects of an eventing function's stats that are
+// reported
+var eventingStatGroups = []string{"event_processing_stats", "execution_stats", "failure_stats"}
+
+// getCouchServiceStats collects the query, index, full text search and
+// eventing metrics of every node running those services
+func getCouchServiceStats(log *logrus.Logger, config CouchbaseConfig) ([]MetricData, error) {
+	clusterResponse, err := getClusterInfo(log, config)
+	if err != nil {
+		return make([]MetricData, 0), err
+	}
+	return mergeResults(runTasks(config, serviceTasks(log, config, clusterResponse)))
+}
+
+// serviceTasks returns a task for every service with a collector on every
+// node
+func serviceTasks(log *logrus.Logger, config CouchbaseConfig, clusterResponse CouchbaseClusterInfo) []task {
+	tasks := make([]task, 0)
+	for _, node := range clusterResponse.Nodes {
+		services := make([]string, len(node.Services))
+		copy(services, node.Services)
+		sort.Strings(services)
+		for _, service := range services {
+			collector, ok := serviceCollectors[service]
+			if !ok {
+				continue
+			}
+			hostName := node.HostName
+			tasks = append(tasks, task{
+				name: fmt.Sprintf("%s metrics of %s", collector.name, hostName),
+				run: func() ([]MetricData, error) {
+					metrics, err := collector.collect(log, config, serviceHost(config, hostName, collector.port))
+					if err != nil {
+						return nil, err
+					}
+					for _, metric := range metrics {
+						metric["event_type"] = EVENT_TYPE
+						metric["provider"] = PROVIDER
+						metric["couchbase.scalr.clustername"] = os.Getenv("CB_CLUSTER_NAME")
+						metric["couchbase.cluster.name"] = clusterResponse.Name
+						metric[fmt.Sprintf("couchbase.%s.node", collector.name)] = hostName
+					}
+					return metrics, nil
+				},
+			})
+		}
+	}
+	return tasks
+}
+
+// serviceHost builds the address of a service from the node's hostname, which
+// includes the cluster manager port, using the scheme of COUCHBASE_HOST
+func serviceHost(config CouchbaseConfig, hostname string, port string) string {
+	scheme := "http"
+	if parsed, err := url.Parse(config.CouchbaseHost); err == nil && parsed.Scheme != "" {
+		scheme = parsed.Scheme
+	}
+	host, _, err := net.SplitHostPort(hostname)
+	if err != nil {
+		host = strings.Trim(hostname, "[]")
+	}
+	return fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(host, port))
+}
+
+func getServiceAPI(log *logrus.Logger, config CouchbaseConfig, host string, endpoint string, record interface{}) error {
+	return callAPI(log, config, fmt.Sprintf("%v/%v", host, endpoint), record)
+}
+
+// getQueryStats reports the query service vitals along with the requests
+// running on the node. Durations, reported as e.g. "536.57µs", are converted
+// to milliseconds and suffixed with _ms.
+func getQueryStats(log *logrus.Logger, config CouchbaseConfig, host string) ([]MetricData, error) {
+	var vitals map[string]interface{}
+	if err := getServiceAPI(log, config, host, "admin/vitals", &vitals); err != nil {
+		return nil, err
+	}
+	sample := MetricData{}
+	for key, value := range vitals {
+		switch v := value.(type) {
+		case float64:
+			sample["couchbase.query."+key] = v
+		case string:
+			if key == "version" {
+				sample["couchbase.query.version"] = v
+			} else if duration, err := time.ParseDuration(v); err == nil {
+				sample["couchbase.query."+key+"_ms"] = durationMs(duration)
+			}
+		}
+	}
+
+	var activeRequests []struct {
+		ElapsedTime string `json:"elapsedTime"`
+	}
+	if err := getServiceAPI(log, config, host, "admin/active_requests", &activeRequests); err != nil {
+		log.WithFields(logrus.Fields{
+			"host":  host,
+			"error": err,
+		}).Warn("Failed to collect query active requests")
+		return []MetricData{sample}, nil
+	}
+	var longest time.Duration
+	for _, request := range activeRequests {
+		if elapsed, err := time.ParseDuration(request.ElapsedTime); err == nil && elapsed > longest {
+			longest = elapsed
+		}
+	}
+	sample["couchbase.query.active_requests"] = len(activeRequests)
+	sample["couchbase.query.active_requests.longest_elapsed_ms"] = durationMs(longest)
+	return []MetricData{sample}, nil
+}
+
+// getIndexStats reports the stats of every index on the node, e.g. the items
+// count, fragmentation and scan latency, along with those of the indexer. The
+// indexes are keyed by "<bucket>:<index>", or by
+// "<bucket>:<scope>:<collection>:<index>" for those of a named collection.
+func getIndexStats(log *logrus.Logger, config CouchbaseConfig, host string) ([]MetricData, error) {
+	var stats map[string]map[string]interface{}
+	if err := getServiceAPI(log, config, host, "api/v1/stats", &stats); err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(stats))
+	for key := range stats {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	returnMetrics := make([]MetricData, 0, len(keys))
+	for _, key := range keys {
+		if key == "indexer" {
+			sample := MetricData{}
+			addNumericStats(sample, "couchbase.indexer", stats[key])
+			returnMetrics = append(returnMetrics, sample)
+			continue
+		}
+		parts := strings.Split(key, ":")
+		if len(parts) < 2 {
+			continue
+		}
+		sample := MetricData{
+			"couchbase.index.bucket": parts[0],
+			"couchbase.index.index":  parts[len(parts)-1],
+		}
+		if len(parts) == 4 {
+			sample["couchbase.index.scope"] = parts[1]
+			sample["couchbase.index.collection"] = parts[2]
+		}
+		addNumericStats(sample, "couchbase.index", stats[key])
+		returnMetrics = append(returnMetrics, sample)
+	}
+	return returnMetrics, nil
+}
+
+// getFTSStats reports the stats of every full text search index on the node
+// along with those of the node. Index stats are keyed by
+// "<bucket>:<index>:<stat>", the node's have no prefix.
+func getFTSStats(log *logrus.Logger, config CouchbaseConfig, host string) ([]MetricData, error) {
+	var stats map[string]interface{}
+	if err := getServiceAPI(log, config, host, "api/nsstats", &stats); err != nil {
+		return nil, err
+	}
+	nodeSample := MetricData{}
+	indexSamples := make(map[string]MetricData)
+	for key, value := range stats {
+		number, ok := value.(float64)
+		if !ok {
+			continue
+		}
+		parts := strings.Split(key, ":")
+		if len(parts) < 3 {
+			nodeSample["couchbase.fts."+key] = number
+			continue
+		}
+		index := strings.Join(parts[:len(parts)-1], ":")
+		if _, ok := indexSamples[index]; !ok {
+			indexSamples[index] = MetricData{
+				"couchbase.fts.bucket": parts[0],
+				"couchbase.fts.index":  parts[len(parts)-2],
+			}
+		}
+		indexSamples[index]["couchbase.fts."+parts[len(parts)-1]] = number
+	}
+
+	indexes := make([]string, 0, len(indexSamples))
+	for index := range indexSamples {
+		indexes = append(indexes, index)
+	}
+	sort.Strings(indexes)
+	returnMetrics := []MetricData{nodeSample}
+	for _, index := range indexes {
+		returnMetrics = append(returnMetrics, indexSamples[index])
+	}
+	return returnMetrics, nil
+}
+
+// getEventingStats reports the processing, execution and failure counts of
+// every eventing function deployed on the node
+func getEventingStats(log *logrus.Logger, config CouchbaseConfig, host string) ([]MetricData, error) {
+	var functions []map[string]interface{}
+	if err := getServiceAPI(log, config, host, "api/v1/stats", &functions); err != nil {
+		return nil, err
+	}
+	returnMetrics := make([]MetricData, 0, len(functions))
+	for _, function := range functions {
+		name, _ := function["function_name"].(string)
+		sample := MetricData{
+			"couchbase.eventing.function": name,
+		}
+		for _, group := range eventingStatGroups {
+			if stats, ok := function[group].(map[string]interface{}); ok {
+				addNumericStats(sample, "couchbase.eventing."+group, stats)
+			}
+		}
+		returnMetrics = append(returnMetrics, sample)
+	}
+	sort.SliceStable(returnMetrics, func(i, j int) bool {
+		return returnMetrics[i]["couchbase.eventing.function"].(string) < returnMetrics[j]["couchbase.eventing.function"].(string)
+	})
+	return returnMetrics, nil
+}
+
+// addNumericStats copies the numeric stats into the sample
+func addNumericStats(sample MetricData, prefix string, stats map[string]interface{}) {
+	for key, value := range stats {
+		if number, ok := value.(float64); ok {
+			sample[prefix+"."+key] = number
+		}
+	}
+}
+
+func durationMs(duration time.Duration) float64 {
+	return float64(duration) / float64(time.Millisecond)
+}
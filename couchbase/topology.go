@@ -0,0 +1,222 @@
+package couchbase
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/GannettDigital/go-newrelic-plugin/helpers"
+	"github.com/Sirupsen/logrus"
+)
+
+const REBALANCE_EVENT_TYPE string = "CouchbaseRebalance"
+const FAILOVER_EVENT_TYPE string = "CouchbaseAutoFailover"
+const MEMBERSHIP_EVENT_TYPE string = "CouchbaseNodeMembershipChange"
+
+// STATE_FILE_NAME is the topology state file in the working directory when
+// COUCHBASE_STATE_FILE is not set
+const STATE_FILE_NAME string = "couchbasetopology"
+
+// CouchbaseTask is an entry of /pools/default/tasks
+type CouchbaseTask struct {
+	Type     string  `json:"type"`
+	Status   string  `json:"status"`
+	Progress float64 `json:"progress"`
+}
+
+// AutoFailoverSettings is /settings/autoFailover, the count is the number of
+// nodes failed over automatically since it was last reset
+type AutoFailoverSettings struct {
+	Enabled bool `json:"enabled"`
+	Timeout int  `json:"timeout"`
+	Count   int  `json:"count"`
+}
+
+// topology is what a run found of the cluster layout. It is only reported
+// when the cluster and its buckets were found, tasks and autoFailover are
+// left unset when they couldn't be read.
+type topology struct {
+	found        bool
+	cluster      CouchbaseClusterInfo
+	buckets      []CouchbaseBucketStatsURI
+	tasks        []CouchbaseTask
+	tasksFound   bool
+	autoFailover *AutoFailoverSettings
+}
+
+// topologyState is what is kept of the topology between runs
+type topologyState struct {
+	Rebalance     string            `json:"rebalance"`
+	FailoverCount int               `json:"failover_count"`
+	Nodes         map[string]string `json:"nodes"`
+}
+
+func getClusterTasks(log *logrus.Logger, config CouchbaseConfig) ([]CouchbaseTask, error) {
+	var tasks []CouchbaseTask
+	if err := getAPI(log, config, "/pools/default/tasks", &tasks); err != nil {
+		return nil, err
+	}
+	return tasks, nil
+}
+
+func getAutoFailoverSettings(log *logrus.Logger, config CouchbaseConfig) (AutoFailoverSettings, error) {
+	var settings AutoFailoverSettings
+	if err := getAPI(log, config, "/settings/autoFailover", &settings); err != nil {
+		return AutoFailoverSettings{}, err
+	}
+	return settings, nil
+}
+
+// topologyInventory reports the service quotas of the cluster, the version and
+// services of every node and the definition of every bucket
+func topologyInventory(clusterTopology topology) map[string]InventoryData {
+	cluster := clusterTopology.cluster
+	inventory := map[string]InventoryData{
+		"cluster": {
+			"name":                  cluster.Name,
+			"memory_quota":          cluster.MemoryQuota,
+			"index_memory_quota":    cluster.IndexMemoryQuota,
+			"fts_memory_quota":      cluster.FTSMemoryQuota,
+			"cbas_memory_quota":     cluster.CBASMemoryQuota,
+			"eventing_memory_quota": cluster.EventingMemoryQuota,
+		},
+	}
+	for _, node := range cluster.Nodes {
+		services := make([]string, len(node.Services))
+		copy(services, node.Services)
+		sort.Strings(services)
+		inventory["nodes/"+node.HostName] = InventoryData{
+			"version":            node.Version,
+			"services":           strings.Join(services, ","),
+			"status":             node.Status,
+			"cluster_membership": node.ClusterMembership,
+		}
+	}
+	for _, bucket := range clusterTopology.buckets {
+		inventory["buckets/"+bucket.Name] = InventoryData{
+			"type":            bucket.BucketType,
+			"replicas":        bucket.ReplicaNumber,
+			"eviction_policy": bucket.EvictionPolicy,
+			"ram_quota":       bucket.Quota.RAM,
+		}
+	}
+	return inventory
+}
+
+// topologyEvents compares the topology with the previous run and returns an
+// event when a rebalance starts or finishes, when nodes were failed over
+// automatically and for every node that left the active membership, along
+// with the state to save. Whatever couldn't be read this run keeps its
+// previous state.
+func topologyEvents(previous topologyState, clusterTopology topology) ([]EventData, topologyState) {
+	events := make([]EventData, 0)
+	current := topologyState{
+		Rebalance:     previous.Rebalance,
+		FailoverCount: previous.FailoverCount,
+		Nodes:         make(map[string]string),
+	}
+	clusterName := clusterTopology.cluster.Name
+
+	if clusterTopology.tasksFound {
+		current.Rebalance = "notRunning"
+		var progress float64
+		for _, clusterTask := range clusterTopology.tasks {
+			if clusterTask.Type == "rebalance" {
+				current.Rebalance = clusterTask.Status
+				progress = clusterTask.Progress
+			}
+		}
+		if previous.Rebalance != "" && (previous.Rebalance == "running") != (current.Rebalance == "running") {
+			state := "started"
+			if current.Rebalance != "running" {
+				state = "finished"
+			}
+			event := EventData{
+				"event_type":                 REBALANCE_EVENT_TYPE,
+				"provider":                   PROVIDER,
+				"category":                   "notifications",
+				"summary":                    fmt.Sprintf("couchbase cluster %s rebalance %s", clusterName, state),
+				"couchbase.cluster.name":     clusterName,
+				"couchbase.rebalance.status": state,
+			}
+			if state == "started" {
+				event["couchbase.rebalance.progress"] = progress
+			}
+			events = append(events, event)
+		}
+	}
+
+	if clusterTopology.autoFailover != nil {
+		current.FailoverCount = clusterTopology.autoFailover.Count
+		if current.FailoverCount > previous.FailoverCount {
+			var failedNodes []string
+			for _, node := range clusterTopology.cluster.Nodes {
+				if node.ClusterMembership == "inactiveFailed" {
+					failedNodes = append(failedNodes, node.HostName)
+				}
+			}
+			sort.Strings(failedNodes)
+			events = append(events, EventData{
+				"event_type":               FAILOVER_EVENT_TYPE,
+				"provider":                 PROVIDER,
+				"category":                 "notifications",
+				"summary":                  fmt.Sprintf("couchbase cluster %s failed over %d node(s) automatically", clusterName, current.FailoverCount-previous.FailoverCount),
+				"couchbase.cluster.name":   clusterName,
+				"couchbase.failover.count": current.FailoverCount,
+				"couchbase.failover.nodes": strings.Join(failedNodes, ","),
+				"couchbase.failover.delta": current.FailoverCount - previous.FailoverCount,
+			})
+		}
+	}
+
+	for _, node := range clusterTopology.cluster.Nodes {
+		current.Nodes[node.HostName] = node.ClusterMembership
+	}
+	hostNames := make([]string, 0, len(previous.Nodes))
+	for hostName := range previous.Nodes {
+		hostNames = append(hostNames, hostName)
+	}
+	sort.Strings(hostNames)
+	for _, hostName := range hostNames {
+		membership, ok := current.Nodes[hostName]
+		if !ok {
+			membership = "removed"
+		}
+		if previous.Nodes[hostName] != "active" || membership == "active" {
+			continue
+		}
+		events = append(events, EventData{
+			"event_type":              MEMBERSHIP_EVENT_TYPE,
+			"provider":                PROVIDER,
+			"category":                "notifications",
+			"summary":                 fmt.Sprintf("couchbase node %s of cluster %s went from active to %s", hostName, clusterName, membership),
+			"couchbase.cluster.name":  clusterName,
+			"couchbase.node.hostname": hostName,
+			"couchbase.node.previousClusterMembership": "active",
+			"couchbase.node.clusterMembership":         membership,
+		})
+	}
+	return events, current
+}
+
+// readTopologyState loads the topology saved by the previous run. The boolean
+// is false when there is no usable previous state.
+func readTopologyState(log *logrus.Logger, config CouchbaseConfig) (topologyState, bool) {
+	var state topologyState
+	found, err := helpers.ReadState(config.CouchbaseStateFile, STATE_FILE_NAME, &state)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("error reading couchbase topology state file")
+		return topologyState{}, false
+	}
+	return state, found
+}
+
+func writeTopologyState(log *logrus.Logger, config CouchbaseConfig, state topologyState) {
+	if err := helpers.WriteState(config.CouchbaseStateFile, STATE_FILE_NAME, state); err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("error writing couchbase topology state file")
+	}
+}
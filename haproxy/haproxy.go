@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
 
@@ -27,6 +28,8 @@ type Config struct {
 	HaproxyPort      string
 	HaproxyStatusURI string
 	HaproxyHost      string
+	HaproxySocket    string
+	HaproxyStateFile string
 }
 
 // InventoryData is the data type for inventory data produced by a plugin data
@@ -72,16 +75,28 @@ func Run(log *logrus.Logger, prettyPrint bool, version string) {
 		HaproxyPort:      os.Getenv("HAPROXYPORT"),
 		HaproxyStatusURI: os.Getenv("HAPROXYSTATUSURI"),
 		HaproxyHost:      os.Getenv("HAPROXYHOST"),
+		HaproxySocket:    os.Getenv("HAPROXYSOCKET"),
+		HaproxyStateFile: os.Getenv("HAPROXYSTATEFILE"),
 	}
 	validErr := validateConfig(log, haproxyConf)
 	if validErr != nil {
 		log.Fatalf("config: %v\n", validErr)
 	}
 
-	metric, err := getHaproxyStatus(log, haproxyConf)
+	var metric []MetricData
+	var err error
+	if haproxyConf.HaproxySocket != "" {
+		metric, err = getSocketStats(log, haproxyConf)
+	} else {
+		metric, err = getHaproxyStatus(log, haproxyConf)
+	}
 	fatalIfErr(log, err)
 
 	data.Metrics = metric
+	previous, _ := readServerState(log, haproxyConf)
+	events, current := serverStateEvents(previous, metric)
+	data.Events = append(data.Events, events...)
+	writeServerState(log, haproxyConf, current)
 	fatalIfErr(log, helpers.OutputJSON(data, prettyPrint))
 }
 
@@ -105,8 +120,7 @@ func initStats(log *logrus.Logger, haproxyConf Config) ([][]string, error) {
 		}).Error("Encountered error calling CallAPI")
 		return nil, err
 	}
-	r := csv.NewReader(strings.NewReader(string(data)))
-	everything, err := r.ReadAll()
+	everything, err := readCSV(data)
 	if err != nil {
 		log.WithFields(logrus.Fields{
 			"err": err,
@@ -116,6 +130,59 @@ func initStats(log *logrus.Logger, haproxyConf Config) ([][]string, error) {
 	return everything, nil
 }
 
+// columnNames are the names the stats columns have always been reported as,
+// every other numeric column is reported under its own snake_case name, e.g.
+// haproxy.backend.check_duration, so both read the same way
+var columnNames = map[string]string{
+	"qcur":       "queue.current",
+	"qmax":       "queue.max",
+	"scur":       "session.current",
+	"smax":       "session.max",
+	"slim":       "session.limit",
+	"stot":       "session.total",
+	"bin":        "bytes.in_rate",
+	"bout":       "bytes.out_rate",
+	"dreq":       "denied.req_rate",
+	"dresp":      "denied.resp_rate",
+	"ereq":       "errors.req_rate",
+	"econ":       "errors.con_rate",
+	"eresp":      "errors.resp_rate",
+	"wretr":      "warnings.retr_rate",
+	"wredis":     "warnings.redis_rate",
+	"rate":       "session.rate",
+	"hrsp_1xx":   "response.1xx",
+	"hrsp_2xx":   "response.2xx",
+	"hrsp_3xx":   "response.3xx",
+	"hrsp_4xx":   "response.4xx",
+	"hrsp_5xx":   "response.5xx",
+	"hrsp_other": "response.other",
+	"req_rate":   "requests.rate",
+	"qtime":      "queue.time",
+	"ctime":      "connect.time",
+	"rtime":      "response.time",
+	"ttime":      "session.time",
+}
+
+// textColumns are the text columns that are reported, the rest such as
+// addresses and descriptions are left out
+var textColumns = map[string]string{
+	"status":       "status",
+	"check_status": "check_status",
+	"last_chk":     "last_check",
+	"check_desc":   "check_description",
+}
+
+var numericPattern = regexp.MustCompile(`^-?[0-9]+$`)
+
+// readCSV reads the stats CSV, which is the same over HTTP and the stats socket
+func readCSV(data []byte) ([][]string, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	// a row with a different number of columns shouldn't fail the whole page,
+	// parseStats copes with missing columns
+	r.FieldsPerRecord = -1
+	return r.ReadAll()
+}
+
 func getHaproxyStatus(log *logrus.Logger, haproxyConf Config) ([]MetricData, error) {
 	InitialStats, err := initStats(log, haproxyConf)
 	if err != nil {
@@ -125,122 +192,85 @@ func getHaproxyStatus(log *logrus.Logger, haproxyConf Config) ([]MetricData, err
 		}).Error("Encountered error querying Stats")
 		return nil, err
 	}
+	return parseStats(log, InitialStats)
+}
+
+// parseStats reads the rows of the stats CSV by the column names in its
+// "# pxname,svname,..." header, since the columns and their positions differ
+// between HAProxy versions. A column missing from a version or a short row is
+// left out of the sample.
+func parseStats(log *logrus.Logger, records [][]string) ([]MetricData, error) {
+	if len(records) == 0 {
+		return nil, errors.New("HAProxy stats CSV is empty")
+	}
+	columns := make([]string, len(records[0]))
+	for i, column := range records[0] {
+		columns[i] = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(column), "#"))
+	}
+	if len(columns) < 2 || columns[0] != "pxname" || columns[1] != "svname" {
+		return nil, fmt.Errorf("HAProxy stats CSV header is missing pxname and svname: %v", records[0])
+	}
+
 	Stats := make([]MetricData, 0)
-	for _, record := range InitialStats[1:] {
-		if strings.TrimSpace(record[0]) != "stats" && record[1] == "FRONTEND" {
-			Stats = append(Stats, MetricData{
-				"event_type":                        EVENT_TYPE,
-				"provider":                          PROVIDER,
-				"haproxy.type":                      "frontend",
-				"haproxy.frontend.name":             strings.TrimSpace(record[0]),
-				"haproxy.frontend.session.current":  toInt(log, record[4]),
-				"haproxy.frontend.session.max":      toInt(log, record[5]),
-				"haproxy.frontend.session.limit":    toInt(log, record[6]),
-				"haproxy.frontend.session.total":    toInt(log, record[7]),
-				"haproxy.frontend.bytes.in_rate":    toInt64(log, record[8]),
-				"haproxy.frontend.bytes.out_rate":   toInt64(log, record[9]),
-				"haproxy.frontend.denied.req_rate":  toInt(log, record[10]),
-				"haproxy.frontend.denied.resp_rate": toInt(log, record[11]),
-				"haproxy.frontend.errors.req_rate":  toInt(log, record[12]),
-				"haproxy.frontend.session.rate":     toInt(log, record[33]),
-				"haproxy.frontend.response.1xx":     toInt(log, record[39]),
-				"haproxy.frontend.response.2xx":     toInt(log, record[40]),
-				"haproxy.frontend.response.3xx":     toInt(log, record[41]),
-				"haproxy.frontend.response.4xx":     toInt(log, record[42]),
-				"haproxy.frontend.response.5xx":     toInt(log, record[43]),
-				"haproxy.frontend.response.other":   toInt(log, record[44]),
-				"haproxy.frontend.requests.rate":    toInt(log, record[46]),
-			})
-			continue
-		} else if strings.TrimSpace(record[0]) != "stats" && record[1] == "BACKEND" {
-			Stats = append(Stats, MetricData{
-				"event_type":                          EVENT_TYPE,
-				"provider":                            PROVIDER,
-				"haproxy.type":                        "backend",
-				"haproxy.backend.name":                strings.TrimSpace(record[0]),
-				"haproxy.backend.queue.current":       toInt(log, record[2]),
-				"haproxy.backend.queue.max":           toInt(log, record[3]),
-				"haproxy.backend.session.current":     toInt(log, record[4]),
-				"haproxy.backend.session.max":         toInt(log, record[5]),
-				"haproxy.backend.session.limit":       toInt(log, record[6]),
-				"haproxy.backend.session.total":       toInt(log, record[7]),
-				"haproxy.backend.bytes.in_rate":       toInt64(log, record[8]),
-				"haproxy.backend.bytes.out_rate":      toInt64(log, record[9]),
-				"haproxy.backend.denied.req_rate":     toInt(log, record[10]),
-				"haproxy.backend.denied.resp_rate":    toInt(log, record[11]),
-				"haproxy.backend.errors.con_rate":     toInt(log, record[13]),
-				"haproxy.backend.errors.resp_rate":    toInt(log, record[14]),
-				"haproxy.backend.warnings.retr_rate":  toInt(log, record[15]),
-				"haproxy.backend.warnings.redis_rate": toInt(log, record[16]),
-				"haproxy.backend.session.rate":        toInt(log, record[33]),
-				"haproxy.backend.response.1xx":        toInt(log, record[39]),
-				"haproxy.backend.response.2xx":        toInt(log, record[40]),
-				"haproxy.backend.response.3xx":        toInt(log, record[41]),
-				"haproxy.backend.response.4xx":        toInt(log, record[42]),
-				"haproxy.backend.response.5xx":        toInt(log, record[43]),
-				"haproxy.backend.response.other":      toInt(log, record[44]),
-				"haproxy.backend.queue.time":          toInt(log, record[58]),
-				"haproxy.backend.connect.time":        toInt(log, record[59]),
-				"haproxy.backend.response.time":       toInt(log, record[60]),
-				"haproxy.backend.session.time":        toInt(log, record[61]),
-			})
+	for _, record := range records[1:] {
+		fields := make(map[string]string, len(columns))
+		for i, value := range record {
+			if i < len(columns) && columns[i] != "" {
+				fields[columns[i]] = strings.TrimSpace(value)
+			}
+		}
+		proxy := fields["pxname"]
+		server := fields["svname"]
+		// type 3 rows are the listeners of a frontend with socket-stats enabled
+		if proxy == "" || proxy == "stats" || server == "" || fields["type"] == "3" {
 			continue
-		} else if strings.TrimSpace(record[0]) != "stats" && record[1] != "BACKEND" && record[1] != "FRONTEND" {
-			Stats = append(Stats, MetricData{
-				"event_type":                          EVENT_TYPE,
-				"provider":                            PROVIDER,
-				"haproxy.type":                        "backend-member",
-				"haproxy.backend.name":                strings.TrimSpace(record[0]),
-				"haproxy.backend.member.name":         record[1],
-				"haproxy.backend.queue.current":       toInt(log, record[2]),
-				"haproxy.backend.queue.max":           toInt(log, record[3]),
-				"haproxy.backend.session.current":     toInt(log, record[4]),
-				"haproxy.backend.session.max":         toInt(log, record[5]),
-				"haproxy.backend.session.limit":       toInt(log, record[6]),
-				"haproxy.backend.session.total":       toInt(log, record[7]),
-				"haproxy.backend.bytes.in_rate":       toInt64(log, record[8]),
-				"haproxy.backend.bytes.out_rate":      toInt64(log, record[9]),
-				"haproxy.backend.denied.req_rate":     toInt(log, record[10]),
-				"haproxy.backend.denied.resp_rate":    toInt(log, record[11]),
-				"haproxy.backend.errors.con_rate":     toInt(log, record[13]),
-				"haproxy.backend.errors.resp_rate":    toInt(log, record[14]),
-				"haproxy.backend.warnings.retr_rate":  toInt(log, record[15]),
-				"haproxy.backend.warnings.redis_rate": toInt(log, record[16]),
-				"haproxy.backend.status":              record[17],
-				"haproxy.backend.session.rate":        toInt(log, record[33]),
-				"haproxy.backend.response.1xx":        toInt(log, record[39]),
-				"haproxy.backend.response.2xx":        toInt(log, record[40]),
-				"haproxy.backend.response.3xx":        toInt(log, record[41]),
-				"haproxy.backend.response.4xx":        toInt(log, record[42]),
-				"haproxy.backend.response.5xx":        toInt(log, record[43]),
-				"haproxy.backend.response.other":      toInt(log, record[44]),
-				"haproxy.backend.last_check":          record[56],
-				"haproxy.backend.queue.time":          toInt(log, record[58]),
-				"haproxy.backend.connect.time":        toInt(log, record[59]),
-				"haproxy.backend.response.time":       toInt(log, record[60]),
-				"haproxy.backend.session.time":        toInt(log, record[61]),
-			})
+		}
+
+		switch server {
+		case "FRONTEND":
+			metric := statsSample(log, "frontend", "haproxy.frontend", fields)
+			metric["haproxy.frontend.name"] = proxy
+			Stats = append(Stats, metric)
+		case "BACKEND":
+			metric := statsSample(log, "backend", "haproxy.backend", fields)
+			metric["haproxy.backend.name"] = proxy
+			Stats = append(Stats, metric)
+		default:
+			metric := statsSample(log, "backend-member", "haproxy.backend", fields)
+			metric["haproxy.backend.name"] = proxy
+			metric["haproxy.backend.member.name"] = server
+			Stats = append(Stats, metric)
 		}
 	}
-	//return Stats, nil
-	return Stats, err
+	return Stats, nil
 }
 
-func toInt(log *logrus.Logger, value string) int {
-	if value == "" {
-		return 0
+// statsSample reports every numeric column of a row along with a few of the
+// text ones, empty columns are left out
+func statsSample(log *logrus.Logger, kind string, prefix string, fields map[string]string) MetricData {
+	metric := MetricData{
+		"event_type":   EVENT_TYPE,
+		"provider":     PROVIDER,
+		"haproxy.type": kind,
 	}
-	valueInt, err := strconv.Atoi(value)
-	if err != nil {
-		log.WithFields(logrus.Fields{
-			"valueInt": valueInt,
-			"error":    err,
-		}).Debug("Error converting value to int")
-
-		return 0
+	for column, value := range fields {
+		if value == "" || column == "pxname" || column == "svname" {
+			continue
+		}
+		if name, ok := textColumns[column]; ok {
+			metric[prefix+"."+name] = value
+			continue
+		}
+		if !numericPattern.MatchString(value) {
+			continue
+		}
+		name, ok := columnNames[column]
+		if !ok {
+			name = column
+		}
+		metric[prefix+"."+name] = toInt64(log, value)
 	}
-
-	return valueInt
+	return metric
 }
 
 func toInt64(log *logrus.Logger, value string) int64 {
@@ -261,6 +291,10 @@ func toInt64(log *logrus.Logger, value string) int64 {
 }
 
 func validateConfig(log *logrus.Logger, haproxyConf Config) error {
+	// the stats socket replaces the HTTP status page
+	if haproxyConf.HaproxySocket != "" {
+		return nil
+	}
 	if haproxyConf.HaproxyStatusURI == "" {
 		return errors.New("Config is missing the HaproxyStatusURI. Please check the config to continue")
 	}
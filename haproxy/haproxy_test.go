@@ -1,7 +1,13 @@
 package haproxy
 
 import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 
 	fake "github.com/GannettDigital/paas-api-utils/utilsHTTP/fake"
@@ -73,18 +79,18 @@ func TestGetHaproxyStatus(t *testing.T) {
 	}
 }
 
-func TestToInt(t *testing.T) {
+func TestToInt64(t *testing.T) {
 	g := goblin.Goblin(t)
 
 	var tests = []struct {
 		Value           string
-		ExpectedResult  int
+		ExpectedResult  int64
 		TestDescription string
 	}{
 		{
-			Value:           "8675301",
-			ExpectedResult:  8675301,
-			TestDescription: "Should return int 8675301 of string",
+			Value:           "98765432100",
+			ExpectedResult:  98765432100,
+			TestDescription: "Should return entire number when passed 98765432100 string",
 		},
 		{
 			Value:           "",
@@ -99,46 +105,334 @@ func TestToInt(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		g.Describe("toInt()", func() {
+		g.Describe("toInt64()", func() {
 			g.It(test.TestDescription, func() {
-				result := toInt(logrus.New(), test.Value)
+				result := toInt64(logrus.New(), test.Value)
 				g.Assert(reflect.DeepEqual(result, test.ExpectedResult)).Equal(true)
 			})
 		})
 	}
 }
 
-func TestToInt64(t *testing.T) {
-	g := goblin.Goblin(t)
+// stats pages with the exact headers HAProxy 1.5, 1.8 and 2.2 print, each
+// version adds columns. The rows are written by hand to match those headers,
+// they are not captured from running servers.
+var haproxy15Stats = `# pxname,svname,qcur,qmax,scur,smax,slim,stot,bin,bout,dreq,dresp,ereq,econ,eresp,wretr,wredis,status,weight,act,bck,chkfail,chkdown,lastchg,downtime,qlimit,pid,iid,sid,throttle,lbtot,tracked,type,rate,rate_lim,rate_max,check_status,check_code,check_duration,hrsp_1xx,hrsp_2xx,hrsp_3xx,hrsp_4xx,hrsp_5xx,hrsp_other,hanafail,req_rate,req_rate_max,req_tot,cli_abrt,srv_abrt,comp_in,comp_out,comp_byp,comp_rsp,lastsess,last_chk,last_agt,qtime,ctime,rtime,ttime,
+stats,FRONTEND,,,1,,,,,,,,,,,,,OPEN,,,,,,,,,,,,,,,0,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,
+www,FRONTEND,,,3,12,2000,1500,120000,950000,0,0,2,,,,,OPEN,,,,,,,,,1,2,0,,,,0,1,0,9,,,,0,1400,50,40,8,2,,1,10,1500,,,0,0,0,0,,,,,,,,
+app,web1,0,0,1,6,,700,60000,470000,,0,,0,1,0,0,UP,1,1,0,0,0,3600,0,,1,3,1,,700,,2,0,,5,L7OK,200,2,0,690,5,3,2,0,,,,,1,0,,,,,4,OK,,0,1,25,40,
+app,web2,0,0,0,6,,700,60000,470000,,0,,0,1,0,0,DOWN,1,1,0,0,0,60,60,,1,3,2,,700,,2,0,,5,L4CON,,0,0,690,5,3,2,0,,,,,1,0,,,,,4,Connection refused,,0,1,25,40,
+app,BACKEND,0,0,1,8,200,1400,120000,940000,0,0,,3,1,0,0,UP,1,1,0,,0,3600,0,,1,3,0,,1400,,1,1,,9,,,,0,1380,10,6,4,0,,,,1400,1,0,0,0,0,0,4,,,0,1,26,41,
+`
+
+var haproxy18Stats = `# pxname,svname,qcur,qmax,scur,smax,slim,stot,bin,bout,dreq,dresp,ereq,econ,eresp,wretr,wredis,status,weight,act,bck,chkfail,chkdown,lastchg,downtime,qlimit,pid,iid,sid,throttle,lbtot,tracked,type,rate,rate_lim,rate_max,check_status,check_code,check_duration,hrsp_1xx,hrsp_2xx,hrsp_3xx,hrsp_4xx,hrsp_5xx,hrsp_other,hanafail,req_rate,req_rate_max,req_tot,cli_abrt,srv_abrt,comp_in,comp_out,comp_byp,comp_rsp,lastsess,last_chk,last_agt,qtime,ctime,rtime,ttime,agent_status,agent_code,agent_duration,check_desc,agent_desc,check_rise,check_fall,check_health,agent_rise,agent_fall,agent_health,addr,cookie,mode,algo,conn_rate,conn_rate_max,conn_tot,intercepted,dcon,dses,
+stats,FRONTEND,,,1,,,,,,,,,,,,,OPEN,,,,,,,,,,,,,,,0,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,
+www,FRONTEND,,,3,12,2000,1500,120000,950000,0,0,2,,,,,OPEN,,,,,,,,,1,2,0,,,,0,1,0,9,,,,0,1400,50,40,8,2,,1,10,1500,,,0,0,0,0,,,,,,,,,,,,,,,,,,,,,http,,1,9,1500,0,0,0,
+app,web1,0,0,1,6,,700,60000,470000,,0,,0,1,0,0,UP,1,1,0,0,0,3600,0,,1,3,1,,700,,2,0,,5,L7OK,200,2,0,690,5,3,2,0,,,,,1,0,,,,,4,OK,,0,1,25,40,,,,Layer7 check passed,,2,3,4,1,1,0,10.0.0.1:8080,,http,,,,,,,,
+app,web2,0,0,0,6,,700,60000,470000,,0,,0,1,0,0,DOWN,1,1,0,0,0,60,60,,1,3,2,,700,,2,0,,5,L4CON,,0,0,690,5,3,2,0,,,,,1,0,,,,,4,Connection refused,,0,1,25,40,,,,Layer4 connection problem,,2,3,4,1,1,0,10.0.0.2:8080,,http,,,,,,,,
+app,BACKEND,0,0,1,8,200,1400,120000,940000,0,0,,3,1,0,0,UP,1,1,0,,0,3600,0,,1,3,0,,1400,,1,1,,9,,,,0,1380,10,6,4,0,,,,1400,1,0,0,0,0,0,4,,,0,1,26,41,,,,,,,,,,,,,,http,roundrobin,,,,,,,
+`
 
+var haproxy22Stats = `# pxname,svname,qcur,qmax,scur,smax,slim,stot,bin,bout,dreq,dresp,ereq,econ,eresp,wretr,wredis,status,weight,act,bck,chkfail,chkdown,lastchg,downtime,qlimit,pid,iid,sid,throttle,lbtot,tracked,type,rate,rate_lim,rate_max,check_status,check_code,check_duration,hrsp_1xx,hrsp_2xx,hrsp_3xx,hrsp_4xx,hrsp_5xx,hrsp_other,hanafail,req_rate,req_rate_max,req_tot,cli_abrt,srv_abrt,comp_in,comp_out,comp_byp,comp_rsp,lastsess,last_chk,last_agt,qtime,ctime,rtime,ttime,agent_status,agent_code,agent_duration,check_desc,agent_desc,check_rise,check_fall,check_health,agent_rise,agent_fall,agent_health,addr,cookie,mode,algo,conn_rate,conn_rate_max,conn_tot,intercepted,dcon,dses,wrew,connect,reuse,cache_lookups,cache_hits,srv_icur,src_ilim,qtime_max,ctime_max,rtime_max,ttime_max,eint,idle_conn_cur,safe_conn_cur,used_conn_cur,need_conn_est,
+stats,FRONTEND,,,1,,,,,,,,,,,,,OPEN,,,,,,,,,,,,,,,0,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,
+www,FRONTEND,,,3,12,2000,1500,120000,950000,0,0,2,,,,,OPEN,,,,,,,,,1,2,0,,,,0,1,0,9,,,,0,1400,50,40,8,2,,1,10,1500,,,0,0,0,0,,,,,,,,,,,,,,,,,,,,,http,,1,9,1500,0,0,0,0,,,0,0,,,,,,,0,,,,,
+app,web1,0,0,1,6,,700,60000,470000,,0,,0,1,0,0,UP,1,1,0,0,0,3600,0,,1,3,1,,700,,2,0,,5,L7OK,200,2,0,690,5,3,2,0,,,,,1,0,,,,,4,OK,,0,1,25,40,,,,Layer7 check passed,,2,3,4,1,1,0,10.0.0.1:8080,,http,,,,,,,,0,700,0,,,0,0,3,9,310,420,0,0,0,1,0,
+app,web2,0,0,0,6,,700,60000,470000,,0,,0,1,0,0,DOWN,1,1,0,0,0,60,60,,1,3,2,,700,,2,0,,5,L4CON,,0,0,690,5,3,2,0,,,,,1,0,,,,,4,Connection refused,,0,1,25,40,,,,Layer4 connection problem,,2,3,4,1,1,0,10.0.0.2:8080,,http,,,,,,,,0,700,0,,,0,0,3,9,310,420,0,0,0,1,0,
+app,BACKEND,0,0,1,8,200,1400,120000,940000,0,0,,3,1,0,0,UP,1,1,0,,0,3600,0,,1,3,0,,1400,,1,1,,9,,,,0,1380,10,6,4,0,,,,1400,1,0,0,0,0,0,4,,,0,1,26,41,,,,,,,,,,,,,,http,roundrobin,,,,,,,0,1400,0,0,0,,,3,9,310,420,0,,,,,
+`
+
+func TestParseStats(t *testing.T) {
+	g := goblin.Goblin(t)
 	var tests = []struct {
-		Value           string
-		ExpectedResult  int64
+		Data            string
 		TestDescription string
+		ExpectedLength  int
+		Expected        []MetricData
 	}{
 		{
-			Value:           "98765432100",
-			ExpectedResult:  98765432100,
-			TestDescription: "Should return entire number when passed 98765432100 string",
+			Data:            haproxy15Stats,
+			TestDescription: "Should read the columns of HAProxy 1.5 by name",
+			ExpectedLength:  4,
+			Expected: []MetricData{
+				{"haproxy.type": "frontend", "haproxy.frontend.name": "www", "haproxy.frontend.requests.rate": int64(1), "haproxy.frontend.response.5xx": int64(8), "haproxy.frontend.req_tot": int64(1500), "haproxy.frontend.status": "OPEN", "haproxy.frontend.queue.current": nil, "haproxy.frontend.conn_tot": nil},
+				{"haproxy.type": "backend-member", "haproxy.backend.member.name": "web1", "haproxy.backend.session.time": int64(40), "haproxy.backend.check_duration": int64(2), "haproxy.backend.check_status": "L7OK", "haproxy.backend.last_check": "OK"},
+				{"haproxy.type": "backend-member", "haproxy.backend.member.name": "web2", "haproxy.backend.status": "DOWN", "haproxy.backend.downtime": int64(60), "haproxy.backend.last_check": "Connection refused", "haproxy.backend.check_code": nil},
+				{"haproxy.type": "backend", "haproxy.backend.name": "app", "haproxy.backend.errors.con_rate": int64(3), "haproxy.backend.bytes.out_rate": int64(940000), "haproxy.backend.lbtot": int64(1400)},
+			},
 		},
 		{
-			Value:           "",
-			ExpectedResult:  0,
-			TestDescription: "Should return 0 if empty string",
+			Data:            haproxy18Stats,
+			TestDescription: "Should read the columns added by HAProxy 1.8",
+			ExpectedLength:  4,
+			Expected: []MetricData{
+				{"haproxy.frontend.name": "www", "haproxy.frontend.requests.rate": int64(1), "haproxy.frontend.conn_tot": int64(1500), "haproxy.frontend.mode": nil},
+				{"haproxy.backend.member.name": "web1", "haproxy.backend.check_health": int64(4), "haproxy.backend.addr": nil, "haproxy.backend.rtime_max": nil},
+				{"haproxy.backend.member.name": "web2", "haproxy.backend.status": "DOWN"},
+				{"haproxy.backend.name": "app", "haproxy.backend.session.time": int64(41)},
+			},
 		},
 		{
-			Value:           "arf",
-			ExpectedResult:  0,
-			TestDescription: "Should return 0 if error converting to int",
+			Data:            haproxy22Stats,
+			TestDescription: "Should read the columns added by HAProxy 2.x",
+			ExpectedLength:  4,
+			Expected: []MetricData{
+				{"haproxy.frontend.name": "www", "haproxy.frontend.response.2xx": int64(1400), "haproxy.frontend.cache_lookups": int64(0)},
+				{"haproxy.backend.member.name": "web1", "haproxy.backend.rtime_max": int64(310), "haproxy.backend.used_conn_cur": int64(1)},
+				{"haproxy.backend.member.name": "web2", "haproxy.backend.connect": int64(700)},
+				{"haproxy.backend.name": "app", "haproxy.backend.ttime_max": int64(420), "haproxy.backend.response.time": int64(26)},
+			},
+		},
+		{
+			Data:            "# pxname,svname,qcur,scur,status,\nweb,FRONTEND,,7,OPEN,\napp,web1,2\n",
+			TestDescription: "Should leave out the columns a short row is missing",
+			ExpectedLength:  2,
+			Expected: []MetricData{
+				{"haproxy.frontend.name": "web", "haproxy.frontend.session.current": int64(7), "haproxy.frontend.status": "OPEN"},
+				{"haproxy.backend.member.name": "web1", "haproxy.backend.queue.current": int64(2), "haproxy.backend.session.current": nil, "haproxy.backend.status": nil},
+			},
 		},
 	}
 
 	for _, test := range tests {
-		g.Describe("toInt64()", func() {
+		g.Describe("parseStats()", func() {
 			g.It(test.TestDescription, func() {
-				result := toInt64(logrus.New(), test.Value)
-				g.Assert(reflect.DeepEqual(result, test.ExpectedResult)).Equal(true)
+				runner = &fake.HTTPResult{
+					ResultsList: []fake.Result{
+						{
+							Method: "GET",
+							URI:    "/haproxy;csv",
+							Code:   200,
+							Data:   []byte(test.Data),
+						},
+					},
+				}
+				result, err := getHaproxyStatus(logrus.New(), fakeConfig)
+				g.Assert(err).Equal(nil)
+				g.Assert(len(result)).Equal(test.ExpectedLength)
+				for i, expected := range test.Expected {
+					for key, value := range expected {
+						g.Assert(result[i][key]).Equal(value)
+					}
+				}
 			})
 		})
 	}
+
+	g.Describe("parseStats()", func() {
+		g.It("Should return an error when the header has no pxname and svname", func() {
+			_, err := parseStats(logrus.New(), [][]string{{"www", "FRONTEND", "1"}})
+			g.Assert(err == nil).Equal(false)
+		})
+		g.It("Should return an error for an empty page", func() {
+			_, err := parseStats(logrus.New(), [][]string{})
+			g.Assert(err == nil).Equal(false)
+		})
+	})
+}
+
+var haproxyInfo = `Name: HAProxy
+Version: 1.8.8-1ubuntu0.11
+Release_date: 2020/04/03
+Nbproc: 1
+Process_num: 1
+Pid: 1510
+Uptime: 0d 2h13m04s
+Uptime_sec: 7984
+Memmax_MB: 0
+Maxsock: 8039
+Maxconn: 4000
+CurrConns: 12
+CumConns: 20140
+ConnRate: 3
+ConnRateLimit: 0
+MaxConnRate: 48
+SslRate: 1
+SslFrontendKeyRate: 0
+Idle_pct: 97
+node: lb01
+`
+
+// fakeSocket answers the commands it is sent with the responses and closes
+// the connection, as a non-interactive HAProxy stats socket does
+func fakeSocket(t *testing.T, network string, address string, responses map[string]string) (net.Listener, string) {
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when listening", err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			command, _ := bufio.NewReader(conn).ReadString('\n')
+			response, ok := responses[strings.TrimSpace(command)]
+			if !ok {
+				response = "Unknown command. Please enter one of the following commands only :\n"
+			}
+			conn.Write([]byte(response))
+			conn.Close()
+		}
+	}()
+	return listener, listener.Addr().String()
+}
+
+func TestParseInfo(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	g.Describe("parseInfo()", func() {
+		g.It("Should report the numeric fields and the version", func() {
+			result := parseInfo(logrus.New(), haproxyInfo)
+			g.Assert(result["haproxy.type"]).Equal("process")
+			g.Assert(result["haproxy.process.version"]).Equal("1.8.8-1ubuntu0.11")
+			g.Assert(result["haproxy.process.node"]).Equal("lb01")
+			g.Assert(result["haproxy.process.uptimeSec"]).Equal(int64(7984))
+			g.Assert(result["haproxy.process.connRate"]).Equal(int64(3))
+			g.Assert(result["haproxy.process.sslRate"]).Equal(int64(1))
+			g.Assert(result["haproxy.process.maxconn"]).Equal(int64(4000))
+			g.Assert(result["haproxy.process.idlePct"]).Equal(int64(97))
+			g.Assert(result["haproxy.process.nbproc"]).Equal(int64(1))
+			g.Assert(result["haproxy.process.uptime"]).Equal(nil)
+			g.Assert(result["haproxy.process.releaseDate"]).Equal(nil)
+		})
+	})
+}
+
+func TestGetSocketStats(t *testing.T) {
+	g := goblin.Goblin(t)
+	dir, err := ioutil.TempDir("", "haproxy")
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when creating a temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+
+	unixListener, unixSocket := fakeSocket(t, "unix", filepath.Join(dir, "haproxy.sock"), map[string]string{
+		"show info": haproxyInfo,
+		"show stat": haproxy18Stats,
+	})
+	defer unixListener.Close()
+	process1, socket1 := fakeSocket(t, "tcp", "127.0.0.1:0", map[string]string{
+		"show info": strings.Replace(haproxyInfo, "Nbproc: 1", "Nbproc: 2", 1),
+		"show stat": haproxy18Stats,
+	})
+	defer process1.Close()
+	process2, socket2 := fakeSocket(t, "tcp", "127.0.0.1:0", map[string]string{
+		"show info": strings.Replace(strings.Replace(haproxyInfo, "Nbproc: 1", "Nbproc: 2", 1), "Process_num: 1", "Process_num: 2", 1),
+		"show stat": haproxy18Stats,
+	})
+	defer process2.Close()
+	noStat, noStatSocket := fakeSocket(t, "tcp", "127.0.0.1:0", map[string]string{
+		"show info": haproxyInfo,
+	})
+	defer noStat.Close()
+
+	g.Describe("getSocketStats()", func() {
+		g.It("Should read show info and show stat from a unix socket", func() {
+			result, err := getSocketStats(logrus.New(), Config{HaproxySocket: unixSocket})
+			g.Assert(err).Equal(nil)
+			g.Assert(len(result)).Equal(5)
+			g.Assert(result[0]["haproxy.type"]).Equal("process")
+			g.Assert(result[0]["haproxy.process.socket"]).Equal(unixSocket)
+			g.Assert(result[1]["haproxy.frontend.name"]).Equal("www")
+			g.Assert(result[1]["haproxy.process.num"]).Equal(nil)
+		})
+		g.It("Should report every process of a TCP socket per process", func() {
+			result, err := getSocketStats(logrus.New(), Config{HaproxySocket: socket1 + ", " + socket2})
+			g.Assert(err).Equal(nil)
+			g.Assert(len(result)).Equal(10)
+			g.Assert(result[0]["haproxy.process.processNum"]).Equal(int64(1))
+			g.Assert(result[1]["haproxy.process.num"]).Equal(int64(1))
+			g.Assert(result[5]["haproxy.process.processNum"]).Equal(int64(2))
+			g.Assert(result[9]["haproxy.process.num"]).Equal(int64(2))
+		})
+		g.It("Should skip a socket that rejects a command", func() {
+			result, err := getSocketStats(logrus.New(), Config{HaproxySocket: noStatSocket + "," + unixSocket})
+			g.Assert(err).Equal(nil)
+			g.Assert(len(result)).Equal(5)
+			g.Assert(result[0]["haproxy.process.socket"]).Equal(unixSocket)
+		})
+		g.It("Should return an error when no socket could be read", func() {
+			_, err := getSocketStats(logrus.New(), Config{HaproxySocket: filepath.Join(dir, "missing.sock")})
+			g.Assert(err == nil).Equal(false)
+		})
+	})
+}
+
+func TestServerStateEvents(t *testing.T) {
+	g := goblin.Goblin(t)
+	member := func(name string, status string, downtime int64) MetricData {
+		return MetricData{
+			"haproxy.type":                      "backend-member",
+			"haproxy.backend.name":              "app",
+			"haproxy.backend.member.name":       name,
+			"haproxy.backend.status":            status,
+			"haproxy.backend.downtime":          downtime,
+			"haproxy.backend.check_description": "Layer4 connection problem",
+		}
+	}
+	samples := []MetricData{
+		{"haproxy.type": "backend", "haproxy.backend.name": "app", "haproxy.backend.status": "UP"},
+		member("web1", "UP", 0),
+		member("web2", "DOWN", 90),
+		member("web3", "UP 1/3", 0),
+		member("web4", "MAINT (via app/web1)", 0),
+		member("web5", "UP", 0),
+	}
+	previous := map[string]serverState{
+		"app/web1": {Status: "UP"},
+		"app/web2": {Status: "UP", Downtime: 30},
+		"app/web3": {Status: "UP"},
+		"app/web4": {Status: "UP"},
+		"app/gone": {Status: "UP"},
+	}
+
+	g.Describe("serverStateEvents()", func() {
+		g.It("Should report the members whose status changed", func() {
+			events, current := serverStateEvents(previous, samples)
+			g.Assert(len(events)).Equal(2)
+			g.Assert(events[0]).Equal(EventData{
+				"event_type":                      STATE_CHANGE_EVENT_TYPE,
+				"provider":                        PROVIDER,
+				"category":                        "notifications",
+				"summary":                         "HAProxy server app/web2 changed from UP to DOWN",
+				"haproxy.backend.name":            "app",
+				"haproxy.backend.member.name":     "web2",
+				"haproxy.server.previousStatus":   "UP",
+				"haproxy.server.status":           "DOWN",
+				"haproxy.server.downtimeDelta":    int64(60),
+				"haproxy.server.checkDescription": "Layer4 connection problem",
+			})
+			g.Assert(events[1]["haproxy.server.status"]).Equal("MAINT")
+			g.Assert(current).Equal(map[string]serverState{
+				"app/web1": {Status: "UP"},
+				"app/web2": {Status: "DOWN", Downtime: 90},
+				"app/web3": {Status: "UP"},
+				"app/web4": {Status: "MAINT"},
+				"app/web5": {Status: "UP"},
+			})
+		})
+		g.It("Should only save the state on the first run", func() {
+			events, current := serverStateEvents(nil, samples)
+			g.Assert(len(events)).Equal(0)
+			g.Assert(len(current)).Equal(5)
+		})
+	})
+
+	g.Describe("readServerState()", func() {
+		g.It("Should read back the saved state", func() {
+			dir, err := ioutil.TempDir("", "haproxy")
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when creating a temp dir", err)
+			}
+			defer os.RemoveAll(dir)
+			stateConfig := Config{HaproxyStateFile: filepath.Join(dir, "haproxyserverstate")}
+
+			_, found := readServerState(logrus.New(), stateConfig)
+			g.Assert(found).Equal(false)
+			writeServerState(logrus.New(), stateConfig, previous)
+			states, found := readServerState(logrus.New(), stateConfig)
+			g.Assert(found).Equal(true)
+			g.Assert(states).Equal(previous)
+		})
+	})
 }
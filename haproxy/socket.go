@@ -0,0 +1,145 @@
+package haproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/GannettDigital/go-newrelic-plugin/helpers"
+	"github.com/Sirupsen/logrus"
+)
+
+// DEFAULT_SOCKET_TIMEOUT bounds each command sent to a stats socket
+const DEFAULT_SOCKET_TIMEOUT time.Duration = 5 * time.Second
+
+// infoText are the text fields of show info that are reported, the other
+// fields are reported when they are numeric
+var infoText = map[string]string{
+	"Version": "version",
+	"node":    "node",
+}
+
+// getSocketStats collects show info and show stat from every stats socket in
+// HAPROXYSOCKET. With nbproc each process has its own socket, so every socket
+// gets a process sample and the stats samples are tagged with the process
+// number. A socket that can't be read is logged and skipped, an error is only
+// returned when none of them could be.
+func getSocketStats(log *logrus.Logger, haproxyConf Config) ([]MetricData, error) {
+	samples := make([]MetricData, 0)
+	var lastErr error
+	read := 0
+	for _, socket := range strings.Split(haproxyConf.HaproxySocket, ",") {
+		socket = strings.TrimSpace(socket)
+		if socket == "" {
+			continue
+		}
+		socketSamples, err := getSocketSamples(log, socket)
+		if err != nil {
+			log.WithError(err).Warn(fmt.Sprintf("Failed to collect from HAProxy socket %s", socket))
+			lastErr = err
+			continue
+		}
+		read++
+		samples = append(samples, socketSamples...)
+	}
+	if read == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	return samples, nil
+}
+
+func getSocketSamples(log *logrus.Logger, socket string) ([]MetricData, error) {
+	info, err := socketCommand(socket, "show info", DEFAULT_SOCKET_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	process := parseInfo(log, info)
+	process["haproxy.process.socket"] = socket
+
+	stat, err := socketCommand(socket, "show stat", DEFAULT_SOCKET_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	records, err := readCSV([]byte(stat))
+	if err != nil {
+		return nil, err
+	}
+	stats, err := parseStats(log, records)
+	if err != nil {
+		return nil, err
+	}
+	if nbproc, ok := process["haproxy.process.nbproc"].(int64); ok && nbproc > 1 {
+		for _, sample := range stats {
+			sample["haproxy.process.num"] = process["haproxy.process.processNum"]
+		}
+	}
+	return append([]MetricData{process}, stats...), nil
+}
+
+// socketCommand sends a command to a stats socket and returns the response.
+// A socket given as a path is a unix socket, otherwise it is a TCP host:port.
+// HAProxy closes the connection once it has answered.
+func socketCommand(socket string, command string, timeout time.Duration) (string, error) {
+	network := "tcp"
+	if strings.HasPrefix(socket, "/") {
+		network = "unix"
+	}
+	conn, err := net.DialTimeout(network, socket, timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return "", err
+	}
+	if _, err := fmt.Fprintf(conn, "%s\n", command); err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return "", err
+	}
+	response := string(data)
+	if strings.HasPrefix(response, "Unknown command") || strings.HasPrefix(response, "Permission denied") {
+		return "", fmt.Errorf("HAProxy socket %s rejected %q: %s", socket, command, strings.TrimSpace(strings.SplitN(response, "\n", 2)[0]))
+	}
+	if strings.TrimSpace(response) == "" {
+		return "", fmt.Errorf("HAProxy socket %s returned nothing for %q", socket, command)
+	}
+	return response, nil
+}
+
+// parseInfo turns the "Name: value" lines of show info into the process
+// sample, e.g. Uptime_sec, ConnRate, SslRate, Maxconn, Idle_pct and, when
+// running with nbproc, Process_num and Nbproc
+func parseInfo(log *logrus.Logger, info string) MetricData {
+	sample := MetricData{
+		"event_type":   EVENT_TYPE,
+		"provider":     PROVIDER,
+		"haproxy.type": "process",
+	}
+	scanner := bufio.NewScanner(strings.NewReader(info))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		field := strings.TrimSpace(parts[0])
+		value := strings.TrimSpace(parts[1])
+		if name, ok := infoText[field]; ok {
+			sample["haproxy.process."+name] = value
+			continue
+		}
+		if !numericPattern.MatchString(value) {
+			continue
+		}
+		name := helpers.CamelCase(field)
+		if name != "" {
+			sample["haproxy.process."+strings.ToLower(name[:1])+name[1:]] = toInt64(log, value)
+		}
+	}
+	return sample
+}
@@ -0,0 +1,96 @@
+package haproxy
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/GannettDigital/go-newrelic-plugin/helpers"
+	"github.com/Sirupsen/logrus"
+)
+
+const STATE_CHANGE_EVENT_TYPE string = "HAProxyServerStateChange"
+
+// STATE_FILE_NAME is the server state file in the working directory when
+// HAPROXYSTATEFILE is not set
+const STATE_FILE_NAME string = "haproxyserverstate"
+
+// serverState is what is kept of a backend member between runs
+type serverState struct {
+	Status   string `json:"status"`
+	Downtime int64  `json:"downtime"`
+}
+
+// transitions are reported in the status as e.g. "UP 1/3" while the checks
+// are going down and maintenance as "MAINT (via app/web1)", both are the same
+// state as the plain status
+var statusDetailPattern = regexp.MustCompile(`\s+(\d+/\d+|\(via .*\))$`)
+
+// serverStateEvents compares the backend members' status with the previous
+// run and returns an event for every member that changed, along with the
+// state to save. Members that weren't seen before only have their state
+// saved.
+func serverStateEvents(previous map[string]serverState, samples []MetricData) ([]EventData, map[string]serverState) {
+	events := make([]EventData, 0)
+	current := make(map[string]serverState)
+	for _, sample := range samples {
+		if sample["haproxy.type"] != "backend-member" {
+			continue
+		}
+		status, _ := sample["haproxy.backend.status"].(string)
+		if status == "" {
+			continue
+		}
+		key := fmt.Sprintf("%v/%v", sample["haproxy.backend.name"], sample["haproxy.backend.member.name"])
+		if process, ok := sample["haproxy.process.num"]; ok {
+			key = fmt.Sprintf("%s/%v", key, process)
+		}
+		downtime, _ := sample["haproxy.backend.downtime"].(int64)
+		state := serverState{Status: statusDetailPattern.ReplaceAllString(status, ""), Downtime: downtime}
+		current[key] = state
+
+		before, found := previous[key]
+		if !found || before.Status == state.Status {
+			continue
+		}
+		event := EventData{
+			"event_type":                    STATE_CHANGE_EVENT_TYPE,
+			"provider":                      PROVIDER,
+			"category":                      "notifications",
+			"summary":                       fmt.Sprintf("HAProxy server %v changed from %v to %v", key, before.Status, state.Status),
+			"haproxy.backend.name":          sample["haproxy.backend.name"],
+			"haproxy.backend.member.name":   sample["haproxy.backend.member.name"],
+			"haproxy.server.previousStatus": before.Status,
+			"haproxy.server.status":         state.Status,
+			"haproxy.server.downtimeDelta":  state.Downtime - before.Downtime,
+		}
+		if description, ok := sample["haproxy.backend.check_description"]; ok {
+			event["haproxy.server.checkDescription"] = description
+		}
+		if process, ok := sample["haproxy.process.num"]; ok {
+			event["haproxy.process.num"] = process
+		}
+		events = append(events, event)
+	}
+	return events, current
+}
+
+// readServerState loads the backend members' state saved by the previous run.
+// The boolean is false when there is no usable previous state.
+func readServerState(log *logrus.Logger, haproxyConf Config) (map[string]serverState, bool) {
+	var states map[string]serverState
+	found, err := helpers.ReadState(haproxyConf.HaproxyStateFile, STATE_FILE_NAME, &states)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("error reading haproxy server state file")
+	}
+	return states, found
+}
+
+func writeServerState(log *logrus.Logger, haproxyConf Config, states map[string]serverState) {
+	if err := helpers.WriteState(haproxyConf.HaproxyStateFile, STATE_FILE_NAME, states); err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("error writing haproxy server state file")
+	}
+}
@@ -1,6 +1,9 @@
 package helpers
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/franela/goblin"
@@ -114,3 +117,46 @@ func TestAsValue(t *testing.T) {
 		})
 	}
 }
+
+func TestState(t *testing.T) {
+	g := goblin.Goblin(t)
+	dir, err := ioutil.TempDir("", "helpers")
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when creating a temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state")
+
+	g.Describe("ReadState()", func() {
+		g.It("Should report no state before the first write", func() {
+			var state map[string]int
+			found, err := ReadState(path, "unused", &state)
+			g.Assert(found).Equal(false)
+			g.Assert(err).Equal(nil)
+		})
+		g.It("Should read back the written state", func() {
+			g.Assert(WriteState(path, "unused", map[string]int{"a": 1})).Equal(nil)
+			var state map[string]int
+			found, err := ReadState(path, "unused", &state)
+			g.Assert(found).Equal(true)
+			g.Assert(err).Equal(nil)
+			g.Assert(state).Equal(map[string]int{"a": 1})
+		})
+		g.It("Should return an error for a corrupt state file", func() {
+			g.Assert(ioutil.WriteFile(path, []byte("{"), 0644)).Equal(nil)
+			var state map[string]int
+			found, err := ReadState(path, "unused", &state)
+			g.Assert(found).Equal(false)
+			g.Assert(err != nil).Equal(true)
+		})
+	})
+
+	g.Describe("StatePath()", func() {
+		g.It("Should default to a file in the working directory", func() {
+			wd, _ := os.Getwd()
+			location, err := StatePath("", "collectorstate")
+			g.Assert(err).Equal(nil)
+			g.Assert(location).Equal(filepath.Join(wd, "collectorstate"))
+		})
+	})
+}
@@ -0,0 +1,164 @@
+package helpers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const DEFAULT_CUSTOM_QUERY_TIMEOUT int = 10
+
+// CustomQuery is a named query from CUSTOM_QUERIES. Every row it returns is
+// reported as its own sample, with the attribute columns kept as strings and
+// the metric columns reported as numbers.
+type CustomQuery struct {
+	Name       string   `yaml:"name"`
+	Query      string   `yaml:"query"`
+	EventType  string   `yaml:"event_type"`
+	Attributes []string `yaml:"attributes"`
+	Metrics    []string `yaml:"metrics"`
+	Timeout    int      `yaml:"timeout"`
+}
+
+// ParseCustomQueries reads the CUSTOM_QUERIES YAML list and fills in the
+// defaults for anything left out
+func ParseCustomQueries(value string, defaultEventType string) ([]CustomQuery, error) {
+	var queries []CustomQuery
+	if err := yaml.Unmarshal([]byte(value), &queries); err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool)
+	for i := range queries {
+		query := &queries[i]
+		if query.Name == "" {
+			return nil, fmt.Errorf("custom query %d is missing a name", i+1)
+		}
+		if names[query.Name] {
+			return nil, fmt.Errorf("custom query %s is defined more than once", query.Name)
+		}
+		names[query.Name] = true
+		if query.Query == "" {
+			return nil, fmt.Errorf("custom query %s is missing a query", query.Name)
+		}
+		if len(query.Metrics) == 0 {
+			return nil, fmt.Errorf("custom query %s has no metric columns", query.Name)
+		}
+		if query.EventType == "" {
+			query.EventType = defaultEventType
+		}
+		if query.Timeout <= 0 {
+			query.Timeout = DEFAULT_CUSTOM_QUERY_TIMEOUT
+		}
+	}
+	return queries, nil
+}
+
+// CustomQuerySamples runs every custom query. A failing query is logged and
+// skipped so the other queries are still reported.
+func CustomQuerySamples(log *logrus.Logger, db *sql.DB, queries []CustomQuery, provider string) []map[string]interface{} {
+	samples := make([]map[string]interface{}, 0)
+	for _, query := range queries {
+		querySamples, err := runCustomQuery(log, db, query, provider)
+		if err != nil {
+			log.WithError(err).Warn(fmt.Sprintf("Failed to run custom query %s", query.Name))
+			continue
+		}
+		samples = append(samples, querySamples...)
+	}
+	return samples
+}
+
+func runCustomQuery(log *logrus.Logger, db *sql.DB, query CustomQuery, provider string) ([]map[string]interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(query.Timeout)*time.Second)
+	defer cancel()
+
+	rows, err := QueryRowsContext(ctx, db, query.Query)
+	if err != nil {
+		return nil, err
+	}
+
+	samples := make([]map[string]interface{}, 0, len(rows))
+	for _, row := range rows {
+		sample := map[string]interface{}{
+			"event_type": query.EventType,
+			"provider":   provider,
+			"query":      query.Name,
+		}
+		for _, column := range query.Attributes {
+			if value, ok := row[column]; ok {
+				sample[column] = value
+			}
+		}
+		for _, column := range query.Metrics {
+			value, ok := row[column]
+			if !ok {
+				continue
+			}
+			number, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				log.Warn(fmt.Sprintf("Custom query %s returned a non numeric value for %s: %s", query.Name, column, value))
+				continue
+			}
+			sample[column] = number
+		}
+		samples = append(samples, sample)
+	}
+	return samples, nil
+}
+
+// QueryRows runs a query and returns every row keyed by column name. NULL
+// columns are left out of the row.
+func QueryRows(db *sql.DB, query string) ([]map[string]string, error) {
+	return QueryRowsContext(context.Background(), db, query)
+}
+
+func QueryRowsContext(ctx context.Context, db *sql.DB, query string) ([]map[string]string, error) {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]map[string]string, 0)
+	for rows.Next() {
+		rawResult := make([]sql.RawBytes, len(cols))
+		dest := make([]interface{}, len(cols))
+		for i := range rawResult {
+			dest[i] = &rawResult[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		row := make(map[string]string, len(cols))
+		for i, raw := range rawResult {
+			if raw != nil {
+				row[cols[i]] = string(raw)
+			}
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+// FixPrefix turns the first underscore of a metric name starting with one of
+// the space separated prefixes into a dot, e.g. innodb_data_read becomes
+// innodb.data_read
+func FixPrefix(src string, prefixes string) string {
+	for _, prefix := range strings.Split(prefixes, " ") {
+		if strings.HasPrefix(src, prefix) {
+			return strings.Replace(src, "_", ".", 1)
+		}
+	}
+	return src
+}
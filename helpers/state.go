@@ -0,0 +1,55 @@
+package helpers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// StatePath returns the configured state file, or defaultName in the working
+// directory when none is configured. Collectors keep what they need to compare
+// with the previous run in such a file.
+func StatePath(path string, defaultName string) (string, error) {
+	if path != "" {
+		return path, nil
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(wd, defaultName), nil
+}
+
+// ReadState decodes the JSON state file into v. It returns false when there is
+// no usable previous state, with an error unless the file doesn't exist yet.
+func ReadState(path string, defaultName string, v interface{}) (bool, error) {
+	location, err := StatePath(path, defaultName)
+	if err != nil {
+		return false, err
+	}
+	raw, err := ioutil.ReadFile(location)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// WriteState saves v as JSON to the state file
+func WriteState(path string, defaultName string, v interface{}) error {
+	location, err := StatePath(path, defaultName)
+	if err != nil {
+		return err
+	}
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(location, raw, 0644)
+}
@@ -0,0 +1,210 @@
+package jenkins
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/GannettDigital/go-newrelic-plugin/helpers"
+	"github.com/Sirupsen/logrus"
+	"github.com/bndr/gojenkins"
+)
+
+// BuildEventType - the event reported for every completed build
+const BuildEventType string = "CIBuildEvent"
+
+// buildTree asks a job for its recent builds along with the actions telling
+// their causes, revision, time in queue and test results
+const buildTree string = "builds[number,building,result,timestamp,duration,builtOn," +
+	"actions[causes[shortDescription],lastBuiltRevision[SHA1],queuingDurationMillis,totalCount,failCount,skipCount]]"
+
+// masterNode - the name Jenkins gives the node builds run on when builtOn is empty
+const masterNode string = "master"
+
+// buildHistory is a job's recent builds, the latest first
+type buildHistory struct {
+	Builds []buildRecord `json:"builds"`
+}
+
+// buildRecord is a build as the tree query returns it
+type buildRecord struct {
+	Number    int           `json:"number"`
+	Building  bool          `json:"building"`
+	Result    string        `json:"result"`
+	Timestamp int64         `json:"timestamp"`
+	Duration  int           `json:"duration"`
+	BuiltOn   string        `json:"builtOn"`
+	Actions   []buildAction `json:"actions"`
+}
+
+// buildAction holds the fields of the actions we read, each is set by a
+// different action: the causes by CauseAction, the revision by the git
+// plugin's BuildData, the time in queue by the metrics plugin's
+// TimeInQueueAction and the counts by the test result action
+type buildAction struct {
+	Causes []struct {
+		ShortDescription string `json:"shortDescription"`
+	} `json:"causes"`
+	LastBuiltRevision *struct {
+		SHA1 string `json:"SHA1"`
+	} `json:"lastBuiltRevision"`
+	QueuingDurationMillis *int `json:"queuingDurationMillis"`
+	TotalCount            *int `json:"totalCount"`
+	FailCount             *int `json:"failCount"`
+	SkipCount             *int `json:"skipCount"`
+}
+
+// jobBuilds is what the state file remembers of a job: the last build
+// reported and the earlier ones that were still running at the time
+type jobBuilds struct {
+	Last    int   `json:"last"`
+	Running []int `json:"running,omitempty"`
+}
+
+// getBuildEvents reports the builds of every job completed since the last
+// reported one. Without a previous state only the state is saved, to not
+// report the whole history on the first run. A job whose builds can't be
+// fetched keeps its previous state.
+func getBuildEvents(log *logrus.Logger, jenkins *gojenkins.Jenkins, jobs []*gojenkins.Job, previous map[string]jobBuilds, found bool) ([]EventData, map[string]jobBuilds) {
+	events := make([]EventData, 0)
+	current := make(map[string]jobBuilds)
+
+	for _, job := range jobs {
+		name := getFullJobName(*job)
+		builds, buildsErr := getBuildHistory(jenkins, job)
+		if buildsErr != nil {
+			log.WithFields(logrus.Fields{
+				"job":   name,
+				"error": buildsErr,
+			}).Warn("Error getting build history")
+			if state, ok := previous[name]; ok {
+				current[name] = state
+			}
+			continue
+		}
+		var jobEvents []EventData
+		jobEvents, current[name] = buildEvents(name, builds, previous[name], found)
+		events = append(events, jobEvents...)
+	}
+
+	return events, current
+}
+
+// gets a job's recent builds in a single request
+func getBuildHistory(jenkins *gojenkins.Jenkins, job *gojenkins.Job) ([]buildRecord, error) {
+	var history buildHistory
+	_, err := jenkins.Requester.GetJSON(job.Base, &history, map[string]string{"tree": buildTree})
+	if err != nil {
+		return nil, err
+	}
+	return history.Builds, nil
+}
+
+// buildEvents returns an event for every build completed after the last
+// reported one, in order, along with the job's new state. A build still
+// running is remembered and reported once it completes, so it neither holds
+// back the builds after it nor is skipped when they complete first.
+func buildEvents(jobName string, builds []buildRecord, previous jobBuilds, report bool) ([]EventData, jobBuilds) {
+	events := make([]EventData, 0)
+	sorted := make([]buildRecord, len(builds))
+	copy(sorted, builds)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Number < sorted[j].Number })
+
+	// a job deleted and created again starts over from build 1
+	if len(sorted) > 0 && sorted[len(sorted)-1].Number < previous.Last {
+		previous = jobBuilds{}
+	}
+	running := make(map[int]bool)
+	for _, number := range previous.Running {
+		running[number] = true
+	}
+
+	current := jobBuilds{Last: previous.Last}
+	for _, build := range sorted {
+		if build.Number <= previous.Last && !running[build.Number] {
+			continue
+		}
+		if build.Building {
+			current.Running = append(current.Running, build.Number)
+			continue
+		}
+		if report {
+			events = append(events, buildEvent(jobName, build))
+		}
+		if build.Number > current.Last {
+			current.Last = build.Number
+		}
+	}
+	return events, current
+}
+
+// buildEvent describes a completed build, the time in queue and the test
+// counts are only set when Jenkins reports them
+func buildEvent(jobName string, build buildRecord) EventData {
+	result := strings.ToLower(build.Result)
+	node := build.BuiltOn
+	if node == "" {
+		node = masterNode
+	}
+	event := EventData{
+		"entity_name":                       jobName,
+		"event_type":                        BuildEventType,
+		"provider":                          ProviderName,
+		"category":                          "notifications",
+		"summary":                           fmt.Sprintf("Jenkins build %v #%v finished with %v", jobName, build.Number, result),
+		"jenkins.build.number":              build.Number,
+		"jenkins.build.result":              result,
+		"jenkins.build.date":                time.Unix(0, build.Timestamp*int64(time.Millisecond)),
+		"jenkins.build.durationMillisecond": build.Duration,
+		"jenkins.build.node":                node,
+	}
+
+	var causes []string
+	for _, action := range build.Actions {
+		for _, cause := range action.Causes {
+			causes = append(causes, cause.ShortDescription)
+		}
+		if action.LastBuiltRevision != nil && event["jenkins.build.revision"] == nil {
+			event["jenkins.build.revision"] = action.LastBuiltRevision.SHA1
+		}
+		if action.QueuingDurationMillis != nil {
+			event["jenkins.build.queueMillisecond"] = *action.QueuingDurationMillis
+		}
+		if action.TotalCount != nil {
+			event["jenkins.build.tests"] = *action.TotalCount
+		}
+		if action.FailCount != nil {
+			event["jenkins.build.testsFailed"] = *action.FailCount
+		}
+		if action.SkipCount != nil {
+			event["jenkins.build.testsSkipped"] = *action.SkipCount
+		}
+	}
+	if len(causes) > 0 {
+		event["jenkins.build.cause"] = strings.Join(causes, ", ")
+	}
+	return event
+}
+
+// STATE_FILE_NAME is the build state file in the working directory when
+// JENKINS_STATE_FILE is not set
+const STATE_FILE_NAME string = "jenkinsbuilds"
+
+// readBuildState loads the builds of every job already reported. The boolean
+// is false when there is no usable previous state.
+func readBuildState(log *logrus.Logger, config Config) (map[string]jobBuilds, bool) {
+	var states map[string]jobBuilds
+	found, err := helpers.ReadState(config.JenkinsStateFile, STATE_FILE_NAME, &states)
+	if err != nil {
+		log.WithError(err).Error("Error reading jenkins build state file")
+		return nil, false
+	}
+	return states, found
+}
+
+func writeBuildState(log *logrus.Logger, config Config, states map[string]jobBuilds) {
+	if err := helpers.WriteState(config.JenkinsStateFile, STATE_FILE_NAME, states); err != nil {
+		log.WithError(err).Error("Error writing jenkins build state file")
+	}
+}
@@ -25,6 +25,8 @@ type Config struct {
 	JenkinsAPIUser string
 	JenkinsAPIKey  string
 	JenkinsHost    string
+
+	JenkinsStateFile string
 }
 
 // InventoryData is the data type for inventory data produced by a plugin data
@@ -97,6 +99,8 @@ func Run(log *logrus.Logger, prettyPrint bool, version string) {
 		JenkinsHost:    os.Getenv("JENKINS_HOST"),
 		JenkinsAPIUser: os.Getenv("JENKINS_API_USER"),
 		JenkinsAPIKey:  os.Getenv("JENKINS_API_KEY"),
+
+		JenkinsStateFile: os.Getenv("JENKINS_STATE_FILE"),
 	}
 	validErr := validateConfig(config)
 	if validErr != nil {
@@ -110,13 +114,24 @@ func Run(log *logrus.Logger, prettyPrint bool, version string) {
 		return
 	}
 
-	metrics, metricsErr := getMetrics(log, jenkins)
+	jobs, jobsErr := getAllJobs(log, jenkins)
+	if jobsErr != nil {
+		log.WithError(jobsErr).Error("Error collecting metrics")
+		return
+	}
+
+	metrics, metricsErr := getMetrics(log, jenkins, jobs)
 	if metricsErr != nil {
 		log.WithError(metricsErr).Error("Error collecting metrics")
 		return
 	}
 	data.Metrics = append(data.Metrics, metrics...)
 
+	previous, found := readBuildState(log, config)
+	events, current := getBuildEvents(log, jenkins, jobs, previous, found)
+	writeBuildState(log, config, current)
+	data.Events = append(data.Events, events...)
+
 	outputErr := helpers.OutputJSON(data, prettyPrint)
 	if outputErr != nil {
 		log.WithError(outputErr).Error("Error formatting output JSON")
@@ -137,14 +152,10 @@ func validateConfig(config Config) error {
 	return nil
 }
 
-func getMetrics(log *logrus.Logger, jenkins *gojenkins.Jenkins) ([]MetricData, error) {
+func getMetrics(log *logrus.Logger, jenkins *gojenkins.Jenkins, jobs []*gojenkins.Job) ([]MetricData, error) {
 	var records []MetricData
 
-	jobData, jobDataErr := getAllJobStats(log, jenkins)
-	if jobDataErr != nil {
-		return nil, jobDataErr
-	}
-	for _, job := range jobData {
+	for _, job := range getAllJobStats(jobs) {
 		records = append(records, MetricData{
 			"entity_name":                          job.EntityName,
 			"event_type":                           "CIJobSample",
@@ -192,13 +203,22 @@ func getJenkins(config Config) *gojenkins.Jenkins {
 }
 
 // gets job information
-func getAllJobStats(log *logrus.Logger, jenkins *gojenkins.Jenkins) ([]JobMetric, error) {
+func getAllJobStats(jobs []*gojenkins.Job) []JobMetric {
 	var jobRecords []JobMetric
 
+	for _, job := range jobs {
+		jobRecords = append(jobRecords, getJobStats(*job))
+	}
+
+	return jobRecords
+}
+
+// gets all jobs along with their child jobs
+func getAllJobs(log *logrus.Logger, jenkins *gojenkins.Jenkins) ([]*gojenkins.Job, error) {
 	jobs, jobsErr := jenkins.GetAllJobs()
 	if jobsErr != nil {
 		log.WithError(jobsErr).Error("Error getting job statistics")
-		return jobRecords, jobsErr
+		return nil, jobsErr
 	}
 
 	for _, job := range jobs {
@@ -208,11 +228,7 @@ func getAllJobStats(log *logrus.Logger, jenkins *gojenkins.Jenkins) ([]JobMetric
 		}
 	}
 
-	for _, job := range jobs {
-		jobRecords = append(jobRecords, getJobStats(*job))
-	}
-
-	return jobRecords, nil
+	return jobs, nil
 }
 
 // recursively finds all child jobs for a job
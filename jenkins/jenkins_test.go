@@ -2,7 +2,10 @@ package jenkins
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
 	"reflect"
 	"regexp"
 	"strings"
@@ -71,7 +74,11 @@ func TestGetMetrics(t *testing.T) {
 	g := goblin.Goblin(t)
 	fakeJenkins := fakeJenkins()
 	g.Describe("jenkins getMetrics()", func() {
-		res, err := getMetrics(fakeLog, fakeJenkins)
+		jobs, err := getAllJobs(fakeLog, fakeJenkins)
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when getting the jobs", err)
+		}
+		res, err := getMetrics(fakeLog, fakeJenkins, jobs)
 		g.It("should return metric data", func() {
 			g.Assert(err).Equal(nil)
 			g.Assert(len(res) > 0).Equal(true)
@@ -185,7 +192,8 @@ func TestGetAllJobStats(t *testing.T) {
 				BuildArtifacts:  1,
 			},
 		}
-		res, err := getAllJobStats(fakeLog, fakeJenkins)
+		jobs, err := getAllJobs(fakeLog, fakeJenkins)
+		res := getAllJobStats(jobs)
 		g.It("should return statistics about many jobs", func() {
 			g.Assert(err).Equal(nil)
 			g.Assert(len(res)).Equal(len(expected))
@@ -280,6 +288,131 @@ func TestFindChildJobs(t *testing.T) {
 	})
 }
 
+func TestBuildEvents(t *testing.T) {
+	g := goblin.Goblin(t)
+	queued := 1500
+	total, failed, skipped := 12, 1, 2
+	builds := []buildRecord{
+		{Number: 7, Result: "SUCCESS", Timestamp: 1483229400000, Duration: 20},
+		{Number: 6, Building: true, Timestamp: 1483229200000},
+		{
+			Number:    5,
+			Result:    "FAILURE",
+			Timestamp: 1483229000000,
+			Duration:  30,
+			BuiltOn:   "test-1",
+			Actions: []buildAction{
+				{Causes: []struct {
+					ShortDescription string `json:"shortDescription"`
+				}{{ShortDescription: "Started by an SCM change"}}},
+				{LastBuiltRevision: &struct {
+					SHA1 string `json:"SHA1"`
+				}{SHA1: "abcdef2"}},
+				{QueuingDurationMillis: &queued},
+				{TotalCount: &total, FailCount: &failed, SkipCount: &skipped},
+				{},
+			},
+		},
+		{Number: 4, Result: "SUCCESS", Timestamp: 1483228800000, Duration: 10},
+	}
+
+	g.Describe("jenkins buildEvents()", func() {
+		g.It("should report the completed builds and remember the running ones", func() {
+			events, current := buildEvents("foo", builds, jobBuilds{Last: 4}, true)
+			g.Assert(reflect.DeepEqual(current, jobBuilds{Last: 7, Running: []int{6}})).Equal(true)
+			g.Assert(len(events)).Equal(2)
+			g.Assert(reflect.DeepEqual(events[0], EventData{
+				"entity_name":                       "foo",
+				"event_type":                        BuildEventType,
+				"provider":                          "jenkins",
+				"category":                          "notifications",
+				"summary":                           "Jenkins build foo #5 finished with failure",
+				"jenkins.build.number":              5,
+				"jenkins.build.result":              "failure",
+				"jenkins.build.date":                time.Unix(1483229000, 0),
+				"jenkins.build.durationMillisecond": 30,
+				"jenkins.build.node":                "test-1",
+				"jenkins.build.cause":               "Started by an SCM change",
+				"jenkins.build.revision":            "abcdef2",
+				"jenkins.build.queueMillisecond":    1500,
+				"jenkins.build.tests":               12,
+				"jenkins.build.testsFailed":         1,
+				"jenkins.build.testsSkipped":        2,
+			})).Equal(true)
+			g.Assert(events[1]["jenkins.build.number"]).Equal(7)
+		})
+		g.It("should report a running build once it completes", func() {
+			completed := append([]buildRecord{{Number: 6, Result: "ABORTED", Timestamp: 1483229200000, Duration: 40}}, builds[0], builds[2], builds[3])
+			events, current := buildEvents("foo", completed, jobBuilds{Last: 7, Running: []int{6}}, true)
+			g.Assert(len(events)).Equal(1)
+			g.Assert(events[0]["jenkins.build.number"]).Equal(6)
+			g.Assert(events[0]["jenkins.build.result"]).Equal("aborted")
+			g.Assert(reflect.DeepEqual(current, jobBuilds{Last: 7})).Equal(true)
+		})
+		g.It("should report nothing new when already up to date", func() {
+			events, current := buildEvents("foo", builds, jobBuilds{Last: 7, Running: []int{6}}, true)
+			g.Assert(len(events)).Equal(0)
+			g.Assert(reflect.DeepEqual(current, jobBuilds{Last: 7, Running: []int{6}})).Equal(true)
+		})
+		g.It("should only save the state when not reporting", func() {
+			events, current := buildEvents("foo", builds, jobBuilds{}, false)
+			g.Assert(len(events)).Equal(0)
+			g.Assert(reflect.DeepEqual(current, jobBuilds{Last: 7, Running: []int{6}})).Equal(true)
+		})
+		g.It("should start over when the job was created again", func() {
+			events, current := buildEvents("foo", builds[3:], jobBuilds{Last: 9}, true)
+			g.Assert(len(events)).Equal(1)
+			g.Assert(events[0]["jenkins.build.number"]).Equal(4)
+			g.Assert(events[0]["jenkins.build.node"]).Equal("master")
+			g.Assert(reflect.DeepEqual(current, jobBuilds{Last: 4})).Equal(true)
+		})
+	})
+}
+
+func TestGetBuildEvents(t *testing.T) {
+	g := goblin.Goblin(t)
+	fakeJenkins := fakeJenkins()
+	jobs, err := getAllJobs(fakeLog, fakeJenkins)
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when getting the jobs", err)
+	}
+	expected := map[string]jobBuilds{"foo": {Last: 1}, "bar": {Last: 1}, "baz": {}, "baz/qux": {Last: 1}}
+	g.Describe("jenkins getBuildEvents()", func() {
+		g.It("should report the builds completed since the previous run", func() {
+			events, current := getBuildEvents(fakeLog, fakeJenkins, jobs, map[string]jobBuilds{"foo": {Last: 1}, "bar": {}}, true)
+			g.Assert(len(events)).Equal(2)
+			g.Assert(events[0]["entity_name"]).Equal("bar")
+			g.Assert(events[0]["jenkins.build.revision"]).Equal("abcdef1")
+			g.Assert(events[0]["jenkins.build.cause"]).Equal("Started by user test-user")
+			g.Assert(events[1]["entity_name"]).Equal("baz/qux")
+			g.Assert(reflect.DeepEqual(current, expected)).Equal(true)
+		})
+		g.It("should only save the state on the first run", func() {
+			events, current := getBuildEvents(fakeLog, fakeJenkins, jobs, nil, false)
+			g.Assert(len(events)).Equal(0)
+			g.Assert(reflect.DeepEqual(current, expected)).Equal(true)
+		})
+	})
+
+	g.Describe("jenkins readBuildState()", func() {
+		g.It("should read back the saved state", func() {
+			dir, err := ioutil.TempDir("", "jenkins")
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when creating a temp dir", err)
+			}
+			defer os.RemoveAll(dir)
+			stateConfig := Config{JenkinsStateFile: filepath.Join(dir, "jenkinsbuilds")}
+
+			_, found := readBuildState(fakeLog, stateConfig)
+			g.Assert(found).Equal(false)
+			writeBuildState(fakeLog, stateConfig, map[string]jobBuilds{"foo": {Last: 7, Running: []int{6}}})
+			states, found := readBuildState(fakeLog, stateConfig)
+			g.Assert(found).Equal(true)
+			g.Assert(reflect.DeepEqual(states, map[string]jobBuilds{"foo": {Last: 7, Running: []int{6}}})).Equal(true)
+		})
+	})
+}
+
 func fakeJenkins() *gojenkins.Jenkins {
 	jenkins := gojenkins.CreateJenkins(
 		fakeConfig.JenkinsHost,
@@ -312,7 +445,7 @@ func registerResponders(transport *httpmock.MockTransport) {
 		{"GET", "/", 200, `{"jobs":[{"name":"foo"},{"name":"bar"},{"name":"baz"}]}`},
 
 		{"GET", "/job/foo", 200, `{"name":"foo","builds":[{"number":1}],"lastBuild":{"number":1},"healthReport":[{"score":100},{"score":80}],"previousBuild":{"number":1}}`},
-		{"GET", "/job/bar", 200, `{"name":"bar","builds":[{"number":1}],"lastBuild":{"number":1},"healthReport":[{"score":100},{"score":80}],"previousBuild":{"number":1}}`},
+		{"GET", "/job/bar", 200, `{"name":"bar","builds":[{"number":1,"result":"SUCCESS","timestamp":1483228800000,"duration":5,"actions":[{"causes":[{"shortDescription":"Started by user test-user"}]},{"lastBuiltRevision":{"SHA1":"abcdef1"}}]}],"lastBuild":{"number":1},"healthReport":[{"score":100},{"score":80}],"previousBuild":{"number":1}}`},
 		{"GET", "/job/baz", 200, `{"name":"baz","jobs":[{"name":"qux"}]}`},
 		{"GET", "/job/baz/job/qux", 200, `{"name":"qux","builds":[{"number":1}],"lastBuild":{"number":1},"healthReport":[{"score":100},{"score":80}],"previousBuild":{"number":1}}`},
 
@@ -0,0 +1,139 @@
+package kafka
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Sirupsen/logrus"
+	"github.com/xdg/scram"
+)
+
+// DEFAULT_CLIENT_ID identifies the collector to the brokers when
+// KAFKA_CLIENT_ID is not set
+const DEFAULT_CLIENT_ID string = "go-newrelic-plugin"
+
+// DEFAULT_TIMEOUT bounds dialing, reading from and writing to a broker, in
+// seconds, when KAFKA_TIMEOUT is not set
+const DEFAULT_TIMEOUT int = 10
+
+// InitKafkaClient - function to create a kafka client
+func InitKafkaClient(log *logrus.Logger, config Config) sarama.Client {
+	saramaConf, err := saramaConfig(config)
+	fatalIfErr(log, err)
+	client, err := sarama.NewClient(splitList(config.KafkaBrokers), saramaConf)
+	fatalIfErr(log, err)
+	return client
+}
+
+// saramaConfig turns the collector config into the client settings
+func saramaConfig(config Config) (*sarama.Config, error) {
+	saramaConf := sarama.NewConfig()
+	saramaConf.ClientID = DEFAULT_CLIENT_ID
+	if config.KafkaClientID != "" {
+		saramaConf.ClientID = config.KafkaClientID
+	}
+	if config.KafkaVersion != "" {
+		version, err := sarama.ParseKafkaVersion(config.KafkaVersion)
+		if err != nil {
+			return nil, err
+		}
+		saramaConf.Version = version
+	}
+
+	timeout := time.Duration(DEFAULT_TIMEOUT) * time.Second
+	if seconds, err := strconv.Atoi(config.KafkaTimeout); err == nil && seconds > 0 {
+		timeout = time.Duration(seconds) * time.Second
+	}
+	saramaConf.Net.DialTimeout = timeout
+	saramaConf.Net.ReadTimeout = timeout
+	saramaConf.Net.WriteTimeout = timeout
+	// a collection runs every interval, retrying would only delay it
+	saramaConf.Metadata.Retry.Max = 1
+
+	if mechanism := strings.ToUpper(config.KafkaSASLMechanism); mechanism != "" {
+		saramaConf.Net.SASL.Enable = true
+		saramaConf.Net.SASL.Mechanism = sarama.SASLMechanism(mechanism)
+		saramaConf.Net.SASL.User = config.KafkaSASLUser
+		saramaConf.Net.SASL.Password = config.KafkaSASLPassword
+		switch mechanism {
+		case sarama.SASLTypeSCRAMSHA256:
+			saramaConf.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+				return &scramClient{HashGeneratorFcn: scram.HashGeneratorFcn(sha256.New)}
+			}
+		case sarama.SASLTypeSCRAMSHA512:
+			saramaConf.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+				return &scramClient{HashGeneratorFcn: scram.HashGeneratorFcn(sha512.New)}
+			}
+		}
+	}
+
+	if config.KafkaTLS {
+		tlsConf, err := tlsConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		saramaConf.Net.TLS.Enable = true
+		saramaConf.Net.TLS.Config = tlsConf
+	}
+	return saramaConf, saramaConf.Validate()
+}
+
+// tlsConfig builds the client TLS configuration from the CA and client
+// certificate files
+func tlsConfig(config Config) (*tls.Config, error) {
+	tlsConf := &tls.Config{
+		InsecureSkipVerify: config.KafkaTLSInsecure,
+		ServerName:         config.KafkaTLSServerName,
+	}
+	if config.KafkaTLSCAFile != "" {
+		caPem, err := ioutil.ReadFile(config.KafkaTLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA file: %v", err)
+		}
+		tlsConf.RootCAs = x509.NewCertPool()
+		if !tlsConf.RootCAs.AppendCertsFromPEM(caPem) {
+			return nil, fmt.Errorf("no certificates found in CA file %v", config.KafkaTLSCAFile)
+		}
+	}
+	if config.KafkaTLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.KafkaTLSCertFile, config.KafkaTLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %v", err)
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConf, nil
+}
+
+// scramClient runs the SCRAM conversation of the SASL handshake for sarama
+type scramClient struct {
+	*scram.Client
+	*scram.ClientConversation
+	scram.HashGeneratorFcn
+}
+
+func (c *scramClient) Begin(userName, password, authzID string) error {
+	client, err := c.HashGeneratorFcn.NewClient(userName, password, authzID)
+	if err != nil {
+		return err
+	}
+	c.Client = client
+	c.ClientConversation = client.NewConversation()
+	return nil
+}
+
+func (c *scramClient) Step(challenge string) (string, error) {
+	return c.ClientConversation.Step(challenge)
+}
+
+func (c *scramClient) Done() bool {
+	return c.ClientConversation.Done()
+}
@@ -0,0 +1,267 @@
+package kafka
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/GannettDigital/go-newrelic-plugin/helpers"
+	"github.com/Shopify/sarama"
+	"github.com/Sirupsen/logrus"
+)
+
+const NAME string = "kafka"
+const PROVIDER string = "kafka"
+const PROTOCOL_VERSION string = "1"
+const EVENT_TYPE string = "QueueSample"
+
+// Config is the keeper of the config
+type Config struct {
+	KafkaBrokers        string
+	KafkaVersion        string
+	KafkaClientID       string
+	KafkaTimeout        string
+	KafkaTopics         string
+	KafkaConsumerGroups string
+
+	KafkaSASLMechanism string
+	KafkaSASLUser      string
+	KafkaSASLPassword  string
+
+	KafkaTLS           bool
+	KafkaTLSCAFile     string
+	KafkaTLSCertFile   string
+	KafkaTLSKeyFile    string
+	KafkaTLSInsecure   bool
+	KafkaTLSServerName string
+}
+
+type inventoryData map[string]interface{}
+type metricData map[string]interface{}
+type eventData map[string]interface{}
+
+type pluginData struct {
+	Name            string                   `json:"name"`
+	ProtocolVersion string                   `json:"protocol_version"`
+	PluginVersion   string                   `json:"plugin_version"`
+	Metrics         []metricData             `json:"metrics"`
+	Inventory       map[string]inventoryData `json:"inventory"`
+	Events          []eventData              `json:"events"`
+	Status          string                   `json:"status"`
+}
+
+// brokerStats counts the partitions a broker leads and holds a replica of
+type brokerStats struct {
+	leaders  int
+	replicas int
+}
+
+// topicStats is what the metadata tells of a topic
+type topicStats struct {
+	partitions        int
+	replicationFactor int
+	underReplicated   int
+	offline           int
+	internal          bool
+}
+
+func Run(log *logrus.Logger, client sarama.Client, config Config, prettyPrint bool, version string) {
+	// Initialize the output structure
+	var data = pluginData{
+		Name:            NAME,
+		ProtocolVersion: PROTOCOL_VERSION,
+		PluginVersion:   version,
+		Inventory:       make(map[string]inventoryData),
+		Metrics:         make([]metricData, 0),
+		Events:          make([]eventData, 0),
+	}
+	defer client.Close()
+
+	metadata, err := getMetadata(client)
+	fatalIfErr(log, err)
+	data.Metrics = append(data.Metrics, clusterMetrics(metadata, splitList(config.KafkaTopics))...)
+
+	lagMetrics, err := consumerLagMetrics(log, client, config, metadata)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err,
+		}).Warn("Failed to collect kafka consumer lag")
+	}
+	data.Metrics = append(data.Metrics, lagMetrics...)
+
+	fatalIfErr(log, helpers.OutputJSON(data, prettyPrint))
+}
+
+// getMetadata asks the controller for the brokers and every topic
+func getMetadata(client sarama.Client) (*sarama.MetadataResponse, error) {
+	controller, err := client.Controller()
+	if err != nil {
+		return nil, err
+	}
+	// version 1 returns the controller, the racks and, without topics, all
+	// of them
+	return controller.GetMetadata(&sarama.MetadataRequest{Version: 1})
+}
+
+// clusterMetrics reports the partition counts of the cluster, the partitions
+// every broker leads and the replication state of every topic. A partition is
+// under replicated when some of its replicas are out of the ISR and offline
+// when it has no leader. Only the topics listed are reported, all of them
+// when none are.
+func clusterMetrics(metadata *sarama.MetadataResponse, topics []string) []metricData {
+	brokers := make(map[int32]*brokerStats)
+	for _, broker := range metadata.Brokers {
+		brokers[broker.ID()] = &brokerStats{}
+	}
+	topicNames := make([]string, 0, len(metadata.Topics))
+	topicsStats := make(map[string]topicStats)
+	var partitions, underReplicated, offline, nonPreferredLeaders int
+	for _, topic := range metadata.Topics {
+		if topic.Err != sarama.ErrNoError || !included(topic.Name, topics) {
+			continue
+		}
+		stats := topicStats{
+			partitions: len(topic.Partitions),
+			internal:   topic.IsInternal,
+		}
+		for _, partition := range topic.Partitions {
+			if len(partition.Replicas) > stats.replicationFactor {
+				stats.replicationFactor = len(partition.Replicas)
+			}
+			if len(partition.Isr) < len(partition.Replicas) {
+				stats.underReplicated++
+			}
+			if partition.Leader < 0 {
+				stats.offline++
+			} else if len(partition.Replicas) > 0 && partition.Replicas[0] != partition.Leader {
+				nonPreferredLeaders++
+			}
+			if broker, ok := brokers[partition.Leader]; ok {
+				broker.leaders++
+			}
+			for _, replica := range partition.Replicas {
+				if broker, ok := brokers[replica]; ok {
+					broker.replicas++
+				}
+			}
+		}
+		partitions += stats.partitions
+		underReplicated += stats.underReplicated
+		offline += stats.offline
+		topicNames = append(topicNames, topic.Name)
+		topicsStats[topic.Name] = stats
+	}
+	sort.Strings(topicNames)
+
+	returnMetrics := []metricData{
+		{
+			"event_type":                                EVENT_TYPE,
+			"provider":                                  PROVIDER,
+			"kafka.cluster.controller":                  metadata.ControllerID,
+			"kafka.cluster.brokers":                     len(metadata.Brokers),
+			"kafka.cluster.topics":                      len(topicNames),
+			"kafka.cluster.partitions":                  partitions,
+			"kafka.cluster.under_replicated_partitions": underReplicated,
+			"kafka.cluster.offline_partitions":          offline,
+			"kafka.cluster.non_preferred_leaders":       nonPreferredLeaders,
+		},
+	}
+
+	sortedBrokers := make([]*sarama.Broker, len(metadata.Brokers))
+	copy(sortedBrokers, metadata.Brokers)
+	sort.Slice(sortedBrokers, func(i, j int) bool { return sortedBrokers[i].ID() < sortedBrokers[j].ID() })
+	for _, broker := range sortedBrokers {
+		stats := brokers[broker.ID()]
+		sample := metricData{
+			"event_type":                      EVENT_TYPE,
+			"provider":                        PROVIDER,
+			"kafka.broker.id":                 broker.ID(),
+			"kafka.broker.address":            broker.Addr(),
+			"kafka.broker.controller":         broker.ID() == metadata.ControllerID,
+			"kafka.broker.leader_partitions":  stats.leaders,
+			"kafka.broker.replica_partitions": stats.replicas,
+		}
+		if partitions > 0 {
+			sample["kafka.broker.leader_share"] = float64(stats.leaders) / float64(partitions) * 100
+		}
+		if rack := broker.Rack(); rack != "" {
+			sample["kafka.broker.rack"] = rack
+		}
+		returnMetrics = append(returnMetrics, sample)
+	}
+
+	for _, name := range topicNames {
+		stats := topicsStats[name]
+		returnMetrics = append(returnMetrics, metricData{
+			"event_type":                              EVENT_TYPE,
+			"provider":                                PROVIDER,
+			"kafka.topic.name":                        name,
+			"kafka.topic.internal":                    stats.internal,
+			"kafka.topic.partitions":                  stats.partitions,
+			"kafka.topic.replication_factor":          stats.replicationFactor,
+			"kafka.topic.under_replicated_partitions": stats.underReplicated,
+			"kafka.topic.offline_partitions":          stats.offline,
+		})
+	}
+	return returnMetrics
+}
+
+// splitList reads a comma separated setting
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// included tells whether name is in the list, an empty list includes all
+func included(name string, list []string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, item := range list {
+		if item == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateConfig validates the config
+func ValidateConfig(config Config) error {
+	if len(splitList(config.KafkaBrokers)) == 0 {
+		return errors.New("kafka brokers must be set")
+	}
+	if config.KafkaVersion != "" {
+		version, err := sarama.ParseKafkaVersion(config.KafkaVersion)
+		if err != nil {
+			return fmt.Errorf("kafka version %v is invalid: %v", config.KafkaVersion, err)
+		}
+		if !version.IsAtLeast(sarama.V0_10_0_0) {
+			return fmt.Errorf("kafka version %v is not supported, the collector needs 0.10.0 or later", config.KafkaVersion)
+		}
+	}
+	switch strings.ToUpper(config.KafkaSASLMechanism) {
+	case "":
+	case sarama.SASLTypePlaintext, sarama.SASLTypeSCRAMSHA256, sarama.SASLTypeSCRAMSHA512:
+		if config.KafkaSASLUser == "" || config.KafkaSASLPassword == "" {
+			return errors.New("kafka SASL user and password must be set")
+		}
+	default:
+		return fmt.Errorf("kafka SASL mechanism %v is not supported", config.KafkaSASLMechanism)
+	}
+	if (config.KafkaTLSCertFile == "") != (config.KafkaTLSKeyFile == "") {
+		return errors.New("kafka TLS certificate and key files must be set together")
+	}
+	return nil
+}
+
+func fatalIfErr(log *logrus.Logger, err error) {
+	if err != nil {
+		log.WithError(err).Fatal("can't continue")
+	}
+}
@@ -0,0 +1,341 @@
+package kafka
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Sirupsen/logrus"
+	"github.com/franela/goblin"
+)
+
+var fakeLog = logrus.New()
+
+func TestValidateConfig(t *testing.T) {
+	g := goblin.Goblin(t)
+	g.Describe("kafka ValidateConfig()", func() {
+		expected := map[string]struct {
+			ExpectedIsNil bool
+			KafkaConfig   Config
+		}{
+			"brokers":                         {true, Config{KafkaBrokers: "kafka1:9092,kafka2:9092"}},
+			"no":                              {false, Config{}},
+			"blank brokers":                   {false, Config{KafkaBrokers: " , "}},
+			"brokers, version":                {true, Config{KafkaBrokers: "kafka1:9092", KafkaVersion: "2.1.0"}},
+			"brokers, bad version":            {false, Config{KafkaBrokers: "kafka1:9092", KafkaVersion: "two"}},
+			"brokers, old version":            {false, Config{KafkaBrokers: "kafka1:9092", KafkaVersion: "0.9.0.1"}},
+			"brokers, SCRAM user, password":   {true, Config{KafkaBrokers: "kafka1:9092", KafkaSASLMechanism: "scram-sha-512", KafkaSASLUser: "User", KafkaSASLPassword: "Pass"}},
+			"brokers, PLAIN user":             {false, Config{KafkaBrokers: "kafka1:9092", KafkaSASLMechanism: "PLAIN", KafkaSASLUser: "User"}},
+			"brokers, GSSAPI user, password":  {false, Config{KafkaBrokers: "kafka1:9092", KafkaSASLMechanism: "GSSAPI", KafkaSASLUser: "User", KafkaSASLPassword: "Pass"}},
+			"brokers, TLS certificate no key": {false, Config{KafkaBrokers: "kafka1:9092", KafkaTLS: true, KafkaTLSCertFile: "client.pem"}},
+		}
+		for name, ex := range expected {
+			desc := fmt.Sprintf("should return %v when %v fields are set", ex.ExpectedIsNil, name)
+			g.It(desc, func() {
+				valid := ValidateConfig(ex.KafkaConfig)
+				g.Assert(valid == nil).Equal(ex.ExpectedIsNil)
+			})
+		}
+	})
+}
+
+func TestSaramaConfig(t *testing.T) {
+	g := goblin.Goblin(t)
+	g.Describe("kafka saramaConfig()", func() {
+		g.It("should apply the defaults", func() {
+			saramaConf, err := saramaConfig(Config{KafkaBrokers: "kafka1:9092"})
+			g.Assert(err).Equal(nil)
+			g.Assert(saramaConf.ClientID).Equal(DEFAULT_CLIENT_ID)
+			g.Assert(saramaConf.Net.ReadTimeout).Equal(time.Duration(DEFAULT_TIMEOUT) * time.Second)
+			g.Assert(saramaConf.Net.SASL.Enable).IsFalse()
+			g.Assert(saramaConf.Net.TLS.Enable).IsFalse()
+		})
+		g.It("should apply the version, timeout and SCRAM settings", func() {
+			saramaConf, err := saramaConfig(Config{
+				KafkaBrokers:       "kafka1:9092",
+				KafkaVersion:       "2.1.0",
+				KafkaClientID:      "monitor",
+				KafkaTimeout:       "3",
+				KafkaSASLMechanism: "scram-sha-256",
+				KafkaSASLUser:      "User",
+				KafkaSASLPassword:  "Pass",
+				KafkaTLS:           true,
+				KafkaTLSInsecure:   true,
+			})
+			g.Assert(err).Equal(nil)
+			g.Assert(saramaConf.Version).Equal(sarama.V2_1_0_0)
+			g.Assert(saramaConf.ClientID).Equal("monitor")
+			g.Assert(saramaConf.Net.DialTimeout).Equal(3 * time.Second)
+			g.Assert(saramaConf.Net.SASL.Enable).IsTrue()
+			g.Assert(string(saramaConf.Net.SASL.Mechanism)).Equal(sarama.SASLTypeSCRAMSHA256)
+			g.Assert(saramaConf.Net.SASL.SCRAMClientGeneratorFunc != nil).IsTrue()
+			g.Assert(saramaConf.Net.TLS.Enable).IsTrue()
+			g.Assert(saramaConf.Net.TLS.Config.InsecureSkipVerify).IsTrue()
+		})
+		g.It("should fail on a missing CA file", func() {
+			_, err := saramaConfig(Config{KafkaBrokers: "kafka1:9092", KafkaTLS: true, KafkaTLSCAFile: "/does/not/exist.pem"})
+			g.Assert(err != nil).IsTrue()
+		})
+	})
+}
+
+func TestScramClient(t *testing.T) {
+	g := goblin.Goblin(t)
+	g.Describe("kafka scramClient", func() {
+		g.It("should start the SCRAM conversation with the client first message", func() {
+			saramaConf, err := saramaConfig(Config{KafkaBrokers: "kafka1:9092", KafkaSASLMechanism: "SCRAM-SHA-512", KafkaSASLUser: "User", KafkaSASLPassword: "Pass"})
+			g.Assert(err).Equal(nil)
+			client := saramaConf.Net.SASL.SCRAMClientGeneratorFunc()
+			g.Assert(client.Begin("User", "Pass", "")).Equal(nil)
+			first, err := client.Step("")
+			g.Assert(err).Equal(nil)
+			g.Assert(first[:9]).Equal("n,,n=User")
+			g.Assert(client.Done()).IsFalse()
+		})
+	})
+}
+
+func fakeMetadata(brokers map[string]int32) *sarama.MetadataResponse {
+	metadata := &sarama.MetadataResponse{Version: 1, ControllerID: 1}
+	for addr, id := range brokers {
+		metadata.AddBroker(addr, id)
+	}
+	metadata.AddTopicPartition("orders", 0, 1, []int32{1, 2}, []int32{1, 2}, nil, sarama.ErrNoError)
+	metadata.AddTopicPartition("orders", 1, 1, []int32{2, 1}, []int32{1}, nil, sarama.ErrNoError)
+	metadata.AddTopicPartition("payments", 0, -1, []int32{1, 2}, []int32{}, nil, sarama.ErrLeaderNotAvailable)
+	metadata.AddTopicPartition("payments", 1, 2, []int32{2, 1}, []int32{2, 1}, nil, sarama.ErrNoError)
+	return metadata
+}
+
+func TestClusterMetrics(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	var tests = []struct {
+		InputTopics     []string
+		ExpectedResult  []metricData
+		TestDescription string
+	}{
+		{
+			ExpectedResult: []metricData{
+				{
+					"event_type":                                EVENT_TYPE,
+					"provider":                                  PROVIDER,
+					"kafka.cluster.controller":                  int32(1),
+					"kafka.cluster.brokers":                     2,
+					"kafka.cluster.topics":                      2,
+					"kafka.cluster.partitions":                  4,
+					"kafka.cluster.under_replicated_partitions": 2,
+					"kafka.cluster.offline_partitions":          1,
+					"kafka.cluster.non_preferred_leaders":       1,
+				},
+				{
+					"event_type":                      EVENT_TYPE,
+					"provider":                        PROVIDER,
+					"kafka.broker.id":                 int32(1),
+					"kafka.broker.address":            "kafka1:9092",
+					"kafka.broker.controller":         true,
+					"kafka.broker.leader_partitions":  2,
+					"kafka.broker.replica_partitions": 4,
+					"kafka.broker.leader_share":       float64(50),
+				},
+				{
+					"event_type":                      EVENT_TYPE,
+					"provider":                        PROVIDER,
+					"kafka.broker.id":                 int32(2),
+					"kafka.broker.address":            "kafka2:9092",
+					"kafka.broker.controller":         false,
+					"kafka.broker.leader_partitions":  1,
+					"kafka.broker.replica_partitions": 4,
+					"kafka.broker.leader_share":       float64(25),
+				},
+				{
+					"event_type":                              EVENT_TYPE,
+					"provider":                                PROVIDER,
+					"kafka.topic.name":                        "orders",
+					"kafka.topic.internal":                    false,
+					"kafka.topic.partitions":                  2,
+					"kafka.topic.replication_factor":          2,
+					"kafka.topic.under_replicated_partitions": 1,
+					"kafka.topic.offline_partitions":          0,
+				},
+				{
+					"event_type":                              EVENT_TYPE,
+					"provider":                                PROVIDER,
+					"kafka.topic.name":                        "payments",
+					"kafka.topic.internal":                    false,
+					"kafka.topic.partitions":                  2,
+					"kafka.topic.replication_factor":          2,
+					"kafka.topic.under_replicated_partitions": 1,
+					"kafka.topic.offline_partitions":          1,
+				},
+			},
+			TestDescription: "Should report the cluster, every broker and every topic",
+		},
+		{
+			InputTopics: []string{"orders"},
+			ExpectedResult: []metricData{
+				{
+					"event_type":                                EVENT_TYPE,
+					"provider":                                  PROVIDER,
+					"kafka.cluster.controller":                  int32(1),
+					"kafka.cluster.brokers":                     2,
+					"kafka.cluster.topics":                      1,
+					"kafka.cluster.partitions":                  2,
+					"kafka.cluster.under_replicated_partitions": 1,
+					"kafka.cluster.offline_partitions":          0,
+					"kafka.cluster.non_preferred_leaders":       1,
+				},
+				{
+					"event_type":                      EVENT_TYPE,
+					"provider":                        PROVIDER,
+					"kafka.broker.id":                 int32(1),
+					"kafka.broker.address":            "kafka1:9092",
+					"kafka.broker.controller":         true,
+					"kafka.broker.leader_partitions":  2,
+					"kafka.broker.replica_partitions": 2,
+					"kafka.broker.leader_share":       float64(100),
+				},
+				{
+					"event_type":                      EVENT_TYPE,
+					"provider":                        PROVIDER,
+					"kafka.broker.id":                 int32(2),
+					"kafka.broker.address":            "kafka2:9092",
+					"kafka.broker.controller":         false,
+					"kafka.broker.leader_partitions":  0,
+					"kafka.broker.replica_partitions": 2,
+					"kafka.broker.leader_share":       float64(0),
+				},
+				{
+					"event_type":                              EVENT_TYPE,
+					"provider":                                PROVIDER,
+					"kafka.topic.name":                        "orders",
+					"kafka.topic.internal":                    false,
+					"kafka.topic.partitions":                  2,
+					"kafka.topic.replication_factor":          2,
+					"kafka.topic.under_replicated_partitions": 1,
+					"kafka.topic.offline_partitions":          0,
+				},
+			},
+			TestDescription: "Should only report the topics listed",
+		},
+	}
+
+	for _, test := range tests {
+		g.Describe("clusterMetrics()", func() {
+			g.It(test.TestDescription, func() {
+				metadata := fakeMetadata(map[string]int32{"kafka1:9092": 1, "kafka2:9092": 2})
+				g.Assert(clusterMetrics(metadata, test.InputTopics)).Equal(test.ExpectedResult)
+			})
+		})
+	}
+}
+
+// fakeCluster starts two in process brokers answering the requests of a
+// collection
+func fakeCluster(t *testing.T) (*sarama.MockBroker, *sarama.MockBroker) {
+	seed := sarama.NewMockBroker(t, 1)
+	other := sarama.NewMockBroker(t, 2)
+	metadata := fakeMetadata(map[string]int32{seed.Addr(): 1, other.Addr(): 2})
+	handlers := map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockWrapper(metadata),
+		"ListGroupsRequest": sarama.NewMockListGroupsResponse(t).
+			AddGroup("billing", CONSUMER_PROTOCOL_TYPE).
+			AddGroup("shipping", CONSUMER_PROTOCOL_TYPE).
+			AddGroup("connect-sink", "connect"),
+		"FindCoordinatorRequest": sarama.NewMockFindCoordinatorResponse(t).
+			SetCoordinator(sarama.CoordinatorGroup, "billing", seed).
+			SetCoordinator(sarama.CoordinatorGroup, "shipping", other),
+		"OffsetFetchRequest": sarama.NewMockOffsetFetchResponse(t).
+			SetOffset("billing", "orders", 0, 90, "", sarama.ErrNoError).
+			SetOffset("billing", "orders", 1, 260, "", sarama.ErrNoError).
+			SetOffset("billing", "payments", 1, 5, "", sarama.ErrNoError).
+			SetOffset("shipping", "orders", 0, 100, "", sarama.ErrNoError).
+			SetOffset("shipping", "orders", 1, -1, "", sarama.ErrNoError),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset("orders", 0, sarama.OffsetNewest, 100).
+			SetOffset("orders", 1, sarama.OffsetNewest, 250).
+			SetOffset("payments", 1, sarama.OffsetNewest, 40),
+	}
+	seed.SetHandlerByMap(handlers)
+	other.SetHandlerByMap(handlers)
+	return seed, other
+}
+
+func fakeClient(t *testing.T, seed *sarama.MockBroker) sarama.Client {
+	saramaConf := sarama.NewConfig()
+	saramaConf.Version = sarama.V0_10_0_0
+	saramaConf.Metadata.Retry.Max = 0
+	client, err := sarama.NewClient([]string{seed.Addr()}, saramaConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestConsumerLagMetrics(t *testing.T) {
+	g := goblin.Goblin(t)
+	seed, other := fakeCluster(t)
+	defer seed.Close()
+	defer other.Close()
+
+	var tests = []struct {
+		InputConfig     Config
+		ExpectedResult  []metricData
+		TestDescription string
+	}{
+		{
+			ExpectedResult: []metricData{
+				{"event_type": EVENT_TYPE, "provider": PROVIDER, "kafka.consumer.group": "billing", "kafka.consumer.topic": "orders", "kafka.consumer.partition": int32(0), "kafka.consumer.committed_offset": int64(90), "kafka.consumer.latest_offset": int64(100), "kafka.consumer.lag": int64(10)},
+				{"event_type": EVENT_TYPE, "provider": PROVIDER, "kafka.consumer.group": "billing", "kafka.consumer.topic": "orders", "kafka.consumer.partition": int32(1), "kafka.consumer.committed_offset": int64(260), "kafka.consumer.latest_offset": int64(250), "kafka.consumer.lag": int64(0)},
+				{"event_type": EVENT_TYPE, "provider": PROVIDER, "kafka.consumer.group": "billing", "kafka.consumer.topic": "payments", "kafka.consumer.partition": int32(1), "kafka.consumer.committed_offset": int64(5), "kafka.consumer.latest_offset": int64(40), "kafka.consumer.lag": int64(35)},
+				{"event_type": EVENT_TYPE, "provider": PROVIDER, "kafka.consumer.group": "billing", "kafka.consumer.topic": "orders", "kafka.consumer.partitions": 2, "kafka.consumer.total_lag": int64(10), "kafka.consumer.max_lag": int64(10)},
+				{"event_type": EVENT_TYPE, "provider": PROVIDER, "kafka.consumer.group": "billing", "kafka.consumer.topic": "payments", "kafka.consumer.partitions": 1, "kafka.consumer.total_lag": int64(35), "kafka.consumer.max_lag": int64(35)},
+				{"event_type": EVENT_TYPE, "provider": PROVIDER, "kafka.consumer.group": "shipping", "kafka.consumer.topic": "orders", "kafka.consumer.partition": int32(0), "kafka.consumer.committed_offset": int64(100), "kafka.consumer.latest_offset": int64(100), "kafka.consumer.lag": int64(0)},
+				{"event_type": EVENT_TYPE, "provider": PROVIDER, "kafka.consumer.group": "shipping", "kafka.consumer.topic": "orders", "kafka.consumer.partitions": 1, "kafka.consumer.total_lag": int64(0), "kafka.consumer.max_lag": int64(0)},
+			},
+			TestDescription: "Should report the lag of every consumer group on every partition it committed",
+		},
+		{
+			InputConfig: Config{KafkaTopics: "payments", KafkaConsumerGroups: "billing"},
+			ExpectedResult: []metricData{
+				{"event_type": EVENT_TYPE, "provider": PROVIDER, "kafka.consumer.group": "billing", "kafka.consumer.topic": "payments", "kafka.consumer.partition": int32(1), "kafka.consumer.committed_offset": int64(5), "kafka.consumer.latest_offset": int64(40), "kafka.consumer.lag": int64(35)},
+				{"event_type": EVENT_TYPE, "provider": PROVIDER, "kafka.consumer.group": "billing", "kafka.consumer.topic": "payments", "kafka.consumer.partitions": 1, "kafka.consumer.total_lag": int64(35), "kafka.consumer.max_lag": int64(35)},
+			},
+			TestDescription: "Should only report the topics and consumer groups listed",
+		},
+	}
+
+	for _, test := range tests {
+		g.Describe("consumerLagMetrics()", func() {
+			g.It(test.TestDescription, func() {
+				client := fakeClient(t, seed)
+				defer client.Close()
+				metadata, err := getMetadata(client)
+				g.Assert(err).Equal(nil)
+				result, err := consumerLagMetrics(fakeLog, client, test.InputConfig, metadata)
+				g.Assert(err).Equal(nil)
+				g.Assert(result).Equal(test.ExpectedResult)
+			})
+		})
+	}
+}
+
+func TestGetMetadata(t *testing.T) {
+	g := goblin.Goblin(t)
+	seed, other := fakeCluster(t)
+	defer seed.Close()
+	defer other.Close()
+
+	g.Describe("getMetadata()", func() {
+		g.It("Should ask the controller for every topic", func() {
+			client := fakeClient(t, seed)
+			defer client.Close()
+			metadata, err := getMetadata(client)
+			g.Assert(err).Equal(nil)
+			g.Assert(metadata.ControllerID).Equal(int32(1))
+			g.Assert(len(metadata.Brokers)).Equal(2)
+			g.Assert(len(metadata.Topics)).Equal(2)
+		})
+	})
+}
@@ -0,0 +1,244 @@
+package kafka
+
+import (
+	"sort"
+
+	"github.com/Shopify/sarama"
+	"github.com/Sirupsen/logrus"
+)
+
+// CONSUMER_PROTOCOL_TYPE is the protocol type of the groups of Kafka
+// consumers, those of e.g. Kafka Connect don't commit offsets
+const CONSUMER_PROTOCOL_TYPE string = "consumer"
+
+// topicPartition identifies a partition
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+// groupOffsets are the offsets a consumer group committed
+type groupOffsets struct {
+	group   string
+	offsets map[topicPartition]int64
+}
+
+// consumerLagMetrics reports the lag of every consumer group, the latest offset
+// minus the committed offset, on every partition it committed an offset for
+// along with its total and largest lag on every topic. The groups listed are
+// reported, all the consumer groups when none are. A group whose offsets
+// can't be fetched is skipped.
+func consumerLagMetrics(log *logrus.Logger, client sarama.Client, config Config, metadata *sarama.MetadataResponse) ([]metricData, error) {
+	groups := splitList(config.KafkaConsumerGroups)
+	if len(groups) == 0 {
+		var err error
+		groups, err = listConsumerGroups(log, client)
+		if err != nil {
+			return make([]metricData, 0), err
+		}
+	}
+
+	leaders := make(map[topicPartition]int32)
+	topics := splitList(config.KafkaTopics)
+	for _, topic := range metadata.Topics {
+		if topic.Err != sarama.ErrNoError || topic.IsInternal || !included(topic.Name, topics) {
+			continue
+		}
+		for _, partition := range topic.Partitions {
+			if partition.Leader >= 0 {
+				leaders[topicPartition{topic: topic.Name, partition: partition.ID}] = partition.Leader
+			}
+		}
+	}
+
+	committed := make([]groupOffsets, 0, len(groups))
+	consumed := make(map[topicPartition]int32)
+	for _, group := range groups {
+		offsets, err := getCommittedOffsets(client, group, leaders)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"group": group,
+				"error": err,
+			}).Warn("Failed to fetch kafka consumer group offsets")
+			continue
+		}
+		for partition := range offsets {
+			consumed[partition] = leaders[partition]
+		}
+		committed = append(committed, groupOffsets{group: group, offsets: offsets})
+	}
+
+	latest := getLatestOffsets(log, client, consumed)
+	return lagMetrics(committed, latest), nil
+}
+
+// listConsumerGroups asks every broker for the groups it coordinates
+func listConsumerGroups(log *logrus.Logger, client sarama.Client) ([]string, error) {
+	found := make(map[string]bool)
+	var lastErr error
+	for _, broker := range client.Brokers() {
+		// an already open broker returns ErrAlreadyConnected
+		_ = broker.Open(client.Config())
+		response, err := broker.ListGroups(&sarama.ListGroupsRequest{})
+		if err == nil && response.Err != sarama.ErrNoError {
+			err = response.Err
+		}
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"broker": broker.Addr(),
+				"error":  err,
+			}).Warn("Failed to list kafka consumer groups")
+			lastErr = err
+			continue
+		}
+		for group, protocolType := range response.Groups {
+			if protocolType == CONSUMER_PROTOCOL_TYPE {
+				found[group] = true
+			}
+		}
+	}
+	if len(found) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	groups := make([]string, 0, len(found))
+	for group := range found {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	return groups, nil
+}
+
+// getCommittedOffsets asks the group's coordinator for its offsets on the
+// partitions, those it never committed are left out
+func getCommittedOffsets(client sarama.Client, group string, partitions map[topicPartition]int32) (map[topicPartition]int64, error) {
+	coordinator, err := client.Coordinator(group)
+	if err != nil {
+		return nil, err
+	}
+	request := &sarama.OffsetFetchRequest{Version: 1, ConsumerGroup: group}
+	for partition := range partitions {
+		request.AddPartition(partition.topic, partition.partition)
+	}
+	response, err := coordinator.FetchOffset(request)
+	if err != nil {
+		return nil, err
+	}
+	offsets := make(map[topicPartition]int64)
+	for partition := range partitions {
+		block := response.GetBlock(partition.topic, partition.partition)
+		if block == nil || block.Err != sarama.ErrNoError || block.Offset < 0 {
+			continue
+		}
+		offsets[partition] = block.Offset
+	}
+	return offsets, nil
+}
+
+// getLatestOffsets asks the leader of every partition for its latest offset,
+// with a single request per leader
+func getLatestOffsets(log *logrus.Logger, client sarama.Client, partitions map[topicPartition]int32) map[topicPartition]int64 {
+	// brokers before 0.10.1 only answer version 0, which returns a list of
+	// offsets
+	var version int16
+	if client.Config().Version.IsAtLeast(sarama.V0_10_1_0) {
+		version = 1
+	}
+	requests := make(map[int32]*sarama.OffsetRequest)
+	for partition, leader := range partitions {
+		request, ok := requests[leader]
+		if !ok {
+			request = &sarama.OffsetRequest{Version: version}
+			requests[leader] = request
+		}
+		request.AddBlock(partition.topic, partition.partition, sarama.OffsetNewest, 1)
+	}
+
+	latest := make(map[topicPartition]int64)
+	for leader, request := range requests {
+		broker, err := client.Broker(leader)
+		var response *sarama.OffsetResponse
+		if err == nil {
+			response, err = broker.GetAvailableOffsets(request)
+		}
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"broker": leader,
+				"error":  err,
+			}).Warn("Failed to fetch kafka latest offsets")
+			continue
+		}
+		for partition, partitionLeader := range partitions {
+			if partitionLeader != leader {
+				continue
+			}
+			block := response.GetBlock(partition.topic, partition.partition)
+			if block == nil || block.Err != sarama.ErrNoError || len(block.Offsets) == 0 {
+				continue
+			}
+			latest[partition] = block.Offsets[0]
+		}
+	}
+	return latest
+}
+
+// lagMetrics returns a sample per group and partition followed by a sample per
+// group and topic, sorted by group, topic and partition
+func lagMetrics(committed []groupOffsets, latest map[topicPartition]int64) []metricData {
+	sort.Slice(committed, func(i, j int) bool { return committed[i].group < committed[j].group })
+	returnMetrics := make([]metricData, 0)
+	for _, group := range committed {
+		partitions := make([]topicPartition, 0, len(group.offsets))
+		for partition := range group.offsets {
+			if _, ok := latest[partition]; ok {
+				partitions = append(partitions, partition)
+			}
+		}
+		sort.Slice(partitions, func(i, j int) bool {
+			if partitions[i].topic != partitions[j].topic {
+				return partitions[i].topic < partitions[j].topic
+			}
+			return partitions[i].partition < partitions[j].partition
+		})
+
+		var topicSamples []metricData
+		var topicSample metricData
+		for _, partition := range partitions {
+			lag := latest[partition] - group.offsets[partition]
+			if lag < 0 {
+				// a commit past the end of the log, e.g. after an unclean
+				// leader election
+				lag = 0
+			}
+			returnMetrics = append(returnMetrics, metricData{
+				"event_type":                      EVENT_TYPE,
+				"provider":                        PROVIDER,
+				"kafka.consumer.group":            group.group,
+				"kafka.consumer.topic":            partition.topic,
+				"kafka.consumer.partition":        partition.partition,
+				"kafka.consumer.committed_offset": group.offsets[partition],
+				"kafka.consumer.latest_offset":    latest[partition],
+				"kafka.consumer.lag":              lag,
+			})
+
+			if topicSample == nil || topicSample["kafka.consumer.topic"] != partition.topic {
+				topicSample = metricData{
+					"event_type":                EVENT_TYPE,
+					"provider":                  PROVIDER,
+					"kafka.consumer.group":      group.group,
+					"kafka.consumer.topic":      partition.topic,
+					"kafka.consumer.partitions": 0,
+					"kafka.consumer.total_lag":  int64(0),
+					"kafka.consumer.max_lag":    int64(0),
+				}
+				topicSamples = append(topicSamples, topicSample)
+			}
+			topicSample["kafka.consumer.partitions"] = topicSample["kafka.consumer.partitions"].(int) + 1
+			topicSample["kafka.consumer.total_lag"] = topicSample["kafka.consumer.total_lag"].(int64) + lag
+			if lag > topicSample["kafka.consumer.max_lag"].(int64) {
+				topicSample["kafka.consumer.max_lag"] = lag
+			}
+		}
+		returnMetrics = append(returnMetrics, topicSamples...)
+	}
+	return returnMetrics
+}
@@ -2,11 +2,13 @@ package kraken
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"regexp"
 	"strconv"
+	"strings"
 
 	"github.com/GannettDigital/go-newrelic-plugin/helpers"
 	"github.com/GannettDigital/paas-api-utils/utilsHTTP"
@@ -28,6 +30,8 @@ const ProtocolVersion string = "1"
 type Config struct {
 	KrakenListenPort string
 	KrakenHost       string
+
+	KrakenStateFile string
 }
 
 // InventoryData is the data type for inventory data produced by a plugin data
@@ -71,12 +75,28 @@ func Run(log *logrus.Logger, prettyPrint bool, version string) {
 	var krakenConf = Config{
 		KrakenListenPort: os.Getenv("KRAKEN_PORT"),
 		KrakenHost:       os.Getenv("KRAKEN_HOST"),
+
+		KrakenStateFile: os.Getenv("KRAKEN_STATE_FILE"),
 	}
 	validateConfig(log, krakenConf)
 
-	var metric = scrapeStatus(log, getKrakenStatus(log, krakenConf))
-
+	status := getKrakenStatus(log, krakenConf)
+	metric, parsed, err := scrapeStatus(log, status)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"status": status,
+			"error":  err,
+		}).Fatal("Unable to parse the kraken status page")
+	}
 	data.Metrics = append(data.Metrics, metric)
+
+	// a complete test stays on the status page until the next one starts,
+	// its results are only reported once
+	events, reported := testResultEvents(readReportedTests(log, krakenConf), status, parsed)
+	if len(events) > 0 {
+		writeReportedTests(log, krakenConf, reported)
+	}
+	data.Events = append(data.Events, events...)
 	fatalIfErr(log, helpers.OutputJSON(data, prettyPrint))
 }
 
@@ -113,80 +133,190 @@ func getKrakenStatus(log *logrus.Logger, config Config) string {
 	return string(data)
 }
 
-func scrapeStatus(log *logrus.Logger, status string) map[string]interface{} {
-	krakenVersion := regexp.MustCompile(`Version: (\d+(\.\d+)?(\.\d+)?)`).FindStringSubmatch(status)[1]
-	krakenCustomer := regexp.MustCompile(`Customer: (\w+)`).FindStringSubmatch(status)[1]
-	krakenProject := regexp.MustCompile(`Project: (\w+)`).FindStringSubmatch(status)[1]
-	krakenState := regexp.MustCompile(`State: (\w+)`).FindStringSubmatch(status)[1]
-	sample_count := ""
-	sample_failure := ""
-	duration := ""
-	avg_resp_time := ""
-	avg_latency := ""
-	avg_conn_time := ""
-	percentiles_50 := ""
-	percentiles_90 := ""
-	percentiles_95 := ""
-	percentiles_99 := ""
-	percentiles_100 := ""
-
-	if krakenState == "Complete" {
-		re_samples := regexp.MustCompile(`Samples count: (\d+), (\d+(\.\d+)?). failures`)
-		multi := re_samples.FindString(status)
-		sample_count = re_samples.FindStringSubmatch(multi)[1]
-		sample_failure = re_samples.FindStringSubmatch(multi)[2]
-
-		duration = regexp.MustCompile(`Test duration: (.*)`).FindStringSubmatch(status)[1]
-
-		re_avgtimes := regexp.MustCompile(`Average times: total (\d+\.\d+), latency (\d+\.\d+), connect (\d+\.\d+)`)
-		multi = re_avgtimes.FindString(status)
-		avg_resp_time = re_avgtimes.FindStringSubmatch(multi)[1]
-		avg_latency = re_avgtimes.FindStringSubmatch(multi)[2]
-		avg_conn_time = re_avgtimes.FindStringSubmatch(multi)[3]
-
-		percentiles_50 = regexp.MustCompile(`Percentile\s+50.0%:\s+(\d+\.\d+)`).FindStringSubmatch(status)[1]
-		percentiles_90 = regexp.MustCompile(`Percentile\s+90.0%:\s+(\d+\.\d+)`).FindStringSubmatch(status)[1]
-		percentiles_95 = regexp.MustCompile(`Percentile\s+95.0%:\s+(\d+\.\d+)`).FindStringSubmatch(status)[1]
-		percentiles_99 = regexp.MustCompile(`Percentile\s+99.0%:\s+(\d+\.\d+)`).FindStringSubmatch(status)[1]
-		percentiles_100 = regexp.MustCompile(`Percentile\s+100.0%:\s+(\d+\.\d+)`).FindStringSubmatch(status)[1]
+// krakenStatus is what the status page tells of the current load test, the
+// results are only there once it is Complete
+type krakenStatus struct {
+	version         string
+	customer        string
+	project         string
+	state           string
+	duration        string
+	durationSeconds int
+	sampleCount     int
+	sampleFailure   float64
+	avgRespTime     float64
+	avgLatency      float64
+	avgConnTime     float64
+	percentiles     []percentile
+}
+
+// percentile is a line of the status page, e.g. "Percentile 99.9%: 0.281"
+type percentile struct {
+	rank  string
+	value float64
+}
+
+var (
+	versionPattern    = regexp.MustCompile(`Version: (\S+)`)
+	customerPattern   = regexp.MustCompile(`Customer: (.+)`)
+	projectPattern    = regexp.MustCompile(`Project: (.+)`)
+	statePattern      = regexp.MustCompile(`State: (\w+)`)
+	durationPattern   = regexp.MustCompile(`Test duration: (.+)`)
+	samplesPattern    = regexp.MustCompile(`Samples count: (\d+), (\d+(?:\.\d+)?)% failures`)
+	avgTimesPattern   = regexp.MustCompile(`Average times: total (\d+(?:\.\d+)?), latency (\d+(?:\.\d+)?), connect (\d+(?:\.\d+)?)`)
+	percentilePattern = regexp.MustCompile(`Percentile\s+(\d+(?:\.\d+)?)%:\s+(\d+(?:\.\d+)?)`)
+	startedPattern    = regexp.MustCompile(`Load Test Started: .*`)
+)
+
+// parseStatus reads the status page. The state is required and, once the test
+// is Complete, so are its sample count and average times. The other fields
+// are left empty when missing.
+func parseStatus(status string) (krakenStatus, error) {
+	var parsed krakenStatus
+	parsed.version = findField(versionPattern, status)
+	parsed.customer = findField(customerPattern, status)
+	parsed.project = findField(projectPattern, status)
+	parsed.state = findField(statePattern, status)
+	if parsed.state == "" {
+		return parsed, errors.New("kraken status has no state")
+	}
+	if parsed.state != "Complete" {
+		return parsed, nil
+	}
+
+	var err error
+	samples := samplesPattern.FindStringSubmatch(status)
+	if samples == nil {
+		return parsed, errors.New("kraken status of a complete test has no samples count")
+	}
+	if parsed.sampleCount, err = strconv.Atoi(samples[1]); err != nil {
+		return parsed, fmt.Errorf("kraken samples count %v is invalid: %v", samples[1], err)
+	}
+	if parsed.sampleFailure, err = strconv.ParseFloat(samples[2], 64); err != nil {
+		return parsed, fmt.Errorf("kraken failures %v is invalid: %v", samples[2], err)
+	}
+
+	avgTimes := avgTimesPattern.FindStringSubmatch(status)
+	if avgTimes == nil {
+		return parsed, errors.New("kraken status of a complete test has no average times")
+	}
+	for i, value := range []*float64{&parsed.avgRespTime, &parsed.avgLatency, &parsed.avgConnTime} {
+		if *value, err = strconv.ParseFloat(avgTimes[i+1], 64); err != nil {
+			return parsed, fmt.Errorf("kraken average time %v is invalid: %v", avgTimes[i+1], err)
+		}
+	}
+
+	parsed.duration = findField(durationPattern, status)
+	parsed.durationSeconds = durationSeconds(parsed.duration)
+	for _, match := range percentilePattern.FindAllStringSubmatch(status, -1) {
+		value, err := strconv.ParseFloat(match[2], 64)
+		if err != nil {
+			return parsed, fmt.Errorf("kraken percentile %v%% value %v is invalid: %v", match[1], match[2], err)
+		}
+		parsed.percentiles = append(parsed.percentiles, percentile{rank: match[1], value: value})
+	}
+	return parsed, nil
+}
+
+// findField returns the trimmed first group of the pattern, empty when the
+// status doesn't match it
+func findField(pattern *regexp.Regexp, status string) string {
+	match := pattern.FindStringSubmatch(status)
+	if match == nil {
+		return ""
+	}
+	return strings.TrimSpace(match[1])
+}
+
+// durationSeconds reads a duration as Python prints it, e.g. 0:00:25 or
+// 1 day, 2:03:04, 0 when it can't be read
+func durationSeconds(duration string) int {
+	if duration == "" {
+		return 0
+	}
+	days := 0
+	if parts := strings.SplitN(duration, " day", 2); len(parts) == 2 {
+		var err error
+		if days, err = strconv.Atoi(parts[0]); err != nil {
+			return 0
+		}
+		duration = strings.TrimLeft(strings.TrimPrefix(parts[1], "s"), ", ")
+	}
+	seconds := days * 24
+	clock := strings.Split(duration, ":")
+	if len(clock) != 3 {
+		return 0
+	}
+	for i, part := range clock {
+		value, err := strconv.Atoi(part)
+		if err != nil {
+			return 0
+		}
+		if i > 0 {
+			seconds *= 60
+		}
+		seconds += value
+	}
+	return seconds
+}
+
+// percentileKey turns a rank into the suffix of its attribute, 50.0 into 50
+// and 99.9 into 99.9
+func percentileKey(rank string) string {
+	value, err := strconv.ParseFloat(rank, 64)
+	if err != nil {
+		return rank
+	}
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// scrapeStatus returns the sample of the status page along with the parsed
+// status. The KPIs are only reported once the test is Complete.
+func scrapeStatus(log *logrus.Logger, status string) (map[string]interface{}, krakenStatus, error) {
+	parsed, err := parseStatus(status)
+	if err != nil {
+		return nil, parsed, err
 	}
 
 	log.WithFields(logrus.Fields{
-		"kraken_version":  krakenVersion,
-		"kraken_customer": krakenCustomer,
-		"kraken_project":  krakenProject,
-		"kraken_state":    krakenState,
-		"avg_resp_time":   avg_resp_time,
-		"avg_latency":     avg_latency,
-		"avg_conn_time":   avg_conn_time,
-		"percentiles_50":  percentiles_50,
-		"percentiles_90":  percentiles_90,
-		"percentiles_95":  percentiles_95,
-		"percentiles_99":  percentiles_99,
-		"percentiles_100": percentiles_100,
-		"sample_count":    sample_count,
-		"sample_failure":  sample_failure,
-		"duration":        duration,
+		"kraken_version":  parsed.version,
+		"kraken_customer": parsed.customer,
+		"kraken_project":  parsed.project,
+		"kraken_state":    parsed.state,
+		"avg_resp_time":   parsed.avgRespTime,
+		"avg_latency":     parsed.avgLatency,
+		"avg_conn_time":   parsed.avgConnTime,
+		"percentiles":     parsed.percentiles,
+		"sample_count":    parsed.sampleCount,
+		"sample_failure":  parsed.sampleFailure,
+		"duration":        parsed.duration,
 	}).Debugf("Scraped KRAKEN values")
-	return map[string]interface{}{
-		"event_type":                 "GKrakenSample",
-		"provider":                   PROVIDER,
-		"kraken.version":             krakenVersion,
-		"kraken.customer":            krakenCustomer,
-		"kraken.project":             krakenProject,
-		"kraken.state":               krakenState,
-		"kraken.kpi.avg_resp_time":   avg_resp_time,
-		"kraken.kpi.avg_latency":     avg_latency,
-		"kraken.kpi.avg_conn_time":   avg_conn_time,
-		"kraken.kpi.percentiles.50":  percentiles_50,
-		"kraken.kpi.percentiles.90":  percentiles_90,
-		"kraken.kpi.percentiles.95":  percentiles_95,
-		"kraken.kpi.percentiles.99":  percentiles_99,
-		"kraken.kpi.percentiles.100": percentiles_100,
-		"kraken.sample_count":        sample_count,
-		"kraken.sample_failure":      sample_failure,
-		"kraken.duration":            duration,
+	metric := map[string]interface{}{
+		"event_type":      "GKrakenSample",
+		"provider":        PROVIDER,
+		"kraken.version":  parsed.version,
+		"kraken.customer": parsed.customer,
+		"kraken.project":  parsed.project,
+		"kraken.state":    parsed.state,
+	}
+	if parsed.state != "Complete" {
+		return metric, parsed, nil
+	}
+
+	metric["kraken.kpi.avg_resp_time"] = parsed.avgRespTime
+	metric["kraken.kpi.avg_latency"] = parsed.avgLatency
+	metric["kraken.kpi.avg_conn_time"] = parsed.avgConnTime
+	for _, p := range parsed.percentiles {
+		switch key := percentileKey(p.rank); key {
+		case "50", "90", "95", "99", "100":
+			metric["kraken.kpi.percentiles."+key] = p.value
+		}
 	}
+	metric["kraken.sample_count"] = parsed.sampleCount
+	metric["kraken.sample_failure"] = parsed.sampleFailure
+	metric["kraken.duration"] = parsed.duration
+	metric["kraken.duration_seconds"] = parsed.durationSeconds
+	return metric, parsed, nil
 }
 
 func toInt(log *logrus.Logger, value string) int {
@@ -2,7 +2,11 @@ package kraken
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 
 	fake "github.com/GannettDigital/paas-api-utils/utilsHTTP/fake"
@@ -55,6 +59,8 @@ func TestGetKrakenStatus(t *testing.T) {
 	}
 }
 
+const completeStatus string = "Load Test Started: 25.0 seconds ago\n\nVersion: 2.2.0\nCustomer: None\nProject: None\nState: Complete\nTest duration: 0:00:25\nSamples count: 178, 100.00% failures\nAverage times: total 0.106, latency 0.106, connect 0.000\nPercentile 0.0%: 0.037\nPercentile 50.0%: 0.120\nPercentile 90.0%: 0.125\nPercentile 95.0%: 0.126\nPercentile 99.0%: 0.167\nPercentile 99.9%: 0.281\nPercentile 100.0%: 0.281 "
+
 func TestScrapeStatus(t *testing.T) {
 	g := goblin.Goblin(t)
 
@@ -65,42 +71,215 @@ func TestScrapeStatus(t *testing.T) {
 		"kraken.customer":            "None",
 		"kraken.project":             "None",
 		"kraken.state":               "Complete",
-		"kraken.kpi.avg_resp_time":   "0.106",
-		"kraken.kpi.avg_latency":     "0.106",
-		"kraken.kpi.avg_conn_time":   "0.000",
-		"kraken.kpi.percentiles.50":  "0.120",
-		"kraken.kpi.percentiles.90":  "0.125",
-		"kraken.kpi.percentiles.95":  "0.126",
-		"kraken.kpi.percentiles.99":  "0.167",
-		"kraken.kpi.percentiles.100": "0.281",
-		"kraken.sample_count":        "178",
-		"kraken.sample_failure":      "100.00",
+		"kraken.kpi.avg_resp_time":   0.106,
+		"kraken.kpi.avg_latency":     0.106,
+		"kraken.kpi.avg_conn_time":   0.0,
+		"kraken.kpi.percentiles.50":  0.120,
+		"kraken.kpi.percentiles.90":  0.125,
+		"kraken.kpi.percentiles.95":  0.126,
+		"kraken.kpi.percentiles.99":  0.167,
+		"kraken.kpi.percentiles.100": 0.281,
+		"kraken.sample_count":        178,
+		"kraken.sample_failure":      100.0,
 		"kraken.duration":            "0:00:25",
+		"kraken.duration_seconds":    25,
 	}
 
 	var tests = []struct {
 		Data            string
 		ExpectedResult  map[string]interface{}
+		ExpectedError   bool
 		TestDescription string
 	}{
 		{
-			Data:            "Load Test Started: 25.0 seconds ago\n\nVersion: 2.2.0\nCustomer: None\nProject: None\nState: Complete\nTest duration: 0:00:25\nSamples count: 178, 100.00% failures\nAverage times: total 0.106, latency 0.106, connect 0.000\nPercentile 0.0%: 0.037\nPercentile 50.0%: 0.120\nPercentile 90.0%: 0.125\nPercentile 95.0%: 0.126\nPercentile 99.0%: 0.167\nPercentile 99.9%: 0.281\nPercentile 100.0%: 0.281 ",
+			Data:            completeStatus,
 			ExpectedResult:  result,
 			TestDescription: "Successfully scrape given status page",
 		},
+		{
+			Data: "Load Test Started: 5.0 seconds ago\n\nVersion: 2.3\nCustomer: acme-corp\nProject: checkout api\nState: Running\n",
+			ExpectedResult: map[string]interface{}{
+				"event_type":      "GKrakenSample",
+				"provider":        "kraken",
+				"kraken.version":  "2.3",
+				"kraken.customer": "acme-corp",
+				"kraken.project":  "checkout api",
+				"kraken.state":    "Running",
+			},
+			TestDescription: "Should only report the state of a running test",
+		},
+		{
+			Data: "State: Complete\nSamples count: 10, 0% failures\nAverage times: total 1, latency 0.5, connect 0\n",
+			ExpectedResult: map[string]interface{}{
+				"event_type":               "GKrakenSample",
+				"provider":                 "kraken",
+				"kraken.version":           "",
+				"kraken.customer":          "",
+				"kraken.project":           "",
+				"kraken.state":             "Complete",
+				"kraken.kpi.avg_resp_time": 1.0,
+				"kraken.kpi.avg_latency":   0.5,
+				"kraken.kpi.avg_conn_time": 0.0,
+				"kraken.sample_count":      10,
+				"kraken.sample_failure":    0.0,
+				"kraken.duration":          "",
+				"kraken.duration_seconds":  0,
+			},
+			TestDescription: "Should leave out the missing optional fields",
+		},
+		{
+			Data:            "<html>Service Unavailable</html>",
+			ExpectedError:   true,
+			TestDescription: "Should return an error without a state",
+		},
+		{
+			Data:            "Version: 2.2.0\nState: Complete\nTest duration: 0:00:25\n",
+			ExpectedError:   true,
+			TestDescription: "Should return an error for a complete test without samples",
+		},
+		{
+			Data:            "State: Complete\nSamples count: 178, 100.00% failures\n",
+			ExpectedError:   true,
+			TestDescription: "Should return an error for a complete test without average times",
+		},
 	}
 
 	for _, test := range tests {
 		g.Describe("scrapeStatus()", func() {
 			g.It(test.TestDescription, func() {
-				result := scrapeStatus(logrus.New(), test.Data)
+				result, _, err := scrapeStatus(logrus.New(), test.Data)
 				fmt.Println(result)
-				g.Assert(reflect.DeepEqual(result, test.ExpectedResult)).Equal(true)
+				g.Assert(err != nil).Equal(test.ExpectedError)
+				if !test.ExpectedError {
+					g.Assert(reflect.DeepEqual(result, test.ExpectedResult)).Equal(true)
+				}
 			})
 		})
 	}
 }
 
+func TestDurationSeconds(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	var tests = []struct {
+		Duration        string
+		ExpectedResult  int
+		TestDescription string
+	}{
+		{
+			Duration:        "0:00:25",
+			ExpectedResult:  25,
+			TestDescription: "Should read hours, minutes and seconds",
+		},
+		{
+			Duration:        "1 day, 2:03:04",
+			ExpectedResult:  93784,
+			TestDescription: "Should read days",
+		},
+		{
+			Duration:        "",
+			ExpectedResult:  0,
+			TestDescription: "Should return 0 if empty string",
+		},
+		{
+			Duration:        "2 days, 0:00:01",
+			ExpectedResult:  172801,
+			TestDescription: "Should read several days",
+		},
+		{
+			Duration:        "25s",
+			ExpectedResult:  0,
+			TestDescription: "Should return 0 if it can't be read",
+		},
+	}
+
+	for _, test := range tests {
+		g.Describe("durationSeconds()", func() {
+			g.It(test.TestDescription, func() {
+				g.Assert(durationSeconds(test.Duration)).Equal(test.ExpectedResult)
+			})
+		})
+	}
+}
+
+func TestTestResultEvents(t *testing.T) {
+	g := goblin.Goblin(t)
+	parsed, err := parseStatus(completeStatus)
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when parsing the status", err)
+	}
+	id := testID(completeStatus)
+
+	g.Describe("testResultEvents()", func() {
+		g.It("Should report a complete test once", func() {
+			events, reported := testResultEvents([]string{"earlier"}, completeStatus, parsed)
+			g.Assert(len(events)).Equal(1)
+			g.Assert(events[0]).Equal(EventData{
+				"event_type":                  TEST_RESULT_EVENT_TYPE,
+				"provider":                    PROVIDER,
+				"category":                    "notifications",
+				"summary":                     "Kraken load test of None/None completed: 178 samples, 100% failures",
+				"kraken.test_id":              id,
+				"kraken.version":              "2.2.0",
+				"kraken.customer":             "None",
+				"kraken.project":              "None",
+				"kraken.duration":             "0:00:25",
+				"kraken.duration_seconds":     25,
+				"kraken.sample_count":         178,
+				"kraken.sample_failure":       100.0,
+				"kraken.kpi.avg_resp_time":    0.106,
+				"kraken.kpi.avg_latency":      0.106,
+				"kraken.kpi.avg_conn_time":    0.0,
+				"kraken.kpi.percentiles.0":    0.037,
+				"kraken.kpi.percentiles.50":   0.120,
+				"kraken.kpi.percentiles.90":   0.125,
+				"kraken.kpi.percentiles.95":   0.126,
+				"kraken.kpi.percentiles.99":   0.167,
+				"kraken.kpi.percentiles.99.9": 0.281,
+				"kraken.kpi.percentiles.100":  0.281,
+			})
+			g.Assert(reported).Equal([]string{"earlier", id})
+
+			// the next poll sees the same test a little later
+			later := strings.Replace(completeStatus, "25.0 seconds ago", "40.0 seconds ago", 1)
+			events, again := testResultEvents(reported, later, parsed)
+			g.Assert(len(events)).Equal(0)
+			g.Assert(again).Equal(reported)
+		})
+		g.It("Should not report a running test", func() {
+			running, _ := parseStatus("State: Running\n")
+			events, reported := testResultEvents(nil, "State: Running\n", running)
+			g.Assert(len(events)).Equal(0)
+			g.Assert(len(reported)).Equal(0)
+		})
+		g.It("Should only remember the latest tests", func() {
+			var previous []string
+			for i := 0; i < MAX_REPORTED_TESTS; i++ {
+				previous = append(previous, fmt.Sprintf("test%d", i))
+			}
+			_, reported := testResultEvents(previous, completeStatus, parsed)
+			g.Assert(len(reported)).Equal(MAX_REPORTED_TESTS)
+			g.Assert(reported[0]).Equal("test1")
+			g.Assert(reported[MAX_REPORTED_TESTS-1]).Equal(id)
+		})
+	})
+
+	g.Describe("readReportedTests()", func() {
+		g.It("Should read back the reported tests", func() {
+			dir, err := ioutil.TempDir("", "kraken")
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when creating a temp dir", err)
+			}
+			defer os.RemoveAll(dir)
+			stateConfig := Config{KrakenStateFile: filepath.Join(dir, "krakentests")}
+
+			g.Assert(len(readReportedTests(logrus.New(), stateConfig))).Equal(0)
+			writeReportedTests(logrus.New(), stateConfig, []string{"earlier", id})
+			g.Assert(readReportedTests(logrus.New(), stateConfig)).Equal([]string{"earlier", id})
+		})
+	})
+}
+
 func TestToInt(t *testing.T) {
 	g := goblin.Goblin(t)
 
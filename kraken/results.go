@@ -0,0 +1,95 @@
+package kraken
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/GannettDigital/go-newrelic-plugin/helpers"
+	"github.com/Sirupsen/logrus"
+)
+
+const TEST_RESULT_EVENT_TYPE string = "KrakenTestResult"
+
+// MAX_REPORTED_TESTS bounds the completed tests remembered in the state file,
+// the status page only ever shows the latest one
+const MAX_REPORTED_TESTS int = 50
+
+// testID identifies a load test. The status page has no ID of its own, so the
+// page is fingerprinted without the line telling how long ago the test
+// started, which is the only one that changes once the test is Complete.
+func testID(status string) string {
+	sum := sha1.Sum([]byte(startedPattern.ReplaceAllString(status, "")))
+	return hex.EncodeToString(sum[:])
+}
+
+// testResultEvent returns the one-off event reporting the results of a
+// complete test along with all its percentiles
+func testResultEvent(id string, parsed krakenStatus) EventData {
+	event := EventData{
+		"event_type":               TEST_RESULT_EVENT_TYPE,
+		"provider":                 PROVIDER,
+		"category":                 "notifications",
+		"summary":                  fmt.Sprintf("Kraken load test of %v/%v completed: %v samples, %v%% failures", parsed.customer, parsed.project, parsed.sampleCount, parsed.sampleFailure),
+		"kraken.test_id":           id,
+		"kraken.version":           parsed.version,
+		"kraken.customer":          parsed.customer,
+		"kraken.project":           parsed.project,
+		"kraken.duration":          parsed.duration,
+		"kraken.duration_seconds":  parsed.durationSeconds,
+		"kraken.sample_count":      parsed.sampleCount,
+		"kraken.sample_failure":    parsed.sampleFailure,
+		"kraken.kpi.avg_resp_time": parsed.avgRespTime,
+		"kraken.kpi.avg_latency":   parsed.avgLatency,
+		"kraken.kpi.avg_conn_time": parsed.avgConnTime,
+	}
+	for _, p := range parsed.percentiles {
+		event["kraken.kpi.percentiles."+percentileKey(p.rank)] = p.value
+	}
+	return event
+}
+
+// testResultEvents returns the event of the status' test when it is Complete
+// and wasn't reported before, along with the test IDs to save
+func testResultEvents(reported []string, status string, parsed krakenStatus) ([]EventData, []string) {
+	events := make([]EventData, 0)
+	if parsed.state != "Complete" {
+		return events, reported
+	}
+	id := testID(status)
+	for _, reportedID := range reported {
+		if reportedID == id {
+			return events, reported
+		}
+	}
+	events = append(events, testResultEvent(id, parsed))
+	reported = append(reported, id)
+	if len(reported) > MAX_REPORTED_TESTS {
+		reported = reported[len(reported)-MAX_REPORTED_TESTS:]
+	}
+	return events, reported
+}
+
+// STATE_FILE_NAME is the reported tests file in the working directory when
+// KRAKEN_STATE_FILE is not set
+const STATE_FILE_NAME string = "krakentests"
+
+// readReportedTests loads the IDs of the complete tests already reported
+func readReportedTests(log *logrus.Logger, krakenConf Config) []string {
+	var reported []string
+	if _, err := helpers.ReadState(krakenConf.KrakenStateFile, STATE_FILE_NAME, &reported); err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("error reading kraken state file")
+		return nil
+	}
+	return reported
+}
+
+func writeReportedTests(log *logrus.Logger, krakenConf Config, reported []string) {
+	if err := helpers.WriteState(krakenConf.KrakenStateFile, STATE_FILE_NAME, reported); err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("error writing kraken state file")
+	}
+}
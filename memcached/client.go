@@ -0,0 +1,84 @@
+package memcached
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// serverError is an error line sent back by memcached. The connection is still
+// usable after one, unlike after a network error.
+type serverError struct {
+	command string
+	line    string
+}
+
+func (e serverError) Error() string {
+	return fmt.Sprintf("memcached returned %q for %q", e.line, e.command)
+}
+
+// client speaks the memcached text protocol over a single connection. Every
+// command gets its own deadline so a stuck server can't hang the collection.
+type client struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+}
+
+func dial(address string, timeout time.Duration) (*client, error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &client{
+		conn:    conn,
+		reader:  bufio.NewReader(conn),
+		timeout: timeout,
+	}, nil
+}
+
+func (c *client) Close() error {
+	return c.conn.Close()
+}
+
+// stats runs a stats command, e.g. "stats" or "stats slabs", and returns the
+// reported values keyed by name
+func (c *client) stats(command string) (map[string]string, error) {
+	if err := c.conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(c.conn, "%s\r\n", command); err != nil {
+		return nil, err
+	}
+
+	stats := make(map[string]string)
+	for {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		localLog.Debug(fmt.Sprintf("stats: command: %s line: %s", command, line))
+
+		switch {
+		case line == "END":
+			return stats, nil
+		case line == "ERROR", strings.HasPrefix(line, "CLIENT_ERROR"), strings.HasPrefix(line, "SERVER_ERROR"):
+			return nil, serverError{command: command, line: line}
+		case strings.HasPrefix(line, "STAT "):
+			fields := strings.SplitN(line, " ", 3)
+			if len(fields) < 2 || fields[1] == "" {
+				continue
+			}
+			value := ""
+			if len(fields) == 3 {
+				value = fields[2]
+			}
+			stats[fields[1]] = value
+		default:
+			localLog.Warn(fmt.Sprintf("Skipping unexpected line from %q: %s", command, line))
+		}
+	}
+}
@@ -1,11 +1,12 @@
 package memcached
 
 import (
-	"bufio"
 	"fmt"
-	"net"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/GannettDigital/go-newrelic-plugin/helpers"
 	"github.com/Sirupsen/logrus"
@@ -16,12 +17,21 @@ const PROVIDER string = "memcached"
 const PROTOCOL_VERSION string = "1"
 const PLUGIN_VERSION string = "1.0.0"
 const STATUS string = "OK"
+const DEFAULT_TIMEOUT time.Duration = 5 * time.Second
 
 //MemcachedConfig is the keeper of the config
 type MemcachedConfig struct {
 	MemcachedHost string
 	MemcachedPort string
 	Commands      string
+	Timeout       time.Duration
+
+	// a pool of nodes is set with a list of host:port addresses or read from
+	// a mcrouter config, instead of MemcachedHost and MemcachedPort
+	Nodes          string
+	Pool           string
+	McrouterConfig string
+	McrouterPools  string
 }
 
 // InventoryData is the data type for inventory data produced by a plugin data
@@ -65,56 +75,172 @@ func Run(log *logrus.Logger, prettyPrint bool, version string) {
 		MemcachedHost: os.Getenv("MEMCACHED_HOST"),
 		MemcachedPort: os.Getenv("MEMCACHED_PORT"),
 		Commands:      os.Getenv("COMMANDS"),
+		Timeout:       timeout(os.Getenv("MEMCACHED_TIMEOUT")),
+
+		Nodes:          os.Getenv("MEMCACHED_NODES"),
+		Pool:           os.Getenv("MEMCACHED_POOL"),
+		McrouterConfig: os.Getenv("MCROUTER_CONFIG"),
+		McrouterPools:  os.Getenv("MCROUTER_POOLS"),
 	}
 	validateConfig(config)
 
-	metric, err := getMetric(config)
+	pools, err := configuredPools(config)
+	fatalIfErr(err, "Unable to read the memcached nodes")
+
+	metrics, err := collectPools(pools, config)
 	if err != nil {
 		data.Status = err.Error()
 	}
-	data.Metrics = append(data.Metrics, metric)
+	data.Metrics = append(data.Metrics, metrics...)
 	fatalIfErr(helpers.OutputJSON(data, prettyPrint), "OutputJSON error")
 }
 
-func getMetric(config MemcachedConfig) (map[string]interface{}, error) {
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%s", config.MemcachedHost, config.MemcachedPort))
+// nodeResult is what was collected from a single node of a pool
+type nodeResult struct {
+	samples []MetricData
+	general map[string]string
+	err     error
+}
+
+// collectNode gathers the general sample along with a sample per slab class
+// from a single connection to the node
+func collectNode(address string, config MemcachedConfig) nodeResult {
+	c, err := dial(address, config.Timeout)
 	if err != nil {
-		localLog.WithError(err).Error(fmt.Sprintf("getMetric: Cannot connect to memcached %s:%s", config.MemcachedHost, config.MemcachedPort))
-		return nil, err
+		localLog.WithError(err).Error(fmt.Sprintf("collectNode: Cannot connect to memcached %s", address))
+		return nodeResult{err: err}
+	}
+	defer c.Close()
+
+	general, err := c.stats("stats")
+	if err != nil {
+		return nodeResult{err: err}
+	}
+	// a group that fails still leaves the general stats already read, they're
+	// reported with the error of the group
+	metric, err := getMetric(c, config, general)
+	samples := []MetricData{metric}
+	if err != nil {
+		return nodeResult{samples: samples, general: general, err: err}
 	}
 
+	slabs, err := getSlabMetrics(c)
+	if err != nil {
+		return nodeResult{samples: samples, general: general, err: err}
+	}
+	return nodeResult{samples: append(samples, slabs...), general: general}
+}
+
+// getMetric runs the configured COMMANDS and flattens their output into one
+// sample, along with the hit ratio and memory utilisation worked out from the
+// general stats. A command the server rejects is logged and skipped, any
+// other failure stops at that command and returns what was read before it.
+func getMetric(c *client, config MemcachedConfig, general map[string]string) (map[string]interface{}, error) {
 	metrics := map[string]interface{}{
 		"event_type": "DatastoreSample",
 		"provider":   PROVIDER,
 	}
+	addRatios(metrics, general)
 
 	for _, command := range strings.Split(config.Commands, ",") {
 		command = strings.TrimSpace(command)
-		localLog.Debug(fmt.Sprintf("scanResult: command: %s", command))
-		fmt.Fprintf(conn, "%s\r\n", command)
-		scanner := bufio.NewScanner(bufio.NewReader(conn))
-		scanResult(scanner, command, metrics)
+		if command == "" {
+			continue
+		}
+		stats := general
+		if command != "stats" {
+			var err error
+			stats, err = c.stats(command)
+			if _, ok := err.(serverError); ok {
+				localLog.WithError(err).Warn(fmt.Sprintf("Skipping command %s", command))
+				continue
+			}
+			if err != nil {
+				return metrics, fmt.Errorf("%s failed: %v", command, err)
+			}
+		}
+		for name, value := range stats {
+			metrics[metricName(command, name)] = helpers.AsValue(value)
+		}
 	}
 	return metrics, nil
 }
 
-func scanResult(scanner *bufio.Scanner, command string, metrics map[string]interface{}) {
-	for scanner.Scan() {
-		localLog.Debug(fmt.Sprintf("scanResult: scanning..."))
+// addRatios works out the get hit ratio and how much of the memory limit is in
+// use from the general stats
+func addRatios(metrics map[string]interface{}, general map[string]string) {
+	hits, _ := strconv.ParseFloat(general["get_hits"], 64)
+	misses, _ := strconv.ParseFloat(general["get_misses"], 64)
+	if hits+misses > 0 {
+		metrics["memcached.hitRatio"] = hits / (hits + misses)
+	}
+	used, _ := strconv.ParseFloat(general["bytes"], 64)
+	limit, _ := strconv.ParseFloat(general["limit_maxbytes"], 64)
+	if limit > 0 {
+		metrics["memcached.memoryUtilization"] = used / limit
+	}
+}
 
-		if err := scanner.Err(); err != nil {
-			localLog.WithError(err).Error("reading scanning connection")
+// getSlabMetrics combines stats slabs and stats items into a sample per slab
+// class, ordered by class
+func getSlabMetrics(c *client) ([]MetricData, error) {
+	slabs, err := c.stats("stats slabs")
+	if err != nil {
+		return nil, err
+	}
+	items, err := c.stats("stats items")
+	if err != nil {
+		return nil, err
+	}
+
+	samples := make(map[int]MetricData)
+	sample := func(class string) MetricData {
+		id, err := strconv.Atoi(class)
+		if err != nil {
+			return nil
 		}
-		result := strings.TrimSuffix(scanner.Text(), "\r")
-		localLog.Debug(fmt.Sprintf("scanResult: result: %s", result))
-		if strings.Compare("END", result) == 0 {
-			break
+		if _, ok := samples[id]; !ok {
+			samples[id] = MetricData{
+				"event_type":           "DatastoreSample",
+				"provider":             PROVIDER,
+				"memcached.slab.class": id,
+			}
 		}
-		line := strings.Split(result, " ")
+		return samples[id]
+	}
 
-		name := metricName(command, line[1])
-		metrics[name] = helpers.AsValue(strings.Join(line[2:], " "))
+	// stats slabs reports "<class>:<name>" along with a few totals that
+	// aren't per class, which are left out
+	for name, value := range slabs {
+		parts := strings.SplitN(name, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if metrics := sample(parts[0]); metrics != nil {
+			metrics["memcached.slab."+helpers.CamelCase(parts[1])] = helpers.AsValue(value)
+		}
 	}
+	// stats items reports "items:<class>:<name>"
+	for name, value := range items {
+		parts := strings.SplitN(name, ":", 3)
+		if len(parts) != 3 || parts[0] != "items" {
+			continue
+		}
+		if metrics := sample(parts[1]); metrics != nil {
+			metrics["memcached.slab.items."+helpers.CamelCase(parts[2])] = helpers.AsValue(value)
+		}
+	}
+
+	classes := make([]int, 0, len(samples))
+	for class := range samples {
+		classes = append(classes, class)
+	}
+	sort.Ints(classes)
+	result := make([]MetricData, 0, len(classes))
+	for _, class := range classes {
+		result = append(result, samples[class])
+	}
+	return result, nil
 }
 
 func metricName(command string, metric string) string {
@@ -132,17 +258,29 @@ func metricName(command string, metric string) string {
 }
 
 func validateConfig(config MemcachedConfig) {
-	if config.MemcachedHost == "" {
-		localLog.Fatal("Config Yaml is missing MEMCACHED_HOST value. Please check the config to continue")
-	}
-	if config.MemcachedPort == "" {
-		localLog.Fatal("Config Yaml is missing MEMCACHED_PORT value. Please check the config to continue")
+	if config.Nodes == "" && config.McrouterConfig == "" {
+		if config.MemcachedHost == "" {
+			localLog.Fatal("Config Yaml is missing MEMCACHED_HOST value. Please check the config to continue")
+		}
+		if config.MemcachedPort == "" {
+			localLog.Fatal("Config Yaml is missing MEMCACHED_PORT value. Please check the config to continue")
+		}
 	}
 	if len(config.Commands) < 1 {
 		localLog.Fatal("Config Yaml is missing COMMANDS value. Please check the config to continue")
 	}
 }
 
+// timeout parses MEMCACHED_TIMEOUT in seconds, falling back to the default
+// when it is unset or invalid
+func timeout(value string) time.Duration {
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds <= 0 {
+		return DEFAULT_TIMEOUT
+	}
+	return time.Duration(seconds) * time.Second
+}
+
 func fatalIfErr(err error, msg string) {
 	if err != nil {
 		localLog.WithError(err).Fatal(msg)
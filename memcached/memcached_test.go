@@ -1,11 +1,16 @@
 package memcached
 
 import (
+	"bufio"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/franela/goblin"
 	"github.com/Sirupsen/logrus"
@@ -25,6 +30,7 @@ func init() {
 		MemcachedHost: "localhost",
 		MemcachedPort: strconv.Itoa(port),
 		Commands:      "stats , stats settings , stats items , stats sizes , stats slabs , stats conns",
+		Timeout:       100 * time.Millisecond,
 	}
 
 }
@@ -55,32 +61,79 @@ func Server(l *net.TCPListener) {
 	}
 }
 
+// fakeResponses are the replies of the fake server, any other command gets an
+// ERROR line and "hang" never gets a reply
+var fakeResponses = map[string]string{
+	"stats":          "STAT slab1:chunks_per_page 13\r\nEND\r\n",
+	"stats settings": "END\r\n",
+	"stats items":    "STAT items:1:number 5\r\nSTAT items:1:age 3600\r\nSTAT items:1:evicted 2\r\nSTAT items:12:number 1\r\nEND\r\n",
+	"stats sizes":    "STAT sizes_status disabled\r\nEND\r\n",
+	"stats slabs":    "STAT 1:chunk_size 96\r\nSTAT 1:used_chunks 5\r\nSTAT 12:chunk_size 944\r\nSTAT active_slabs 2\r\nSTAT total_malloced 2097152\r\nEND\r\n",
+	"stats conns":    "STAT 23:state conn_parse_cmd\r\nSTAT\r\nEND\r\n",
+	"stats broken":   "SERVER_ERROR out of memory\r\n",
+	"stats partial":  "STAT pid 1",
+}
+
 // Handles 'incoming' requests.
 func handleRequest(conn net.Conn) {
-	buf := make([]byte, 1024)
-	_, err := conn.Read(buf)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		command, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command = strings.TrimSpace(command)
+		if command == "hang" {
+			time.Sleep(time.Second)
+			return
+		}
+		response, ok := fakeResponses[command]
+		if !ok {
+			response = "ERROR\r\n"
+		}
+		conn.Write([]byte(response))
+		if command == "stats partial" {
+			return
+		}
+	}
+}
+
+func fakeClient(t *testing.T) *client {
+	c, err := dial(net.JoinHostPort(fakeConfig.MemcachedHost, fakeConfig.MemcachedPort), fakeConfig.Timeout)
 	if err != nil {
-		fmt.Println("Error reading:", err.Error())
+		t.Fatalf("an error '%s' was not expected when connecting to the fake server", err)
 	}
-	conn.Write([]byte("STAT slab1:chunks_per_page 13"))
-	conn.Close()
+	return c
 }
 
 func TestGetMetric(t *testing.T) {
 	g := goblin.Goblin(t)
 	var tests = []struct {
 		TestDescription string
+		commands        string
 		result          map[string]interface{}
 	}{
 		{
 			TestDescription: "Should get metrics without error",
+			commands:        "stats",
 			result:          map[string]interface{}{"event_type": "DatastoreSample", "provider": "memcached", "memcached.slab1.chunksPerPage": 13},
 		},
+		{
+			TestDescription: "Should skip commands the server rejects",
+			commands:        "stats sizes, stats detail dump",
+			result:          map[string]interface{}{"event_type": "DatastoreSample", "provider": "memcached", "memcached.sizes.sizesStatus": "disabled"},
+		},
 	}
 	for _, test := range tests {
 		g.Describe("getMetric)", func() {
 			g.It(test.TestDescription, func() {
-				metric, _ := getMetric(fakeConfig)
+				c := fakeClient(t)
+				defer c.Close()
+				config := fakeConfig
+				config.Commands = test.commands
+				general, _ := c.stats("stats")
+				metric, _ := getMetric(c, config, general)
 				localLog.Debug(metric)
 				g.Assert(metric).Equal(test.result)
 			})
@@ -118,3 +171,289 @@ func TestMetricName(t *testing.T) {
 		})
 	}
 }
+
+func TestClientStats(t *testing.T) {
+	g := goblin.Goblin(t)
+	var tests = []struct {
+		TestDescription string
+		command         string
+		result          map[string]string
+		err             string
+	}{
+		{
+			TestDescription: "Should skip STAT lines without a name",
+			command:         "stats conns",
+			result:          map[string]string{"23:state": "conn_parse_cmd"},
+		},
+		{
+			TestDescription: "Should return an unknown command as an error",
+			command:         "stats detail dump",
+			err:             `memcached returned "ERROR" for "stats detail dump"`,
+		},
+		{
+			TestDescription: "Should return a server error line as an error",
+			command:         "stats broken",
+			err:             `memcached returned "SERVER_ERROR out of memory" for "stats broken"`,
+		},
+		{
+			TestDescription: "Should fail when the connection closes before END",
+			command:         "stats partial",
+			err:             "EOF",
+		},
+	}
+	for _, test := range tests {
+		g.Describe("client.stats()", func() {
+			g.It(test.TestDescription, func() {
+				c := fakeClient(t)
+				defer c.Close()
+				stats, err := c.stats(test.command)
+				if test.err != "" {
+					g.Assert(err.Error()).Equal(test.err)
+					return
+				}
+				g.Assert(err).Equal(nil)
+				g.Assert(stats).Equal(test.result)
+			})
+		})
+	}
+
+	g.Describe("client.stats()", func() {
+		g.It("Should give up when the server doesn't answer in time", func() {
+			c := fakeClient(t)
+			defer c.Close()
+			_, err := c.stats("hang")
+			netErr, ok := err.(net.Error)
+			g.Assert(ok).IsTrue()
+			g.Assert(netErr.Timeout()).IsTrue()
+		})
+	})
+}
+
+func TestGetSlabMetrics(t *testing.T) {
+	g := goblin.Goblin(t)
+	g.Describe("getSlabMetrics()", func() {
+		g.It("Should report a sample per slab class", func() {
+			c := fakeClient(t)
+			defer c.Close()
+			samples, err := getSlabMetrics(c)
+			g.Assert(err).Equal(nil)
+			g.Assert(samples).Equal([]MetricData{
+				{
+					"event_type":                   "DatastoreSample",
+					"provider":                     "memcached",
+					"memcached.slab.class":         1,
+					"memcached.slab.chunkSize":     96,
+					"memcached.slab.usedChunks":    5,
+					"memcached.slab.items.number":  5,
+					"memcached.slab.items.age":     3600,
+					"memcached.slab.items.evicted": 2,
+				},
+				{
+					"event_type":                  "DatastoreSample",
+					"provider":                    "memcached",
+					"memcached.slab.class":        12,
+					"memcached.slab.chunkSize":    944,
+					"memcached.slab.items.number": 1,
+				},
+			})
+		})
+	})
+}
+
+func TestAddRatios(t *testing.T) {
+	g := goblin.Goblin(t)
+	var tests = []struct {
+		TestDescription string
+		general         map[string]string
+		result          map[string]interface{}
+	}{
+		{
+			TestDescription: "Should work out the hit ratio and memory utilisation",
+			general:         map[string]string{"get_hits": "75", "get_misses": "25", "bytes": "16777216", "limit_maxbytes": "67108864"},
+			result:          map[string]interface{}{"memcached.hitRatio": 0.75, "memcached.memoryUtilization": 0.25},
+		},
+		{
+			TestDescription: "Should leave the ratios out for an idle server",
+			general:         map[string]string{"get_hits": "0", "get_misses": "0", "bytes": "0"},
+			result:          map[string]interface{}{},
+		},
+	}
+	for _, test := range tests {
+		g.Describe("addRatios()", func() {
+			g.It(test.TestDescription, func() {
+				metrics := map[string]interface{}{}
+				addRatios(metrics, test.general)
+				g.Assert(metrics).Equal(test.result)
+			})
+		})
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	g := goblin.Goblin(t)
+	g.Describe("timeout()", func() {
+		g.It("Should parse the configured seconds", func() {
+			g.Assert(timeout("2")).Equal(2 * time.Second)
+		})
+		g.It("Should fall back to the default when unset or invalid", func() {
+			g.Assert(timeout("")).Equal(DEFAULT_TIMEOUT)
+			g.Assert(timeout("soon")).Equal(DEFAULT_TIMEOUT)
+		})
+	})
+}
+
+func TestConfiguredPools(t *testing.T) {
+	g := goblin.Goblin(t)
+	var tests = []struct {
+		TestDescription string
+		config          MemcachedConfig
+		result          []pool
+	}{
+		{
+			TestDescription: "Should use the single configured host",
+			config:          MemcachedConfig{MemcachedHost: "cache1", MemcachedPort: "11211"},
+			result:          []pool{{Nodes: []string{"cache1:11211"}}},
+		},
+		{
+			TestDescription: "Should use the node list",
+			config:          MemcachedConfig{Nodes: "cache1:11211, cache2:11211,", Pool: "sessions"},
+			result:          []pool{{Name: "sessions", Nodes: []string{"cache1:11211", "cache2:11211"}}},
+		},
+	}
+	for _, test := range tests {
+		g.Describe("configuredPools()", func() {
+			g.It(test.TestDescription, func() {
+				pools, err := configuredPools(test.config)
+				g.Assert(err).Equal(nil)
+				g.Assert(pools).Equal(test.result)
+			})
+		})
+	}
+}
+
+func TestReadMcrouterPools(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memcached")
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when creating a temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mcrouter.json")
+	mcrouter := `{
+  // the web tier
+  "pools": {
+    "web": {"servers": ["10.0.0.1:11211", "10.0.0.2:11211:ascii:plain"]},
+    "sessions": {"servers": ["[fe80::1]:11211"]}
+  },
+  "route": "PoolRoute|web"
+}`
+	if err := ioutil.WriteFile(path, []byte(mcrouter), 0644); err != nil {
+		t.Fatalf("an error '%s' was not expected when writing the mcrouter config", err)
+	}
+
+	g := goblin.Goblin(t)
+	var tests = []struct {
+		TestDescription string
+		names           string
+		result          []pool
+	}{
+		{
+			TestDescription: "Should read every pool ordered by name",
+			result: []pool{
+				{Name: "sessions", Nodes: []string{"[fe80::1]:11211"}},
+				{Name: "web", Nodes: []string{"10.0.0.1:11211", "10.0.0.2:11211"}},
+			},
+		},
+		{
+			TestDescription: "Should only keep the configured pools",
+			names:           "web",
+			result:          []pool{{Name: "web", Nodes: []string{"10.0.0.1:11211", "10.0.0.2:11211"}}},
+		},
+	}
+	for _, test := range tests {
+		g.Describe("readMcrouterPools()", func() {
+			g.It(test.TestDescription, func() {
+				pools, err := readMcrouterPools(path, test.names)
+				g.Assert(err).Equal(nil)
+				g.Assert(pools).Equal(test.result)
+			})
+		})
+	}
+}
+
+func TestCollectNode(t *testing.T) {
+	g := goblin.Goblin(t)
+	g.Describe("collectNode()", func() {
+		g.It("Should keep the general stats when a later group fails", func() {
+			config := fakeConfig
+			config.Commands = "stats, stats partial, stats sizes"
+			result := collectNode(net.JoinHostPort(fakeConfig.MemcachedHost, fakeConfig.MemcachedPort), config)
+			g.Assert(result.err.Error()).Equal("stats partial failed: EOF")
+			g.Assert(result.general).Equal(map[string]string{"slab1:chunks_per_page": "13"})
+			g.Assert(result.samples).Equal([]MetricData{
+				{"event_type": "DatastoreSample", "provider": "memcached", "memcached.slab1.chunksPerPage": 13},
+			})
+		})
+	})
+}
+
+func TestCollectPools(t *testing.T) {
+	g := goblin.Goblin(t)
+	g.Describe("collectPools()", func() {
+		g.It("Should tag every node's samples and count the unreachable nodes", func() {
+			closed := GetListener()
+			down := closed.Addr().String()
+			closed.Close()
+			up := net.JoinHostPort(fakeConfig.MemcachedHost, fakeConfig.MemcachedPort)
+
+			config := fakeConfig
+			config.Commands = "stats"
+			samples, err := collectPools([]pool{{Name: "web", Nodes: []string{up, down}}}, config)
+			g.Assert(err).Equal(nil)
+			g.Assert(len(samples)).Equal(4)
+			for _, sample := range samples[:3] {
+				g.Assert(sample["memcached.node"]).Equal(up)
+				g.Assert(sample["memcached.pool"]).Equal("web")
+			}
+			g.Assert(samples[3]).Equal(MetricData{
+				"event_type":                      "DatastoreSample",
+				"provider":                        "memcached",
+				"memcached.pool":                  "web",
+				"memcached.pool.nodes":            2,
+				"memcached.pool.unreachableNodes": 1,
+				"memcached.pool.items":            float64(0),
+				"memcached.pool.bytes":            float64(0),
+			})
+		})
+		g.It("Should fail when no node can be reached", func() {
+			closed := GetListener()
+			down := closed.Addr().String()
+			closed.Close()
+
+			_, err := collectPools([]pool{{Nodes: []string{down}}}, fakeConfig)
+			g.Assert(err == nil).IsFalse()
+		})
+	})
+}
+
+func TestPoolSample(t *testing.T) {
+	g := goblin.Goblin(t)
+	g.Describe("poolSample()", func() {
+		g.It("Should add up the nodes of the pool", func() {
+			results := []nodeResult{
+				{general: map[string]string{"curr_items": "10", "bytes": "1024", "get_hits": "90", "get_misses": "10"}},
+				{general: map[string]string{"curr_items": "30", "bytes": "3072", "get_hits": "210", "get_misses": "90"}},
+				{err: fmt.Errorf("connection refused")},
+			}
+			g.Assert(poolSample(pool{Name: "web"}, results)).Equal(MetricData{
+				"event_type":                      "DatastoreSample",
+				"provider":                        "memcached",
+				"memcached.pool":                  "web",
+				"memcached.pool.nodes":            3,
+				"memcached.pool.unreachableNodes": 1,
+				"memcached.pool.items":            float64(40),
+				"memcached.pool.bytes":            float64(4096),
+				"memcached.pool.hitRatio":         0.75,
+			})
+		})
+	})
+}
@@ -0,0 +1,182 @@
+package memcached
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// pool is a named set of memcached nodes reported together
+type pool struct {
+	Name  string
+	Nodes []string
+}
+
+// mcrouterConfig is the part of a mcrouter config file that lists the pools
+type mcrouterConfig struct {
+	Pools map[string]struct {
+		Servers []string `json:"servers"`
+	} `json:"pools"`
+}
+
+// mcrouter allows // comments in its JSON config
+var mcrouterCommentPattern = regexp.MustCompile(`(?m)^\s*//.*$`)
+
+// mcrouter server addresses can carry the protocol and security mechanism
+// after the port, e.g. "10.0.0.1:11211:ascii:plain"
+var mcrouterServerPattern = regexp.MustCompile(`^(\[[^\]]+\]|[^:]+):(\d+)`)
+
+// configuredPools returns the pools to collect from, which is either the
+// MEMCACHED_NODES list, the pools of a mcrouter config or the single node in
+// MEMCACHED_HOST and MEMCACHED_PORT
+func configuredPools(config MemcachedConfig) ([]pool, error) {
+	if config.McrouterConfig != "" {
+		return readMcrouterPools(config.McrouterConfig, config.McrouterPools)
+	}
+	if config.Nodes != "" {
+		nodes := make([]string, 0)
+		for _, node := range strings.Split(config.Nodes, ",") {
+			if node = strings.TrimSpace(node); node != "" {
+				nodes = append(nodes, node)
+			}
+		}
+		return []pool{{Name: config.Pool, Nodes: nodes}}, nil
+	}
+	return []pool{{
+		Name:  config.Pool,
+		Nodes: []string{net.JoinHostPort(config.MemcachedHost, config.MemcachedPort)},
+	}}, nil
+}
+
+// readMcrouterPools reads the pools from a mcrouter config file. names is a
+// comma separated list of the pools to keep, all of them are kept when empty.
+func readMcrouterPools(path string, names string) ([]pool, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config mcrouterConfig
+	if err := json.Unmarshal(mcrouterCommentPattern.ReplaceAll(raw, nil), &config); err != nil {
+		return nil, fmt.Errorf("invalid mcrouter config %s: %v", path, err)
+	}
+
+	wanted := make(map[string]bool)
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			wanted[name] = true
+		}
+	}
+
+	pools := make([]pool, 0)
+	for name, servers := range config.Pools {
+		if len(wanted) > 0 && !wanted[name] {
+			continue
+		}
+		nodes := make([]string, 0, len(servers.Servers))
+		for _, server := range servers.Servers {
+			match := mcrouterServerPattern.FindStringSubmatch(server)
+			if match == nil {
+				return nil, fmt.Errorf("invalid server %q in mcrouter pool %s", server, name)
+			}
+			nodes = append(nodes, net.JoinHostPort(strings.Trim(match[1], "[]"), match[2]))
+		}
+		pools = append(pools, pool{Name: name, Nodes: nodes})
+	}
+	if len(pools) == 0 {
+		return nil, errors.New("no memcached pools found in the mcrouter config")
+	}
+	sort.Slice(pools, func(i, j int) bool { return pools[i].Name < pools[j].Name })
+	return pools, nil
+}
+
+// collectPools collects from every node of every pool at the same time. Each
+// node's samples are tagged with its address and pool, and every pool gets an
+// aggregate sample. An error is only returned when no node could be reached.
+func collectPools(pools []pool, config MemcachedConfig) ([]MetricData, error) {
+	results := make([][]nodeResult, len(pools))
+	var wg sync.WaitGroup
+	for i, p := range pools {
+		results[i] = make([]nodeResult, len(p.Nodes))
+		for j, node := range p.Nodes {
+			wg.Add(1)
+			go func(i int, j int, node string) {
+				defer wg.Done()
+				results[i][j] = collectNode(node, config)
+			}(i, j, node)
+		}
+	}
+	wg.Wait()
+
+	samples := make([]MetricData, 0)
+	var lastErr error
+	reachable := 0
+	for i, p := range pools {
+		for j, node := range p.Nodes {
+			result := results[i][j]
+			if result.err != nil {
+				localLog.WithError(result.err).Warn(fmt.Sprintf("Failed to collect from memcached %s", node))
+				lastErr = result.err
+			}
+			if result.general != nil {
+				reachable++
+			}
+			for _, sample := range result.samples {
+				sample["memcached.node"] = node
+				if p.Name != "" {
+					sample["memcached.pool"] = p.Name
+				}
+				samples = append(samples, sample)
+			}
+		}
+		samples = append(samples, poolSample(p, results[i]))
+	}
+
+	if reachable == 0 && lastErr != nil {
+		return samples, lastErr
+	}
+	return samples, nil
+}
+
+// poolSample adds up the general stats of the nodes in a pool
+func poolSample(p pool, results []nodeResult) MetricData {
+	var items, bytes, hits, misses float64
+	unreachable := 0
+	for _, result := range results {
+		if result.general == nil {
+			unreachable++
+			continue
+		}
+		items += parseStat(result.general, "curr_items")
+		bytes += parseStat(result.general, "bytes")
+		hits += parseStat(result.general, "get_hits")
+		misses += parseStat(result.general, "get_misses")
+	}
+
+	sample := MetricData{
+		"event_type":                      "DatastoreSample",
+		"provider":                        PROVIDER,
+		"memcached.pool.nodes":            len(results),
+		"memcached.pool.unreachableNodes": unreachable,
+		"memcached.pool.items":            items,
+		"memcached.pool.bytes":            bytes,
+	}
+	if p.Name != "" {
+		sample["memcached.pool"] = p.Name
+	}
+	if hits+misses > 0 {
+		sample["memcached.pool.hitRatio"] = hits / (hits + misses)
+	}
+	return sample
+}
+
+func parseStat(stats map[string]string, name string) float64 {
+	value, _ := strconv.ParseFloat(stats[name], 64)
+	return value
+}
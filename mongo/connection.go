@@ -0,0 +1,355 @@
+package mongo
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+)
+
+const DIAL_TIMEOUT = 10 * time.Second
+
+// authentication mechanisms understood by the collector
+const (
+	AUTH_SCRAM_SHA_1   string = "SCRAM-SHA-1"
+	AUTH_SCRAM_SHA_256 string = "SCRAM-SHA-256"
+	AUTH_X509          string = "MONGODB-X509"
+	// AUTH_MONGODB_CR is the mechanism of servers before 3.0
+	AUTH_MONGODB_CR string = "MONGODB-CR"
+)
+
+// readPreferences maps connection string read preferences onto mgo modes
+var readPreferences = map[string]mgo.Mode{
+	"primary":            mgo.Primary,
+	"primarypreferred":   mgo.PrimaryPreferred,
+	"secondary":          mgo.Secondary,
+	"secondarypreferred": mgo.SecondaryPreferred,
+	"nearest":            mgo.Nearest,
+}
+
+// connectionOptions holds the connection string options mgo doesn't handle
+// itself, merged with the explicit config settings
+type connectionOptions struct {
+	AuthMechanism         string
+	ReadPreference        string
+	TLS                   bool
+	TLSCAFile             string
+	TLSCertificateKeyFile string
+	TLSInsecure           bool
+}
+
+// connectionURI returns the configured MONGODB_URI or builds one from the
+// individual host settings
+func connectionURI(config Config) string {
+	if config.MongoDBURI != "" {
+		return config.MongoDBURI
+	}
+	var credentials string
+	if config.MongoDBUser != "" {
+		credentials = url.QueryEscape(config.MongoDBUser)
+		if config.MongoDBPassword != "" {
+			credentials += ":" + url.QueryEscape(config.MongoDBPassword)
+		}
+		credentials += "@"
+	}
+	return fmt.Sprintf("mongodb://%v%v:%v/%v", credentials, config.MongoDBHost, config.MongoDBPort, config.MongoDB)
+}
+
+// splitConnectionURI separates the options mgo.ParseURL supports from the ones
+// the collector applies itself, resolving mongodb+srv seed lists on the way
+func splitConnectionURI(uri string, lookupSRV func(string, string, string) (string, []*net.SRV, error), lookupTXT func(string) ([]string, error)) (string, connectionOptions, error) {
+	var opts connectionOptions
+
+	base := uri
+	rawQuery := ""
+	if i := strings.Index(uri, "?"); i >= 0 {
+		base, rawQuery = uri[:i], uri[i+1:]
+	}
+
+	// mgo accepts both separators, url.ParseQuery only the ampersand
+	query, err := url.ParseQuery(strings.Replace(rawQuery, ";", "&", -1))
+	if err != nil {
+		return "", opts, fmt.Errorf("invalid connection string options: %v", err)
+	}
+
+	if strings.HasPrefix(base, "mongodb+srv://") {
+		base, err = resolveSRV(base, query, lookupSRV, lookupTXT)
+		if err != nil {
+			return "", opts, err
+		}
+		// mongodb+srv implies TLS unless it is explicitly turned off
+		opts.TLS = true
+	}
+
+	mgoOptions := make([]string, 0)
+	for key, values := range query {
+		value := values[len(values)-1]
+		switch strings.ToLower(key) {
+		case "authmechanism":
+			// mgo refuses mechanisms it doesn't know, so the mechanism is
+			// applied after parsing
+			opts.AuthMechanism = value
+		case "readpreference":
+			opts.ReadPreference = value
+		case "ssl", "tls":
+			opts.TLS, err = strconv.ParseBool(value)
+			if err != nil {
+				return "", opts, fmt.Errorf("bad value for %v: %v", key, value)
+			}
+		case "tlscafile", "sslcertificateauthorityfile":
+			opts.TLSCAFile = value
+		case "tlscertificatekeyfile", "sslclientcertificatekeyfile":
+			opts.TLSCertificateKeyFile = value
+		case "tlsinsecure", "tlsallowinvalidcertificates", "sslallowinvalidcertificates":
+			opts.TLSInsecure, err = strconv.ParseBool(value)
+			if err != nil {
+				return "", opts, fmt.Errorf("bad value for %v: %v", key, value)
+			}
+		default:
+			// mgo doesn't unescape option values, so they are passed on as is
+			mgoOptions = append(mgoOptions, key+"="+value)
+		}
+	}
+
+	if len(mgoOptions) > 0 {
+		sort.Strings(mgoOptions)
+		return base + "?" + strings.Join(mgoOptions, "&"), opts, nil
+	}
+	return base, opts, nil
+}
+
+// resolveSRV turns a mongodb+srv connection string into a plain seed list and
+// adds the replicaSet and authSource options published in the TXT record
+func resolveSRV(base string, query url.Values, lookupSRV func(string, string, string) (string, []*net.SRV, error), lookupTXT func(string) ([]string, error)) (string, error) {
+	rest := strings.TrimPrefix(base, "mongodb+srv://")
+	credentials := ""
+	if i := strings.LastIndex(rest, "@"); i >= 0 {
+		credentials, rest = rest[:i+1], rest[i+1:]
+	}
+	host, path := rest, ""
+	if i := strings.Index(rest, "/"); i >= 0 {
+		host, path = rest[:i], rest[i:]
+	}
+	if strings.Contains(host, ",") || strings.Contains(host, ":") {
+		return "", errors.New("mongodb+srv connection strings take a single host name without a port")
+	}
+
+	_, records, err := lookupSRV("mongodb", "tcp", host)
+	if err != nil {
+		return "", fmt.Errorf("unable to resolve SRV records for %v: %v", host, err)
+	}
+	if len(records) == 0 {
+		return "", fmt.Errorf("no SRV records found for %v", host)
+	}
+	addrs := make([]string, 0, len(records))
+	for _, record := range records {
+		addrs = append(addrs, net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port))))
+	}
+
+	txts, err := lookupTXT(host)
+	if err == nil {
+		for _, txt := range txts {
+			txtQuery, err := url.ParseQuery(txt)
+			if err != nil {
+				return "", fmt.Errorf("invalid TXT record for %v: %v", host, err)
+			}
+			for key, values := range txtQuery {
+				// options in the connection string take precedence over DNS
+				if _, ok := query[key]; !ok {
+					query[key] = values
+				}
+			}
+		}
+	}
+
+	return "mongodb://" + credentials + strings.Join(addrs, ",") + path, nil
+}
+
+// tlsConfig builds the client TLS configuration from the CA and client
+// certificate files
+func tlsConfig(opts connectionOptions) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: opts.TLSInsecure}
+	if opts.TLSCAFile != "" {
+		caPem, err := ioutil.ReadFile(opts.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA file: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(caPem) {
+			return nil, fmt.Errorf("no certificates found in CA file %v", opts.TLSCAFile)
+		}
+	}
+	if opts.TLSCertificateKeyFile != "" {
+		// the certificate and its key are expected in the same PEM file
+		cert, err := tls.LoadX509KeyPair(opts.TLSCertificateKeyFile, opts.TLSCertificateKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// x509Subject returns the RFC 2253 subject of the client certificate, which is
+// the user name MONGODB-X509 authenticates as
+func x509Subject(config *tls.Config) (string, error) {
+	if len(config.Certificates) == 0 {
+		return "", errors.New("MONGODB-X509 authentication requires a client certificate")
+	}
+	cert, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	if err != nil {
+		return "", fmt.Errorf("unable to parse client certificate: %v", err)
+	}
+	return cert.Subject.String(), nil
+}
+
+// dialInfo turns the collector config into the mgo dial settings and the read
+// mode for the session
+func dialInfo(config Config) (*mgo.DialInfo, mgo.Mode, error) {
+	mode := mgo.Strong
+
+	uri, opts, err := splitConnectionURI(connectionURI(config), net.LookupSRV, net.LookupTXT)
+	if err != nil {
+		return nil, mode, err
+	}
+
+	// explicit settings win over the connection string
+	if config.MongoDBReadPreference != "" {
+		opts.ReadPreference = config.MongoDBReadPreference
+	}
+	if config.MongoDBTLS {
+		opts.TLS = true
+	}
+	if config.MongoDBTLSCAFile != "" {
+		opts.TLSCAFile = config.MongoDBTLSCAFile
+	}
+	if config.MongoDBTLSCertificateKeyFile != "" {
+		opts.TLSCertificateKeyFile = config.MongoDBTLSCertificateKeyFile
+	}
+	if config.MongoDBTLSInsecure {
+		opts.TLSInsecure = true
+	}
+
+	if config.MongoDBAuthMechanism != "" {
+		opts.AuthMechanism = config.MongoDBAuthMechanism
+	}
+
+	info, err := mgo.ParseURL(uri)
+	if err != nil {
+		return nil, mode, err
+	}
+	info.Timeout = DIAL_TIMEOUT
+	if config.MongoDBAuthSource != "" {
+		info.Source = config.MongoDBAuthSource
+	}
+	if config.MongoDBReplicaSet != "" {
+		info.ReplicaSetName = config.MongoDBReplicaSet
+	}
+
+	if opts.ReadPreference != "" {
+		var ok bool
+		mode, ok = readPreferences[strings.ToLower(opts.ReadPreference)]
+		if !ok {
+			return nil, mode, fmt.Errorf("unsupported read preference %v", opts.ReadPreference)
+		}
+	}
+
+	var tlsConf *tls.Config
+	if opts.TLS || opts.TLSCAFile != "" || opts.TLSCertificateKeyFile != "" {
+		tlsConf, err = tlsConfig(opts)
+		if err != nil {
+			return nil, mode, err
+		}
+	}
+
+	var scram *scramCredential
+	switch strings.ToUpper(opts.AuthMechanism) {
+	case "", AUTH_SCRAM_SHA_1, AUTH_MONGODB_CR:
+		info.Mechanism = strings.ToUpper(opts.AuthMechanism)
+	case AUTH_X509:
+		if tlsConf == nil {
+			return nil, mode, errors.New("MONGODB-X509 authentication requires TLS")
+		}
+		info.Mechanism = AUTH_X509
+		info.Password = ""
+		if info.Username == "" {
+			info.Username, err = x509Subject(tlsConf)
+			if err != nil {
+				return nil, mode, err
+			}
+		}
+	case AUTH_SCRAM_SHA_256:
+		if info.Username == "" {
+			return nil, mode, errors.New("SCRAM-SHA-256 authentication requires a user")
+		}
+		scram = &scramCredential{
+			Source:   authSource(info),
+			Username: info.Username,
+			Password: info.Password,
+		}
+		// the connection is authenticated before mgo sees it
+		info.Username, info.Password, info.Mechanism = "", "", ""
+	default:
+		return nil, mode, fmt.Errorf("unsupported authentication mechanism %v", opts.AuthMechanism)
+	}
+
+	if tlsConf != nil || scram != nil {
+		info.DialServer = serverDialer(tlsConf, scram)
+	}
+	return info, mode, nil
+}
+
+// authSource mirrors how mgo picks the database credentials are checked against
+func authSource(info *mgo.DialInfo) string {
+	if info.Source != "" {
+		return info.Source
+	}
+	if info.Database != "" {
+		return info.Database
+	}
+	return "admin"
+}
+
+// serverDialer returns an mgo DialServer function that wraps connections in
+// TLS and runs the SCRAM-SHA-256 conversation when required
+func serverDialer(tlsConf *tls.Config, scram *scramCredential) func(addr *mgo.ServerAddr) (net.Conn, error) {
+	return func(addr *mgo.ServerAddr) (net.Conn, error) {
+		dialer := &net.Dialer{Timeout: DIAL_TIMEOUT}
+		var conn net.Conn
+		var err error
+		if tlsConf != nil {
+			conf := tlsConf.Clone()
+			if conf.ServerName == "" {
+				host, _, splitErr := net.SplitHostPort(addr.String())
+				if splitErr == nil {
+					conf.ServerName = host
+				}
+			}
+			conn, err = tls.DialWithDialer(dialer, "tcp", addr.String(), conf)
+		} else {
+			conn, err = dialer.Dial("tcp", addr.String())
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if scram != nil {
+			conn.SetDeadline(time.Now().Add(DIAL_TIMEOUT))
+			if err := scram.login(conn); err != nil {
+				conn.Close()
+				return nil, fmt.Errorf("SCRAM-SHA-256 authentication failed: %v", err)
+			}
+			conn.SetDeadline(time.Time{})
+		}
+		return conn, nil
+	}
+}
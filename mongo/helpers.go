@@ -4,11 +4,12 @@ import (
 	"gopkg.in/mgo.v2"
 )
 
-func NewSession(mongoUrl string) Session {
-	mgoSession, err := mgo.Dial(mongoUrl)
+func NewSession(dialInfo *mgo.DialInfo, mode mgo.Mode) Session {
+	mgoSession, err := mgo.DialWithInfo(dialInfo)
 	if err != nil {
 		panic(err)
 	}
+	mgoSession.SetMode(mode, true)
 	return MongoSession{mgoSession}
 }
 
@@ -131,7 +132,8 @@ func formatServerStatsStructToMap(serverStatus serverStatus) (dbInfoMap map[stri
 }
 
 func formatReplStatsStructToMap(replStats ReplStats, index int) map[string]interface{} {
-	return map[string]interface{}{
+	member := replStats.Members[index]
+	replInfoMap := map[string]interface{}{
 		"event_type":                          EVENT_TYPE,
 		"provider":                            PROVIDER,
 		"mongo.repl.set":                      replStats.Set,
@@ -156,5 +158,25 @@ func formatReplStatsStructToMap(replStats ReplStats, index int) map[string]inter
 		"mongo.repl.member.configVersion":     replStats.Members[index].ConfigVersion,
 		"mongo.repl.member.self":              replStats.Members[index].Self,
 		"mongo.repl.ok":                       replStats.OK,
+		"mongo.repl.member.abnormalState":     member.State != REPL_STATE_PRIMARY && member.State != REPL_STATE_SECONDARY,
+	}
+	if lag, ok := replicationLag(replStats, member); ok {
+		replInfoMap["mongo.repl.member.replicationLagSeconds"] = lag
+	}
+	return replInfoMap
+}
+
+// replicationLag returns how many seconds a secondary's optimeDate trails the
+// primary's. The boolean is false for non secondaries or when there is no
+// primary to compare against.
+func replicationLag(replStats ReplStats, member ReplMember) (float64, bool) {
+	if member.State != REPL_STATE_SECONDARY {
+		return 0, false
+	}
+	for _, candidate := range replStats.Members {
+		if candidate.State == REPL_STATE_PRIMARY {
+			return candidate.OptimeDate.Sub(member.OptimeDate).Seconds(), true
+		}
 	}
+	return 0, false
 }
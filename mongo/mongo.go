@@ -3,6 +3,8 @@ package mongo
 import (
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/GannettDigital/go-newrelic-plugin/helpers"
 	"github.com/Sirupsen/logrus"
@@ -12,6 +14,13 @@ const NAME string = "mongo"
 const EVENT_TYPE string = "DatastoreSample"
 const PROVIDER string = "mongo"
 const PROTOCOL_VERSION string = "1"
+const REPL_EVENT_TYPE string = "MongoReplicaSetEvent"
+
+// replica set member states as reported by replSetGetStatus
+const (
+	REPL_STATE_PRIMARY   int = 1
+	REPL_STATE_SECONDARY int = 2
+)
 
 func Run(log *logrus.Logger, session Session, mongoConfig Config, prettyPrint bool, version string) {
 	// Initialize the output structure
@@ -34,6 +43,13 @@ func Run(log *logrus.Logger, session Session, mongoConfig Config, prettyPrint bo
 		for index := range databaseReplicatStats.Members {
 			data.Metrics = append(data.Metrics, formatReplStatsStructToMap(databaseReplicatStats, index))
 		}
+
+		currentState := newReplSetState(databaseReplicatStats)
+		previousState, found := readReplSetState(log, mongoConfig)
+		if found {
+			data.Events = append(data.Events, replSetEvents(previousState, currentState)...)
+		}
+		writeReplSetState(log, mongoConfig, currentState)
 	}
 
 	serverStatusResult := readServerStats(log, session)
@@ -76,18 +92,127 @@ func readDBReplicaStats(log *logrus.Logger, db DataLayer) (bool, ReplStats) {
 	return true, databaseReplicaStats
 }
 
+// newReplSetState captures the primary and the state of every member from a
+// replSetGetStatus result
+func newReplSetState(replStats ReplStats) replSetState {
+	state := replSetState{
+		Set:     replStats.Set,
+		Members: make(map[string]string),
+	}
+	for _, member := range replStats.Members {
+		if member.State == REPL_STATE_PRIMARY {
+			state.Primary = member.Name
+		}
+		state.Members[member.Name] = member.StateStr
+	}
+	return state
+}
+
+// replSetEvents compares the replica set state from the previous run with the
+// current one and returns an event for a primary change and for every member
+// whose state changed
+func replSetEvents(previous replSetState, current replSetState) []eventData {
+	events := make([]eventData, 0)
+	if previous.Primary != current.Primary {
+		events = append(events, eventData{
+			"event_type":                 REPL_EVENT_TYPE,
+			"provider":                   PROVIDER,
+			"category":                   "notifications",
+			"summary":                    fmt.Sprintf("replica set %v primary changed from %q to %q", current.Set, previous.Primary, current.Primary),
+			"mongo.repl.set":             current.Set,
+			"mongo.repl.event":           "primaryChanged",
+			"mongo.repl.previousPrimary": previous.Primary,
+			"mongo.repl.primary":         current.Primary,
+		})
+	}
+
+	names := make([]string, 0, len(current.Members))
+	for name := range current.Members {
+		names = append(names, name)
+	}
+	for name := range previous.Members {
+		if _, ok := current.Members[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		previousStateStr := previous.Members[name]
+		currentStateStr := current.Members[name]
+		if previousStateStr == currentStateStr {
+			continue
+		}
+		events = append(events, eventData{
+			"event_type":                      REPL_EVENT_TYPE,
+			"provider":                        PROVIDER,
+			"category":                        "notifications",
+			"summary":                         fmt.Sprintf("replica set %v member %v changed state from %q to %q", current.Set, name, previousStateStr, currentStateStr),
+			"mongo.repl.set":                  current.Set,
+			"mongo.repl.event":                "memberStateChanged",
+			"mongo.repl.member.name":          name,
+			"mongo.repl.member.previousState": previousStateStr,
+			"mongo.repl.member.stateStr":      currentStateStr,
+		})
+	}
+	return events
+}
+
+// STATE_FILE_NAME is the replica set state file in the working directory when
+// MONGODB_STATE_FILE is not set
+const STATE_FILE_NAME string = "mongoreplstate"
+
+// readReplSetState loads the replica set state saved by the previous run
+func readReplSetState(log *logrus.Logger, config Config) (replSetState, bool) {
+	var state replSetState
+	found, err := helpers.ReadState(config.StateFile, STATE_FILE_NAME, &state)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("error reading mongo replica set state file")
+	}
+	if !found {
+		return replSetState{}, false
+	}
+	return state, true
+}
+
+func writeReplSetState(log *logrus.Logger, config Config, state replSetState) {
+	if err := helpers.WriteState(config.StateFile, STATE_FILE_NAME, state); err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("error writing mongo replica set state file")
+	}
+}
+
 // InitMongoClient - function to create a mongo client
 func InitMongoClient(log *logrus.Logger, config Config) Session {
-	mongoURL := fmt.Sprintf("mongodb://%v:%v@%v:%v/%v", config.MongoDBUser, config.MongoDBPassword, config.MongoDBHost, config.MongoDBPort, config.MongoDB)
-	return NewSession(mongoURL)
+	info, mode, err := dialInfo(config)
+	fatalIfErr(log, err)
+	return NewSession(info, mode)
 }
 
 // ValidateConfig validates the config
 func ValidateConfig(config Config) error {
-	if config.MongoDBUser == "" {
+	mechanism := strings.ToUpper(config.MongoDBAuthMechanism)
+	switch mechanism {
+	case "", AUTH_SCRAM_SHA_1, AUTH_SCRAM_SHA_256, AUTH_X509, AUTH_MONGODB_CR:
+	default:
+		return fmt.Errorf("mongo auth mechanism %v is not supported", config.MongoDBAuthMechanism)
+	}
+	if mechanism == AUTH_X509 && config.MongoDBTLSCertificateKeyFile == "" && config.MongoDBURI == "" {
+		return errors.New("mongo TLS certificate key file must be set for MONGODB-X509")
+	}
+	if config.MongoDBURI != "" {
+		if !strings.HasPrefix(config.MongoDBURI, "mongodb://") && !strings.HasPrefix(config.MongoDBURI, "mongodb+srv://") {
+			return errors.New("mongo URI must start with mongodb:// or mongodb+srv://")
+		}
+		return nil
+	}
+	if config.MongoDBUser == "" && mechanism != AUTH_X509 {
 		return errors.New("mongo DBUser must be set")
 	}
-	if config.MongoDBPassword == "" {
+	if config.MongoDBPassword == "" && mechanism != AUTH_X509 {
 		return errors.New("mongo DBPassword must be set")
 	}
 	if config.MongoDBHost == "" {
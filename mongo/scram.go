@@ -0,0 +1,167 @@
+package mongo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+
+	"github.com/xdg/scram"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// wire protocol op codes used for the authentication conversation
+const (
+	OP_REPLY int32 = 1
+	OP_QUERY int32 = 2004
+)
+
+var commandRequestID int32
+
+// scramNonce generates the client nonce when set, tests replace it to get a
+// deterministic conversation
+var scramNonce scram.NonceGeneratorFcn
+
+// scramCredential authenticates a connection with SCRAM-SHA-256, which the mgo
+// driver doesn't implement. Authentication is per connection, so the sockets
+// handed to mgo are already logged in.
+type scramCredential struct {
+	Source   string
+	Username string
+	Password string
+}
+
+// login runs the saslStart/saslContinue conversation on the connection. The
+// SCRAM messages, SASLprep of the credentials included, come from
+// github.com/xdg/scram, mgo has no way to run a command on a connection it
+// is still dialing so the commands are framed here.
+func (cred *scramCredential) login(conn net.Conn) error {
+	client, err := scram.SHA256.NewClient(cred.Username, cred.Password, "")
+	if err != nil {
+		return err
+	}
+	if scramNonce != nil {
+		client = client.WithNonceGenerator(scramNonce)
+	}
+	conversation := client.NewConversation()
+	first, err := conversation.Step("")
+	if err != nil {
+		return err
+	}
+
+	res, err := runCommand(conn, cred.Source, bson.D{
+		{Name: "saslStart", Value: 1},
+		{Name: "mechanism", Value: AUTH_SCRAM_SHA_256},
+		{Name: "payload", Value: []byte(first)},
+		{Name: "autoAuthorize", Value: 1},
+	})
+	for err == nil && !conversation.Done() {
+		var response string
+		// the last step checks the server signature and has nothing to send
+		if response, err = conversation.Step(string(saslPayload(res))); err != nil || conversation.Done() {
+			break
+		}
+		res, err = saslContinue(conn, cred.Source, res, []byte(response))
+	}
+	if err != nil {
+		return err
+	}
+
+	// older servers want one more empty round trip before they are done
+	for done, _ := res["done"].(bool); !done; done, _ = res["done"].(bool) {
+		if res, err = saslContinue(conn, cred.Source, res, []byte{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saslContinue sends the next payload of the conversation the previous reply
+// belongs to
+func saslContinue(conn net.Conn, db string, previous bson.M, payload []byte) (bson.M, error) {
+	return runCommand(conn, db, bson.D{
+		{Name: "saslContinue", Value: 1},
+		{Name: "conversationId", Value: previous["conversationId"]},
+		{Name: "payload", Value: payload},
+	})
+}
+
+// runCommand sends a command to the database as an OP_QUERY on <db>.$cmd, the
+// same framing mgo uses, and returns the reply document
+func runCommand(conn net.Conn, db string, cmd bson.D) (bson.M, error) {
+	doc, err := bson.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	collection := db + ".$cmd"
+	var msg bytes.Buffer
+	header := []int32{0, atomic.AddInt32(&commandRequestID, 1), 0, OP_QUERY, 0}
+	binary.Write(&msg, binary.LittleEndian, header)
+	msg.WriteString(collection)
+	msg.WriteByte(0)
+	binary.Write(&msg, binary.LittleEndian, []int32{0, -1})
+	msg.Write(doc)
+	raw := msg.Bytes()
+	binary.LittleEndian.PutUint32(raw, uint32(len(raw)))
+	if _, err := conn.Write(raw); err != nil {
+		return nil, err
+	}
+
+	replyHeader := make([]byte, 16)
+	if _, err := io.ReadFull(conn, replyHeader); err != nil {
+		return nil, err
+	}
+	length := int32(binary.LittleEndian.Uint32(replyHeader[0:4]))
+	opCode := int32(binary.LittleEndian.Uint32(replyHeader[12:16]))
+	if opCode != OP_REPLY || length < 36 {
+		return nil, fmt.Errorf("unexpected reply with op code %d and length %d", opCode, length)
+	}
+	body := make([]byte, length-16)
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return nil, err
+	}
+	// body is responseFlags, cursorID, startingFrom and numberReturned
+	// followed by the documents
+	if binary.LittleEndian.Uint32(body[16:20]) < 1 {
+		return nil, errors.New("reply contained no documents")
+	}
+
+	var res bson.M
+	if err := bson.Unmarshal(body[20:], &res); err != nil {
+		return nil, err
+	}
+	if !commandOK(res["ok"]) {
+		return nil, fmt.Errorf("command failed: %v", res["errmsg"])
+	}
+	return res, nil
+}
+
+func commandOK(ok interface{}) bool {
+	switch v := ok.(type) {
+	case float64:
+		return v == 1
+	case int:
+		return v == 1
+	case int64:
+		return v == 1
+	case bool:
+		return v
+	}
+	return false
+}
+
+func saslPayload(res bson.M) []byte {
+	switch payload := res["payload"].(type) {
+	case []byte:
+		return payload
+	case bson.Binary:
+		return payload.Data
+	case string:
+		return []byte(payload)
+	}
+	return nil
+}
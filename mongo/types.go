@@ -85,11 +85,21 @@ func (db MockDatabase) Run(selector interface{}, update interface{}) error {
 
 //Config is the keeper of the config
 type Config struct {
-	MongoDBUser     string
-	MongoDBPassword string
-	MongoDBHost     string
-	MongoDBPort     string
-	MongoDB         string
+	MongoDBUser                  string
+	MongoDBPassword              string
+	MongoDBHost                  string
+	MongoDBPort                  string
+	MongoDB                      string
+	MongoDBURI                   string
+	MongoDBAuthMechanism         string
+	MongoDBAuthSource            string
+	MongoDBReplicaSet            string
+	MongoDBReadPreference        string
+	MongoDBTLS                   bool
+	MongoDBTLSCAFile             string
+	MongoDBTLSCertificateKeyFile string
+	MongoDBTLSInsecure           bool
+	StateFile                    string
 }
 
 // InventoryData is the data type for inventory data produced by a plugin data
@@ -329,6 +339,14 @@ type ReplMember struct {
 	Self              bool       `bson:"self" json:"self"`
 }
 
+// replSetState is the replica set view persisted between runs so elections
+// and member state changes can be detected
+type replSetState struct {
+	Set     string            `json:"set"`
+	Primary string            `json:"primary"`
+	Members map[string]string `json:"members"`
+}
+
 type ReplOptime struct {
 	TS int64 `bson:"ts" json:"ts"`
 	T  int64 `bson:"t" json:"t"`
@@ -0,0 +1,204 @@
+package mysql
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/GannettDigital/go-newrelic-plugin/helpers"
+)
+
+const REPLICATION_QUERY string = "SHOW SLAVE STATUS"
+const INNODB_STATUS_QUERY string = "SHOW ENGINE INNODB STATUS"
+const INNODB_ROW_LOCK_QUERY string = "SHOW GLOBAL STATUS LIKE 'Innodb_row_lock%'"
+const PROCESSLIST_QUERY string = "SELECT COMMAND, STATE, TIME FROM information_schema.PROCESSLIST WHERE ID != CONNECTION_ID()"
+
+// DEFAULT_LONG_QUERY_SECONDS is how long a query has to run before it counts as
+// long running when LONG_QUERY_SECONDS is not set
+const DEFAULT_LONG_QUERY_SECONDS int = 60
+
+// metricGroup is a built-in set of metrics that can be switched on in the config
+type metricGroup struct {
+	name    string
+	enabled func() bool
+	collect func(db *sql.DB) (map[string]interface{}, error)
+}
+
+var metricGroups = []metricGroup{
+	{"replication", func() bool { return config.replication }, getReplicationMetrics},
+	{"innodb", func() bool { return config.innodb }, getInnodbMetrics},
+	{"processlist", func() bool { return config.processlist }, getProcesslistMetrics},
+}
+
+// innodbStatusPatterns pull the buffer pool and locking figures out of the
+// SHOW ENGINE INNODB STATUS report
+var innodbStatusPatterns = map[string]*regexp.Regexp{
+	"mysql.innodb.bufferPool.pagesTotal":    regexp.MustCompile(`(?m)^Buffer pool size\s+(\d+)`),
+	"mysql.innodb.bufferPool.pagesFree":     regexp.MustCompile(`(?m)^Free buffers\s+(\d+)`),
+	"mysql.innodb.bufferPool.pagesData":     regexp.MustCompile(`(?m)^Database pages\s+(\d+)`),
+	"mysql.innodb.bufferPool.pagesDirty":    regexp.MustCompile(`(?m)^Modified db pages\s+(\d+)`),
+	"mysql.innodb.bufferPool.pendingReads":  regexp.MustCompile(`(?m)^Pending reads\s+(\d+)`),
+	"mysql.innodb.bufferPool.pendingWrites": regexp.MustCompile(`(?m)^Pending writes: LRU (\d+)`),
+	"mysql.innodb.historyListLength":        regexp.MustCompile(`(?m)^History list length (\d+)`),
+}
+
+var innodbHitRatePattern = regexp.MustCompile(`(?m)^Buffer pool hit rate (\d+) / (\d+)`)
+var innodbLockWaitPattern = regexp.MustCompile(`(?m)^LOCK WAIT `)
+var innodbLockWaitTimePattern = regexp.MustCompile(`(?m)^------- TRX HAS BEEN WAITING (\d+) SEC`)
+
+// getGroupMetrics runs every enabled metric group. A failing group is logged
+// and skipped so the rest of the sample is still reported.
+func getGroupMetrics(db *sql.DB, metrics map[string]interface{}) {
+	for _, group := range metricGroups {
+		if !group.enabled() {
+			continue
+		}
+		groupMetrics, err := group.collect(db)
+		if err != nil {
+			log.WithError(err).Warn(fmt.Sprintf("Failed to collect %s metrics", group.name))
+			continue
+		}
+		for name, value := range groupMetrics {
+			metrics[name] = value
+		}
+	}
+}
+
+// getReplicationMetrics reports the replica's lag and thread state. A server
+// that isn't replicating only reports mysql.replication.isReplica.
+func getReplicationMetrics(db *sql.DB) (map[string]interface{}, error) {
+	rows, err := helpers.QueryRows(db, REPLICATION_QUERY)
+	if err != nil {
+		return nil, err
+	}
+	metrics := map[string]interface{}{
+		"mysql.replication.isReplica": len(rows) > 0,
+	}
+	if len(rows) == 0 {
+		return metrics, nil
+	}
+
+	// multi-source replicas return a row per channel, the first is reported
+	status := rows[0]
+	metrics["mysql.replication.ioThreadRunning"] = status["Slave_IO_Running"] == "Yes"
+	metrics["mysql.replication.sqlThreadRunning"] = status["Slave_SQL_Running"] == "Yes"
+	if lag, ok := status["Seconds_Behind_Master"]; ok {
+		metrics["mysql.replication.secondsBehindMaster"] = helpers.AsValue(lag)
+	}
+	for column, name := range map[string]string{
+		"Master_Host":         "mysql.replication.masterHost",
+		"Master_Log_File":     "mysql.replication.masterLogFile",
+		"Read_Master_Log_Pos": "mysql.replication.readMasterLogPos",
+		"Relay_Log_File":      "mysql.replication.relayLogFile",
+		"Relay_Log_Pos":       "mysql.replication.relayLogPos",
+		"Exec_Master_Log_Pos": "mysql.replication.execMasterLogPos",
+		"Relay_Log_Space":     "mysql.replication.relayLogSpace",
+		"Last_IO_Errno":       "mysql.replication.lastIOErrno",
+		"Last_SQL_Errno":      "mysql.replication.lastSQLErrno",
+	} {
+		if value, ok := status[column]; ok {
+			metrics[name] = helpers.AsValue(value)
+		}
+	}
+	return metrics, nil
+}
+
+// getInnodbMetrics reports the buffer pool and row lock figures from the InnoDB
+// status report and the row lock status counters
+func getInnodbMetrics(db *sql.DB) (map[string]interface{}, error) {
+	rows, err := helpers.QueryRows(db, INNODB_STATUS_QUERY)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("%s returned no rows", INNODB_STATUS_QUERY)
+	}
+	metrics := parseInnodbStatus(rows[0]["Status"])
+
+	lockRows, err := helpers.QueryRows(db, INNODB_ROW_LOCK_QUERY)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range lockRows {
+		name := strings.TrimPrefix(strings.ToLower(row["Variable_name"]), "innodb_")
+		metrics["mysql.innodb."+helpers.CamelCase(name)] = helpers.AsValue(row["Value"])
+	}
+	return metrics, nil
+}
+
+func parseInnodbStatus(status string) map[string]interface{} {
+	metrics := make(map[string]interface{})
+	for name, pattern := range innodbStatusPatterns {
+		if match := pattern.FindStringSubmatch(status); match != nil {
+			metrics[name] = helpers.AsValue(match[1])
+		}
+	}
+	if match := innodbHitRatePattern.FindStringSubmatch(status); match != nil {
+		hits, _ := strconv.ParseFloat(match[1], 64)
+		total, _ := strconv.ParseFloat(match[2], 64)
+		if total > 0 {
+			metrics["mysql.innodb.bufferPool.hitRate"] = hits / total
+		}
+	}
+
+	metrics["mysql.innodb.transactionsInLockWait"] = len(innodbLockWaitPattern.FindAllString(status, -1))
+	longestWait := 0
+	for _, match := range innodbLockWaitTimePattern.FindAllStringSubmatch(status, -1) {
+		if seconds, err := strconv.Atoi(match[1]); err == nil && seconds > longestWait {
+			longestWait = seconds
+		}
+	}
+	metrics["mysql.innodb.longestLockWaitSeconds"] = longestWait
+	return metrics
+}
+
+// getProcesslistMetrics counts the server's threads by command and by state,
+// along with the queries that have been running longer than the threshold
+func getProcesslistMetrics(db *sql.DB) (map[string]interface{}, error) {
+	rows, err := helpers.QueryRows(db, PROCESSLIST_QUERY)
+	if err != nil {
+		return nil, err
+	}
+
+	metrics := map[string]interface{}{
+		"mysql.processlist.threads": len(rows),
+	}
+	longRunning := 0
+	longest := 0
+	for _, row := range rows {
+		command := row["COMMAND"]
+		state := row["STATE"]
+		if state == "" {
+			state = "none"
+		}
+		increment(metrics, "mysql.processlist.command."+processlistKey(command))
+		increment(metrics, "mysql.processlist.state."+processlistKey(state))
+
+		if command != "Query" {
+			continue
+		}
+		seconds, _ := strconv.Atoi(row["TIME"])
+		if seconds >= config.longQuerySeconds {
+			longRunning++
+		}
+		if seconds > longest {
+			longest = seconds
+		}
+	}
+	metrics["mysql.processlist.longRunningQueries"] = longRunning
+	metrics["mysql.processlist.longestQuerySeconds"] = longest
+	return metrics, nil
+}
+
+// processlistKey turns a command or state such as "Sending data" into a metric
+// name segment
+func processlistKey(value string) string {
+	return helpers.CamelCase(strings.ToLower(strings.Replace(value, " ", "_", -1)))
+}
+
+func increment(metrics map[string]interface{}, name string) {
+	count, _ := metrics[name].(int)
+	metrics[name] = count + 1
+}
@@ -0,0 +1,155 @@
+package mysql
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/GannettDigital/go-newrelic-plugin/helpers"
+	"github.com/Sirupsen/logrus"
+)
+
+const VARIABLES_QUERY string = "SHOW GLOBAL VARIABLES"
+const PLUGINS_QUERY string = "SHOW PLUGINS"
+const SCHEMAS_QUERY string = "SHOW DATABASES"
+const VARIABLE_EVENT_TYPE string = "MysqlVariableChange"
+
+// volatileVariables change with every write on a GTID enabled server, they are
+// left out of the inventory and the change events along with those listed in
+// IGNORED_VARIABLES
+var volatileVariables = []string{"gtid_executed", "gtid_owned", "gtid_purged"}
+
+// getVariables returns the server's global variables keyed by name, without
+// the ignored ones
+func getVariables(db *sql.DB) (map[string]string, error) {
+	rows, err := helpers.QueryRows(db, VARIABLES_QUERY)
+	if err != nil {
+		return nil, err
+	}
+	ignored := ignoredVariables(config.ignoredVariables)
+	variables := make(map[string]string, len(rows))
+	for _, row := range rows {
+		if !ignored[row["Variable_name"]] {
+			variables[row["Variable_name"]] = row["Value"]
+		}
+	}
+	return variables, nil
+}
+
+// ignoredVariables returns the volatile variables along with the comma
+// separated ones of IGNORED_VARIABLES
+func ignoredVariables(value string) map[string]bool {
+	ignored := make(map[string]bool)
+	for _, name := range volatileVariables {
+		ignored[name] = true
+	}
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			ignored[strings.ToLower(name)] = true
+		}
+	}
+	return ignored
+}
+
+// getInventory reports the server version, global variables, plugins and
+// schemas as inventory. Plugins and schemas that can't be read are logged and
+// left out.
+func getInventory(db *sql.DB, variables map[string]string) map[string]InventoryData {
+	inventory := map[string]InventoryData{
+		"version": {
+			"value":   variables["version"],
+			"comment": variables["version_comment"],
+		},
+	}
+	for name, value := range variables {
+		inventory["variables/"+name] = InventoryData{"value": value}
+	}
+
+	plugins, err := helpers.QueryRows(db, PLUGINS_QUERY)
+	if err != nil {
+		log.WithError(err).Warn("Failed to collect mysql plugins")
+	}
+	for _, plugin := range plugins {
+		inventory["plugins/"+plugin["Name"]] = InventoryData{
+			"status":  plugin["Status"],
+			"type":    plugin["Type"],
+			"library": plugin["Library"],
+			"license": plugin["License"],
+		}
+	}
+
+	schemas, err := helpers.QueryRows(db, SCHEMAS_QUERY)
+	if err != nil {
+		log.WithError(err).Warn("Failed to collect mysql schemas")
+	}
+	for _, schema := range schemas {
+		inventory["schemas/"+schema["Database"]] = InventoryData{"name": schema["Database"]}
+	}
+	return inventory
+}
+
+// variableEvents compares the global variables from the previous run with the
+// current ones and returns an event for every variable that changed, was added
+// or was removed. Ignored variables a previous state may still hold aren't
+// reported.
+func variableEvents(previous map[string]string, current map[string]string) []EventData {
+	ignored := ignoredVariables(config.ignoredVariables)
+	names := make([]string, 0, len(current))
+	for name := range current {
+		names = append(names, name)
+	}
+	for name := range previous {
+		if _, ok := current[name]; !ok && !ignored[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	events := make([]EventData, 0)
+	for _, name := range names {
+		previousValue, found := previous[name]
+		value, ok := current[name]
+		if found && ok && previousValue == value {
+			continue
+		}
+		events = append(events, EventData{
+			"event_type":                   VARIABLE_EVENT_TYPE,
+			"provider":                     PROVIDER,
+			"category":                     "notifications",
+			"summary":                      fmt.Sprintf("mysql variable %v changed from %q to %q", name, previousValue, value),
+			"mysql.host":                   config.host,
+			"mysql.variable.name":          name,
+			"mysql.variable.previousValue": previousValue,
+			"mysql.variable.value":         value,
+		})
+	}
+	return events
+}
+
+// STATE_FILE_NAME is the variable state file in the working directory when
+// STATE_FILE is not set
+const STATE_FILE_NAME string = "mysqlvariables"
+
+// readVariableState loads the global variables saved by the previous run
+func readVariableState() (map[string]string, bool) {
+	var variables map[string]string
+	found, err := helpers.ReadState(config.stateFile, STATE_FILE_NAME, &variables)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("error reading mysql variable state file")
+	}
+	if !found {
+		return nil, false
+	}
+	return variables, true
+}
+
+func writeVariableState(variables map[string]string) {
+	if err := helpers.WriteState(config.stateFile, STATE_FILE_NAME, variables); err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("error writing mysql variable state file")
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"database/sql"
 	"fmt"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/GannettDigital/go-newrelic-plugin/helpers"
@@ -27,6 +29,15 @@ type mysqlConfig struct {
 	database string
 	queries  string
 	prefixes string
+
+	replication      bool
+	innodb           bool
+	processlist      bool
+	longQuerySeconds int
+
+	customQueries    string
+	stateFile        string
+	ignoredVariables string
 }
 
 // InventoryData is the data type for inventory data produced by a plugin data
@@ -61,6 +72,15 @@ var config = mysqlConfig{
 	database: os.Getenv("DATABASE"),
 	queries:  os.Getenv("QUERIES"),
 	prefixes: os.Getenv("PREFIXES"),
+
+	replication:      os.Getenv("REPLICATION_METRICS") == "true",
+	innodb:           os.Getenv("INNODB_METRICS") == "true",
+	processlist:      os.Getenv("PROCESSLIST_METRICS") == "true",
+	longQuerySeconds: longQuerySeconds(os.Getenv("LONG_QUERY_SECONDS")),
+
+	customQueries:    os.Getenv("CUSTOM_QUERIES"),
+	stateFile:        os.Getenv("STATE_FILE"),
+	ignoredVariables: os.Getenv("IGNORED_VARIABLES"),
 }
 
 func Run(logger *logrus.Logger, prettyPrint bool, version string) {
@@ -77,6 +97,8 @@ func Run(logger *logrus.Logger, prettyPrint bool, version string) {
 	}
 
 	validateConfig()
+	customQueries, err := parseCustomQueries(config.customQueries)
+	fatalIfErr(err, "Config Yaml has an invalid CUSTOM_QUERIES value. Please check the config to continue")
 
 	db, err := sql.Open("mysql", generateDSN())
 	if err != nil {
@@ -90,6 +112,19 @@ func Run(logger *logrus.Logger, prettyPrint bool, version string) {
 		data.Status = err.Error()
 	}
 	data.Metrics = append(data.Metrics, metric)
+	data.Metrics = append(data.Metrics, getCustomQuerySamples(db, customQueries)...)
+
+	variables, err := getVariables(db)
+	if err != nil {
+		log.WithError(err).Warn("Failed to collect mysql global variables")
+	} else {
+		data.Inventory = getInventory(db, variables)
+		previousVariables, found := readVariableState()
+		if found {
+			data.Events = append(data.Events, variableEvents(previousVariables, variables)...)
+		}
+		writeVariableState(variables)
+	}
 	fatalIfErr(helpers.OutputJSON(data, prettyPrint), "OutputJSON error")
 }
 
@@ -105,6 +140,10 @@ func getMetrics(db *sql.DB) (map[string]interface{}, error) {
 		if query == "" {
 			continue
 		}
+		if isVariablesQuery(query) {
+			log.Warn(fmt.Sprintf("Skipping query %s, the global variables are reported as inventory", query))
+			continue
+		}
 		rows, err := db.Query(query)
 		if err != nil {
 			log.WithError(err).Warn(" query; " + query)
@@ -142,9 +181,21 @@ func getMetrics(db *sql.DB) (map[string]interface{}, error) {
 			}
 		}
 	}
+
+	getGroupMetrics(db, metrics)
 	return metrics, nil
 }
 
+// variablesQueryPattern matches the statements listing the server variables,
+// older configs still list them in QUERIES
+var variablesQueryPattern = regexp.MustCompile(`(?i)^show\s+(global\s+)?variables$`)
+
+// isVariablesQuery tells whether the query lists the variables, which are now
+// reported as inventory instead of flattened into the sample
+func isVariablesQuery(query string) bool {
+	return variablesQueryPattern.MatchString(strings.TrimSpace(query))
+}
+
 func metricName(metric string) string {
 	log.Debug(fmt.Sprintf("metricName: metric: %s", metric))
 	result := fmt.Sprintf("mysql.%s", helpers.CamelCase(fixPrefix(metric)))
@@ -153,13 +204,7 @@ func metricName(metric string) string {
 }
 
 func fixPrefix(src string) string {
-	for _, prefix := range strings.Split(config.prefixes, " ") {
-		if strings.HasPrefix(src, prefix) {
-			src = strings.Replace(src, "_", ".", 1)
-			return src
-		}
-	}
-	return src
+	return helpers.FixPrefix(src, config.prefixes)
 }
 
 func generateDSN() string {
@@ -184,14 +229,25 @@ func validateConfig() {
 	if config.database == "" {
 		log.Fatal("Config Yaml is missing DATABASE value. Please check the config to continue")
 	}
-	if config.queries == "" {
+	groupsEnabled := config.replication || config.innodb || config.processlist
+	if config.queries == "" && !groupsEnabled && config.customQueries == "" {
 		log.Fatal("Config Yaml is missing QUERIES value. Please check the config to continue")
 	}
-	if config.prefixes == "" {
+	if config.queries != "" && config.prefixes == "" {
 		log.Fatal("Config Yaml is missing PREFIXES value. Please check the config to continue")
 	}
 }
 
+// longQuerySeconds parses LONG_QUERY_SECONDS, falling back to the default when
+// it is unset or invalid
+func longQuerySeconds(value string) int {
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds <= 0 {
+		return DEFAULT_LONG_QUERY_SECONDS
+	}
+	return seconds
+}
+
 func fatalIfErr(err error, msg string) {
 	if err != nil {
 		log.WithError(err).Fatal(msg)
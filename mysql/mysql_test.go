@@ -1,8 +1,14 @@
 package mysql
 
 import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
 	"testing"
 
+	"github.com/GannettDigital/go-newrelic-plugin/helpers"
 	"github.com/franela/goblin"
 	"github.com/Sirupsen/logrus"
 	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
@@ -57,6 +63,48 @@ func TestGetMetrics(t *testing.T) {
 	getMetrics(db)
 }
 
+func TestIsVariablesQuery(t *testing.T) {
+	g := goblin.Goblin(t)
+	var tests = []struct {
+		TestDescription string
+		query           string
+		result          bool
+	}{
+		{
+			TestDescription: "Should match show global variables",
+			query:           " show global variables",
+			result:          true,
+		},
+		{
+			TestDescription: "Should match any case and spacing",
+			query:           "SHOW  GLOBAL\tVARIABLES",
+			result:          true,
+		},
+		{
+			TestDescription: "Should match show variables",
+			query:           "show variables",
+			result:          true,
+		},
+		{
+			TestDescription: "Should not match show status",
+			query:           "show global status",
+			result:          false,
+		},
+		{
+			TestDescription: "Should not match a filtered variables query",
+			query:           "show global variables like 'max_connections'",
+			result:          false,
+		},
+	}
+	for _, test := range tests {
+		g.Describe("isVariablesQuery()", func() {
+			g.It(test.TestDescription, func() {
+				g.Assert(isVariablesQuery(test.query)).Equal(test.result)
+			})
+		})
+	}
+}
+
 func TestMetricName(t *testing.T) {
 	g := goblin.Goblin(t)
 	var tests = []struct {
@@ -123,3 +171,435 @@ func TestGenerateDSN(t *testing.T) {
 		})
 	}
 }
+
+func TestGetReplicationMetrics(t *testing.T) {
+	g := goblin.Goblin(t)
+	var tests = []struct {
+		TestDescription string
+		rows            *sqlmock.Rows
+		result          map[string]interface{}
+	}{
+		{
+			TestDescription: "Should report lag and thread state for a replica",
+			rows: sqlmock.NewRows([]string{"Slave_IO_State", "Master_Host", "Master_Log_File", "Read_Master_Log_Pos", "Relay_Log_File", "Relay_Log_Pos", "Slave_IO_Running", "Slave_SQL_Running", "Last_SQL_Errno", "Exec_Master_Log_Pos", "Seconds_Behind_Master"}).
+				AddRow("Waiting for master to send event", "db-primary", "mysql-bin.000042", 1337, "relay-bin.000007", 420, "Yes", "No", 1062, 1300, nil),
+			result: map[string]interface{}{
+				"mysql.replication.isReplica":        true,
+				"mysql.replication.ioThreadRunning":  true,
+				"mysql.replication.sqlThreadRunning": false,
+				"mysql.replication.masterHost":       "db-primary",
+				"mysql.replication.masterLogFile":    "mysql-bin.000042",
+				"mysql.replication.readMasterLogPos": 1337,
+				"mysql.replication.relayLogFile":     "relay-bin.000007",
+				"mysql.replication.relayLogPos":      420,
+				"mysql.replication.execMasterLogPos": 1300,
+				"mysql.replication.lastSQLErrno":     1062,
+			},
+		},
+		{
+			TestDescription: "Should only report isReplica for a server that isn't replicating",
+			rows:            sqlmock.NewRows([]string{"Slave_IO_State"}),
+			result:          map[string]interface{}{"mysql.replication.isReplica": false},
+		},
+	}
+	for _, test := range tests {
+		g.Describe("getReplicationMetrics()", func() {
+			g.It(test.TestDescription, func() {
+				db, mock, err := sqlmock.New()
+				if err != nil {
+					t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+				}
+				defer db.Close()
+				mock.ExpectQuery(regexp.QuoteMeta(REPLICATION_QUERY)).WillReturnRows(test.rows)
+
+				metrics, err := getReplicationMetrics(db)
+				g.Assert(err).Equal(nil)
+				g.Assert(metrics).Equal(test.result)
+			})
+		})
+	}
+}
+
+func TestGetInnodbMetrics(t *testing.T) {
+	g := goblin.Goblin(t)
+	status := `
+------------
+TRANSACTIONS
+------------
+Trx id counter 1537
+History list length 12
+LIST OF TRANSACTIONS FOR EACH SESSION:
+---TRANSACTION 1536, ACTIVE 14 sec starting index read
+mysql tables in use 1, locked 1
+LOCK WAIT 2 lock struct(s), heap size 1136, 1 row lock(s)
+------- TRX HAS BEEN WAITING 14 SEC FOR THIS LOCK TO BE GRANTED:
+---TRANSACTION 1535, ACTIVE 3 sec starting index read, thread declared inside InnoDB 5000
+mysql tables in use 1, locked 1
+LOCK WAIT 2 lock struct(s), heap size 1136, 1 row lock(s)
+------- TRX HAS BEEN WAITING 3 SEC FOR THIS LOCK TO BE GRANTED:
+----------------------
+BUFFER POOL AND MEMORY
+----------------------
+Total large memory allocated 137428992
+Buffer pool size   8191
+Free buffers       7741
+Database pages     450
+Modified db pages  3
+Pending reads      1
+Pending writes: LRU 2, flush list 0, single page 0
+Buffer pool hit rate 995 / 1000, young-making rate 0 / 1000 not 0 / 1000
+`
+
+	g.Describe("getInnodbMetrics()", func() {
+		g.It("Should report buffer pool and row lock metrics", func() {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+			mock.ExpectQuery(regexp.QuoteMeta(INNODB_STATUS_QUERY)).
+				WillReturnRows(sqlmock.NewRows([]string{"Type", "Name", "Status"}).AddRow("InnoDB", "", status))
+			mock.ExpectQuery(regexp.QuoteMeta(INNODB_ROW_LOCK_QUERY)).
+				WillReturnRows(sqlmock.NewRows([]string{"Variable_name", "Value"}).
+					AddRow("Innodb_row_lock_current_waits", 2).
+					AddRow("Innodb_row_lock_time_avg", 17))
+
+			metrics, err := getInnodbMetrics(db)
+			g.Assert(err).Equal(nil)
+			g.Assert(metrics).Equal(map[string]interface{}{
+				"mysql.innodb.bufferPool.pagesTotal":    8191,
+				"mysql.innodb.bufferPool.pagesFree":     7741,
+				"mysql.innodb.bufferPool.pagesData":     450,
+				"mysql.innodb.bufferPool.pagesDirty":    3,
+				"mysql.innodb.bufferPool.pendingReads":  1,
+				"mysql.innodb.bufferPool.pendingWrites": 2,
+				"mysql.innodb.bufferPool.hitRate":       0.995,
+				"mysql.innodb.historyListLength":        12,
+				"mysql.innodb.transactionsInLockWait":   2,
+				"mysql.innodb.longestLockWaitSeconds":   14,
+				"mysql.innodb.rowLockCurrentWaits":      2,
+				"mysql.innodb.rowLockTimeAvg":           17,
+			})
+		})
+	})
+}
+
+func TestGetProcesslistMetrics(t *testing.T) {
+	g := goblin.Goblin(t)
+	g.Describe("getProcesslistMetrics()", func() {
+		g.It("Should count threads by command and state and flag long running queries", func() {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+			mock.ExpectQuery(regexp.QuoteMeta(PROCESSLIST_QUERY)).
+				WillReturnRows(sqlmock.NewRows([]string{"COMMAND", "STATE", "TIME"}).
+					AddRow("Sleep", "", 300).
+					AddRow("Query", "Sending data", 75).
+					AddRow("Query", "Sending data", 12).
+					AddRow("Binlog Dump", "Master has sent all binlog to slave; waiting for more updates", 9000))
+
+			original := config
+			defer func() { config = original }()
+			config.longQuerySeconds = 60
+			metrics, err := getProcesslistMetrics(db)
+			g.Assert(err).Equal(nil)
+			g.Assert(metrics).Equal(map[string]interface{}{
+				"mysql.processlist.threads":                                                  4,
+				"mysql.processlist.command.sleep":                                            1,
+				"mysql.processlist.command.query":                                            2,
+				"mysql.processlist.command.binlogDump":                                       1,
+				"mysql.processlist.state.none":                                               1,
+				"mysql.processlist.state.sendingData":                                        2,
+				"mysql.processlist.state.masterHasSentAllBinlogToSlaveWaitingForMoreUpdates": 1,
+				"mysql.processlist.longRunningQueries":                                       1,
+				"mysql.processlist.longestQuerySeconds":                                      75,
+			})
+		})
+	})
+}
+
+func TestGetGroupMetrics(t *testing.T) {
+	g := goblin.Goblin(t)
+	g.Describe("getGroupMetrics()", func() {
+		g.It("Should only run the enabled groups and skip the ones that fail", func() {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+			mock.ExpectQuery(regexp.QuoteMeta(REPLICATION_QUERY)).WillReturnError(errors.New("Access denied; you need the REPLICATION CLIENT privilege"))
+			mock.ExpectQuery(regexp.QuoteMeta(PROCESSLIST_QUERY)).
+				WillReturnRows(sqlmock.NewRows([]string{"COMMAND", "STATE", "TIME"}))
+
+			defaultConfig := config
+			defer func() { config = defaultConfig }()
+			config.replication = true
+			config.innodb = false
+			config.processlist = true
+
+			metrics := map[string]interface{}{"provider": PROVIDER}
+			getGroupMetrics(db, metrics)
+			g.Assert(metrics["mysql.processlist.threads"]).Equal(0)
+			g.Assert(metrics["mysql.replication.isReplica"]).Equal(nil)
+			g.Assert(mock.ExpectationsWereMet()).Equal(nil)
+		})
+	})
+}
+
+func TestLongQuerySeconds(t *testing.T) {
+	g := goblin.Goblin(t)
+	g.Describe("longQuerySeconds()", func() {
+		g.It("Should parse the configured threshold", func() {
+			g.Assert(longQuerySeconds("30")).Equal(30)
+		})
+		g.It("Should fall back to the default when unset or invalid", func() {
+			g.Assert(longQuerySeconds("")).Equal(DEFAULT_LONG_QUERY_SECONDS)
+			g.Assert(longQuerySeconds("soon")).Equal(DEFAULT_LONG_QUERY_SECONDS)
+		})
+	})
+}
+
+func TestParseCustomQueries(t *testing.T) {
+	g := goblin.Goblin(t)
+	var tests = []struct {
+		TestDescription string
+		value           string
+		result          []helpers.CustomQuery
+		err             string
+	}{
+		{
+			TestDescription: "Should fill in the event type and timeout defaults",
+			value: `
+- name: schemaSize
+  query: SELECT table_schema, count(*) AS tables FROM information_schema.tables GROUP BY table_schema
+  attributes: [table_schema]
+  metrics: [tables]
+- name: orders
+  query: SELECT status, count(*) AS total FROM shop.orders GROUP BY status
+  event_type: ShopOrderSample
+  attributes: [status]
+  metrics: [total]
+  timeout: 3
+`,
+			result: []helpers.CustomQuery{
+				{
+					Name:       "schemaSize",
+					Query:      "SELECT table_schema, count(*) AS tables FROM information_schema.tables GROUP BY table_schema",
+					EventType:  DEFAULT_CUSTOM_QUERY_EVENT_TYPE,
+					Attributes: []string{"table_schema"},
+					Metrics:    []string{"tables"},
+					Timeout:    helpers.DEFAULT_CUSTOM_QUERY_TIMEOUT,
+				},
+				{
+					Name:       "orders",
+					Query:      "SELECT status, count(*) AS total FROM shop.orders GROUP BY status",
+					EventType:  "ShopOrderSample",
+					Attributes: []string{"status"},
+					Metrics:    []string{"total"},
+					Timeout:    3,
+				},
+			},
+		},
+		{
+			TestDescription: "Should return nothing when no queries are configured",
+			value:           "",
+			result:          nil,
+		},
+		{
+			TestDescription: "Should reject a query without metric columns",
+			value:           "- {name: orders, query: SELECT 1}",
+			err:             "custom query orders has no metric columns",
+		},
+		{
+			TestDescription: "Should reject duplicate names",
+			value:           "- {name: orders, query: SELECT 1 AS one, metrics: [one]}\n- {name: orders, query: SELECT 2 AS two, metrics: [two]}",
+			err:             "custom query orders is defined more than once",
+		},
+	}
+	for _, test := range tests {
+		g.Describe("parseCustomQueries()", func() {
+			g.It(test.TestDescription, func() {
+				queries, err := parseCustomQueries(test.value)
+				if test.err != "" {
+					g.Assert(err.Error()).Equal(test.err)
+					return
+				}
+				g.Assert(err).Equal(nil)
+				g.Assert(queries).Equal(test.result)
+			})
+		})
+	}
+}
+
+func TestGetCustomQuerySamples(t *testing.T) {
+	g := goblin.Goblin(t)
+	g.Describe("getCustomQuerySamples()", func() {
+		g.It("Should report a sample per row and skip the queries that fail", func() {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+			mock.ExpectQuery("^SELECT table_schema").
+				WillReturnRows(sqlmock.NewRows([]string{"table_schema", "tables", "data_length"}).
+					AddRow("shop", 12, 16384).
+					AddRow("mysql", 31, nil))
+			mock.ExpectQuery("^SELECT status").WillReturnError(errors.New("Table 'shop.orders' doesn't exist"))
+
+			queries := []helpers.CustomQuery{
+				{
+					Name:       "schemaSize",
+					Query:      "SELECT table_schema, count(*) AS tables, sum(data_length) AS data_length FROM information_schema.tables GROUP BY table_schema",
+					EventType:  "MysqlSchemaSample",
+					Attributes: []string{"table_schema"},
+					Metrics:    []string{"tables", "data_length"},
+					Timeout:    5,
+				},
+				{
+					Name:      "orders",
+					Query:     "SELECT status, count(*) AS total FROM shop.orders GROUP BY status",
+					EventType: DEFAULT_CUSTOM_QUERY_EVENT_TYPE,
+					Metrics:   []string{"total"},
+					Timeout:   5,
+				},
+			}
+			samples := getCustomQuerySamples(db, queries)
+			g.Assert(samples).Equal([]MetricData{
+				{"event_type": "MysqlSchemaSample", "provider": PROVIDER, "query": "schemaSize", "table_schema": "shop", "tables": float64(12), "data_length": float64(16384)},
+				{"event_type": "MysqlSchemaSample", "provider": PROVIDER, "query": "schemaSize", "table_schema": "mysql", "tables": float64(31)},
+			})
+			g.Assert(mock.ExpectationsWereMet()).Equal(nil)
+		})
+	})
+}
+
+func TestGetInventory(t *testing.T) {
+	g := goblin.Goblin(t)
+	g.Describe("getInventory()", func() {
+		g.It("Should report the version, variables but the ignored ones, plugins and schemas", func() {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+			mock.ExpectQuery(VARIABLES_QUERY).
+				WillReturnRows(sqlmock.NewRows([]string{"Variable_name", "Value"}).
+					AddRow("gtid_executed", "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5").
+					AddRow("innodb_buffer_pool_size", "134217728").
+					AddRow("read_only", "OFF").
+					AddRow("version", "5.7.20-log").
+					AddRow("version_comment", "MySQL Community Server (GPL)"))
+			mock.ExpectQuery(PLUGINS_QUERY).
+				WillReturnRows(sqlmock.NewRows([]string{"Name", "Status", "Type", "Library", "License"}).
+					AddRow("InnoDB", "ACTIVE", "STORAGE ENGINE", nil, "GPL"))
+			mock.ExpectQuery(SCHEMAS_QUERY).WillReturnError(errors.New("Access denied"))
+
+			original := config
+			defer func() { config = original }()
+			config.ignoredVariables = "Read_Only, super_read_only"
+			variables, err := getVariables(db)
+			g.Assert(err).Equal(nil)
+			g.Assert(getInventory(db, variables)).Equal(map[string]InventoryData{
+				"version":                           {"value": "5.7.20-log", "comment": "MySQL Community Server (GPL)"},
+				"variables/innodb_buffer_pool_size": {"value": "134217728"},
+				"variables/version":                 {"value": "5.7.20-log"},
+				"variables/version_comment":         {"value": "MySQL Community Server (GPL)"},
+				"plugins/InnoDB":                    {"status": "ACTIVE", "type": "STORAGE ENGINE", "library": "", "license": "GPL"},
+			})
+			g.Assert(mock.ExpectationsWereMet()).Equal(nil)
+		})
+	})
+}
+
+func TestVariableEvents(t *testing.T) {
+	g := goblin.Goblin(t)
+	var tests = []struct {
+		TestDescription string
+		previous        map[string]string
+		current         map[string]string
+		result          []EventData
+	}{
+		{
+			TestDescription: "Should not report anything when nothing changed",
+			previous:        map[string]string{"max_connections": "151"},
+			current:         map[string]string{"max_connections": "151"},
+			result:          []EventData{},
+		},
+		{
+			TestDescription: "Should not report the ignored variables of a previous state",
+			previous:        map[string]string{"gtid_executed": "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5"},
+			current:         map[string]string{},
+			result:          []EventData{},
+		},
+		{
+			TestDescription: "Should report changed, added and removed variables",
+			previous:        map[string]string{"max_connections": "151", "query_cache_size": "1048576"},
+			current:         map[string]string{"max_connections": "500", "read_only": "ON"},
+			result: []EventData{
+				{
+					"event_type":                   VARIABLE_EVENT_TYPE,
+					"provider":                     PROVIDER,
+					"category":                     "notifications",
+					"summary":                      `mysql variable max_connections changed from "151" to "500"`,
+					"mysql.host":                   "HOST",
+					"mysql.variable.name":          "max_connections",
+					"mysql.variable.previousValue": "151",
+					"mysql.variable.value":         "500",
+				},
+				{
+					"event_type":                   VARIABLE_EVENT_TYPE,
+					"provider":                     PROVIDER,
+					"category":                     "notifications",
+					"summary":                      `mysql variable query_cache_size changed from "1048576" to ""`,
+					"mysql.host":                   "HOST",
+					"mysql.variable.name":          "query_cache_size",
+					"mysql.variable.previousValue": "1048576",
+					"mysql.variable.value":         "",
+				},
+				{
+					"event_type":                   VARIABLE_EVENT_TYPE,
+					"provider":                     PROVIDER,
+					"category":                     "notifications",
+					"summary":                      `mysql variable read_only changed from "" to "ON"`,
+					"mysql.host":                   "HOST",
+					"mysql.variable.name":          "read_only",
+					"mysql.variable.previousValue": "",
+					"mysql.variable.value":         "ON",
+				},
+			},
+		},
+	}
+	for _, test := range tests {
+		g.Describe("variableEvents()", func() {
+			g.It(test.TestDescription, func() {
+				g.Assert(variableEvents(test.previous, test.current)).Equal(test.result)
+			})
+		})
+	}
+}
+
+func TestVariableState(t *testing.T) {
+	g := goblin.Goblin(t)
+	g.Describe("readVariableState()", func() {
+		g.It("Should read back the variables saved by the previous run", func() {
+			dir, err := ioutil.TempDir("", "mysql")
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when creating a temp dir", err)
+			}
+			defer os.RemoveAll(dir)
+
+			defaultConfig := config
+			defer func() { config = defaultConfig }()
+			config.stateFile = filepath.Join(dir, "mysqlvariables")
+
+			_, found := readVariableState()
+			g.Assert(found).Equal(false)
+			writeVariableState(map[string]string{"max_connections": "151"})
+			variables, found := readVariableState()
+			g.Assert(found).Equal(true)
+			g.Assert(variables).Equal(map[string]string{"max_connections": "151"})
+		})
+	})
+}
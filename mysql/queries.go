@@ -0,0 +1,25 @@
+package mysql
+
+import (
+	"database/sql"
+
+	"github.com/GannettDigital/go-newrelic-plugin/helpers"
+)
+
+const DEFAULT_CUSTOM_QUERY_EVENT_TYPE string = "MysqlCustomQuerySample"
+
+// parseCustomQueries reads the CUSTOM_QUERIES YAML list, see
+// helpers.ParseCustomQueries
+func parseCustomQueries(value string) ([]helpers.CustomQuery, error) {
+	return helpers.ParseCustomQueries(value, DEFAULT_CUSTOM_QUERY_EVENT_TYPE)
+}
+
+// getCustomQuerySamples reports a sample per row of every custom query, the
+// queries that fail are logged and skipped
+func getCustomQuerySamples(db *sql.DB, queries []helpers.CustomQuery) []MetricData {
+	samples := make([]MetricData, 0)
+	for _, sample := range helpers.CustomQuerySamples(log, db, queries, PROVIDER) {
+		samples = append(samples, MetricData(sample))
+	}
+	return samples
+}
@@ -0,0 +1,373 @@
+package nginx
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/GannettDigital/go-newrelic-plugin/helpers"
+	"github.com/Sirupsen/logrus"
+)
+
+// DEFAULT_LOG_FORMAT is nginx's predefined combined format with the request
+// and upstream timings added, which are needed for the latency metrics
+const DEFAULT_LOG_FORMAT string = `$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent "$http_referer" "$http_user_agent" $request_time $upstream_response_time $upstream_addr`
+
+var logVariablePattern = regexp.MustCompile(`\$([a-z0-9_]+)`)
+
+// the upstream variables list a value per upstream tried, separated by ", "
+// or " : ", so they can't simply stop at the next space
+const upstreamListPattern string = `[^ ]+(?:(?:, | : )[^ ]+)*`
+
+// MAX_LOG_BYTES caps how much of the access log is read in one run. Whatever
+// is left is read by the next runs, so a burst of traffic or a log that wasn't
+// read for a while can't stall the plugin.
+const MAX_LOG_BYTES int64 = 64 * 1024 * 1024
+
+// LOG_STATE_FILE_NAME is the access log state file in the working directory
+// when NGINXSTATEFILE is not set
+const LOG_STATE_FILE_NAME string = "nginxlogstate"
+
+// logState is where the previous run stopped reading the access log and
+// whether it left lines over MAX_LOG_BYTES for the next run
+type logState struct {
+	Inode     uint64 `json:"inode"`
+	Offset    int64  `json:"offset"`
+	Timestamp int64  `json:"timestamp"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+// logTimings are the timings of the requests seen for one set of metrics
+type logTimings struct {
+	requests     int
+	statuses     map[string]int
+	requestTimes []float64
+	upstreamTime []float64
+}
+
+func newLogTimings() *logTimings {
+	return &logTimings{statuses: make(map[string]int)}
+}
+
+// compileLogFormat turns an nginx log_format into a regular expression with a
+// named group for every variable
+func compileLogFormat(format string) (*regexp.Regexp, error) {
+	var pattern bytes.Buffer
+	pattern.WriteString("^")
+	last := 0
+	for _, match := range logVariablePattern.FindAllStringSubmatchIndex(format, -1) {
+		pattern.WriteString(regexp.QuoteMeta(format[last:match[0]]))
+		name := format[match[2]:match[3]]
+		if strings.HasPrefix(name, "upstream_") {
+			pattern.WriteString(fmt.Sprintf("(?P<%s>%s)", name, upstreamListPattern))
+		} else {
+			pattern.WriteString(fmt.Sprintf("(?P<%s>.*?)", name))
+		}
+		last = match[1]
+	}
+	pattern.WriteString(regexp.QuoteMeta(format[last:]))
+	pattern.WriteString("$")
+	return regexp.Compile(pattern.String())
+}
+
+// getLogMetrics reads the access log written since the last run and returns
+// a sample of the whole log, kept apart from the status samples which may not
+// include the one of the host, along with a sample per upstream
+func getLogMetrics(log *logrus.Logger, config Config) (MetricData, []MetricData, error) {
+	format := config.NginxLogFormat
+	if format == "" {
+		format = DEFAULT_LOG_FORMAT
+	}
+	pattern, err := compileLogFormat(format)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid log format: %v", err)
+	}
+
+	now := time.Now()
+	previous, found := readLogState(log, config)
+	aggregate := newLogAggregate(pattern)
+	current, err := readNewLines(config.NginxAccessLog, previous, found, MAX_LOG_BYTES, aggregate.add)
+	if err != nil {
+		return nil, nil, err
+	}
+	current.Timestamp = now.Unix()
+	writeLogState(log, config, current)
+
+	total, upstreams := aggregate.total, aggregate.upstreams
+	metrics := timingMetrics("nginx.log", total)
+	metrics["event_type"] = "LoadBalancerSample"
+	metrics["provider"] = PROVIDER
+	metrics["nginx.hostname"] = os.Getenv("HOSTNAME")
+	metrics["nginx.log.unparsedLines"] = aggregate.unparsed
+	// a capped read holds lines of more than the time since the last run, as
+	// does the read picking up what it left
+	if found && !previous.Truncated && !current.Truncated && previous.Timestamp > 0 && now.Unix() > previous.Timestamp {
+		metrics["nginx.log.requestsPerSecond"] = float64(total.requests) / float64(now.Unix()-previous.Timestamp)
+	}
+
+	names := make([]string, 0, len(upstreams))
+	for name := range upstreams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	samples := make([]MetricData, 0, len(names))
+	for _, name := range names {
+		sample := timingMetrics("nginx.log.upstream", upstreams[name])
+		sample["event_type"] = "LoadBalancerSample"
+		sample["provider"] = PROVIDER
+		sample["nginx.hostname"] = os.Getenv("HOSTNAME")
+		sample["nginx.log.upstream"] = name
+		samples = append(samples, sample)
+	}
+	return metrics, samples, nil
+}
+
+// readNewLines hands the complete lines written to the log since the previous
+// state to handle, reading at most limit bytes. A new inode means the log was
+// rotated, so the rest of the rotated file is read first when it can still be
+// found next to the log, e.g. as <log>.1 or <log>-20180312. A file smaller than
+// the offset was truncated and is read from the start. On the first run the
+// log is only read from its current end.
+func readNewLines(path string, previous logState, found bool, limit int64, handle func(line string)) (logState, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return previous, err
+	}
+	current := logState{Inode: fileInode(info), Offset: info.Size()}
+	if !found {
+		return current, nil
+	}
+
+	offset := previous.Offset
+	if previous.Inode != current.Inode {
+		if rotated := rotatedLog(path, previous.Inode); rotated != "" {
+			end, _, err := readLines(rotated, previous.Offset, limit, handle)
+			if err != nil {
+				return previous, err
+			}
+			limit -= end - previous.Offset
+			if limit <= 0 {
+				// the rest of the rotated log is left for the next run
+				return logState{Inode: previous.Inode, Offset: end, Truncated: true}, nil
+			}
+		}
+		offset = 0
+	} else if offset > info.Size() {
+		offset = 0
+	}
+
+	end, truncated, err := readLines(path, offset, limit, handle)
+	if err != nil {
+		return previous, err
+	}
+	current.Offset = end
+	current.Truncated = truncated
+	return current, nil
+}
+
+// rotatedLog looks for the file the log was rotated to by its inode, so both
+// numbered and dated names are found. A compressed log is a new file and is
+// never matched.
+func rotatedLog(path string, inode uint64) string {
+	for _, pattern := range []string{path + ".*", path + "-*"} {
+		candidates, _ := filepath.Glob(pattern)
+		for _, candidate := range candidates {
+			if info, err := os.Stat(candidate); err == nil && info.Mode().IsRegular() && fileInode(info) == inode {
+				return candidate
+			}
+		}
+	}
+	return ""
+}
+
+// readLines hands the complete lines from offset to handle until at least
+// limit bytes were read and returns the offset just after the last one, along
+// with whether the limit left lines unread. A partly written line is left for
+// the next run.
+func readLines(path string, offset int64, limit int64, handle func(line string)) (int64, bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return offset, false, err
+	}
+	defer file.Close()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return offset, false, err
+	}
+
+	start := offset
+	reader := bufio.NewReader(file)
+	for offset-start < limit {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			return offset, false, nil
+		}
+		if err != nil {
+			return offset, false, err
+		}
+		offset += int64(len(line))
+		handle(strings.TrimRight(line, "\r\n"))
+	}
+	_, err = reader.ReadString('\n')
+	return offset, err == nil, nil
+}
+
+// logAggregate adds up the requests overall and for every upstream that
+// served one as the lines are read
+type logAggregate struct {
+	pattern   *regexp.Regexp
+	names     []string
+	total     *logTimings
+	upstreams map[string]*logTimings
+	unparsed  int
+}
+
+func newLogAggregate(pattern *regexp.Regexp) *logAggregate {
+	return &logAggregate{
+		pattern:   pattern,
+		names:     pattern.SubexpNames(),
+		total:     newLogTimings(),
+		upstreams: make(map[string]*logTimings),
+	}
+}
+
+func (a *logAggregate) add(line string) {
+	match := a.pattern.FindStringSubmatch(line)
+	if match == nil {
+		a.unparsed++
+		return
+	}
+	fields := make(map[string]string, len(a.names))
+	for i, name := range a.names {
+		if name != "" {
+			fields[name] = match[i]
+		}
+	}
+
+	statusClass := ""
+	if status := fields["status"]; len(status) == 3 {
+		statusClass = status[:1] + "xx"
+	}
+	requestTime, hasRequestTime := parseLogTime(fields["request_time"])
+	upstreamTime, hasUpstreamTime := parseLogTime(fields["upstream_response_time"])
+	a.total.add(statusClass, requestTime, hasRequestTime, upstreamTime, hasUpstreamTime)
+
+	if upstream := lastLogValue(fields["upstream_addr"]); upstream != "" && upstream != "-" {
+		if _, ok := a.upstreams[upstream]; !ok {
+			a.upstreams[upstream] = newLogTimings()
+		}
+		a.upstreams[upstream].add(statusClass, requestTime, hasRequestTime, upstreamTime, hasUpstreamTime)
+	}
+}
+
+func (t *logTimings) add(statusClass string, requestTime float64, hasRequestTime bool, upstreamTime float64, hasUpstreamTime bool) {
+	t.requests++
+	if statusClass != "" {
+		t.statuses[statusClass]++
+	}
+	if hasRequestTime {
+		t.requestTimes = append(t.requestTimes, requestTime)
+	}
+	if hasUpstreamTime {
+		t.upstreamTime = append(t.upstreamTime, upstreamTime)
+	}
+}
+
+// timingMetrics reports the request count, the count per status class and
+// the latency percentiles in seconds
+func timingMetrics(prefix string, timings *logTimings) MetricData {
+	metrics := MetricData{
+		prefix + ".requests": timings.requests,
+	}
+	for _, class := range []string{"1xx", "2xx", "3xx", "4xx", "5xx"} {
+		metrics[prefix+".status."+class] = timings.statuses[class]
+	}
+	addPercentiles(metrics, prefix+".requestTime", timings.requestTimes)
+	addPercentiles(metrics, prefix+".upstreamResponseTime", timings.upstreamTime)
+	return metrics
+}
+
+func addPercentiles(metrics MetricData, prefix string, values []float64) {
+	if len(values) == 0 {
+		return
+	}
+	sort.Float64s(values)
+	for _, p := range []int{50, 90, 95, 99} {
+		metrics[fmt.Sprintf("%s.p%d", prefix, p)] = percentile(values, p)
+	}
+	metrics[prefix+".max"] = values[len(values)-1]
+}
+
+// percentile uses the nearest rank of the sorted values
+func percentile(sorted []float64, p int) float64 {
+	rank := int(math.Ceil(float64(p) / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// parseLogTime reads a timing variable. When nginx tried more than one
+// upstream the times are listed and added up, "-" means there was none.
+func parseLogTime(value string) (float64, bool) {
+	total := 0.0
+	found := false
+	for _, part := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ':' || r == ' ' }) {
+		seconds, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			continue
+		}
+		total += seconds
+		found = true
+	}
+	return total, found
+}
+
+// lastLogValue returns the upstream that finally served the request from a
+// list such as "10.0.0.1:80, 10.0.0.2:80 : 10.0.0.3:80"
+func lastLogValue(value string) string {
+	if i := strings.LastIndex(value, ","); i >= 0 {
+		value = value[i+1:]
+	}
+	if i := strings.LastIndex(value, " : "); i >= 0 {
+		value = value[i+3:]
+	}
+	return strings.TrimSpace(value)
+}
+
+func fileInode(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+	return 0
+}
+
+// readLogState loads where the previous run stopped reading. The boolean is
+// false when there is no usable previous state.
+func readLogState(log *logrus.Logger, config Config) (logState, bool) {
+	var state logState
+	found, err := helpers.ReadState(config.NginxStateFile, LOG_STATE_FILE_NAME, &state)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("error reading nginx access log state file")
+	}
+	return state, found
+}
+
+func writeLogState(log *logrus.Logger, config Config, state logState) {
+	if err := helpers.WriteState(config.NginxStateFile, LOG_STATE_FILE_NAME, state); err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("error writing nginx access log state file")
+	}
+}
@@ -3,12 +3,12 @@ package nginx
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"regexp"
 	"strconv"
-	"strings"
 
 	"github.com/GannettDigital/paas-api-utils/utilsHTTP"
 	"github.com/Sirupsen/logrus"
@@ -30,6 +30,11 @@ type Config struct {
 	NginxListenPort string
 	NginxStatusURI  string
 	NginxHost       string
+	NginxMode       string
+	NginxAPIVersion string
+	NginxAccessLog  string
+	NginxLogFormat  string
+	NginxStateFile  string
 }
 
 // InventoryData is the data type for inventory data produced by a plugin data
@@ -99,12 +104,47 @@ func Run(log *logrus.Logger, prettyPrint bool, version string) {
 		NginxListenPort: os.Getenv("NGINXLISTENPORT"),
 		NginxHost:       os.Getenv("NGINXHOST"),
 		NginxStatusURI:  os.Getenv("NGINXSTATUSURI"),
+		NginxMode:       os.Getenv("NGINXMODE"),
+		NginxAPIVersion: os.Getenv("NGINXAPIVERSION"),
+		NginxAccessLog:  os.Getenv("NGINXACCESSLOG"),
+		NginxLogFormat:  os.Getenv("NGINXLOGFORMAT"),
+		NginxStateFile:  os.Getenv("NGINXSTATEFILE"),
+	}
+	if nginxConf.NginxMode == "" {
+		nginxConf.NginxMode = MODE_STUB_STATUS
+	}
+	if nginxConf.NginxAPIVersion == "" {
+		nginxConf.NginxAPIVersion = DEFAULT_API_VERSION
 	}
 	validateConfig(log, nginxConf)
 
-	var metric = scrapeStatus(log, getNginxStatus(log, nginxConf))
+	if nginxConf.NginxMode == MODE_PLUS {
+		metrics, err := getPlusMetrics(log, nginxConf)
+		if err != nil {
+			log.WithError(err).Error("Unable to read the nginx Plus API")
+			data.Status = err.Error()
+		}
+		data.Metrics = append(data.Metrics, metrics...)
+	} else {
+		metric, err := scrapeStatus(log, getNginxStatus(log, nginxConf))
+		if err != nil {
+			log.WithError(err).Error("Unable to scrape the nginx status page")
+			data.Status = err.Error()
+		} else {
+			data.Metrics = append(data.Metrics, metric)
+		}
+	}
 
-	data.Metrics = append(data.Metrics, metric)
+	if nginxConf.NginxAccessLog != "" {
+		logMetrics, upstreams, err := getLogMetrics(log, nginxConf)
+		if err != nil {
+			log.WithError(err).Error("Unable to read the nginx access log")
+			data.Status = err.Error()
+		} else {
+			data.Metrics = append(data.Metrics, logMetrics)
+			data.Metrics = append(data.Metrics, upstreams...)
+		}
+	}
 	fatalIfErr(log, OutputJSON(data, prettyPrint))
 }
 
@@ -112,6 +152,9 @@ func validateConfig(log *logrus.Logger, nginxConf Config) {
 	if nginxConf.NginxHost == "" || nginxConf.NginxListenPort == "" || nginxConf.NginxStatusURI == "" {
 		log.Fatal("Config Yaml is missing values. Please check the config to continue")
 	}
+	if nginxConf.NginxMode != MODE_STUB_STATUS && nginxConf.NginxMode != MODE_PLUS {
+		log.Fatal(fmt.Sprintf("Config Yaml has an unknown NGINXMODE %q. Please check the config to continue", nginxConf.NginxMode))
+	}
 }
 
 func fatalIfErr(log *logrus.Logger, err error) {
@@ -142,32 +185,45 @@ func getNginxStatus(log *logrus.Logger, config Config) string {
 	return string(data)
 }
 
-func scrapeStatus(log *logrus.Logger, status string) map[string]interface{} {
-
-	multi := regexp.MustCompile(`Active connections: (\d+)`).FindString(status)
-	contents := strings.Fields(multi)
-	active := contents[2]
-
-	multi = regexp.MustCompile(`(\d+)\s(\d+)\s(\d+)`).FindString(status)
-	contents = strings.Fields(multi)
-	accepts := contents[0]
-	handled := contents[1]
-	requests := contents[2]
-
-	multi = regexp.MustCompile(`Reading: (\d+)`).FindString(status)
-	contents = strings.Fields(multi)
-	reading := contents[1]
+// stub_status reports the connection counters in this layout:
+//
+//	Active connections: 2
+//	server accepts handled requests
+//	 29 29 31
+//	Reading: 0 Writing: 1 Waiting: 1
+var (
+	activePattern   = regexp.MustCompile(`Active connections:\s*(\d+)`)
+	countersPattern = regexp.MustCompile(`(?m)^\s*(\d+)\s+(\d+)\s+(\d+)\s*$`)
+	readingPattern  = regexp.MustCompile(`Reading:\s*(\d+)`)
+	writingPattern  = regexp.MustCompile(`Writing:\s*(\d+)`)
+	waitingPattern  = regexp.MustCompile(`Waiting:\s*(\d+)`)
+)
 
-	multi = regexp.MustCompile(`Writing: (\d+)`).FindString(status)
-	contents = strings.Fields(multi)
-	writing := contents[1]
+func scrapeStatus(log *logrus.Logger, status string) (map[string]interface{}, error) {
+	active := activePattern.FindStringSubmatch(status)
+	if active == nil {
+		return nil, errors.New("status page has no active connections, is it a stub_status page?")
+	}
+	counters := countersPattern.FindStringSubmatch(status)
+	if counters == nil {
+		return nil, errors.New("status page has no accepts, handled and requests counters")
+	}
+	accepts, handled, requests := counters[1], counters[2], counters[3]
 
-	multi = regexp.MustCompile(`Waiting: (\d+)`).FindString(status)
-	contents = strings.Fields(multi)
-	waiting := contents[1]
+	// older releases leave out some of the connection states
+	var reading, writing, waiting string
+	if match := readingPattern.FindStringSubmatch(status); match != nil {
+		reading = match[1]
+	}
+	if match := writingPattern.FindStringSubmatch(status); match != nil {
+		writing = match[1]
+	}
+	if match := waitingPattern.FindStringSubmatch(status); match != nil {
+		waiting = match[1]
+	}
 
 	log.WithFields(logrus.Fields{
-		"active":   active,
+		"active":   active[1],
 		"accepts":  accepts,
 		"handled":  handled,
 		"requests": requests,
@@ -179,14 +235,14 @@ func scrapeStatus(log *logrus.Logger, status string) map[string]interface{} {
 		"event_type":            "LoadBalancerSample",
 		"provider":              PROVIDER,
 		"nginx.hostname":        os.Getenv("HOSTNAME"),
-		"nginx.net.connections": toInt(log, active),
+		"nginx.net.connections": toInt(log, active[1]),
 		"nginx.net.accepts":     toInt(log, accepts),
 		"nginx.net.handled":     toInt(log, handled),
 		"nginx.net.requests":    toInt(log, requests),
 		"nginx.net.writing":     toInt(log, writing),
 		"nginx.net.waiting":     toInt(log, waiting),
 		"nginx.net.reading":     toInt(log, reading),
-	}
+	}, nil
 }
 
 func toInt(log *logrus.Logger, value string) int {
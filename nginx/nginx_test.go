@@ -2,9 +2,12 @@ package nginx
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 
 	fake "github.com/GannettDigital/paas-api-utils/utilsHTTP/fake"
 	"github.com/franela/goblin"
@@ -77,6 +80,7 @@ func TestScrapeStatus(t *testing.T) {
 	var tests = []struct {
 		Data            string
 		ExpectedResult  map[string]interface{}
+		ExpectedError   string
 		TestDescription string
 	}{
 		{
@@ -84,13 +88,28 @@ func TestScrapeStatus(t *testing.T) {
 			ExpectedResult:  result,
 			TestDescription: "Successfully scrape given status page",
 		},
+		{
+			Data:            "<html><body>404 Not Found</body></html>",
+			ExpectedError:   "status page has no active connections, is it a stub_status page?",
+			TestDescription: "Should return an error for a page that isn't stub_status",
+		},
+		{
+			Data:            "Active connections: 2 \nserver accepts handled requests\n",
+			ExpectedError:   "status page has no accepts, handled and requests counters",
+			TestDescription: "Should return an error for a truncated page",
+		},
 	}
 
 	for _, test := range tests {
 		g.Describe("scrapeStatus()", func() {
 			g.It(test.TestDescription, func() {
-				result := scrapeStatus(logrus.New(), test.Data)
+				result, err := scrapeStatus(logrus.New(), test.Data)
 				fmt.Println(result)
+				if test.ExpectedError != "" {
+					g.Assert(err.Error()).Equal(test.ExpectedError)
+					return
+				}
+				g.Assert(err).Equal(nil)
 				g.Assert(reflect.DeepEqual(result, test.ExpectedResult)).Equal(true)
 			})
 		})
@@ -131,3 +150,384 @@ func TestToInt(t *testing.T) {
 		})
 	}
 }
+
+func TestGetPlusMetrics(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	plusConfig := Config{
+		NginxListenPort: "8080",
+		NginxStatusURI:  "/api/",
+		NginxHost:       "http://localhost",
+		NginxMode:       MODE_PLUS,
+		NginxAPIVersion: "3",
+	}
+	results := []fake.Result{
+		{
+			Method: "GET",
+			URI:    "/api/3/connections",
+			Code:   200,
+			Data:   []byte(`{"accepted": 4968119, "dropped": 3, "active": 5, "idle": 117}`),
+		},
+		{
+			Method: "GET",
+			URI:    "/api/3/http/requests",
+			Code:   200,
+			Data:   []byte(`{"total": 10624511, "current": 4}`),
+		},
+		{
+			Method: "GET",
+			URI:    "/api/3/http/server_zones",
+			Code:   200,
+			Data:   []byte(`{"www": {"processing": 1, "requests": 706690, "responses": {"1xx": 0, "2xx": 699482, "3xx": 4522, "4xx": 907, "5xx": 266, "total": 705177}, "discarded": 1513, "received": 172711587, "sent": 19415530115}}`),
+		},
+		{
+			Method: "GET",
+			URI:    "/api/3/http/upstreams",
+			Code:   200,
+			Data:   []byte(`{"trac-backend": {"peers": [{"id": 0, "server": "10.0.0.1:8080", "backup": false, "weight": 1, "state": "unhealthy", "active": 0, "requests": 1001, "responses": {"2xx": 990, "5xx": 11, "total": 1001}, "fails": 11, "unavail": 1, "health_checks": {"checks": 100, "fails": 2, "unhealthy": 1, "last_passed": false}, "downtime": 3000, "response_time": 30}], "keepalive": 2, "zombies": 0, "zone": "trac-backend"}}`),
+		},
+		{
+			Method: "GET",
+			URI:    "/api/3/http/caches",
+			Code:   200,
+			Data:   []byte(`{"http_cache": {"size": 530915328, "max_size": 536870912, "cold": false, "hit": {"responses": 300, "bytes": 8192}, "miss": {"responses": 100, "bytes": 4096}}}`),
+		},
+	}
+
+	g.Describe("getPlusMetrics()", func() {
+		g.It("Should report the connections, server zones, upstream peers and caches", func() {
+			runner = fake.HTTPResult{ResultsList: results}
+			samples, err := getPlusMetrics(logrus.New(), plusConfig)
+			g.Assert(err).Equal(nil)
+			g.Assert(samples).Equal([]MetricData{
+				{
+					"event_type":                "LoadBalancerSample",
+					"provider":                  "nginx",
+					"nginx.hostname":            os.Getenv("HOSTNAME"),
+					"nginx.net.connections":     5,
+					"nginx.net.accepts":         4968119,
+					"nginx.net.handled":         4968116,
+					"nginx.net.dropped":         3,
+					"nginx.net.idle":            117,
+					"nginx.net.requests":        10624511,
+					"nginx.net.currentRequests": 4,
+				},
+				{
+					"event_type":                       "LoadBalancerSample",
+					"provider":                         "nginx",
+					"nginx.hostname":                   os.Getenv("HOSTNAME"),
+					"nginx.serverZone":                 "www",
+					"nginx.serverZone.processing":      int64(1),
+					"nginx.serverZone.requests":        int64(706690),
+					"nginx.serverZone.responses.1xx":   int64(0),
+					"nginx.serverZone.responses.2xx":   int64(699482),
+					"nginx.serverZone.responses.3xx":   int64(4522),
+					"nginx.serverZone.responses.4xx":   int64(907),
+					"nginx.serverZone.responses.5xx":   int64(266),
+					"nginx.serverZone.responses.total": int64(705177),
+					"nginx.serverZone.discarded":       int64(1513),
+					"nginx.serverZone.received":        int64(172711587),
+					"nginx.serverZone.sent":            int64(19415530115),
+				},
+				{
+					"event_type":                                  "LoadBalancerSample",
+					"provider":                                    "nginx",
+					"nginx.hostname":                              os.Getenv("HOSTNAME"),
+					"nginx.upstream":                              "trac-backend",
+					"nginx.upstream.keepalive":                    2,
+					"nginx.upstream.zombies":                      0,
+					"nginx.upstream.peer.id":                      int64(0),
+					"nginx.upstream.peer.server":                  "10.0.0.1:8080",
+					"nginx.upstream.peer.backup":                  false,
+					"nginx.upstream.peer.weight":                  int64(1),
+					"nginx.upstream.peer.state":                   "unhealthy",
+					"nginx.upstream.peer.active":                  int64(0),
+					"nginx.upstream.peer.requests":                int64(1001),
+					"nginx.upstream.peer.responses.2xx":           int64(990),
+					"nginx.upstream.peer.responses.5xx":           int64(11),
+					"nginx.upstream.peer.responses.total":         int64(1001),
+					"nginx.upstream.peer.fails":                   int64(11),
+					"nginx.upstream.peer.unavail":                 int64(1),
+					"nginx.upstream.peer.healthChecks.checks":     int64(100),
+					"nginx.upstream.peer.healthChecks.fails":      int64(2),
+					"nginx.upstream.peer.healthChecks.unhealthy":  int64(1),
+					"nginx.upstream.peer.healthChecks.lastPassed": false,
+					"nginx.upstream.peer.downtime":                int64(3000),
+					"nginx.upstream.peer.responseTime":            int64(30),
+				},
+				{
+					"event_type":                 "LoadBalancerSample",
+					"provider":                   "nginx",
+					"nginx.hostname":             os.Getenv("HOSTNAME"),
+					"nginx.cache":                "http_cache",
+					"nginx.cache.size":           int64(530915328),
+					"nginx.cache.maxSize":        int64(536870912),
+					"nginx.cache.cold":           false,
+					"nginx.cache.hit.responses":  int64(300),
+					"nginx.cache.hit.bytes":      int64(8192),
+					"nginx.cache.miss.responses": int64(100),
+					"nginx.cache.miss.bytes":     int64(4096),
+					"nginx.cache.hitRatio":       0.75,
+				},
+			})
+		})
+
+		g.It("Should report what it could read when an endpoint fails", func() {
+			runner = fake.HTTPResult{ResultsList: []fake.Result{results[0], {
+				Method: "GET",
+				URI:    "/api/3/http/requests",
+				Code:   404,
+				Data:   []byte(`{"error": {"status": 404, "text": "unknown version", "code": "UnknownVersion"}}`),
+			}, results[2], {
+				Method: "GET",
+				URI:    "/api/3/http/upstreams",
+				Code:   500,
+			}, {
+				Method: "GET",
+				URI:    "/api/3/http/caches",
+				Code:   200,
+				Data:   []byte(`{}`),
+			}}}
+			samples, err := getPlusMetrics(logrus.New(), plusConfig)
+			g.Assert(err).Equal(nil)
+			g.Assert(len(samples)).Equal(2)
+			g.Assert(samples[0]).Equal(MetricData{
+				"event_type":            "LoadBalancerSample",
+				"provider":              "nginx",
+				"nginx.hostname":        os.Getenv("HOSTNAME"),
+				"nginx.net.connections": 5,
+				"nginx.net.accepts":     4968119,
+				"nginx.net.handled":     4968116,
+				"nginx.net.dropped":     3,
+				"nginx.net.idle":        117,
+			})
+			g.Assert(samples[1]["nginx.serverZone"]).Equal("www")
+		})
+
+		g.It("Should return an error when no endpoint can be read", func() {
+			failed := []fake.Result{}
+			for _, result := range results {
+				failed = append(failed, fake.Result{Method: result.Method, URI: result.URI, Code: 404})
+			}
+			runner = fake.HTTPResult{ResultsList: failed}
+			samples, err := getPlusMetrics(logrus.New(), plusConfig)
+			g.Assert(err.Error()).Equal("nginx Plus API connections returned status 404")
+			g.Assert(samples).Equal([]MetricData{})
+		})
+	})
+}
+
+func TestAggregateLog(t *testing.T) {
+	g := goblin.Goblin(t)
+	pattern, err := compileLogFormat(DEFAULT_LOG_FORMAT)
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when compiling the log format", err)
+	}
+	lines := []string{
+		`10.1.1.1 - - [12/Mar/2018:10:00:01 +0000] "GET /index.html HTTP/1.1" 200 612 "-" "curl/7.47.0" 0.010 0.008 10.0.0.1:8080`,
+		`10.1.1.2 - bob [12/Mar/2018:10:00:02 +0000] "POST /api/orders HTTP/1.1" 502 166 "https://example.com/" "Mozilla/5.0 (X11; Linux x86_64)" 1.500 0.700, 0.750 10.0.0.1:8080, 10.0.0.2:8080`,
+		`10.1.1.3 - - [12/Mar/2018:10:00:03 +0000] "GET /favicon.ico HTTP/1.1" 404 0 "-" "curl/7.47.0" 0.000 - -`,
+		`not an access log line`,
+	}
+
+	g.Describe("logAggregate.add()", func() {
+		g.It("Should count requests per status class and upstream", func() {
+			aggregate := newLogAggregate(pattern)
+			for _, line := range lines {
+				aggregate.add(line)
+			}
+			total, upstreams := aggregate.total, aggregate.upstreams
+			g.Assert(aggregate.unparsed).Equal(1)
+			g.Assert(total.requests).Equal(3)
+			g.Assert(total.statuses).Equal(map[string]int{"2xx": 1, "5xx": 1, "4xx": 1})
+			g.Assert(total.requestTimes).Equal([]float64{0.010, 1.500, 0.000})
+			g.Assert(total.upstreamTime).Equal([]float64{0.008, 1.45})
+			g.Assert(len(upstreams)).Equal(2)
+			g.Assert(upstreams["10.0.0.1:8080"].statuses).Equal(map[string]int{"2xx": 1})
+			g.Assert(upstreams["10.0.0.2:8080"].statuses).Equal(map[string]int{"5xx": 1})
+		})
+	})
+}
+
+func TestTimingMetrics(t *testing.T) {
+	g := goblin.Goblin(t)
+	timings := newLogTimings()
+	for i := 1; i <= 100; i++ {
+		timings.add("2xx", float64(i)/100, true, 0, false)
+	}
+
+	g.Describe("timingMetrics()", func() {
+		g.It("Should report the counts and nearest rank percentiles", func() {
+			g.Assert(timingMetrics("nginx.log", timings)).Equal(MetricData{
+				"nginx.log.requests":        100,
+				"nginx.log.status.1xx":      0,
+				"nginx.log.status.2xx":      100,
+				"nginx.log.status.3xx":      0,
+				"nginx.log.status.4xx":      0,
+				"nginx.log.status.5xx":      0,
+				"nginx.log.requestTime.p50": 0.5,
+				"nginx.log.requestTime.p90": 0.9,
+				"nginx.log.requestTime.p95": 0.95,
+				"nginx.log.requestTime.p99": 0.99,
+				"nginx.log.requestTime.max": 1.0,
+			})
+		})
+	})
+}
+
+func TestReadNewLines(t *testing.T) {
+	g := goblin.Goblin(t)
+	dir, err := ioutil.TempDir("", "nginx")
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when creating a temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+	appendLog := func(text string) {
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when writing the log", err)
+		}
+		defer file.Close()
+		file.WriteString(text)
+	}
+
+	var lines []string
+	handle := func(line string) {
+		lines = append(lines, line)
+	}
+	read := func(previous logState, found bool, limit int64) (logState, error) {
+		lines = []string{}
+		return readNewLines(path, previous, found, limit, handle)
+	}
+
+	g.Describe("readNewLines()", func() {
+		var state logState
+		g.It("Should start from the end of the log on the first run", func() {
+			appendLog("old 1\nold 2\n")
+			current, err := read(logState{}, false, MAX_LOG_BYTES)
+			g.Assert(err).Equal(nil)
+			g.Assert(len(lines)).Equal(0)
+			g.Assert(current.Offset).Equal(int64(12))
+			state = current
+		})
+		g.It("Should read the complete lines written since the last run", func() {
+			appendLog("new 1\nnew 2\nparti")
+			current, err := read(state, true, MAX_LOG_BYTES)
+			g.Assert(err).Equal(nil)
+			g.Assert(lines).Equal([]string{"new 1", "new 2"})
+			g.Assert(current.Offset).Equal(int64(24))
+			state = current
+		})
+		g.It("Should finish the rotated log before reading the new one", func() {
+			appendLog("al\n")
+			if err := os.Rename(path, path+".1"); err != nil {
+				t.Fatalf("an error '%s' was not expected when rotating the log", err)
+			}
+			appendLog("rotated 1\n")
+			current, err := read(state, true, MAX_LOG_BYTES)
+			g.Assert(err).Equal(nil)
+			g.Assert(lines).Equal([]string{"partial", "rotated 1"})
+			g.Assert(current.Offset).Equal(int64(10))
+			state = current
+		})
+		g.It("Should start again from the beginning of a truncated log", func() {
+			if err := os.Truncate(path, 0); err != nil {
+				t.Fatalf("an error '%s' was not expected when truncating the log", err)
+			}
+			appendLog("x\n")
+			current, err := read(state, true, MAX_LOG_BYTES)
+			g.Assert(err).Equal(nil)
+			g.Assert(lines).Equal([]string{"x"})
+			state = current
+		})
+		g.It("Should leave what is over the limit for the next run", func() {
+			appendLog("line 1\nline 2\nline 3\n")
+			current, err := read(state, true, 10)
+			g.Assert(err).Equal(nil)
+			g.Assert(lines).Equal([]string{"line 1", "line 2"})
+			g.Assert(current.Offset).Equal(int64(16))
+			g.Assert(current.Truncated).IsTrue()
+			state = current
+		})
+		g.It("Should find a log rotated to a dated name and keep reading it over several runs", func() {
+			appendLog("line 4\nline 5\n")
+			if err := os.Rename(path, path+"-20180312"); err != nil {
+				t.Fatalf("an error '%s' was not expected when rotating the log", err)
+			}
+			appendLog("dated 1\n")
+			current, err := read(state, true, 10)
+			g.Assert(err).Equal(nil)
+			g.Assert(lines).Equal([]string{"line 3", "line 4"})
+			g.Assert(current.Offset).Equal(int64(30))
+			g.Assert(current.Truncated).IsTrue()
+
+			current, err = read(current, true, MAX_LOG_BYTES)
+			g.Assert(err).Equal(nil)
+			g.Assert(lines).Equal([]string{"line 5", "dated 1"})
+			g.Assert(current.Offset).Equal(int64(8))
+			g.Assert(current.Truncated).IsFalse()
+		})
+	})
+}
+
+func TestGetLogMetrics(t *testing.T) {
+	g := goblin.Goblin(t)
+	dir, err := ioutil.TempDir("", "nginx")
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when creating a temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+	logConfig := Config{
+		NginxAccessLog: filepath.Join(dir, "access.log"),
+		NginxLogFormat: `$status $request_time $upstream_addr`,
+		NginxStateFile: filepath.Join(dir, "nginxlogstate"),
+	}
+	ioutil.WriteFile(logConfig.NginxAccessLog, []byte("200 0.5 -\n"), 0644)
+
+	g.Describe("getLogMetrics()", func() {
+		g.It("Should report nothing on the first run", func() {
+			metrics, upstreams, err := getLogMetrics(logrus.New(), logConfig)
+			g.Assert(err).Equal(nil)
+			g.Assert(metrics["nginx.log.requests"]).Equal(0)
+			g.Assert(len(upstreams)).Equal(0)
+		})
+		g.It("Should report the requests logged since the last run", func() {
+			file, _ := os.OpenFile(logConfig.NginxAccessLog, os.O_APPEND|os.O_WRONLY, 0644)
+			file.WriteString("200 0.25 10.0.0.1:80\n503 1.5 10.0.0.1:80\n")
+			file.Close()
+
+			metrics, upstreams, err := getLogMetrics(logrus.New(), logConfig)
+			g.Assert(err).Equal(nil)
+			g.Assert(metrics["event_type"]).Equal("LoadBalancerSample")
+			g.Assert(metrics["nginx.log.requests"]).Equal(2)
+			g.Assert(metrics["nginx.log.status.5xx"]).Equal(1)
+			g.Assert(metrics["nginx.log.requestTime.max"]).Equal(1.5)
+			g.Assert(len(upstreams)).Equal(1)
+			g.Assert(upstreams[0]["nginx.log.upstream"]).Equal("10.0.0.1:80")
+			g.Assert(upstreams[0]["nginx.log.upstream.requests"]).Equal(2)
+		})
+		g.It("Should only report the request rate when neither this read nor the last one was capped", func() {
+			for _, truncated := range []bool{true, false} {
+				info, err := os.Stat(logConfig.NginxAccessLog)
+				if err != nil {
+					t.Fatalf("an error '%s' was not expected when reading the log", err)
+				}
+				writeLogState(logrus.New(), logConfig, logState{
+					Inode:     fileInode(info),
+					Offset:    info.Size(),
+					Timestamp: time.Now().Unix() - 10,
+					Truncated: truncated,
+				})
+				file, _ := os.OpenFile(logConfig.NginxAccessLog, os.O_APPEND|os.O_WRONLY, 0644)
+				file.WriteString("200 0.25 -\n")
+				file.Close()
+
+				metrics, _, err := getLogMetrics(logrus.New(), logConfig)
+				g.Assert(err).Equal(nil)
+				_, ok := metrics["nginx.log.requestsPerSecond"]
+				g.Assert(ok).Equal(!truncated)
+			}
+		})
+	})
+}
@@ -0,0 +1,204 @@
+package nginx
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/GannettDigital/go-newrelic-plugin/helpers"
+	"github.com/Sirupsen/logrus"
+)
+
+// MODE_STUB_STATUS scrapes the open source stub_status page and MODE_PLUS
+// reads the nginx Plus JSON API
+const (
+	MODE_STUB_STATUS string = "stub_status"
+	MODE_PLUS        string = "plus"
+)
+
+// DEFAULT_API_VERSION is the nginx Plus API version used when NGINXAPIVERSION
+// is not set, it first shipped in R16 so older releases need NGINXAPIVERSION
+const DEFAULT_API_VERSION string = "3"
+
+// plusConnections is /api/N/connections
+type plusConnections struct {
+	Accepted int `json:"accepted"`
+	Dropped  int `json:"dropped"`
+	Active   int `json:"active"`
+	Idle     int `json:"idle"`
+}
+
+// plusRequests is /api/N/http/requests
+type plusRequests struct {
+	Total   int `json:"total"`
+	Current int `json:"current"`
+}
+
+// plusUpstream is an entry of /api/N/http/upstreams. Peers are kept as raw
+// maps so every counter the running version reports is passed through.
+type plusUpstream struct {
+	Peers     []map[string]interface{} `json:"peers"`
+	Keepalive int                      `json:"keepalive"`
+	Zombies   int                      `json:"zombies"`
+	Zone      string                   `json:"zone"`
+}
+
+// getPlusMetrics reads the nginx Plus API and returns the overall sample
+// followed by a sample per server zone, upstream peer and cache zone. An
+// endpoint that fails is logged and left out, the error is only returned when
+// none of them could be read.
+func getPlusMetrics(log *logrus.Logger, config Config) ([]MetricData, error) {
+	samples := make([]MetricData, 0)
+	var firstErr error
+	failed := func(endpoint string, err error) {
+		log.WithError(err).Warn(fmt.Sprintf("Unable to read the nginx Plus API %s", endpoint))
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	overall := MetricData{
+		"event_type":     "LoadBalancerSample",
+		"provider":       PROVIDER,
+		"nginx.hostname": os.Getenv("HOSTNAME"),
+	}
+	var connections plusConnections
+	connectionsErr := getPlusAPI(log, config, "connections", &connections)
+	if connectionsErr != nil {
+		failed("connections", connectionsErr)
+	} else {
+		overall["nginx.net.connections"] = connections.Active
+		overall["nginx.net.accepts"] = connections.Accepted
+		overall["nginx.net.handled"] = connections.Accepted - connections.Dropped
+		overall["nginx.net.dropped"] = connections.Dropped
+		overall["nginx.net.idle"] = connections.Idle
+	}
+	var requests plusRequests
+	requestsErr := getPlusAPI(log, config, "http/requests", &requests)
+	if requestsErr != nil {
+		failed("http/requests", requestsErr)
+	} else {
+		overall["nginx.net.requests"] = requests.Total
+		overall["nginx.net.currentRequests"] = requests.Current
+	}
+	if connectionsErr == nil || requestsErr == nil {
+		samples = append(samples, overall)
+	}
+
+	var serverZones map[string]map[string]interface{}
+	if err := getPlusAPI(log, config, "http/server_zones", &serverZones); err != nil {
+		failed("http/server_zones", err)
+	}
+	for _, name := range sortedKeys(serverZones) {
+		sample := plusSample("nginx.serverZone", name)
+		flatten(sample, "nginx.serverZone", serverZones[name])
+		samples = append(samples, sample)
+	}
+
+	var upstreams map[string]plusUpstream
+	if err := getPlusAPI(log, config, "http/upstreams", &upstreams); err != nil {
+		failed("http/upstreams", err)
+	}
+	names := make([]string, 0, len(upstreams))
+	for name := range upstreams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		upstream := upstreams[name]
+		for _, peer := range upstream.Peers {
+			sample := plusSample("nginx.upstream", name)
+			sample["nginx.upstream.keepalive"] = upstream.Keepalive
+			sample["nginx.upstream.zombies"] = upstream.Zombies
+			flatten(sample, "nginx.upstream.peer", peer)
+			samples = append(samples, sample)
+		}
+	}
+
+	var caches map[string]map[string]interface{}
+	if err := getPlusAPI(log, config, "http/caches", &caches); err != nil {
+		failed("http/caches", err)
+	}
+	for _, name := range sortedKeys(caches) {
+		sample := plusSample("nginx.cache", name)
+		flatten(sample, "nginx.cache", caches[name])
+		hits, _ := sample["nginx.cache.hit.responses"].(int64)
+		misses, _ := sample["nginx.cache.miss.responses"].(int64)
+		if hits+misses > 0 {
+			sample["nginx.cache.hitRatio"] = float64(hits) / float64(hits+misses)
+		}
+		samples = append(samples, sample)
+	}
+
+	if len(samples) == 0 && firstErr != nil {
+		return samples, firstErr
+	}
+	return samples, nil
+}
+
+// getPlusAPI calls an endpoint of the versioned nginx Plus API and decodes
+// the JSON response into result
+func getPlusAPI(log *logrus.Logger, config Config, endpoint string, result interface{}) error {
+	url := fmt.Sprintf("%v:%v/%v/%v/%v", config.NginxHost, config.NginxListenPort, strings.Trim(config.NginxStatusURI, "/"), config.NginxAPIVersion, endpoint)
+	httpReq, err := http.NewRequest("GET", url, bytes.NewBuffer([]byte("")))
+	if err != nil {
+		return err
+	}
+	code, data, err := runner.CallAPI(log, nil, httpReq, &http.Client{})
+	if err != nil {
+		return fmt.Errorf("calling nginx Plus API %s: %v", endpoint, err)
+	}
+	if code != 200 {
+		return fmt.Errorf("nginx Plus API %s returned status %d", endpoint, code)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(result); err != nil {
+		return fmt.Errorf("decoding nginx Plus API %s: %v", endpoint, err)
+	}
+	return nil
+}
+
+func plusSample(attribute string, name string) MetricData {
+	return MetricData{
+		"event_type":     "LoadBalancerSample",
+		"provider":       PROVIDER,
+		"nginx.hostname": os.Getenv("HOSTNAME"),
+		attribute:        name,
+	}
+}
+
+// flatten copies the values of an API object into the sample, joining nested
+// object keys with dots, e.g. responses.5xx or health_checks.fails becomes
+// <prefix>.responses.5xx and <prefix>.healthChecks.fails. Lists are left out.
+func flatten(sample MetricData, prefix string, values map[string]interface{}) {
+	for key, value := range values {
+		name := prefix + "." + helpers.CamelCase(key)
+		switch v := value.(type) {
+		case map[string]interface{}:
+			flatten(sample, name, v)
+		case json.Number:
+			if i, err := v.Int64(); err == nil {
+				sample[name] = i
+			} else if f, err := v.Float64(); err == nil {
+				sample[name] = f
+			}
+		case string, bool:
+			sample[name] = v
+		}
+	}
+}
+
+func sortedKeys(values map[string]map[string]interface{}) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
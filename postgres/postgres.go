@@ -0,0 +1,169 @@
+package postgres
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+
+	"github.com/GannettDigital/go-newrelic-plugin/helpers"
+
+	"github.com/Sirupsen/logrus"
+	_ "github.com/lib/pq"
+)
+
+const NAME string = "postgres"
+const PROVIDER string = "postgres"
+const PROTOCOL_VERSION string = "1"
+const PLUGIN_VERSION string = "1.0.0"
+const STATUS string = "OK"
+const EVENT_TYPE string = "DatastoreSample"
+
+// postgresConfig is the keeper of the config
+type postgresConfig struct {
+	host          string
+	port          string
+	user          string
+	password      string
+	database      string
+	sslMode       string
+	queries       string
+	prefixes      string
+	customQueries string
+}
+
+// InventoryData is the data type for inventory data produced by a plugin data
+// source and emitted to the agent's inventory data store
+type InventoryData map[string]interface{}
+
+// MetricData is the data type for events produced by a plugin data source and
+// emitted to the agent's metrics data store
+type MetricData map[string]interface{}
+
+// EventData is the data type for single shot events
+type EventData map[string]interface{}
+
+// PluginData defines the format of the output JSON that plugins will return
+type PluginData struct {
+	Name            string                   `json:"name"`
+	ProtocolVersion string                   `json:"protocol_version"`
+	PluginVersion   string                   `json:"plugin_version"`
+	Status          string                   `json:"status"`
+	Metrics         []MetricData             `json:"metrics"`
+	Inventory       map[string]InventoryData `json:"inventory"`
+	Events          []EventData              `json:"events"`
+}
+
+var log *logrus.Logger
+
+var config = postgresConfig{
+	host:          os.Getenv("HOST"),
+	port:          os.Getenv("PORT"),
+	user:          os.Getenv("USER"),
+	password:      os.Getenv("PASSWORD"),
+	database:      os.Getenv("DATABASE"),
+	sslMode:       os.Getenv("SSLMODE"),
+	queries:       os.Getenv("QUERIES"),
+	prefixes:      os.Getenv("PREFIXES"),
+	customQueries: os.Getenv("CUSTOM_QUERIES"),
+}
+
+// collector returns the samples for one of the postgres statistics views
+type collector struct {
+	name    string
+	collect func(db *sql.DB) ([]MetricData, error)
+}
+
+var collectors = []collector{
+	{"server", getServerMetrics},
+	{"database", getDatabaseMetrics},
+	{"replication", getReplicationMetrics},
+	{"table", getTableMetrics},
+	{"query", getQueryMetrics},
+}
+
+func Run(logger *logrus.Logger, prettyPrint bool, version string) {
+	log = logger
+	// Initialize the output structure
+	var data = PluginData{
+		Name:            NAME,
+		PluginVersion:   PLUGIN_VERSION,
+		ProtocolVersion: PROTOCOL_VERSION,
+		Status:          STATUS,
+		Metrics:         make([]MetricData, 0),
+		Inventory:       make(map[string]InventoryData),
+		Events:          make([]EventData, 0),
+	}
+
+	validateConfig()
+	customQueries, err := parseCustomQueries(config.customQueries)
+	fatalIfErr(err, "Config Yaml has an invalid CUSTOM_QUERIES value. Please check the config to continue")
+
+	db, err := sql.Open("postgres", generateDSN())
+	if err != nil {
+		log.WithError(err).Error(fmt.Sprintf("getMetric: Cannot connect to postgres %s:%s", config.host, config.port))
+		return
+	}
+	defer db.Close()
+
+	if err := db.Ping(); err != nil {
+		data.Status = err.Error()
+	} else {
+		data.Metrics = append(data.Metrics, getMetrics(db)...)
+		data.Metrics = append(data.Metrics, getCustomQuerySamples(db, customQueries)...)
+	}
+	fatalIfErr(helpers.OutputJSON(data, prettyPrint), "OutputJSON error")
+}
+
+// getMetrics runs every collector. A failing collector is logged and skipped
+// so the rest of the samples are still reported, e.g. when the monitoring user
+// can't read one of the views.
+func getMetrics(db *sql.DB) []MetricData {
+	samples := make([]MetricData, 0)
+	for _, c := range collectors {
+		collected, err := c.collect(db)
+		if err != nil {
+			log.WithError(err).Warn(fmt.Sprintf("Failed to collect %s metrics", c.name))
+			continue
+		}
+		samples = append(samples, collected...)
+	}
+	return samples
+}
+
+func generateDSN() string {
+	dsn := url.URL{
+		Scheme: "postgres",
+		User:   url.UserPassword(config.user, config.password),
+		Host:   fmt.Sprintf("%s:%s", config.host, config.port),
+		Path:   "/" + config.database,
+	}
+	if config.sslMode != "" {
+		dsn.RawQuery = url.Values{"sslmode": {config.sslMode}}.Encode()
+	}
+	return dsn.String()
+}
+
+func validateConfig() {
+	if config.host == "" {
+		log.Fatal("Config Yaml is missing HOST value. Please check the config to continue")
+	}
+	if config.port == "" {
+		log.Fatal("Config Yaml is missing PORT value. Please check the config to continue")
+	}
+	if config.user == "" {
+		log.Fatal("Config Yaml is missing USER value. Please check the config to continue")
+	}
+	if config.password == "" {
+		log.Fatal("Config Yaml is missing PASSWORD value. Please check the config to continue")
+	}
+	if config.database == "" {
+		log.Fatal("Config Yaml is missing DATABASE value. Please check the config to continue")
+	}
+}
+
+func fatalIfErr(err error, msg string) {
+	if err != nil {
+		log.WithError(err).Fatal(msg)
+	}
+}
@@ -0,0 +1,76 @@
+package postgres
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/GannettDigital/go-newrelic-plugin/helpers"
+)
+
+const DEFAULT_CUSTOM_QUERY_EVENT_TYPE string = "PostgresCustomQuerySample"
+
+// parseCustomQueries reads the CUSTOM_QUERIES YAML list, see
+// helpers.ParseCustomQueries
+func parseCustomQueries(value string) ([]helpers.CustomQuery, error) {
+	return helpers.ParseCustomQueries(value, DEFAULT_CUSTOM_QUERY_EVENT_TYPE)
+}
+
+// getCustomQuerySamples reports a sample per row of every custom query, the
+// queries that fail are logged and skipped
+func getCustomQuerySamples(db *sql.DB, queries []helpers.CustomQuery) []MetricData {
+	samples := make([]MetricData, 0)
+	for _, sample := range helpers.CustomQuerySamples(log, db, queries, PROVIDER) {
+		samples = append(samples, MetricData(sample))
+	}
+	return samples
+}
+
+// getQueryMetrics runs the QUERIES the way the mysql plugin does, every two
+// column row is reported as postgres.<name> with PREFIXES applied to the name.
+// A failing query is logged and skipped.
+func getQueryMetrics(db *sql.DB) ([]MetricData, error) {
+	sample := MetricData{
+		"event_type": EVENT_TYPE,
+		"provider":   PROVIDER,
+	}
+	found := false
+	for _, query := range strings.Split(config.queries, ";") {
+		query = strings.TrimSpace(query)
+		if query == "" {
+			continue
+		}
+		rows, err := db.Query(query)
+		if err != nil {
+			log.WithError(err).Warn(" query; " + query)
+			continue
+		}
+		cols, err := rows.Columns()
+		if err != nil || len(cols) != 2 {
+			log.Warn(fmt.Sprintf("Unknown query result: query %s columns: %v", query, cols))
+			rows.Close()
+			continue
+		}
+		for rows.Next() {
+			var name, value sql.NullString
+			if err := rows.Scan(&name, &value); err != nil {
+				log.WithError(err).Warn(fmt.Sprintf("Failed to scan row. Query: %s", query))
+				continue
+			}
+			if !name.Valid || !value.Valid {
+				continue
+			}
+			sample[metricName(name.String)] = helpers.AsValue(value.String)
+			found = true
+		}
+		rows.Close()
+	}
+	if !found {
+		return []MetricData{}, nil
+	}
+	return []MetricData{sample}, nil
+}
+
+func metricName(metric string) string {
+	return fmt.Sprintf("postgres.%s", helpers.CamelCase(helpers.FixPrefix(metric, config.prefixes)))
+}
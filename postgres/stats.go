@@ -0,0 +1,289 @@
+package postgres
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/GannettDigital/go-newrelic-plugin/helpers"
+)
+
+const SERVER_VERSION_QUERY string = "SHOW server_version_num"
+const BGWRITER_QUERY string = "SELECT checkpoints_timed, checkpoints_req, checkpoint_write_time, checkpoint_sync_time, buffers_checkpoint, buffers_clean, maxwritten_clean, buffers_backend, buffers_backend_fsync, buffers_alloc FROM pg_stat_bgwriter"
+
+// PostgreSQL 17 moved the checkpoint columns to pg_stat_checkpointer and
+// dropped the backend writes from pg_stat_bgwriter, they're summed from the
+// client backend rows of pg_stat_io instead. All are aliased to the old
+// column names.
+const CHECKPOINTER_VERSION int = 170000
+const CHECKPOINTER_QUERY string = "SELECT num_timed AS checkpoints_timed, num_requested AS checkpoints_req, write_time AS checkpoint_write_time, sync_time AS checkpoint_sync_time, buffers_written AS buffers_checkpoint FROM pg_stat_checkpointer"
+const BGWRITER_17_QUERY string = "SELECT buffers_clean, maxwritten_clean, buffers_alloc FROM pg_stat_bgwriter"
+const BACKEND_IO_QUERY string = "SELECT sum(writes) AS buffers_backend, sum(fsyncs) AS buffers_backend_fsync FROM pg_stat_io WHERE backend_type = 'client backend'"
+
+const ACTIVITY_QUERY string = "SELECT state, count(*) AS connections FROM pg_stat_activity WHERE state IS NOT NULL GROUP BY state"
+const MAX_CONNECTIONS_QUERY string = "SELECT setting FROM pg_settings WHERE name = 'max_connections'"
+const RECOVERY_QUERY string = "SELECT pg_is_in_recovery() AS in_recovery, EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()) AS replay_delay"
+const DATABASE_QUERY string = "SELECT datname, numbackends, xact_commit, xact_rollback, blks_read, blks_hit, tup_returned, tup_fetched, tup_inserted, tup_updated, tup_deleted, conflicts, temp_files, temp_bytes, deadlocks FROM pg_stat_database WHERE datname IS NOT NULL AND datname NOT LIKE 'template%'"
+const REPLICATION_QUERY string = "SELECT application_name, client_addr, state, sync_state, pg_wal_lsn_diff(pg_current_wal_lsn(), sent_lsn) AS sent_lag_bytes, pg_wal_lsn_diff(pg_current_wal_lsn(), replay_lsn) AS replay_lag_bytes, EXTRACT(EPOCH FROM write_lag) AS write_lag, EXTRACT(EPOCH FROM flush_lag) AS flush_lag, EXTRACT(EPOCH FROM replay_lag) AS replay_lag FROM pg_stat_replication"
+
+// pg_current_wal_lsn() errors during recovery, so a cascading standby measures
+// its downstream standbys against the WAL it has received instead
+const IN_RECOVERY_QUERY string = "SELECT pg_is_in_recovery() AS in_recovery"
+const STANDBY_REPLICATION_QUERY string = "SELECT application_name, client_addr, state, sync_state, pg_wal_lsn_diff(pg_last_wal_receive_lsn(), sent_lsn) AS sent_lag_bytes, pg_wal_lsn_diff(pg_last_wal_receive_lsn(), replay_lsn) AS replay_lag_bytes, EXTRACT(EPOCH FROM write_lag) AS write_lag, EXTRACT(EPOCH FROM flush_lag) AS flush_lag, EXTRACT(EPOCH FROM replay_lag) AS replay_lag FROM pg_stat_replication"
+const TABLE_QUERY string = "SELECT schemaname, relname, seq_scan, idx_scan, n_live_tup, n_dead_tup, n_mod_since_analyze, vacuum_count, autovacuum_count, analyze_count, autoanalyze_count, EXTRACT(EPOCH FROM now() - greatest(last_vacuum, last_autovacuum)) AS since_vacuum, EXTRACT(EPOCH FROM now() - greatest(last_analyze, last_autoanalyze)) AS since_analyze FROM pg_stat_user_tables"
+
+var bgwriterMetrics = map[string]string{
+	"checkpoints_timed":     "postgres.bgwriter.checkpointsTimed",
+	"checkpoints_req":       "postgres.bgwriter.checkpointsRequested",
+	"checkpoint_write_time": "postgres.bgwriter.checkpointWriteTimeMs",
+	"checkpoint_sync_time":  "postgres.bgwriter.checkpointSyncTimeMs",
+	"buffers_checkpoint":    "postgres.bgwriter.buffersCheckpoint",
+	"buffers_clean":         "postgres.bgwriter.buffersClean",
+	"maxwritten_clean":      "postgres.bgwriter.maxWrittenClean",
+	"buffers_backend":       "postgres.bgwriter.buffersBackend",
+	"buffers_backend_fsync": "postgres.bgwriter.buffersBackendFsync",
+	"buffers_alloc":         "postgres.bgwriter.buffersAlloc",
+}
+
+var databaseMetrics = map[string]string{
+	"numbackends":   "postgres.database.connections",
+	"xact_commit":   "postgres.database.commits",
+	"xact_rollback": "postgres.database.rollbacks",
+	"blks_read":     "postgres.database.blocksRead",
+	"blks_hit":      "postgres.database.blocksHit",
+	"tup_returned":  "postgres.database.rowsReturned",
+	"tup_fetched":   "postgres.database.rowsFetched",
+	"tup_inserted":  "postgres.database.rowsInserted",
+	"tup_updated":   "postgres.database.rowsUpdated",
+	"tup_deleted":   "postgres.database.rowsDeleted",
+	"conflicts":     "postgres.database.conflicts",
+	"temp_files":    "postgres.database.tempFiles",
+	"temp_bytes":    "postgres.database.tempBytes",
+	"deadlocks":     "postgres.database.deadlocks",
+}
+
+var replicationMetrics = map[string]string{
+	"sent_lag_bytes":   "postgres.replication.sentLagBytes",
+	"replay_lag_bytes": "postgres.replication.replayLagBytes",
+	"write_lag":        "postgres.replication.writeLagSeconds",
+	"flush_lag":        "postgres.replication.flushLagSeconds",
+	"replay_lag":       "postgres.replication.replayLagSeconds",
+}
+
+var tableMetrics = map[string]string{
+	"seq_scan":            "postgres.table.sequentialScans",
+	"idx_scan":            "postgres.table.indexScans",
+	"n_live_tup":          "postgres.table.liveRows",
+	"n_dead_tup":          "postgres.table.deadRows",
+	"n_mod_since_analyze": "postgres.table.modifiedSinceAnalyze",
+	"vacuum_count":        "postgres.table.vacuums",
+	"autovacuum_count":    "postgres.table.autovacuums",
+	"analyze_count":       "postgres.table.analyzes",
+	"autoanalyze_count":   "postgres.table.autoanalyzes",
+	"since_vacuum":        "postgres.table.secondsSinceVacuum",
+	"since_analyze":       "postgres.table.secondsSinceAnalyze",
+}
+
+// serverCollector adds one part of the server sample
+type serverCollector struct {
+	name    string
+	collect func(db *sql.DB, sample MetricData) error
+}
+
+var serverCollectors = []serverCollector{
+	{"bgwriter", addBgwriterMetrics},
+	{"connection", addConnectionMetrics},
+	{"max connections", addMaxConnectionsMetrics},
+	{"recovery", addRecoveryMetrics},
+}
+
+// getServerMetrics reports the background writer, the connections by state
+// and, on a standby, how far behind the primary it is. A failing part is
+// logged and skipped so the rest of the sample is still reported.
+func getServerMetrics(db *sql.DB) ([]MetricData, error) {
+	sample := MetricData{
+		"event_type": EVENT_TYPE,
+		"provider":   PROVIDER,
+	}
+
+	failed := 0
+	for _, c := range serverCollectors {
+		if err := c.collect(db, sample); err != nil {
+			log.WithError(err).Warn(fmt.Sprintf("Failed to collect %s metrics", c.name))
+			failed++
+		}
+	}
+	if failed == len(serverCollectors) {
+		return nil, errors.New("none of the server metrics could be collected")
+	}
+	return []MetricData{sample}, nil
+}
+
+// addBgwriterMetrics picks the checkpoint and background writer queries for
+// the server version
+func addBgwriterMetrics(db *sql.DB, sample MetricData) error {
+	rows, err := helpers.QueryRows(db, SERVER_VERSION_QUERY)
+	if err != nil {
+		return err
+	}
+	version := 0
+	for _, row := range rows {
+		version, _ = strconv.Atoi(row["server_version_num"])
+	}
+
+	queries := []string{BGWRITER_QUERY}
+	if version >= CHECKPOINTER_VERSION {
+		queries = []string{CHECKPOINTER_QUERY, BGWRITER_17_QUERY, BACKEND_IO_QUERY}
+	}
+	for _, query := range queries {
+		rows, err := helpers.QueryRows(db, query)
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			addMetrics(sample, row, bgwriterMetrics)
+		}
+	}
+	return nil
+}
+
+func addConnectionMetrics(db *sql.DB, sample MetricData) error {
+	rows, err := helpers.QueryRows(db, ACTIVITY_QUERY)
+	if err != nil {
+		return err
+	}
+	total := 0
+	for _, row := range rows {
+		connections, _ := strconv.Atoi(row["connections"])
+		sample["postgres.connections."+helpers.CamelCase(row["state"])] = connections
+		total += connections
+	}
+	sample["postgres.connections.total"] = total
+	return nil
+}
+
+func addMaxConnectionsMetrics(db *sql.DB, sample MetricData) error {
+	rows, err := helpers.QueryRows(db, MAX_CONNECTIONS_QUERY)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		sample["postgres.connections.max"] = helpers.AsValue(row["setting"])
+	}
+	return nil
+}
+
+func addRecoveryMetrics(db *sql.DB, sample MetricData) error {
+	rows, err := helpers.QueryRows(db, RECOVERY_QUERY)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		// the boolean comes back as "t" or "true" depending on the driver
+		isReplica, _ := strconv.ParseBool(row["in_recovery"])
+		sample["postgres.replication.isReplica"] = isReplica
+		if delay, ok := row["replay_delay"]; ok && isReplica {
+			sample["postgres.replication.replayDelaySeconds"] = helpers.AsValue(delay)
+		}
+	}
+	return nil
+}
+
+// getDatabaseMetrics reports a sample for every database from
+// pg_stat_database, skipping the templates
+func getDatabaseMetrics(db *sql.DB) ([]MetricData, error) {
+	rows, err := helpers.QueryRows(db, DATABASE_QUERY)
+	if err != nil {
+		return nil, err
+	}
+	samples := make([]MetricData, 0, len(rows))
+	for _, row := range rows {
+		sample := MetricData{
+			"event_type":             EVENT_TYPE,
+			"provider":               PROVIDER,
+			"postgres.database.name": row["datname"],
+		}
+		addMetrics(sample, row, databaseMetrics)
+
+		hit, _ := strconv.ParseFloat(row["blks_hit"], 64)
+		read, _ := strconv.ParseFloat(row["blks_read"], 64)
+		if hit+read > 0 {
+			sample["postgres.database.blocksHitRatio"] = hit / (hit + read)
+		}
+		samples = append(samples, sample)
+	}
+	return samples, nil
+}
+
+// getReplicationMetrics reports a sample for every standby connected to this
+// server. The lag functions need PostgreSQL 10 or newer.
+func getReplicationMetrics(db *sql.DB) ([]MetricData, error) {
+	rows, err := helpers.QueryRows(db, IN_RECOVERY_QUERY)
+	if err != nil {
+		return nil, err
+	}
+	query := REPLICATION_QUERY
+	for _, row := range rows {
+		if isReplica, _ := strconv.ParseBool(row["in_recovery"]); isReplica {
+			query = STANDBY_REPLICATION_QUERY
+		}
+	}
+
+	rows, err = helpers.QueryRows(db, query)
+	if err != nil {
+		return nil, err
+	}
+	samples := make([]MetricData, 0, len(rows))
+	for _, row := range rows {
+		sample := MetricData{
+			"event_type":                         EVENT_TYPE,
+			"provider":                           PROVIDER,
+			"postgres.replication.standby":       row["application_name"],
+			"postgres.replication.clientAddress": row["client_addr"],
+			"postgres.replication.state":         row["state"],
+			"postgres.replication.syncState":     row["sync_state"],
+		}
+		addMetrics(sample, row, replicationMetrics)
+		samples = append(samples, sample)
+	}
+	return samples, nil
+}
+
+// getTableMetrics reports a sample for every table in the configured database
+// with its dead row ratio and how long ago it was vacuumed and analyzed
+func getTableMetrics(db *sql.DB) ([]MetricData, error) {
+	rows, err := helpers.QueryRows(db, TABLE_QUERY)
+	if err != nil {
+		return nil, err
+	}
+	samples := make([]MetricData, 0, len(rows))
+	for _, row := range rows {
+		sample := MetricData{
+			"event_type":             EVENT_TYPE,
+			"provider":               PROVIDER,
+			"postgres.database.name": config.database,
+			"postgres.table.schema":  row["schemaname"],
+			"postgres.table.name":    row["relname"],
+		}
+		addMetrics(sample, row, tableMetrics)
+
+		live, _ := strconv.ParseFloat(row["n_live_tup"], 64)
+		dead, _ := strconv.ParseFloat(row["n_dead_tup"], 64)
+		if live+dead > 0 {
+			sample["postgres.table.deadRowRatio"] = dead / (live + dead)
+		}
+		samples = append(samples, sample)
+	}
+	return samples, nil
+}
+
+// addMetrics copies the columns in names from the row into the sample. NULL
+// columns are left out.
+func addMetrics(sample MetricData, row map[string]string, names map[string]string) {
+	for column, name := range names {
+		if value, ok := row[column]; ok {
+			sample[name] = helpers.AsValue(value)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package rabbitmq
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/GannettDigital/go-newrelic-plugin/helpers"
+	"github.com/Sirupsen/logrus"
+)
+
+const LINK_EVENT_TYPE string = "RabbitmqLinkStateChange"
+const PARTITION_EVENT_TYPE string = "RabbitmqPartition"
+
+// STATE_FILE_NAME is the link state file in the working directory when
+// RABBITMQ_STATE_FILE is not set
+const STATE_FILE_NAME string = "rabbitmqlinkstate"
+
+// ShovelInfo is an entry of /api/shovels
+type ShovelInfo struct {
+	Name   string `json:"name"`
+	Vhost  string `json:"vhost"`
+	Type   string `json:"type"`
+	State  string `json:"state"`
+	Node   string `json:"node"`
+	Reason string `json:"reason"`
+}
+
+// FederationLinkInfo is an entry of /api/federation-links, a link federates
+// either an exchange or a queue from the upstream
+type FederationLinkInfo struct {
+	Upstream string `json:"upstream"`
+	Vhost    string `json:"vhost"`
+	Type     string `json:"type"`
+	Exchange string `json:"exchange"`
+	Queue    string `json:"queue"`
+	Status   string `json:"status"`
+	Node     string `json:"node"`
+	Error    string `json:"error"`
+}
+
+// linkCollectors are the shovel and federation collectors by the link type
+// they report
+var linkCollectors = []struct {
+	kind    string
+	collect func(*logrus.Logger, RabbitmqConfig) ([]MetricData, error)
+}{
+	{kind: "shovel", collect: getShovelMetrics},
+	{kind: "federation", collect: getFederationMetrics},
+}
+
+// getLinkMetrics reports the shovels and federation links along with the
+// link types that couldn't be read this run. An endpoint that doesn't exist
+// because its plugin isn't enabled has no links and isn't a failure.
+func getLinkMetrics(log *logrus.Logger, config RabbitmqConfig) ([]MetricData, map[string]bool) {
+	Stats := make([]MetricData, 0)
+	failed := make(map[string]bool)
+	for _, collector := range linkCollectors {
+		metrics, err := collector.collect(log, config)
+		if isNotFound(err) {
+			log.Debug(fmt.Sprintf("Skipping %s metrics, the %s management plugin isn't enabled", collector.kind, collector.kind))
+			continue
+		}
+		if err != nil {
+			log.WithError(err).Warn(fmt.Sprintf("Failed to collect %s metrics", collector.kind))
+			failed[collector.kind] = true
+			continue
+		}
+		Stats = append(Stats, metrics...)
+	}
+	return Stats, failed
+}
+
+// getShovelMetrics reports the state of every shovel, the endpoint only
+// exists with the shovel management plugin enabled
+func getShovelMetrics(log *logrus.Logger, config RabbitmqConfig) ([]MetricData, error) {
+	var shovels []ShovelInfo
+	if err := getAPI(log, config, "api/shovels", &shovels); err != nil {
+		return nil, err
+	}
+	Stats := make([]MetricData, 0, len(shovels))
+	for _, Shovel := range shovels {
+		sample := MetricData{
+			"event_type":            EVENT_TYPE,
+			"provider":              PROVIDER,
+			"rabbitmq.shovel.name":  Shovel.Name,
+			"rabbitmq.shovel.vhost": Shovel.Vhost,
+			"rabbitmq.shovel.type":  Shovel.Type,
+			"rabbitmq.shovel.state": Shovel.State,
+			"rabbitmq.shovel.node":  Shovel.Node,
+		}
+		if Shovel.Reason != "" {
+			sample["rabbitmq.shovel.reason"] = Shovel.Reason
+		}
+		Stats = append(Stats, sample)
+	}
+	return Stats, nil
+}
+
+// getFederationMetrics reports the status of every federation link, the
+// endpoint only exists with the federation management plugin enabled
+func getFederationMetrics(log *logrus.Logger, config RabbitmqConfig) ([]MetricData, error) {
+	var links []FederationLinkInfo
+	if err := getAPI(log, config, "api/federation-links", &links); err != nil {
+		return nil, err
+	}
+	Stats := make([]MetricData, 0, len(links))
+	for _, Link := range links {
+		sample := MetricData{
+			"event_type":                   EVENT_TYPE,
+			"provider":                     PROVIDER,
+			"rabbitmq.federation.upstream": Link.Upstream,
+			"rabbitmq.federation.vhost":    Link.Vhost,
+			"rabbitmq.federation.type":     Link.Type,
+			"rabbitmq.federation.status":   Link.Status,
+			"rabbitmq.federation.node":     Link.Node,
+		}
+		if Link.Exchange != "" {
+			sample["rabbitmq.federation.exchange"] = Link.Exchange
+		}
+		if Link.Queue != "" {
+			sample["rabbitmq.federation.queue"] = Link.Queue
+		}
+		if Link.Error != "" {
+			sample["rabbitmq.federation.error"] = Link.Error
+		}
+		Stats = append(Stats, sample)
+	}
+	return Stats, nil
+}
+
+// link is a shovel or federation link found in the samples
+type link struct {
+	key    string
+	kind   string
+	name   string
+	vhost  interface{}
+	state  string
+	reason interface{}
+}
+
+func sampleLink(metric MetricData) (link, bool) {
+	if name, ok := metric["rabbitmq.shovel.name"]; ok {
+		state, _ := metric["rabbitmq.shovel.state"].(string)
+		return link{
+			key:    fmt.Sprintf("shovel/%v/%v", metric["rabbitmq.shovel.vhost"], name),
+			kind:   "shovel",
+			name:   fmt.Sprintf("%v", name),
+			vhost:  metric["rabbitmq.shovel.vhost"],
+			state:  state,
+			reason: metric["rabbitmq.shovel.reason"],
+		}, true
+	}
+	if upstream, ok := metric["rabbitmq.federation.upstream"]; ok {
+		target := metric["rabbitmq.federation.exchange"]
+		if target == nil {
+			target = metric["rabbitmq.federation.queue"]
+		}
+		state, _ := metric["rabbitmq.federation.status"].(string)
+		return link{
+			key:    fmt.Sprintf("federation/%v/%v/%v", metric["rabbitmq.federation.vhost"], upstream, target),
+			kind:   "federation",
+			name:   fmt.Sprintf("%v/%v", upstream, target),
+			vhost:  metric["rabbitmq.federation.vhost"],
+			state:  state,
+			reason: metric["rabbitmq.federation.error"],
+		}, true
+	}
+	return link{}, false
+}
+
+// linkEvents compares the state of the shovels and federation links with the
+// previous run and returns an event for every link that is no longer running,
+// along with the states to save. The link types that failed to be read keep
+// their previous state.
+func linkEvents(previous map[string]string, metrics []MetricData, failed map[string]bool) ([]EventData, map[string]string) {
+	events := make([]EventData, 0)
+	current := make(map[string]string)
+	for key, state := range previous {
+		if failed[strings.SplitN(key, "/", 2)[0]] {
+			current[key] = state
+		}
+	}
+	for _, metric := range metrics {
+		l, ok := sampleLink(metric)
+		if !ok {
+			continue
+		}
+		current[l.key] = l.state
+		if previous[l.key] != "running" || l.state == "running" {
+			continue
+		}
+		event := EventData{
+			"event_type":                  LINK_EVENT_TYPE,
+			"provider":                    PROVIDER,
+			"category":                    "notifications",
+			"summary":                     fmt.Sprintf("rabbitmq %s %s in vhost %v left running for %s", l.kind, l.name, l.vhost, l.state),
+			"rabbitmq.link.type":          l.kind,
+			"rabbitmq.link.name":          l.name,
+			"rabbitmq.link.vhost":         l.vhost,
+			"rabbitmq.link.previousState": "running",
+			"rabbitmq.link.state":         l.state,
+		}
+		if l.reason != nil {
+			event["rabbitmq.link.reason"] = l.reason
+		}
+		events = append(events, event)
+	}
+	return events, current
+}
+
+// partitionEvents returns an event for every node that reports a network
+// partition. A partition lasts until the cluster is recovered by hand, so an
+// event is sent on every run until then.
+func partitionEvents(metrics []MetricData) []EventData {
+	events := make([]EventData, 0)
+	for _, metric := range metrics {
+		peers, ok := metric["rabbitmq.node.partitioned_from"].(string)
+		if !ok {
+			continue
+		}
+		events = append(events, EventData{
+			"event_type":                     PARTITION_EVENT_TYPE,
+			"provider":                       PROVIDER,
+			"category":                       "notifications",
+			"summary":                        fmt.Sprintf("rabbitmq node %v is partitioned from %s", metric["rabbitmq.node.name"], peers),
+			"rabbitmq.node.name":             metric["rabbitmq.node.name"],
+			"rabbitmq.node.partitioned_from": peers,
+		})
+	}
+	return events
+}
+
+// clusterPartitioned is whether any node reports a network partition
+func clusterPartitioned(nodes []NodeInfo) bool {
+	for _, node := range nodes {
+		if len(node.Partitions) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// addPartitions adds the nodes a node can't reach to its sample, along with
+// whether the cluster is partitioned at all
+func addPartitions(sample MetricData, node NodeInfo, partitioned bool) {
+	sample["rabbitmq.node.partitions"] = len(node.Partitions)
+	sample["rabbitmq.cluster.partitioned"] = partitioned
+	if len(node.Partitions) > 0 {
+		sample["rabbitmq.node.partitioned_from"] = strings.Join(node.Partitions, ",")
+	}
+}
+
+// readLinkState loads the link states saved by the previous run. The boolean
+// is false when there is no usable previous state.
+func readLinkState(log *logrus.Logger, config RabbitmqConfig) (map[string]string, bool) {
+	var states map[string]string
+	found, err := helpers.ReadState(config.stateFile, STATE_FILE_NAME, &states)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("error reading rabbitmq link state file")
+	}
+	return states, found
+}
+
+func writeLinkState(log *logrus.Logger, config RabbitmqConfig, states map[string]string) {
+	if err := helpers.WriteState(config.stateFile, STATE_FILE_NAME, states); err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("error writing rabbitmq link state file")
+	}
+}
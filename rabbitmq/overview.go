@@ -0,0 +1,198 @@
+package rabbitmq
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const ALARM_EVENT_TYPE string = "RabbitmqAlarm"
+
+// OverviewInfo is /api/overview
+type OverviewInfo struct {
+	ClusterName     string                 `json:"cluster_name"`
+	RabbitmqVersion string                 `json:"rabbitmq_version"`
+	MessageStats    map[string]interface{} `json:"message_stats"`
+	QueueTotals     map[string]interface{} `json:"queue_totals"`
+	ObjectTotals    map[string]interface{} `json:"object_totals"`
+}
+
+type ExchangeInfo struct {
+	Name         string                 `json:"name"`
+	Vhost        string                 `json:"vhost"`
+	Type         string                 `json:"type"`
+	Durable      bool                   `json:"durable"`
+	MessageStats map[string]interface{} `json:"message_stats"`
+}
+
+// ConnectionInfo is an entry of /api/connections or /api/channels, only the
+// fields the counts are grouped by are decoded
+type ConnectionInfo struct {
+	Vhost string `json:"vhost"`
+	User  string `json:"user"`
+}
+
+// getAPI calls an endpoint of the management API and decodes the response
+// into record
+func getAPI(log *logrus.Logger, config RabbitmqConfig, endpoint string, record interface{}) error {
+	rabbitmqURI := fmt.Sprintf("%v:%v/%v", config.rabbitmqHost, config.rabbitmqPort, endpoint)
+	httpReq, err := http.NewRequest("GET", rabbitmqURI, bytes.NewBuffer([]byte("")))
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"rabbitmqURI": rabbitmqURI,
+			"error":       err,
+		}).Error("Encountered error creating http.NewRequest")
+		return err
+	}
+	httpReq.SetBasicAuth(config.rabbitmqUser, config.rabbitmqPassword)
+	return executeAndDecode(log, *httpReq, record)
+}
+
+// getOverviewMetrics reports the cluster wide message rates and object totals
+func getOverviewMetrics(log *logrus.Logger, config RabbitmqConfig) ([]MetricData, error) {
+	var overview OverviewInfo
+	if err := getAPI(log, config, "api/overview", &overview); err != nil {
+		return nil, err
+	}
+	sample := MetricData{
+		"event_type":                     EVENT_TYPE,
+		"provider":                       PROVIDER,
+		"rabbitmq.overview.cluster_name": overview.ClusterName,
+		"rabbitmq.overview.version":      overview.RabbitmqVersion,
+	}
+	addMessageStats(sample, "rabbitmq.overview.message_stats", overview.MessageStats)
+	addMessageStats(sample, "rabbitmq.overview.queue_totals", overview.QueueTotals)
+	addMessageStats(sample, "rabbitmq.overview.object_totals", overview.ObjectTotals)
+	return []MetricData{sample}, nil
+}
+
+// getExchangeMetrics reports the publish counts and rates of every exchange
+func getExchangeMetrics(log *logrus.Logger, config RabbitmqConfig) ([]MetricData, error) {
+	var exchanges []ExchangeInfo
+	if err := getAPI(log, config, "api/exchanges", &exchanges); err != nil {
+		return nil, err
+	}
+	Stats := make([]MetricData, 0, len(exchanges))
+	for _, Exchange := range exchanges {
+		name := Exchange.Name
+		if name == "" {
+			name = "(AMQP default)"
+		}
+		sample := MetricData{
+			"event_type":                EVENT_TYPE,
+			"provider":                  PROVIDER,
+			"rabbitmq.exchange.name":    name,
+			"rabbitmq.exchange.vhost":   Exchange.Vhost,
+			"rabbitmq.exchange.type":    Exchange.Type,
+			"rabbitmq.exchange.durable": Exchange.Durable,
+		}
+		addMessageStats(sample, "rabbitmq.exchange", Exchange.MessageStats)
+		Stats = append(Stats, sample)
+	}
+	return Stats, nil
+}
+
+// getConnectionMetrics counts the connections and channels of every vhost and
+// user
+func getConnectionMetrics(log *logrus.Logger, config RabbitmqConfig) ([]MetricData, error) {
+	var connections []ConnectionInfo
+	if err := getAPI(log, config, "api/connections", &connections); err != nil {
+		return nil, err
+	}
+	var channels []ConnectionInfo
+	if err := getAPI(log, config, "api/channels", &channels); err != nil {
+		return nil, err
+	}
+
+	type vhostUser struct {
+		vhost string
+		user  string
+	}
+	counts := make(map[vhostUser]MetricData)
+	count := func(records []ConnectionInfo, name string) {
+		for _, record := range records {
+			key := vhostUser{vhost: record.Vhost, user: record.User}
+			if _, ok := counts[key]; !ok {
+				counts[key] = MetricData{
+					"event_type":           EVENT_TYPE,
+					"provider":             PROVIDER,
+					"rabbitmq.vhost":       record.Vhost,
+					"rabbitmq.user":        record.User,
+					"rabbitmq.connections": 0,
+					"rabbitmq.channels":    0,
+				}
+			}
+			counts[key][name] = counts[key][name].(int) + 1
+		}
+	}
+	count(connections, "rabbitmq.connections")
+	count(channels, "rabbitmq.channels")
+
+	keys := make([]vhostUser, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].vhost != keys[j].vhost {
+			return keys[i].vhost < keys[j].vhost
+		}
+		return keys[i].user < keys[j].user
+	})
+	Stats := make([]MetricData, 0, len(keys))
+	for _, key := range keys {
+		Stats = append(Stats, counts[key])
+	}
+	return Stats, nil
+}
+
+// addMessageStats copies the counts of a message_stats style object into the
+// sample, the rate of every "<name>_details" object is added as <name>_rate
+func addMessageStats(sample MetricData, prefix string, stats map[string]interface{}) {
+	for key, value := range stats {
+		switch v := value.(type) {
+		case float64:
+			sample[prefix+"."+key] = v
+		case map[string]interface{}:
+			if rate, ok := v["rate"].(float64); ok && strings.HasSuffix(key, "_details") {
+				sample[prefix+"."+strings.TrimSuffix(key, "_details")+"_rate"] = rate
+			}
+		}
+	}
+}
+
+// alarmEvents returns an event for every node with a memory or disk alarm
+// set. The alarm blocks publishers for as long as it is set, so an event is
+// sent on every run until it clears.
+func alarmEvents(metrics []MetricData) []EventData {
+	events := make([]EventData, 0)
+	for _, metric := range metrics {
+		node, ok := metric["rabbitmq.node.name"]
+		if !ok {
+			continue
+		}
+		for _, alarm := range []struct {
+			attribute string
+			name      string
+		}{
+			{attribute: "rabbitmq.node.mem_alarm", name: "memory"},
+			{attribute: "rabbitmq.node.disk_free_alarm", name: "disk"},
+		} {
+			if set, _ := metric[alarm.attribute].(bool); !set {
+				continue
+			}
+			events = append(events, EventData{
+				"event_type":         ALARM_EVENT_TYPE,
+				"provider":           PROVIDER,
+				"category":           "notifications",
+				"summary":            fmt.Sprintf("rabbitmq node %v has a %s alarm set", node, alarm.name),
+				"rabbitmq.node.name": node,
+				"rabbitmq.alarm":     alarm.name,
+			})
+		}
+	}
+	return events
+}
@@ -0,0 +1,161 @@
+package rabbitmq
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// MAX_PAGE_SIZE is the largest page_size the management API accepts
+const MAX_PAGE_SIZE int = 500
+
+// queueRates are the message_stats reported for every queue
+var queueRates = []string{"publish", "deliver_get", "ack", "redeliver"}
+
+// QueuePage is a page of /api/queues
+type QueuePage struct {
+	Items     []QueueInfo `json:"items"`
+	Page      int         `json:"page"`
+	PageCount int         `json:"page_count"`
+}
+
+// queueFilter keeps the queues whose vhost and name match the include
+// patterns and don't match the exclude ones, an unset pattern matches all
+type queueFilter struct {
+	includeVhosts *regexp.Regexp
+	excludeVhosts *regexp.Regexp
+	includeQueues *regexp.Regexp
+	excludeQueues *regexp.Regexp
+}
+
+func newQueueFilter(config RabbitmqConfig) (queueFilter, error) {
+	var filter queueFilter
+	for _, pattern := range []struct {
+		setting string
+		value   string
+		regexp  **regexp.Regexp
+	}{
+		{setting: "RABBITMQ_INCLUDE_VHOSTS", value: config.includeVhosts, regexp: &filter.includeVhosts},
+		{setting: "RABBITMQ_EXCLUDE_VHOSTS", value: config.excludeVhosts, regexp: &filter.excludeVhosts},
+		{setting: "RABBITMQ_INCLUDE_QUEUES", value: config.includeQueues, regexp: &filter.includeQueues},
+		{setting: "RABBITMQ_EXCLUDE_QUEUES", value: config.excludeQueues, regexp: &filter.excludeQueues},
+	} {
+		if pattern.value == "" {
+			continue
+		}
+		compiled, err := regexp.Compile(pattern.value)
+		if err != nil {
+			return filter, fmt.Errorf("invalid %s pattern: %v", pattern.setting, err)
+		}
+		*pattern.regexp = compiled
+	}
+	return filter, nil
+}
+
+func (f queueFilter) apply(queues []QueueInfo) []QueueInfo {
+	kept := make([]QueueInfo, 0, len(queues))
+	for _, queue := range queues {
+		if f.includeVhosts != nil && !f.includeVhosts.MatchString(queue.Vhost) {
+			continue
+		}
+		if f.excludeVhosts != nil && f.excludeVhosts.MatchString(queue.Vhost) {
+			continue
+		}
+		if f.includeQueues != nil && !f.includeQueues.MatchString(queue.Name) {
+			continue
+		}
+		if f.excludeQueues != nil && f.excludeQueues.MatchString(queue.Name) {
+			continue
+		}
+		kept = append(kept, queue)
+	}
+	return kept
+}
+
+// listQueues fetches the queues a page at a time when a page size is set,
+// asking the management API to only return the queues matching the include
+// pattern. Without a page size, the default as brokers before 3.6 can't page
+// the queues, the whole list is fetched at once.
+func listQueues(log *logrus.Logger, config RabbitmqConfig) (queueRecords []QueueInfo, err error) {
+	if config.pageSize <= 0 {
+		err = getAPI(log, config, "api/queues", &queueRecords)
+		if err != nil {
+			return []QueueInfo{}, err
+		}
+		return queueRecords, nil
+	}
+
+	queueRecords = make([]QueueInfo, 0)
+	for page := 1; ; page++ {
+		query := url.Values{}
+		query.Set("page", strconv.Itoa(page))
+		query.Set("page_size", strconv.Itoa(config.pageSize))
+		if config.includeQueues != "" {
+			query.Set("name", config.includeQueues)
+			query.Set("use_regex", "true")
+		}
+		var queuePage QueuePage
+		err = getAPI(log, config, "api/queues?"+query.Encode(), &queuePage)
+		if err != nil {
+			return []QueueInfo{}, err
+		}
+		queueRecords = append(queueRecords, queuePage.Items...)
+		if page >= queuePage.PageCount || len(queuePage.Items) == 0 {
+			return queueRecords, nil
+		}
+	}
+}
+
+// topQueues keeps the n queues with the most messages, all of them are kept
+// when n isn't set
+func topQueues(queues []QueueInfo, n int) []QueueInfo {
+	if n <= 0 || len(queues) <= n {
+		return queues
+	}
+	sorted := make([]QueueInfo, len(queues))
+	copy(sorted, queues)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Messages > sorted[j].Messages
+	})
+	return sorted[:n]
+}
+
+// addQueueRates adds the publish, deliver_get, ack and redeliver counts and
+// rates along with the consumer utilisation of a queue
+func addQueueRates(sample MetricData, queue QueueInfo) {
+	for _, name := range queueRates {
+		if count, ok := queue.MessageStats[name].(float64); ok {
+			sample["rabbitmq.queue.message_stats."+name] = count
+		}
+		if details, ok := queue.MessageStats[name+"_details"].(map[string]interface{}); ok {
+			if rate, ok := details["rate"].(float64); ok {
+				sample["rabbitmq.queue.message_stats."+name+"_rate"] = rate
+			}
+		}
+	}
+	if utilisation, ok := queue.ConsumerUtilisation.(float64); ok {
+		sample["rabbitmq.queue.consumer_utilisation"] = utilisation
+	}
+}
+
+// intSetting parses a numeric setting, falling back to the default when it
+// is unset or invalid
+// validatePageSize refuses a page size the management API won't accept
+func validatePageSize(pageSize int) error {
+	if pageSize > MAX_PAGE_SIZE {
+		return fmt.Errorf("RABBITMQ_PAGE_SIZE %d is over the %d queues the management API returns per page", pageSize, MAX_PAGE_SIZE)
+	}
+	return nil
+}
+
+func intSetting(value string, fallback int) int {
+	setting, err := strconv.Atoi(value)
+	if err != nil || setting < 0 {
+		return fallback
+	}
+	return setting
+}
@@ -24,6 +24,18 @@ type RabbitmqConfig struct {
 	rabbitmqPassword string
 	rabbitmqPort     string
 	rabbitmqHost     string
+
+	// queues are fetched page by page when pageSize is set, filtered by the
+	// vhost and queue name patterns and cut down to the deepest topQueues
+	pageSize      int
+	includeVhosts string
+	excludeVhosts string
+	includeQueues string
+	excludeQueues string
+	topQueues     int
+
+	// where the shovel and federation link states are kept between runs
+	stateFile string
 }
 
 // InventoryData is the data type for inventory data produced by a plugin data
@@ -60,6 +72,12 @@ type NodeInfo struct {
 	RunQueueLength uint32 `json:"run_queue"`
 	Processors     uint32 `json:"processors"`
 	Uptime         uint64 `json:"uptime"`
+	MemLimit       int    `json:"mem_limit"`
+	MemAlarm       bool   `json:"mem_alarm"`
+	DiskFreeAlarm  bool   `json:"disk_free_alarm"`
+
+	// nodes this node can't reach, set during a network partition
+	Partitions []string `json:"partitions"`
 }
 
 type QueueInfo struct {
@@ -85,14 +103,40 @@ type QueueInfo struct {
 	MessagesReady int `json:"messages_ready"`
 	// Number of messages delivered and pending acknowledgements from consumers
 	MessagesUnacknowledged int `json:"messages_unacknowledged"`
+	// Counts and rates of the messages through this queue
+	MessageStats map[string]interface{} `json:"message_stats"`
+	// Fraction of the time the consumers could take new messages, it isn't
+	// a number when the queue has no consumers
+	ConsumerUtilisation interface{} `json:"consumer_utilisation"`
 }
 
 func init() {
 	runner = &utilsHTTP.HTTPRunnerImpl{}
 }
 
+// statusError is a management API response other than 200
+type statusError struct {
+	url  string
+	code int
+}
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("%v returned status %d", e.url, e.code)
+}
+
+// isNotFound is whether the endpoint doesn't exist, e.g. because the plugin
+// serving it isn't enabled
+func isNotFound(err error) bool {
+	status, ok := err.(statusError)
+	return ok && status.code == http.StatusNotFound
+}
+
 func executeAndDecode(log *logrus.Logger, httpReq http.Request, record interface{}) error {
 	code, data, err := runner.CallAPI(log, nil, &httpReq, &http.Client{})
+	if err == nil && code == http.StatusNotFound {
+		// left to the caller to log, a missing plugin endpoint isn't an error
+		return statusError{url: httpReq.URL.String(), code: code}
+	}
 	if err != nil || code != 200 {
 		log.WithFields(logrus.Fields{
 			"code":    code,
@@ -100,6 +144,9 @@ func executeAndDecode(log *logrus.Logger, httpReq http.Request, record interface
 			"httpReq": httpReq,
 			"error":   err,
 		}).Error("Encountered error calling CallAPI")
+		if err == nil {
+			err = statusError{url: httpReq.URL.String(), code: code}
+		}
 		return err
 	}
 	return json.Unmarshal(data, &record)
@@ -134,6 +181,9 @@ func validateConfig(log *logrus.Logger, config RabbitmqConfig) {
 	if config.rabbitmqHost == "" || config.rabbitmqPassword == "" || config.rabbitmqPort == "" || config.rabbitmqUser == "" {
 		log.Fatal("Config Yaml is missing values. Please check the config to continue")
 	}
+	if err := validatePageSize(config.pageSize); err != nil {
+		log.WithError(err).Fatal("Config Yaml has an invalid page size. Please check the config to continue")
+	}
 }
 
 func fatalIfErr(log *logrus.Logger, err error) {
@@ -159,6 +209,15 @@ func Run(log *logrus.Logger, prettyPrint bool, version string) {
 		rabbitmqPassword: os.Getenv("RABBITMQ_PASSWORD"),
 		rabbitmqPort:     os.Getenv("RABBITMQ_PORT"),
 		rabbitmqHost:     os.Getenv("RABBITMQ_HOST"),
+
+		pageSize:      intSetting(os.Getenv("RABBITMQ_PAGE_SIZE"), 0),
+		includeVhosts: os.Getenv("RABBITMQ_INCLUDE_VHOSTS"),
+		excludeVhosts: os.Getenv("RABBITMQ_EXCLUDE_VHOSTS"),
+		includeQueues: os.Getenv("RABBITMQ_INCLUDE_QUEUES"),
+		excludeQueues: os.Getenv("RABBITMQ_EXCLUDE_QUEUES"),
+		topQueues:     intSetting(os.Getenv("RABBITMQ_TOP_QUEUES"), 0),
+
+		stateFile: os.Getenv("RABBITMQ_STATE_FILE"),
 	}
 	validateConfig(log, config)
 
@@ -166,6 +225,16 @@ func Run(log *logrus.Logger, prettyPrint bool, version string) {
 	fatalIfErr(log, err)
 
 	data.Metrics = append(data.Metrics, metrics...)
+	data.Events = append(data.Events, alarmEvents(metrics)...)
+	data.Events = append(data.Events, partitionEvents(metrics)...)
+	linkMetrics, failedLinks := getLinkMetrics(log, config)
+	data.Metrics = append(data.Metrics, linkMetrics...)
+	previousLinks, found := readLinkState(log, config)
+	events, links := linkEvents(previousLinks, linkMetrics, failedLinks)
+	if found {
+		data.Events = append(data.Events, events...)
+	}
+	writeLinkState(log, config, links)
 	fatalIfErr(log, OutputJSON(data, prettyPrint))
 }
 
@@ -188,24 +257,6 @@ func listNodes(log *logrus.Logger, config RabbitmqConfig) (nodeRecords []NodeInf
 	return nodeRecords, nil
 }
 
-func listQueues(log *logrus.Logger, config RabbitmqConfig) (queueRecords []QueueInfo, err error) {
-	rabbitmqQueuesStatsURI := fmt.Sprintf("%v:%v/%v", config.rabbitmqHost, config.rabbitmqPort, "api/queues")
-	httpReq, err := http.NewRequest("GET", rabbitmqQueuesStatsURI, bytes.NewBuffer([]byte("")))
-	if err != nil {
-		log.WithFields(logrus.Fields{
-			"rabbitmqQueuesStatsURI": rabbitmqQueuesStatsURI,
-			"error":                  err,
-		}).Error("Encountered error creating http.NewRequest")
-		return []QueueInfo{}, err
-	}
-	httpReq.SetBasicAuth(config.rabbitmqUser, config.rabbitmqPassword)
-	err = executeAndDecode(log, *httpReq, &queueRecords)
-	if err != nil {
-		return []QueueInfo{}, err
-	}
-	return queueRecords, nil
-}
-
 func getRabbitmqStatus(log *logrus.Logger, config RabbitmqConfig) ([]MetricData, error) {
 	NodesResponse, err := listNodes(log, config)
 	if err != nil {
@@ -216,8 +267,9 @@ func getRabbitmqStatus(log *logrus.Logger, config RabbitmqConfig) ([]MetricData,
 		return make([]MetricData, 0), err
 	}
 	Stats := make([]MetricData, 0)
+	partitioned := clusterPartitioned(NodesResponse)
 	for _, Node := range NodesResponse {
-		Stats = append(Stats, MetricData{
+		sample := MetricData{
 			"event_type":                  EVENT_TYPE,
 			"provider":                    PROVIDER,
 			"rabbitmq.node.name":          Node.Name,
@@ -228,9 +280,22 @@ func getRabbitmqStatus(log *logrus.Logger, config RabbitmqConfig) ([]MetricData,
 			"rabbitmq.node.sockets_total": Node.SocketsTotal,
 			"rabbitmq.node.run_queue":     Node.RunQueueLength,
 			"rabbitmq.node.processors":    Node.Processors,
-		})
+
+			"rabbitmq.node.uptime":          Node.Uptime,
+			"rabbitmq.node.disk_free":       Node.DiskFree,
+			"rabbitmq.node.disk_free_limit": Node.DiskFreeLimit,
+			"rabbitmq.node.disk_free_alarm": Node.DiskFreeAlarm,
+			"rabbitmq.node.mem_limit":       Node.MemLimit,
+			"rabbitmq.node.mem_alarm":       Node.MemAlarm,
+		}
+		addPartitions(sample, Node, partitioned)
+		Stats = append(Stats, sample)
 	}
 
+	filter, err := newQueueFilter(config)
+	if err != nil {
+		return make([]MetricData, 0), err
+	}
 	QueuesResponse, err := listQueues(log, config)
 	if err != nil {
 		log.WithFields(logrus.Fields{
@@ -238,8 +303,8 @@ func getRabbitmqStatus(log *logrus.Logger, config RabbitmqConfig) ([]MetricData,
 		}).Error("Encountered error querying Queues")
 		return make([]MetricData, 0), err
 	}
-	for _, Queue := range QueuesResponse {
-		Stats = append(Stats, MetricData{
+	for _, Queue := range topQueues(filter.apply(QueuesResponse), config.topQueues) {
+		sample := MetricData{
 			"event_type":                             EVENT_TYPE,
 			"provider":                               PROVIDER,
 			"rabbitmq.queue.name":                    Queue.Name,
@@ -251,7 +316,25 @@ func getRabbitmqStatus(log *logrus.Logger, config RabbitmqConfig) ([]MetricData,
 			"rabbitmq.queue.messages":                Queue.Messages,
 			"rabbitmq.queue.messages_ready":          Queue.MessagesReady,
 			"rabbitmq.queue.messages_unacknowledged": Queue.MessagesUnacknowledged,
-		})
+		}
+		addQueueRates(sample, Queue)
+		Stats = append(Stats, sample)
+	}
+
+	for _, collector := range []struct {
+		name    string
+		collect func(*logrus.Logger, RabbitmqConfig) ([]MetricData, error)
+	}{
+		{name: "overview", collect: getOverviewMetrics},
+		{name: "exchange", collect: getExchangeMetrics},
+		{name: "connection", collect: getConnectionMetrics},
+	} {
+		metrics, err := collector.collect(log, config)
+		if err != nil {
+			log.WithError(err).Warn(fmt.Sprintf("Failed to collect %s metrics", collector.name))
+			continue
+		}
+		Stats = append(Stats, metrics...)
 	}
 
 	//return Stats, nil
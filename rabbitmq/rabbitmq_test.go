@@ -1,6 +1,7 @@
 package rabbitmq
 
 import (
+	"encoding/json"
 	"reflect"
 	"testing"
 
@@ -170,3 +171,343 @@ func TestGetRabbitmqStatus(t *testing.T) {
 		})
 	}
 }
+
+func TestGetRabbitmqStatusEndpoints(t *testing.T) {
+	g := goblin.Goblin(t)
+	runner = &fake.HTTPResult{
+		ResultsList: []fake.Result{
+			{
+				Method: "GET",
+				URI:    "/api/nodes",
+				Code:   200,
+				Data:   []byte(`[{"name":"rabbit@rabbit-1","uptime":22237082,"disk_free":1932713984,"disk_free_limit":50000000,"disk_free_alarm":false,"mem_used":61525440,"mem_limit":409350144,"mem_alarm":true}]`),
+			},
+			{
+				Method: "GET",
+				URI:    "/api/queues",
+				Code:   200,
+				Data:   []byte(`[]`),
+			},
+			{
+				Method: "GET",
+				URI:    "/api/overview",
+				Code:   200,
+				Data:   []byte(`{"cluster_name":"rabbit@rabbit-1","rabbitmq_version":"3.6.10","message_stats":{"publish":1200,"publish_details":{"rate":2.4},"deliver_get":1100,"deliver_get_details":{"rate":2.2}},"queue_totals":{"messages":7,"messages_details":{"rate":0.0}},"object_totals":{"consumers":4,"queues":3,"exchanges":9,"connections":3,"channels":4}}`),
+			},
+			{
+				Method: "GET",
+				URI:    "/api/exchanges",
+				Code:   200,
+				Data:   []byte(`[{"name":"","vhost":"/","type":"direct","durable":true},{"name":"orders","vhost":"shop","type":"topic","durable":true,"message_stats":{"publish_in":300,"publish_in_details":{"rate":1.5},"publish_out":290,"publish_out_details":{"rate":1.25}}}]`),
+			},
+			{
+				Method: "GET",
+				URI:    "/api/connections",
+				Code:   200,
+				Data:   []byte(`[{"vhost":"shop","user":"orders"},{"vhost":"/","user":"guest"},{"vhost":"shop","user":"orders"}]`),
+			},
+			{
+				Method: "GET",
+				URI:    "/api/channels",
+				Code:   200,
+				Data:   []byte(`[{"vhost":"shop","user":"orders"},{"vhost":"shop","user":"orders"},{"vhost":"shop","user":"orders"},{"vhost":"/","user":"guest"}]`),
+			},
+		},
+	}
+
+	g.Describe("getRabbitmqStatus()", func() {
+		g.It("Should report the node, overview, exchange and connection samples", func() {
+			result, err := getRabbitmqStatus(logrus.New(), rabbitMqFakeConfig)
+			g.Assert(err).Equal(nil)
+			g.Assert(len(result)).Equal(6)
+			g.Assert(result[0]["rabbitmq.node.uptime"]).Equal(uint64(22237082))
+			g.Assert(result[0]["rabbitmq.node.disk_free_limit"]).Equal(50000000)
+			g.Assert(result[0]["rabbitmq.node.mem_alarm"]).Equal(true)
+			g.Assert(result[1]["rabbitmq.overview.cluster_name"]).Equal("rabbit@rabbit-1")
+			g.Assert(result[1]["rabbitmq.overview.message_stats.publish"]).Equal(float64(1200))
+			g.Assert(result[1]["rabbitmq.overview.message_stats.publish_rate"]).Equal(2.4)
+			g.Assert(result[1]["rabbitmq.overview.queue_totals.messages"]).Equal(float64(7))
+			g.Assert(result[1]["rabbitmq.overview.object_totals.connections"]).Equal(float64(3))
+			g.Assert(result[2]["rabbitmq.exchange.name"]).Equal("(AMQP default)")
+			g.Assert(result[3]["rabbitmq.exchange.publish_in_rate"]).Equal(1.5)
+			g.Assert(result[3]["rabbitmq.exchange.publish_out"]).Equal(float64(290))
+			g.Assert(result[4]).Equal(MetricData{
+				"event_type":           EVENT_TYPE,
+				"provider":             PROVIDER,
+				"rabbitmq.vhost":       "/",
+				"rabbitmq.user":        "guest",
+				"rabbitmq.connections": 1,
+				"rabbitmq.channels":    1,
+			})
+			g.Assert(result[5]["rabbitmq.connections"]).Equal(2)
+			g.Assert(result[5]["rabbitmq.channels"]).Equal(3)
+		})
+		g.It("Should send an event for every alarm set", func() {
+			result, _ := getRabbitmqStatus(logrus.New(), rabbitMqFakeConfig)
+			g.Assert(alarmEvents(result)).Equal([]EventData{{
+				"event_type":         ALARM_EVENT_TYPE,
+				"provider":           PROVIDER,
+				"category":           "notifications",
+				"summary":            "rabbitmq node rabbit@rabbit-1 has a memory alarm set",
+				"rabbitmq.node.name": "rabbit@rabbit-1",
+				"rabbitmq.alarm":     "memory",
+			}})
+		})
+	})
+}
+
+func TestListQueuesPaged(t *testing.T) {
+	g := goblin.Goblin(t)
+	pagedConfig := rabbitMqFakeConfig
+	pagedConfig.pageSize = 2
+	pagedConfig.includeQueues = "^orders"
+
+	g.Describe("listQueues()", func() {
+		g.It("Should fetch every page of the matching queues", func() {
+			runner = &fake.HTTPResult{
+				ResultsList: []fake.Result{
+					{
+						Method: "GET",
+						URI:    "/api/queues?name=%5Eorders&page=1&page_size=2&use_regex=true",
+						Code:   200,
+						Data:   []byte(`{"items":[{"name":"orders.new","vhost":"shop"},{"name":"orders.paid","vhost":"shop"}],"page":1,"page_count":2,"page_size":2}`),
+					},
+					{
+						Method: "GET",
+						URI:    "/api/queues?name=%5Eorders&page=2&page_size=2&use_regex=true",
+						Code:   200,
+						Data:   []byte(`{"items":[{"name":"orders.shipped","vhost":"shop"}],"page":2,"page_count":2,"page_size":2}`),
+					},
+				},
+			}
+			result, err := listQueues(logrus.New(), pagedConfig)
+			g.Assert(err).Equal(nil)
+			g.Assert(len(result)).Equal(3)
+			g.Assert(result[2].Name).Equal("orders.shipped")
+		})
+		g.It("Should return the error of a failed page", func() {
+			runner = &fake.HTTPResult{}
+			_, err := listQueues(logrus.New(), pagedConfig)
+			g.Assert(err == nil).Equal(false)
+		})
+	})
+
+	g.Describe("validatePageSize()", func() {
+		g.It("Should accept no page size and sizes up to 500", func() {
+			g.Assert(validatePageSize(0)).Equal(nil)
+			g.Assert(validatePageSize(MAX_PAGE_SIZE)).Equal(nil)
+		})
+		g.It("Should refuse a page size the management API won't accept", func() {
+			g.Assert(validatePageSize(MAX_PAGE_SIZE+1) == nil).Equal(false)
+		})
+	})
+}
+
+func TestQueueFilter(t *testing.T) {
+	g := goblin.Goblin(t)
+	queues := []QueueInfo{
+		{Name: "orders.new", Vhost: "shop", Messages: 5},
+		{Name: "amq.gen-123", Vhost: "shop", Messages: 50},
+		{Name: "orders.new", Vhost: "test-shop", Messages: 500},
+		{Name: "emails", Vhost: "mail", Messages: 40},
+		{Name: "orders.paid", Vhost: "shop", Messages: 20},
+	}
+
+	g.Describe("queueFilter", func() {
+		g.It("Should keep the queues matching the patterns", func() {
+			filterConfig := rabbitMqFakeConfig
+			filterConfig.excludeVhosts = "^test"
+			filterConfig.excludeQueues = `^amq\.gen-`
+			filter, err := newQueueFilter(filterConfig)
+			g.Assert(err).Equal(nil)
+			g.Assert(filter.apply(queues)).Equal([]QueueInfo{queues[0], queues[3], queues[4]})
+
+			filterConfig.includeVhosts = "^shop$"
+			filter, _ = newQueueFilter(filterConfig)
+			g.Assert(filter.apply(queues)).Equal([]QueueInfo{queues[0], queues[4]})
+		})
+		g.It("Should return an error for an invalid pattern", func() {
+			filterConfig := rabbitMqFakeConfig
+			filterConfig.includeQueues = "orders("
+			_, err := newQueueFilter(filterConfig)
+			g.Assert(err == nil).Equal(false)
+		})
+	})
+
+	g.Describe("topQueues()", func() {
+		g.It("Should keep the deepest queues", func() {
+			g.Assert(topQueues(queues, 2)).Equal([]QueueInfo{queues[2], queues[1]})
+			g.Assert(len(topQueues(queues, 0))).Equal(5)
+		})
+	})
+}
+
+func TestAddQueueRates(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	g.Describe("addQueueRates()", func() {
+		g.It("Should add the message rates and consumer utilisation", func() {
+			var queues []QueueInfo
+			err := json.Unmarshal([]byte(`[{"name":"orders","consumer_utilisation":0.75,"message_stats":{"publish":100,"publish_details":{"rate":1.5},"ack":90,"ack_details":{"rate":1.25},"get":3,"get_details":{"rate":0.0}}},{"name":"idle","consumer_utilisation":""}]`), &queues)
+			g.Assert(err).Equal(nil)
+
+			sample := MetricData{}
+			addQueueRates(sample, queues[0])
+			g.Assert(sample).Equal(MetricData{
+				"rabbitmq.queue.message_stats.publish":      float64(100),
+				"rabbitmq.queue.message_stats.publish_rate": 1.5,
+				"rabbitmq.queue.message_stats.ack":          float64(90),
+				"rabbitmq.queue.message_stats.ack_rate":     1.25,
+				"rabbitmq.queue.consumer_utilisation":       0.75,
+			})
+
+			sample = MetricData{}
+			addQueueRates(sample, queues[1])
+			g.Assert(sample).Equal(MetricData{})
+		})
+	})
+}
+
+func TestLinks(t *testing.T) {
+	g := goblin.Goblin(t)
+	runner = &fake.HTTPResult{
+		ResultsList: []fake.Result{
+			{
+				Method: "GET",
+				URI:    "/api/shovels",
+				Code:   200,
+				Data:   []byte(`[{"name":"orders-dc2","vhost":"shop","type":"dynamic","state":"terminated","node":"rabbit@rabbit-1","reason":"econnrefused"},{"name":"emails-dc2","vhost":"mail","type":"static","state":"running","node":"rabbit@rabbit-1"}]`),
+			},
+			{
+				Method: "GET",
+				URI:    "/api/federation-links",
+				Code:   200,
+				Data:   []byte(`[{"upstream":"dc2","vhost":"shop","type":"exchange","exchange":"orders","status":"error","node":"rabbit@rabbit-2","error":"access_refused"},{"upstream":"dc2","vhost":"shop","type":"queue","queue":"payments","status":"running","node":"rabbit@rabbit-2"}]`),
+			},
+		},
+	}
+	shovels, err := getShovelMetrics(logrus.New(), rabbitMqFakeConfig)
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when getting the shovels", err)
+	}
+	federation, err := getFederationMetrics(logrus.New(), rabbitMqFakeConfig)
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when getting the federation links", err)
+	}
+	metrics := append(shovels, federation...)
+
+	g.Describe("getShovelMetrics()", func() {
+		g.It("Should report the state of every shovel", func() {
+			g.Assert(shovels[0]).Equal(MetricData{
+				"event_type":             EVENT_TYPE,
+				"provider":               PROVIDER,
+				"rabbitmq.shovel.name":   "orders-dc2",
+				"rabbitmq.shovel.vhost":  "shop",
+				"rabbitmq.shovel.type":   "dynamic",
+				"rabbitmq.shovel.state":  "terminated",
+				"rabbitmq.shovel.node":   "rabbit@rabbit-1",
+				"rabbitmq.shovel.reason": "econnrefused",
+			})
+		})
+	})
+
+	g.Describe("getFederationMetrics()", func() {
+		g.It("Should report the status of every link", func() {
+			g.Assert(federation[0]["rabbitmq.federation.exchange"]).Equal("orders")
+			g.Assert(federation[0]["rabbitmq.federation.error"]).Equal("access_refused")
+			g.Assert(federation[1]["rabbitmq.federation.queue"]).Equal("payments")
+			g.Assert(federation[1]["rabbitmq.federation.status"]).Equal("running")
+		})
+	})
+
+	g.Describe("linkEvents()", func() {
+		g.It("Should report the links that left running", func() {
+			previous := map[string]string{
+				"shovel/shop/orders-dc2":           "running",
+				"shovel/mail/emails-dc2":           "starting",
+				"federation/shop/dc2/orders":       "starting",
+				"federation/shop/dc2/payments":     "running",
+				"federation/shop/dc2/old-exchange": "running",
+			}
+			events, current := linkEvents(previous, metrics, nil)
+			g.Assert(events).Equal([]EventData{{
+				"event_type":                  LINK_EVENT_TYPE,
+				"provider":                    PROVIDER,
+				"category":                    "notifications",
+				"summary":                     "rabbitmq shovel orders-dc2 in vhost shop left running for terminated",
+				"rabbitmq.link.type":          "shovel",
+				"rabbitmq.link.name":          "orders-dc2",
+				"rabbitmq.link.vhost":         "shop",
+				"rabbitmq.link.previousState": "running",
+				"rabbitmq.link.state":         "terminated",
+				"rabbitmq.link.reason":        "econnrefused",
+			}})
+			g.Assert(current).Equal(map[string]string{
+				"shovel/shop/orders-dc2":       "terminated",
+				"shovel/mail/emails-dc2":       "running",
+				"federation/shop/dc2/orders":   "error",
+				"federation/shop/dc2/payments": "running",
+			})
+
+			events, _ = linkEvents(current, []MetricData{federation[0], {"rabbitmq.federation.upstream": "dc2", "rabbitmq.federation.vhost": "shop", "rabbitmq.federation.queue": "payments", "rabbitmq.federation.status": "shutdown"}}, nil)
+			g.Assert(len(events)).Equal(1)
+			g.Assert(events[0]["rabbitmq.link.name"]).Equal("dc2/payments")
+		})
+		g.It("Should keep the previous state of the link types that failed", func() {
+			previous := map[string]string{
+				"shovel/shop/orders-dc2":       "running",
+				"federation/shop/dc2/payments": "running",
+			}
+			events, current := linkEvents(previous, federation, map[string]bool{"shovel": true})
+			g.Assert(len(events)).Equal(0)
+			g.Assert(current).Equal(map[string]string{
+				"shovel/shop/orders-dc2":       "running",
+				"federation/shop/dc2/orders":   "error",
+				"federation/shop/dc2/payments": "running",
+			})
+		})
+	})
+
+	g.Describe("getLinkMetrics()", func() {
+		g.It("Should skip a plugin that isn't enabled and record the failures", func() {
+			runner = &fake.HTTPResult{
+				ResultsList: []fake.Result{
+					{Method: "GET", URI: "/api/shovels", Code: 404, Data: []byte(`{"error":"Object Not Found","reason":"Not Found"}`)},
+					{Method: "GET", URI: "/api/federation-links", Code: 500},
+				},
+			}
+			linkMetrics, failed := getLinkMetrics(logrus.New(), rabbitMqFakeConfig)
+			g.Assert(linkMetrics).Equal([]MetricData{})
+			g.Assert(failed).Equal(map[string]bool{"federation": true})
+		})
+	})
+
+	g.Describe("partitionEvents()", func() {
+		g.It("Should report every partitioned node", func() {
+			nodes := []NodeInfo{
+				{Name: "rabbit@rabbit-1", Partitions: []string{"rabbit@rabbit-2", "rabbit@rabbit-3"}},
+				{Name: "rabbit@rabbit-2"},
+			}
+			partitioned := clusterPartitioned(nodes)
+			samples := make([]MetricData, 0)
+			for _, node := range nodes {
+				sample := MetricData{"rabbitmq.node.name": node.Name}
+				addPartitions(sample, node, partitioned)
+				samples = append(samples, sample)
+			}
+			g.Assert(samples[1]).Equal(MetricData{
+				"rabbitmq.node.name":           "rabbit@rabbit-2",
+				"rabbitmq.node.partitions":     0,
+				"rabbitmq.cluster.partitioned": true,
+			})
+			g.Assert(partitionEvents(samples)).Equal([]EventData{{
+				"event_type":                     PARTITION_EVENT_TYPE,
+				"provider":                       PROVIDER,
+				"category":                       "notifications",
+				"summary":                        "rabbitmq node rabbit@rabbit-1 is partitioned from rabbit@rabbit-2,rabbit@rabbit-3",
+				"rabbitmq.node.name":             "rabbit@rabbit-1",
+				"rabbitmq.node.partitioned_from": "rabbit@rabbit-2,rabbit@rabbit-3",
+			}})
+		})
+	})
+}
@@ -0,0 +1,277 @@
+package zookeeper
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// ENSEMBLE_EVENT_TYPE is the event type of the sample describing the ensemble
+// as a whole
+const ENSEMBLE_EVENT_TYPE string = "ZookeeperEnsembleSample"
+
+// DEFAULT_CLIENTPORT is used for ensemble members listed without a port
+const DEFAULT_CLIENTPORT string = "2181"
+
+// DEFAULT_MAX_ZXID_LAG is how many transactions a member may be behind the
+// leader before it is flagged, the members don't answer at the same instant
+// so a small lag is expected on a busy ensemble
+const DEFAULT_MAX_ZXID_LAG int64 = 100
+
+// member is what was collected of a single ensemble member
+type member struct {
+	address     string
+	ok          bool
+	ruokUnknown bool
+	mntr        map[string]string
+	srvr        map[string]string
+	connections int
+	queued      int
+	zxid        int64
+	err         error
+}
+
+// parseEnsemble reads a connection string such as
+// "zk1:2181,zk2:2181,zk3:2181/chroot" into the members' addresses
+func parseEnsemble(connection string, defaultPort string) []string {
+	if defaultPort == "" {
+		defaultPort = DEFAULT_CLIENTPORT
+	}
+	if chroot := strings.Index(connection, "/"); chroot >= 0 {
+		connection = connection[:chroot]
+	}
+	var addresses []string
+	for _, host := range strings.Split(connection, ",") {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = net.JoinHostPort(strings.Trim(host, "[]"), defaultPort)
+		}
+		addresses = append(addresses, host)
+	}
+	return addresses
+}
+
+// queryMember sends ruok, mntr, srvr and cons to a member. A member that
+// doesn't answer imok is still queried as long as it can be reached, it may
+// answer the other commands. When neither ruok nor the AdminServer's ruok is
+// allowed the member's health is unknown rather than not ok.
+func queryMember(log *logrus.Logger, client flwClient) member {
+	result := member{address: client.address}
+	ruok, err := client.send("ruok")
+	if _, unreachable := err.(net.Error); unreachable {
+		result.err = err
+		return result
+	}
+	if _, notWhitelisted := err.(notWhitelistedError); notWhitelisted {
+		ruok, err = client.fallback(log, "ruok", err)
+		result.ruokUnknown = err != nil
+	}
+	result.ok = err == nil && strings.TrimSpace(ruok) == "imok"
+
+	mntr, err := client.command(log, "mntr")
+	if err != nil {
+		result.err = err
+		return result
+	}
+	result.mntr = parseMntr(mntr)
+
+	srvr, err := client.command(log, "srvr")
+	if err != nil {
+		result.err = err
+		return result
+	}
+	result.srvr = parseSrvr(srvr)
+	if zxid, err := strconv.ParseInt(strings.TrimPrefix(result.srvr["Zxid"], "0x"), 16, 64); err == nil {
+		result.zxid = zxid
+	}
+
+	cons, err := client.command(log, "cons")
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"address": client.address,
+			"error":   err,
+		}).Warn("Failed to list zookeeper connections")
+		return result
+	}
+	result.connections, result.queued = parseCons(cons)
+	return result
+}
+
+// parseMntr reads the tab separated key and value lines of mntr
+func parseMntr(reply string) map[string]string {
+	values := make(map[string]string)
+	for _, line := range strings.Split(reply, "\n") {
+		fields := strings.SplitN(strings.TrimSpace(line), "\t", 2)
+		if len(fields) == 2 {
+			values[fields[0]] = fields[1]
+		}
+	}
+	return values
+}
+
+// parseSrvr reads the "Key: value" lines of srvr
+func parseSrvr(reply string) map[string]string {
+	values := make(map[string]string)
+	for _, line := range strings.Split(reply, "\n") {
+		fields := strings.SplitN(line, ":", 2)
+		if len(fields) == 2 {
+			values[strings.TrimSpace(fields[0])] = strings.TrimSpace(fields[1])
+		}
+	}
+	return values
+}
+
+// parseCons counts the connections cons lists, one per line as
+// " /10.0.0.1:54032[1](queued=0,recved=1,sent=1,...)", along with the
+// requests queued on them
+func parseCons(reply string) (connections int, queued int) {
+	for _, line := range strings.Split(reply, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "/") {
+			continue
+		}
+		connections++
+		if start := strings.Index(line, "queued="); start >= 0 {
+			value := line[start+len("queued="):]
+			if end := strings.IndexAny(value, ",)"); end >= 0 {
+				value = value[:end]
+			}
+			count, _ := strconv.Atoi(value)
+			queued += count
+		}
+	}
+	return connections, queued
+}
+
+// getEnsembleMetrics queries every member of the ensemble at once and returns
+// a sample per member, in the order of the connection string, followed by a
+// sample of the ensemble
+func getEnsembleMetrics(log *logrus.Logger, clients []flwClient, maxZxidLag int64) []MetricData {
+	members := make([]member, len(clients))
+	var wg sync.WaitGroup
+	for i, client := range clients {
+		wg.Add(1)
+		go func(i int, client flwClient) {
+			defer wg.Done()
+			members[i] = queryMember(log, client)
+		}(i, client)
+	}
+	wg.Wait()
+	return ensembleSamples(log, members, maxZxidLag)
+}
+
+func ensembleSamples(log *logrus.Logger, members []member, maxZxidLag int64) []MetricData {
+	var leader *member
+	for i := range members {
+		if members[i].err == nil && members[i].srvr["Mode"] == "leader" {
+			leader = &members[i]
+		}
+	}
+
+	samples := make([]MetricData, 0, len(members)+1)
+	var answering, observers int
+	var notOK, lagging []string
+	for _, m := range members {
+		sample := MetricData{
+			"event_type":               "ZookeeperServerSample",
+			"provider":                 PROVIDER,
+			"zookeeper.server.address": m.address,
+		}
+		if !m.ruokUnknown {
+			sample["zookeeper.server.ruok"] = m.ok
+			if !m.ok {
+				notOK = append(notOK, m.address)
+			}
+		}
+		if m.err != nil {
+			log.WithFields(logrus.Fields{
+				"address": m.address,
+				"error":   m.err,
+			}).Warn("Failed to query zookeeper ensemble member")
+			sample["zookeeper.server.error"] = m.err.Error()
+			samples = append(samples, sample)
+			continue
+		}
+		answering++
+		if m.srvr["Mode"] == "observer" {
+			observers++
+		}
+		for key, value := range m.mntr {
+			sample["zookeeper.mntr."+key] = mntrValue(log, key, value)
+		}
+		sample["zookeeper.server.mode"] = m.srvr["Mode"]
+		sample["zookeeper.server.zxid"] = m.zxid
+		sample["zookeeper.server.connections"] = m.connections
+		sample["zookeeper.server.queued_requests"] = m.queued
+		if leader != nil {
+			lag := zxidLag(leader.zxid, m.zxid)
+			sample["zookeeper.server.zxid_lag"] = lag
+			sample["zookeeper.server.lagging"] = lag > maxZxidLag
+			if lag > maxZxidLag {
+				lagging = append(lagging, m.address)
+			}
+		}
+		samples = append(samples, sample)
+	}
+
+	// observers don't vote, so they count for neither the quorum nor reaching
+	// it. A member that can't be queried can't tell its mode and is taken to
+	// be a voting one.
+	quorum := (len(members)-observers)/2 + 1
+	ensemble := MetricData{
+		"event_type":                         ENSEMBLE_EVENT_TYPE,
+		"provider":                           PROVIDER,
+		"zookeeper.ensemble.members":         len(members),
+		"zookeeper.ensemble.observers":       observers,
+		"zookeeper.ensemble.quorum_size":     quorum,
+		"zookeeper.ensemble.answering":       answering,
+		"zookeeper.ensemble.has_quorum":      answering-observers >= quorum,
+		"zookeeper.ensemble.not_ok":          len(notOK),
+		"zookeeper.ensemble.lagging_members": len(lagging),
+	}
+	if len(notOK) > 0 {
+		sort.Strings(notOK)
+		ensemble["zookeeper.ensemble.not_ok_members"] = strings.Join(notOK, ",")
+	}
+	if len(lagging) > 0 {
+		ensemble["zookeeper.ensemble.lagging"] = strings.Join(lagging, ",")
+	}
+	if leader != nil {
+		ensemble["zookeeper.ensemble.leader"] = leader.address
+		ensemble["zookeeper.ensemble.followers"] = toInt(log, leader.mntr["zk_followers"])
+		ensemble["zookeeper.ensemble.synced_followers"] = toInt(log, leader.mntr["zk_synced_followers"])
+		ensemble["zookeeper.ensemble.pending_syncs"] = toInt(log, leader.mntr["zk_pending_syncs"])
+	}
+	return append(samples, ensemble)
+}
+
+// zxidLag is how many transactions a member is behind the leader. The high 32
+// bits of a zxid are the leader's epoch, a member still in an older epoch is
+// behind by at least the leader's transactions in the current one.
+func zxidLag(leader int64, member int64) int64 {
+	leaderEpoch, memberEpoch := leader>>32, member>>32
+	if memberEpoch < leaderEpoch {
+		return leader&0xffffffff + 1
+	}
+	if lag := leader - member; lag > 0 {
+		return lag
+	}
+	return 0
+}
+
+// ensembleLagSetting parses ZK_MAX_ZXID_LAG, falling back to the default when
+// it is unset or invalid
+func ensembleLagSetting(value string) int64 {
+	lag, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || lag < 0 {
+		return DEFAULT_MAX_ZXID_LAG
+	}
+	return lag
+}
@@ -0,0 +1,293 @@
+package zookeeper
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// DEFAULT_FLW_TIMEOUT bounds each four letter word command, from dialing the
+// server to reading its whole reply, when ZK_FLW_TIMEOUT is not set
+const DEFAULT_FLW_TIMEOUT time.Duration = 5 * time.Second
+
+// DEFAULT_ADMIN_PORT is the port of the AdminServer of ZooKeeper 3.5+ when
+// ZK_ADMIN_PORT is not set
+const DEFAULT_ADMIN_PORT string = "8080"
+
+// flwClient sends four letter word commands to a server. When the server
+// doesn't answer them, e.g. ZooKeeper 3.5+ with the command left out of
+// 4lw.commands.whitelist, the commands the AdminServer also serves are sent
+// over HTTP instead.
+type flwClient struct {
+	address  string
+	timeout  time.Duration
+	adminURL string
+}
+
+// notWhitelistedError is returned for a command the server is configured not
+// to answer
+type notWhitelistedError struct {
+	address string
+	command string
+}
+
+func (e notWhitelistedError) Error() string {
+	return fmt.Sprintf("%s is not in the 4lw.commands.whitelist of %s", e.command, e.address)
+}
+
+// adminCommand is a command of the AdminServer along with how its JSON reply
+// is rendered as the reply of the four letter word
+type adminCommand struct {
+	name   string
+	render func(values map[string]interface{}) string
+}
+
+// adminCommands are keyed by the four letter word they replace
+var adminCommands = map[string]adminCommand{
+	"ruok": {name: "ruok", render: renderRuok},
+	"mntr": {name: "mntr", render: renderMntr},
+	"srvr": {name: "server_stats", render: renderSrvr},
+	"cons": {name: "connections", render: renderCons},
+	"conf": {name: "configuration", render: renderConf},
+}
+
+// mntrKeys is the order mntr lists its keys in
+var mntrKeys = []string{
+	"version",
+	"avg_latency",
+	"max_latency",
+	"min_latency",
+	"packets_received",
+	"packets_sent",
+	"num_alive_connections",
+	"outstanding_requests",
+	"server_state",
+	"znode_count",
+	"watch_count",
+	"ephemerals_count",
+	"approximate_data_size",
+	"open_file_descriptor_count",
+	"max_file_descriptor_count",
+	"followers",
+	"synced_followers",
+	"pending_syncs",
+}
+
+// confKeys maps the keys conf lists, in its order, to those of the
+// AdminServer's configuration command
+var confKeys = [][2]string{
+	{"clientPort", "client_port"},
+	{"dataDir", "data_dir"},
+	{"tickTime", "tick_time"},
+	{"maxClientCnxns", "max_client_cnxns"},
+	{"minSessionTimeout", "min_session_timeout"},
+	{"maxSessionTimeout", "max_session_timeout"},
+	{"serverId", "server_id"},
+}
+
+// newFLWClient returns a client of the server at address using the timeout
+// and AdminServer port of the config
+func newFLWClient(ZKConf Config, address string) flwClient {
+	client := flwClient{
+		address: address,
+		timeout: flwTimeoutSetting(ZKConf.ZK_FLW_TIMEOUT),
+	}
+	adminPort := ZKConf.ZK_ADMIN_PORT
+	if adminPort == "" {
+		adminPort = DEFAULT_ADMIN_PORT
+	}
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		client.adminURL = "http://" + net.JoinHostPort(host, adminPort)
+	}
+	return client
+}
+
+// command returns the reply to a four letter word, falling back to the
+// AdminServer when the server doesn't answer it
+func (c flwClient) command(log *logrus.Logger, command string) (string, error) {
+	reply, err := c.send(command)
+	if err == nil {
+		return reply, nil
+	}
+	return c.fallback(log, command, err)
+}
+
+// fallback runs the AdminServer command standing in for a four letter word
+// the server didn't answer with err
+func (c flwClient) fallback(log *logrus.Logger, command string, err error) (string, error) {
+	admin, ok := adminCommands[command]
+	if !ok || c.adminURL == "" {
+		return "", err
+	}
+	log.WithFields(logrus.Fields{
+		"address": c.address,
+		"command": command,
+		"error":   err,
+	}).Debug("Four letter word unavailable, falling back to the AdminServer")
+	reply, adminErr := c.admin(admin)
+	if adminErr != nil {
+		return "", fmt.Errorf("%v, AdminServer: %v", err, adminErr)
+	}
+	return reply, nil
+}
+
+// send sends a four letter word to the server and returns its reply, the
+// whole exchange is bounded by the client's timeout
+func (c flwClient) send(command string) (string, error) {
+	conn, err := net.DialTimeout("tcp", c.address, c.timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return "", err
+	}
+	if _, err := conn.Write([]byte(command)); err != nil {
+		return "", err
+	}
+	reply, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return "", err
+	}
+	if strings.Contains(string(reply), "not in the whitelist") {
+		return "", notWhitelistedError{address: c.address, command: command}
+	}
+	if len(reply) == 0 {
+		return "", fmt.Errorf("%s returned an empty reply to %s", c.address, command)
+	}
+	return string(reply), nil
+}
+
+// admin runs a command of the AdminServer, e.g. /commands/mntr, and renders
+// its reply
+func (c flwClient) admin(command adminCommand) (string, error) {
+	client := &http.Client{Timeout: c.timeout}
+	resp, err := client.Get(c.adminURL + "/commands/" + command.name)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s/commands/%s returned %s", c.adminURL, command.name, resp.Status)
+	}
+	// zxids don't fit a float64, keep the numbers as they were sent
+	decoder := json.NewDecoder(resp.Body)
+	decoder.UseNumber()
+	var values map[string]interface{}
+	if err := decoder.Decode(&values); err != nil {
+		return "", err
+	}
+	if values["error"] != nil {
+		return "", fmt.Errorf("%s/commands/%s returned an error: %v", c.adminURL, command.name, values["error"])
+	}
+	return command.render(values), nil
+}
+
+// renderMntr renders the AdminServer's mntr as mntr lists it, the known keys
+// first in their usual order and then the others sorted
+func renderMntr(values map[string]interface{}) string {
+	var lines []string
+	listed := map[string]bool{"command": true, "error": true}
+	for _, key := range mntrKeys {
+		if value, ok := values[key]; ok {
+			lines = append(lines, "zk_"+key+"\t"+formatValue(value))
+			listed[key] = true
+		}
+	}
+	var others []string
+	for key := range values {
+		if !listed[key] {
+			others = append(others, key)
+		}
+	}
+	sort.Strings(others)
+	for _, key := range others {
+		lines = append(lines, "zk_"+key+"\t"+formatValue(values[key]))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// renderRuok renders the AdminServer's ruok, which has nothing to report but
+// the absence of an error
+func renderRuok(values map[string]interface{}) string {
+	return "imok\n"
+}
+
+// renderSrvr renders the AdminServer's server_stats as srvr lists it
+func renderSrvr(values map[string]interface{}) string {
+	stats, _ := values["server_stats"].(map[string]interface{})
+	lines := []string{
+		"Zookeeper version: " + formatValue(values["version"]),
+		"Latency min/avg/max: " + formatValue(stats["min_latency"]) + "/" + formatValue(stats["avg_latency"]) + "/" + formatValue(stats["max_latency"]),
+		"Received: " + formatValue(stats["packets_received"]),
+		"Sent: " + formatValue(stats["packets_sent"]),
+		"Connections: " + formatValue(stats["num_alive_client_connections"]),
+		"Outstanding: " + formatValue(stats["outstanding_requests"]),
+	}
+	if zxid, err := strconv.ParseInt(formatValue(stats["last_processed_zxid"]), 10, 64); err == nil {
+		lines = append(lines, "Zxid: 0x"+strconv.FormatInt(zxid, 16))
+	}
+	lines = append(lines,
+		"Mode: "+formatValue(stats["server_state"]),
+		"Node count: "+formatValue(values["node_count"]),
+	)
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// renderCons renders the AdminServer's connections as cons lists them
+func renderCons(values map[string]interface{}) string {
+	var lines []string
+	for _, key := range []string{"connections", "secure_connections"} {
+		connections, _ := values[key].([]interface{})
+		for _, connection := range connections {
+			fields, _ := connection.(map[string]interface{})
+			lines = append(lines, fmt.Sprintf(" %s[%s](queued=%s,recved=%s,sent=%s)",
+				formatValue(fields["remote_socket_address"]),
+				formatValue(fields["interest_ops"]),
+				formatValue(fields["outstanding_requests"]),
+				formatValue(fields["packets_received"]),
+				formatValue(fields["packets_sent"])))
+		}
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// renderConf renders the AdminServer's configuration as conf lists it
+func renderConf(values map[string]interface{}) string {
+	lines := make([]string, 0, len(confKeys))
+	for _, key := range confKeys {
+		lines = append(lines, key[0]+"="+formatValue(values[key[1]]))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case json.Number:
+		return v.String()
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// flwTimeoutSetting parses ZK_FLW_TIMEOUT, in seconds, falling back to the
+// default when it is unset or invalid
+func flwTimeoutSetting(value string) time.Duration {
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds <= 0 {
+		return DEFAULT_FLW_TIMEOUT
+	}
+	return time.Duration(seconds) * time.Second
+}
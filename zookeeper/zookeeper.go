@@ -1,12 +1,10 @@
 package zookeeper
 
 import (
-	"io/ioutil"
 	"net"
 	"os"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/GannettDigital/go-newrelic-plugin/helpers"
 	"github.com/Sirupsen/logrus"
@@ -23,10 +21,19 @@ const ProtocolVersion string = "1"
 
 //Config is the keeper of the config
 type Config struct {
-	ZK_TICKTIME   string
-	ZK_DATADIR    string
 	ZK_HOST       string
 	ZK_CLIENTPORT string
+
+	// ZK_ENSEMBLE is a connection string listing every member of the
+	// ensemble, e.g. "zk1:2181,zk2:2181,zk3:2181", all of them are queried
+	// when it is set
+	ZK_ENSEMBLE     string
+	ZK_MAX_ZXID_LAG string
+
+	// ZK_FLW_TIMEOUT bounds each four letter word command, in seconds, and
+	// ZK_ADMIN_PORT is the AdminServer port used when they are unavailable
+	ZK_FLW_TIMEOUT string
+	ZK_ADMIN_PORT  string
 }
 
 // InventoryData is the data type for inventory data produced by a plugin data
@@ -64,14 +71,28 @@ func Run(log *logrus.Logger, prettyPrint bool, version string) {
 	}
 
 	var ZKConf = Config{
-		ZK_TICKTIME:   os.Getenv("ZK_TICKTIME"),
-		ZK_DATADIR:    os.Getenv("ZK_DATADIR"),
 		ZK_HOST:       os.Getenv("ZK_HOST"),
 		ZK_CLIENTPORT: os.Getenv("ZK_CLIENTPORT"),
+
+		ZK_ENSEMBLE:     os.Getenv("ZK_ENSEMBLE"),
+		ZK_MAX_ZXID_LAG: os.Getenv("ZK_MAX_ZXID_LAG"),
+
+		ZK_FLW_TIMEOUT: os.Getenv("ZK_FLW_TIMEOUT"),
+		ZK_ADMIN_PORT:  os.Getenv("ZK_ADMIN_PORT"),
 	}
 
 	validateConfig(log, ZKConf)
 
+	if ZKConf.ZK_ENSEMBLE != "" {
+		var clients []flwClient
+		for _, address := range parseEnsemble(ZKConf.ZK_ENSEMBLE, ZKConf.ZK_CLIENTPORT) {
+			clients = append(clients, newFLWClient(ZKConf, address))
+		}
+		data.Metrics = append(data.Metrics, getEnsembleMetrics(log, clients, ensembleLagSetting(ZKConf.ZK_MAX_ZXID_LAG))...)
+		fatalIfErr(log, helpers.OutputJSON(data, prettyPrint))
+		return
+	}
+
 	var conf_metric = ScrapeFLWconf(log, getFLWconf(log, ZKConf))
 	data.Metrics = append(data.Metrics, conf_metric)
 
@@ -82,11 +103,8 @@ func Run(log *logrus.Logger, prettyPrint bool, version string) {
 }
 
 func validateConfig(log *logrus.Logger, ZKConf Config) {
-	if ZKConf.ZK_TICKTIME == "" {
-		log.Fatal("Config is missing the ZK_TICKTIME. Please check the config to continue")
-	}
-	if ZKConf.ZK_DATADIR == "" {
-		log.Fatal("Config is missing the ZK_DATADIR. Please check the config to continue")
+	if ZKConf.ZK_ENSEMBLE != "" {
+		return
 	}
 	if ZKConf.ZK_HOST == "" {
 		log.Fatal("Config is missing the ZK_HOST. Please check the config to continue")
@@ -104,209 +122,104 @@ func fatalIfErr(log *logrus.Logger, err error) {
 }
 
 func getFLWconf(log *logrus.Logger, ZKConf Config) string {
-
-	tickTime, _ := strconv.Atoi(ZKConf.ZK_TICKTIME)
-	timeOut := time.Duration(tickTime) * time.Millisecond
-
-	conn, err := net.DialTimeout("tcp", ZKConf.ZK_HOST+":"+ZKConf.ZK_CLIENTPORT, timeOut)
-	fatalIfErr(log, err)
-
-	if err != nil {
-		log.WithFields(logrus.Fields{
-			"config.zookeeper.ZK_HOST":       ZKConf.ZK_HOST,
-			"config.zookeeper.ZK_CLIENTPORT": ZKConf.ZK_CLIENTPORT,
-			"config.zookeeper.ZK_TICKTIME":   ZKConf.ZK_TICKTIME,
-			"config.zookeeper.ZK_DATADIR":    ZKConf.ZK_DATADIR,
-			"error": err,
-		}).Fatal("Encountered error calling conf")
-		return ""
-	}
-
-	// close the connection
-	defer conn.Close()
-
-	//Read status using conf
-	_, err = conn.Write([]byte("conf"))
-	fatalIfErr(log, err)
-
-	conn.SetReadDeadline(time.Now().Add(time.Duration(timeOut)))
-
-	everything, err := ioutil.ReadAll(conn)
-	return string(everything)
+	return getFLW(log, ZKConf, "conf")
 }
 
 func getFLWmntr(log *logrus.Logger, ZKConf Config) string {
+	return getFLW(log, ZKConf, "mntr")
+}
 
-	tickTime, _ := strconv.Atoi(ZKConf.ZK_TICKTIME)
-	timeOut := time.Duration(tickTime) * time.Millisecond
-
-	conn, err := net.DialTimeout("tcp", ZKConf.ZK_HOST+":"+ZKConf.ZK_CLIENTPORT, timeOut)
-	fatalIfErr(log, err)
-
+// getFLW returns the reply of ZK_HOST to a four letter word
+func getFLW(log *logrus.Logger, ZKConf Config, command string) string {
+	client := newFLWClient(ZKConf, net.JoinHostPort(ZKConf.ZK_HOST, ZKConf.ZK_CLIENTPORT))
+	reply, err := client.command(log, command)
 	if err != nil {
 		log.WithFields(logrus.Fields{
 			"config.zookeeper.ZK_HOST":       ZKConf.ZK_HOST,
 			"config.zookeeper.ZK_CLIENTPORT": ZKConf.ZK_CLIENTPORT,
-			"config.zookeeper.ZK_TICKTIME":   ZKConf.ZK_TICKTIME,
-			"config.zookeeper.ZK_DATADIR":    ZKConf.ZK_DATADIR,
-			"error": err,
-		}).Fatal("Encountered error calling mntr")
-		return ""
+			"config.zookeeper.ZK_ADMIN_PORT": ZKConf.ZK_ADMIN_PORT,
+			"error":                          err,
+		}).Fatal("Encountered error calling " + command)
 	}
-
-	// close the connection
-	defer conn.Close()
-
-	//Read status using mntr
-	_, err = conn.Write([]byte("mntr"))
-	fatalIfErr(log, err)
-
-	conn.SetReadDeadline(time.Now().Add(time.Duration(timeOut)))
-
-	everything, err := ioutil.ReadAll(conn)
-	return string(everything)
-
+	return reply
 }
 
+// ScrapeFLWconf turns the reply to conf into a sample of the settings listed
+// in confKeys. They are read by key, ZooKeeper 3.5+ lists more settings in
+// between, and a setting the server doesn't list is left out.
 func ScrapeFLWconf(log *logrus.Logger, status string) map[string]interface{} {
-	line := strings.Split(string(status), "\n")
-
-	clientPort := strings.Split(string(line[0]), "=")
-	dataDir := strings.Split(string(line[1]), "=")
-	tickTime := strings.Split(string(line[2]), "=")
-	maxClientCnxns := strings.Split(string(line[3]), "=")
-	minSessionTimeout := strings.Split(string(line[4]), "=")
-	maxSessionTimeout := strings.Split(string(line[5]), "=")
-	serverId := strings.Split(string(line[6]), "=")
-
+	values := parseConf(status)
 	log.WithFields(logrus.Fields{
-		"clientPort":        clientPort[1],
-		"dataDir":           dataDir[1],
-		"tickTime":          tickTime[1],
-		"maxClientCnxns":    maxClientCnxns[1],
-		"minSessionTimeout": minSessionTimeout[1],
-		"maxSessionTimeout": maxSessionTimeout[1],
-		"serverId":          serverId[1],
+		"conf": values,
 	}).Debugf("Scraped ZooKeeper conf values")
-	return map[string]interface{}{
-		"event_type":                       "ZookeeperServerSample",
-		"provider":                         PROVIDER,
-		"zookeeper.conf.clientPort":        toInt(log, clientPort[1]),
-		"zookeeper.conf.dataDir":           dataDir[1],
-		"zookeeper.conf.tickTime":          toInt(log, tickTime[1]),
-		"zookeeper.conf.maxClientCnxns":    toInt(log, maxClientCnxns[1]),
-		"zookeeper.conf.minSessionTimeout": toInt(log, minSessionTimeout[1]),
-		"zookeeper.conf.maxSessionTimeout": toInt(log, maxSessionTimeout[1]),
-		"zookeeper.conf.serverId":          toInt(log, serverId[1]),
+
+	sample := map[string]interface{}{
+		"event_type": "ZookeeperServerSample",
+		"provider":   PROVIDER,
+	}
+	for _, key := range confKeys {
+		value, ok := values[key[0]]
+		if !ok {
+			continue
+		}
+		if key[0] == "dataDir" {
+			sample["zookeeper.conf."+key[0]] = value
+		} else {
+			sample["zookeeper.conf."+key[0]] = toInt(log, value)
+		}
 	}
+	return sample
 }
 
-func ScrapeFLWmntr(log *logrus.Logger, status string) map[string]interface{} {
-	line := strings.Split(string(status), "\n")
-
-	zk_version := strings.Split(string(line[0]), "\t")
-	zk_avg_latency := strings.Split(string(line[1]), "\t")
-	zk_max_latency := strings.Split(string(line[2]), "\t")
-	zk_min_latency := strings.Split(string(line[3]), "\t")
-	zk_packets_received := strings.Split(string(line[4]), "\t")
-	zk_packets_sent := strings.Split(string(line[5]), "\t")
-	zk_num_alive_connections := strings.Split(string(line[6]), "\t")
-	zk_outstanding_requests := strings.Split(string(line[7]), "\t")
-	zk_server_state := strings.Split(string(line[8]), "\t")
-	zk_znode_count := strings.Split(string(line[9]), "\t")
-	zk_watch_count := strings.Split(string(line[10]), "\t")
-	zk_ephemerals_count := strings.Split(string(line[11]), "\t")
-	zk_approximate_data_size := strings.Split(string(line[12]), "\t")
-	zk_open_file_descriptor_count := strings.Split(string(line[13]), "\t")
-	zk_max_file_descriptor_count := strings.Split(string(line[14]), "\t")
-
-	// Add additional attributes if this server is the leader
-	if zk_server_state[1] == "leader" {
-
-		zk_followers := strings.Split(string(line[15]), "\t")
-		zk_synced_followers := strings.Split(string(line[14]), "\t")
-		zk_pending_syncs := strings.Split(string(line[14]), "\t")
-
-		log.WithFields(logrus.Fields{
-			"zk_version":                    zk_version[1],
-			"zk_avg_latency":                zk_avg_latency[1],
-			"zk_max_latency":                zk_max_latency[1],
-			"zk_min_latency":                zk_min_latency[1],
-			"zk_packets_received":           zk_packets_received[1],
-			"zk_packets_sent":               zk_packets_sent[1],
-			"zk_num_alive_connections":      zk_num_alive_connections[1],
-			"zk_outstanding_requests":       zk_outstanding_requests[1],
-			"zk_server_state":               zk_server_state[1],
-			"zk_znode_count":                zk_znode_count[1],
-			"zk_watch_count":                zk_watch_count[1],
-			"zk_ephemerals_count":           zk_ephemerals_count[1],
-			"zk_approximate_data_size":      zk_approximate_data_size[1],
-			"zk_open_file_descriptor_count": zk_open_file_descriptor_count[1],
-			"zk_max_file_descriptor_count":  zk_max_file_descriptor_count[1],
-			"zk_followers":                  zk_followers[1],
-			"zk_synced_followers":           zk_synced_followers[1],
-			"zk_pending_syncs":              zk_pending_syncs[1],
-		}).Debugf("Scraped ZooKeeper values")
-		return map[string]interface{}{
-			"event_type":                                   "ZookeeperServerSample",
-			"provider":                                     PROVIDER,
-			"zookeeper.mntr.zk_version":                    zk_version[1],
-			"zookeeper.mntr.zk_avg_latency":                toInt(log, zk_avg_latency[1]),
-			"zookeeper.mntr.zk_max_latency":                toInt(log, zk_max_latency[1]),
-			"zookeeper.mntr.zk_min_latency":                toInt(log, zk_min_latency[1]),
-			"zookeeper.mntr.zk_packets_received":           toInt(log, zk_packets_received[1]),
-			"zookeeper.mntr.zk_packets_sent":               toInt(log, zk_packets_sent[1]),
-			"zookeeper.mntr.zk_num_alive_connections":      toInt(log, zk_num_alive_connections[1]),
-			"zookeeper.mntr.zk_outstanding_requests":       toInt(log, zk_outstanding_requests[1]),
-			"zookeeper.mntr.zk_server_state":               zk_server_state[1],
-			"zookeeper.mntr.zk_znode_count":                toInt(log, zk_znode_count[1]),
-			"zookeeper.mntr.zk_watch_count":                toInt(log, zk_watch_count[1]),
-			"zookeeper.mntr.zk_ephemerals_count":           toInt(log, zk_ephemerals_count[1]),
-			"zookeeper.mntr.zk_approximate_data_size":      toInt(log, zk_approximate_data_size[1]),
-			"zookeeper.mntr.zk_open_file_descriptor_count": toInt(log, zk_open_file_descriptor_count[1]),
-			"zookeeper.mntr.zk_max_file_descriptor_count":  toInt(log, zk_max_file_descriptor_count[1]),
-			"zookeeper.mntr.zk_followers":                  toInt(log, zk_followers[1]),
-			"zookeeper.mntr.zk_synced_followers":           toInt(log, zk_synced_followers[1]),
-			"zookeeper.mntr.zk_pending_syncs":              toInt(log, zk_pending_syncs[1]),
+// parseConf reads the key=value lines of conf
+func parseConf(reply string) map[string]string {
+	values := make(map[string]string)
+	for _, line := range strings.Split(reply, "\n") {
+		fields := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(fields) == 2 {
+			values[fields[0]] = fields[1]
 		}
 	}
+	return values
+}
 
+// ScrapeFLWmntr turns the reply to mntr into a sample, keyed by the keys mntr
+// lists whatever their order. The counters are reported as numbers and
+// zk_version and zk_server_state as they are.
+func ScrapeFLWmntr(log *logrus.Logger, status string) map[string]interface{} {
+	values := parseMntr(status)
 	log.WithFields(logrus.Fields{
-		"zk_version":                    zk_version[1],
-		"zk_avg_latency":                zk_avg_latency[1],
-		"zk_max_latency":                zk_max_latency[1],
-		"zk_min_latency":                zk_min_latency[1],
-		"zk_packets_received":           zk_packets_received[1],
-		"zk_packets_sent":               zk_packets_sent[1],
-		"zk_num_alive_connections":      zk_num_alive_connections[1],
-		"zk_outstanding_requests":       zk_outstanding_requests[1],
-		"zk_server_state":               zk_server_state[1],
-		"zk_znode_count":                zk_znode_count[1],
-		"zk_watch_count":                zk_watch_count[1],
-		"zk_ephemerals_count":           zk_ephemerals_count[1],
-		"zk_approximate_data_size":      zk_approximate_data_size[1],
-		"zk_open_file_descriptor_count": zk_open_file_descriptor_count[1],
-		"zk_max_file_descriptor_count":  zk_max_file_descriptor_count[1],
+		"mntr": values,
 	}).Debugf("Scraped ZooKeeper values")
-	return map[string]interface{}{
-		"event_type":                                   "ZookeeperServerSample",
-		"provider":                                     PROVIDER,
-		"zookeeper.mntr.zk_version":                    zk_version[1],
-		"zookeeper.mntr.zk_avg_latency":                toInt(log, zk_avg_latency[1]),
-		"zookeeper.mntr.zk_max_latency":                toInt(log, zk_max_latency[1]),
-		"zookeeper.mntr.zk_min_latency":                toInt(log, zk_min_latency[1]),
-		"zookeeper.mntr.zk_packets_received":           toInt(log, zk_packets_received[1]),
-		"zookeeper.mntr.zk_packets_sent":               toInt(log, zk_packets_sent[1]),
-		"zookeeper.mntr.zk_num_alive_connections":      toInt(log, zk_num_alive_connections[1]),
-		"zookeeper.mntr.zk_outstanding_requests":       toInt(log, zk_outstanding_requests[1]),
-		"zookeeper.mntr.zk_server_state":               zk_server_state[1],
-		"zookeeper.mntr.zk_znode_count":                toInt(log, zk_znode_count[1]),
-		"zookeeper.mntr.zk_watch_count":                toInt(log, zk_watch_count[1]),
-		"zookeeper.mntr.zk_ephemerals_count":           toInt(log, zk_ephemerals_count[1]),
-		"zookeeper.mntr.zk_approximate_data_size":      toInt(log, zk_approximate_data_size[1]),
-		"zookeeper.mntr.zk_open_file_descriptor_count": toInt(log, zk_open_file_descriptor_count[1]),
-		"zookeeper.mntr.zk_max_file_descriptor_count":  toInt(log, zk_max_file_descriptor_count[1]),
+
+	sample := map[string]interface{}{
+		"event_type": "ZookeeperServerSample",
+		"provider":   PROVIDER,
+	}
+	for key, value := range values {
+		sample["zookeeper.mntr."+key] = mntrValue(log, key, value)
 	}
+	return sample
+}
+
+// mntrValue converts a value of mntr, the counters are numbers and zk_version
+// and zk_server_state are kept as they are
+func mntrValue(log *logrus.Logger, key string, value string) interface{} {
+	switch {
+	case key == "zk_version" || key == "zk_server_state":
+		return value
+	case isInt(value):
+		return toInt(log, value)
+	}
+	if number, err := strconv.ParseFloat(value, 64); err == nil {
+		return number
+	}
+	return value
+}
+
+func isInt(value string) bool {
+	_, err := strconv.Atoi(value)
+	return err == nil
 }
 
 func toInt(log *logrus.Logger, value string) int {
@@ -3,10 +3,15 @@ package zookeeper
 import (
 	"fmt"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"reflect"
+	"sort"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/franela/goblin"
 	"github.com/Sirupsen/logrus"
@@ -36,8 +41,6 @@ func init() {
 	fakeConfig = Config{
 		ZK_HOST:       "localhost",
 		ZK_CLIENTPORT: "0",
-		ZK_TICKTIME:   "2000",
-		ZK_DATADIR:    "/var/lib/zookeeper",
 	}
 }
 
@@ -71,8 +74,7 @@ func serverConf(l *net.TCPListener) {
 			fmt.Println("Error reading:", read_err.Error())
 		}
 
-		conn.Write([]byte("clientPort=" + strconv.Itoa(l.Addr().(*net.TCPAddr).Port) + "\ndataDir=" +
-			fakeConfig.ZK_DATADIR + "\ntickTime=" + fakeConfig.ZK_TICKTIME +
+		conn.Write([]byte("clientPort=" + strconv.Itoa(l.Addr().(*net.TCPAddr).Port) + "\ndataDir=/var/lib/zookeeper\ntickTime=2000" +
 			"\nmaxClientCnxns=60\nminSessionTimeout=4000\nmaxSessionTimeout=40000\nserverId=0"))
 		conn.Close()
 	}
@@ -161,8 +163,7 @@ func TestGetFLWconf(t *testing.T) {
 		TestDescription string
 	}{
 		{
-			ExpectedResult: "clientPort=" + fakeConfig.ZK_CLIENTPORT + "\ndataDir=" +
-				fakeConfig.ZK_DATADIR + "\ntickTime=" + fakeConfig.ZK_TICKTIME +
+			ExpectedResult: "clientPort=" + fakeConfig.ZK_CLIENTPORT + "\ndataDir=/var/lib/zookeeper\ntickTime=2000" +
 				"\nmaxClientCnxns=60\nminSessionTimeout=4000\nmaxSessionTimeout=40000\nserverId=0",
 			TestDescription: "Successfully got data",
 		},
@@ -204,6 +205,23 @@ func TestScrapeFLWconf(t *testing.T) {
 			ExpectedResult:  result,
 			TestDescription: "Successfully scraped FLW command conf",
 		},
+		{
+			Data: "clientPort=" + fakeConfig.ZK_CLIENTPORT + "\nsecureClientPort=-1\ndataDir=/var/log/zookeeper\ndataDirSize=67108880\n" +
+				"dataLogDir=/var/log/zookeeper\ndataLogSize=67108880\ntickTime=2000\nmaxClientCnxns=60\nminSessionTimeout=4000\n" +
+				"maxSessionTimeout=40000\nclientPortListenBacklog=-1\nserverId=0\n",
+			ExpectedResult:  result,
+			TestDescription: "Should read the conf of ZooKeeper 3.5+ by key",
+		},
+		{
+			Data: "clientPort=" + fakeConfig.ZK_CLIENTPORT + "\ndataDir=/var/log/zookeeper\n",
+			ExpectedResult: map[string]interface{}{
+				"event_type":                "ZookeeperServerSample",
+				"provider":                  PROVIDER,
+				"zookeeper.conf.clientPort": confPort,
+				"zookeeper.conf.dataDir":    "/var/log/zookeeper",
+			},
+			TestDescription: "Should leave out the settings a short reply doesn't list",
+		},
 	}
 
 	for _, test := range tests {
@@ -300,3 +318,371 @@ func TestToInt(t *testing.T) {
 		})
 	}
 }
+
+// fakeFLWServer answers the four letter word commands it has a reply for and
+// closes the connection on the others, it returns the server's address
+func fakeFLWServer(replies map[string]string) string {
+	l := GetListener()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			buf := make([]byte, 4)
+			if _, err := conn.Read(buf); err == nil {
+				conn.Write([]byte(replies[string(buf)]))
+			}
+			conn.Close()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestParseEnsemble(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	var tests = []struct {
+		Connection      string
+		DefaultPort     string
+		ExpectedResult  []string
+		TestDescription string
+	}{
+		{
+			Connection:      "zk1:2181,zk2:2182,zk3/kafka",
+			DefaultPort:     "2181",
+			ExpectedResult:  []string{"zk1:2181", "zk2:2182", "zk3:2181"},
+			TestDescription: "Should read the members and drop the chroot",
+		},
+		{
+			Connection:      " zk1 , [::1]:2181,",
+			ExpectedResult:  []string{"zk1:2181", "[::1]:2181"},
+			TestDescription: "Should default the port and keep IPv6 addresses",
+		},
+	}
+
+	for _, test := range tests {
+		g.Describe("parseEnsemble()", func() {
+			g.It(test.TestDescription, func() {
+				g.Assert(parseEnsemble(test.Connection, test.DefaultPort)).Equal(test.ExpectedResult)
+			})
+		})
+	}
+}
+
+func TestParseCons(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	g.Describe("parseCons()", func() {
+		g.It("Should count the connections and their queued requests", func() {
+			connections, queued := parseCons(" /10.0.0.1:54032[1](queued=2,recved=10,sent=9,sid=0x1000)\n /10.0.0.2:54033[1](queued=1,recved=1,sent=1)\n\n")
+			g.Assert(connections).Equal(2)
+			g.Assert(queued).Equal(3)
+		})
+	})
+}
+
+func TestZxidLag(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	var tests = []struct {
+		Leader          int64
+		Member          int64
+		ExpectedResult  int64
+		TestDescription string
+	}{
+		{Leader: 0x100000010, Member: 0x100000004, ExpectedResult: 12, TestDescription: "Should count the transactions behind in the same epoch"},
+		{Leader: 0x200000003, Member: 0x1000000ff, ExpectedResult: 4, TestDescription: "Should count a member in an older epoch as behind"},
+		{Leader: 0x100000004, Member: 0x100000006, ExpectedResult: 0, TestDescription: "Should not count a member ahead of the leader"},
+	}
+
+	for _, test := range tests {
+		g.Describe("zxidLag()", func() {
+			g.It(test.TestDescription, func() {
+				g.Assert(zxidLag(test.Leader, test.Member)).Equal(test.ExpectedResult)
+			})
+		})
+	}
+}
+
+func TestGetEnsembleMetrics(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	leader := fakeFLWServer(map[string]string{
+		"ruok": "imok",
+		"mntr": "zk_version\t3.4.10\nzk_server_state\tleader\nzk_znode_count\t19\nzk_followers\t2\nzk_synced_followers\t1\nzk_pending_syncs\t0\n",
+		"srvr": "Zookeeper version: 3.4.10, built on 03/23/2017 10:13 GMT\nLatency min/avg/max: 0/0/3\nZxid: 0x100000200\nMode: leader\nNode count: 19\n",
+		"cons": " /10.0.0.1:54032[1](queued=1,recved=10,sent=9)\n",
+	})
+	follower := fakeFLWServer(map[string]string{
+		"ruok": "imok",
+		"mntr": "zk_version\t3.4.10\nzk_server_state\tfollower\nzk_znode_count\t19\n",
+		"srvr": "Zookeeper version: 3.4.10, built on 03/23/2017 10:13 GMT\nZxid: 0x1000001f0\nMode: follower\n",
+		"cons": "",
+	})
+	lagging := fakeFLWServer(map[string]string{
+		"mntr": "zk_version\t3.4.10\nzk_server_state\tfollower\n",
+		"srvr": "Zxid: 0x100000010\nMode: follower\n",
+		"cons": " /10.0.0.3:1[0](queued=0,recved=0,sent=0)\n /10.0.0.4:1[0](queued=0,recved=0,sent=0)\n",
+	})
+	down := GetListener()
+	downAddress := down.Addr().String()
+	down.Close()
+
+	g.Describe("getEnsembleMetrics()", func() {
+		g.It("Should report every member and the ensemble", func() {
+			var clients []flwClient
+			for _, address := range []string{leader, follower, lagging, downAddress} {
+				clients = append(clients, flwClient{address: address, timeout: time.Second})
+			}
+			samples := getEnsembleMetrics(logrus.New(), clients, 100)
+			g.Assert(len(samples)).Equal(5)
+
+			g.Assert(samples[0]["zookeeper.server.mode"]).Equal("leader")
+			g.Assert(samples[0]["zookeeper.server.zxid_lag"]).Equal(int64(0))
+			g.Assert(samples[0]["zookeeper.server.connections"]).Equal(1)
+			g.Assert(samples[0]["zookeeper.server.queued_requests"]).Equal(1)
+			g.Assert(samples[0]["zookeeper.mntr.zk_znode_count"]).Equal(19)
+			g.Assert(samples[1]["zookeeper.server.zxid_lag"]).Equal(int64(16))
+			g.Assert(samples[1]["zookeeper.server.lagging"]).Equal(false)
+			g.Assert(samples[2]["zookeeper.server.ruok"]).Equal(false)
+			g.Assert(samples[2]["zookeeper.server.zxid_lag"]).Equal(int64(0x1f0))
+			g.Assert(samples[2]["zookeeper.server.lagging"]).Equal(true)
+			g.Assert(samples[2]["zookeeper.server.connections"]).Equal(2)
+			g.Assert(samples[3]["zookeeper.server.address"]).Equal(downAddress)
+			_, ok := samples[3]["zookeeper.server.error"]
+			g.Assert(ok).IsTrue()
+
+			notOK := []string{lagging, downAddress}
+			sort.Strings(notOK)
+			g.Assert(samples[4]).Equal(MetricData{
+				"event_type":                          ENSEMBLE_EVENT_TYPE,
+				"provider":                            PROVIDER,
+				"zookeeper.ensemble.members":          4,
+				"zookeeper.ensemble.observers":        0,
+				"zookeeper.ensemble.quorum_size":      3,
+				"zookeeper.ensemble.answering":        3,
+				"zookeeper.ensemble.has_quorum":       true,
+				"zookeeper.ensemble.not_ok":           2,
+				"zookeeper.ensemble.not_ok_members":   strings.Join(notOK, ","),
+				"zookeeper.ensemble.lagging_members":  1,
+				"zookeeper.ensemble.lagging":          lagging,
+				"zookeeper.ensemble.leader":           leader,
+				"zookeeper.ensemble.followers":        2,
+				"zookeeper.ensemble.synced_followers": 1,
+				"zookeeper.ensemble.pending_syncs":    0,
+			})
+		})
+		g.It("Should leave the observers out of the quorum", func() {
+			observer := fakeFLWServer(map[string]string{
+				"ruok": "imok",
+				"mntr": "zk_version\t3.6.3\nzk_server_state\tobserver\nzk_avg_latency\t0.5\n",
+				"srvr": "Zxid: 0x100000200\nMode: observer\n",
+				"cons": "",
+			})
+			clients := []flwClient{
+				{address: leader, timeout: time.Second},
+				{address: observer, timeout: time.Second},
+				{address: observer, timeout: time.Second},
+				{address: downAddress, timeout: time.Second},
+			}
+			samples := getEnsembleMetrics(logrus.New(), clients, 100)
+			g.Assert(len(samples)).Equal(5)
+
+			g.Assert(samples[1]["zookeeper.mntr.zk_avg_latency"]).Equal(0.5)
+			g.Assert(samples[4]["zookeeper.ensemble.observers"]).Equal(2)
+			g.Assert(samples[4]["zookeeper.ensemble.quorum_size"]).Equal(2)
+			g.Assert(samples[4]["zookeeper.ensemble.answering"]).Equal(3)
+			g.Assert(samples[4]["zookeeper.ensemble.has_quorum"]).Equal(false)
+		})
+		g.It("Should count a member that won't answer ruok as unknown rather than not ok", func() {
+			admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/commands/mntr":
+					fmt.Fprint(w, `{"version":"3.5.9","server_state":"follower","znode_count":19,"command":"mntr","error":null}`)
+				case "/commands/server_stats":
+					fmt.Fprint(w, `{"version":"3.5.9","server_stats":{"last_processed_zxid":4294967808,"server_state":"follower"},"command":"server_stats","error":null}`)
+				case "/commands/connections":
+					fmt.Fprint(w, `{"connections":[],"secure_connections":[],"command":"connections","error":null}`)
+				default:
+					http.NotFound(w, r)
+				}
+			}))
+			defer admin.Close()
+			disabled := fakeFLWServer(map[string]string{
+				"ruok": "ruok is not executed because it is not in the whitelist.\n",
+				"mntr": "mntr is not executed because it is not in the whitelist.\n",
+				"srvr": "srvr is not executed because it is not in the whitelist.\n",
+				"cons": "cons is not executed because it is not in the whitelist.\n",
+			})
+			stock := fakeFLWServer(map[string]string{
+				"ruok": "ruok is not executed because it is not in the whitelist.\n",
+				"mntr": "zk_version\t3.5.9\nzk_server_state\tfollower\n",
+				"srvr": "Zxid: 0x100000200\nMode: follower\n",
+				"cons": "",
+			})
+
+			clients := []flwClient{
+				{address: leader, timeout: time.Second},
+				{address: disabled, timeout: time.Second, adminURL: admin.URL},
+				{address: stock, timeout: time.Second},
+			}
+			samples := getEnsembleMetrics(logrus.New(), clients, 100)
+			g.Assert(len(samples)).Equal(4)
+
+			g.Assert(samples[0]["zookeeper.server.ruok"]).Equal(true)
+			for _, sample := range samples[1:3] {
+				_, ok := sample["zookeeper.server.ruok"]
+				g.Assert(ok).IsFalse()
+				g.Assert(sample["zookeeper.server.zxid_lag"]).Equal(int64(0))
+			}
+			g.Assert(samples[1]["zookeeper.mntr.zk_server_state"]).Equal("follower")
+			g.Assert(samples[3]["zookeeper.ensemble.answering"]).Equal(3)
+			g.Assert(samples[3]["zookeeper.ensemble.has_quorum"]).Equal(true)
+			g.Assert(samples[3]["zookeeper.ensemble.not_ok"]).Equal(0)
+			_, ok := samples[3]["zookeeper.ensemble.not_ok_members"]
+			g.Assert(ok).IsFalse()
+		})
+	})
+}
+
+func TestFLWClientCommand(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/commands/mntr":
+			fmt.Fprint(w, `{"version":"3.5.9","avg_latency":0.5,"max_latency":3,"server_state":"standalone","znode_count":19,"uptime":1200,"command":"mntr","error":null}`)
+		case "/commands/configuration":
+			fmt.Fprint(w, `{"client_port":2181,"data_dir":"/var/lib/zookeeper/version-2","tick_time":2000,"max_client_cnxns":60,"min_session_timeout":4000,"max_session_timeout":40000,"server_id":1,"command":"configuration","error":null}`)
+		case "/commands/ruok":
+			fmt.Fprint(w, `{"command":"ruok","error":null}`)
+		case "/commands/server_stats":
+			fmt.Fprint(w, `{"version":"3.5.9","read_only":false,"server_stats":{"packets_sent":9,"packets_received":10,"last_processed_zxid":4294967808,"outstanding_requests":0,"server_state":"leader","avg_latency":0.5,"max_latency":3,"min_latency":0,"num_alive_client_connections":2},"node_count":19,"command":"server_stats","error":null}`)
+		case "/commands/connections":
+			fmt.Fprint(w, `{"connections":[{"remote_socket_address":"/10.0.0.1:54032","interest_ops":1,"outstanding_requests":2,"packets_received":10,"packets_sent":9}],"secure_connections":[{"remote_socket_address":"/10.0.0.2:54040","interest_ops":1,"outstanding_requests":0,"packets_received":3,"packets_sent":3}],"command":"connections","error":null}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer admin.Close()
+
+	whitelisted := fakeFLWServer(map[string]string{
+		"mntr": "zk_version\t3.5.9\n",
+		"conf": "conf is not executed because it is not in the whitelist.\n",
+		"srvr": "srvr is not executed because it is not in the whitelist.\n",
+		"cons": "cons is not executed because it is not in the whitelist.\n",
+	})
+	silent := GetListener()
+	go func() {
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			// never reply, the client's deadline has to end the command
+			defer conn.Close()
+		}
+	}()
+	defer silent.Close()
+
+	var tests = []struct {
+		Client          flwClient
+		Command         string
+		ExpectedResult  string
+		ExpectedError   string
+		TestDescription string
+	}{
+		{
+			Client:          flwClient{address: whitelisted, timeout: time.Second},
+			Command:         "mntr",
+			ExpectedResult:  "zk_version\t3.5.9\n",
+			TestDescription: "Should return the reply of a whitelisted command",
+		},
+		{
+			Client:          flwClient{address: whitelisted, timeout: time.Second},
+			Command:         "srvr",
+			ExpectedError:   "srvr is not in the 4lw.commands.whitelist of " + whitelisted,
+			TestDescription: "Should return a clear error for a command left out of the whitelist",
+		},
+		{
+			Client:          flwClient{address: whitelisted, timeout: time.Second},
+			Command:         "ruok",
+			ExpectedError:   whitelisted + " returned an empty reply to ruok",
+			TestDescription: "Should not take an empty reply for an answer",
+		},
+		{
+			Client:          flwClient{address: silent.Addr().String(), timeout: 100 * time.Millisecond},
+			Command:         "mntr",
+			ExpectedError:   "i/o timeout",
+			TestDescription: "Should give up on a server that doesn't reply",
+		},
+		{
+			Client:          flwClient{address: whitelisted, timeout: time.Second, adminURL: admin.URL},
+			Command:         "conf",
+			ExpectedResult:  "clientPort=2181\ndataDir=/var/lib/zookeeper/version-2\ntickTime=2000\nmaxClientCnxns=60\nminSessionTimeout=4000\nmaxSessionTimeout=40000\nserverId=1",
+			TestDescription: "Should fall back to the AdminServer configuration for conf",
+		},
+		{
+			Client:          flwClient{address: silent.Addr().String(), timeout: 100 * time.Millisecond, adminURL: admin.URL},
+			Command:         "mntr",
+			ExpectedResult:  "zk_version\t3.5.9\nzk_avg_latency\t0.5\nzk_max_latency\t3\nzk_server_state\tstandalone\nzk_znode_count\t19\nzk_uptime\t1200\n",
+			TestDescription: "Should fall back to the AdminServer mntr when the server doesn't reply",
+		},
+		{
+			Client:          flwClient{address: whitelisted, timeout: time.Second, adminURL: admin.URL},
+			Command:         "ruok",
+			ExpectedResult:  "imok\n",
+			TestDescription: "Should fall back to the AdminServer ruok",
+		},
+		{
+			Client:          flwClient{address: whitelisted, timeout: time.Second, adminURL: admin.URL},
+			Command:         "srvr",
+			ExpectedResult:  "Zookeeper version: 3.5.9\nLatency min/avg/max: 0/0.5/3\nReceived: 10\nSent: 9\nConnections: 2\nOutstanding: 0\nZxid: 0x100000200\nMode: leader\nNode count: 19\n",
+			TestDescription: "Should fall back to the AdminServer server_stats for srvr",
+		},
+		{
+			Client:          flwClient{address: whitelisted, timeout: time.Second, adminURL: admin.URL},
+			Command:         "cons",
+			ExpectedResult:  " /10.0.0.1:54032[1](queued=2,recved=10,sent=9)\n /10.0.0.2:54040[1](queued=0,recved=3,sent=3)\n",
+			TestDescription: "Should fall back to the AdminServer connections for cons",
+		},
+		{
+			Client:          flwClient{address: whitelisted, timeout: time.Second, adminURL: admin.URL},
+			Command:         "wchs",
+			ExpectedError:   whitelisted + " returned an empty reply to wchs",
+			TestDescription: "Should not fall back for commands the AdminServer isn't used for",
+		},
+	}
+
+	for _, test := range tests {
+		g.Describe("flwClient.command()", func() {
+			g.It(test.TestDescription, func() {
+				result, err := test.Client.command(logrus.New(), test.Command)
+				if test.ExpectedError != "" {
+					g.Assert(err != nil && strings.Contains(err.Error(), test.ExpectedError)).IsTrue()
+					return
+				}
+				g.Assert(err).Equal(nil)
+				g.Assert(result).Equal(test.ExpectedResult)
+			})
+		})
+	}
+}
+
+func TestNewFLWClient(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	g.Describe("newFLWClient()", func() {
+		g.It("Should default the timeout and AdminServer port", func() {
+			client := newFLWClient(Config{ZK_FLW_TIMEOUT: "0"}, "zk1:2181")
+			g.Assert(client.timeout).Equal(DEFAULT_FLW_TIMEOUT)
+			g.Assert(client.adminURL).Equal("http://zk1:8080")
+		})
+		g.It("Should use the configured timeout and AdminServer port", func() {
+			client := newFLWClient(Config{ZK_FLW_TIMEOUT: "2", ZK_ADMIN_PORT: "9090"}, "[::1]:2181")
+			g.Assert(client.timeout).Equal(2 * time.Second)
+			g.Assert(client.adminURL).Equal("http://[::1]:9090")
+		})
+	})
+}